@@ -0,0 +1,78 @@
+/*
+Package mail sends emails through a pluggable Mailer.
+
+All emails of go-start are sent with Send(), which delivers them
+with Config.Mailer. The default Mailer uses github.com/ungerik/go-mail,
+SMTP sends with net/smtp, FileOutbox writes the emails to a directory
+and MemoryOutbox keeps them in memory.
+Queue stores emails in a mongo collection and retries failed deliveries.
+
+Example:
+
+	mail.Config.From = "Example <noreply@example.com>"
+	mail.Config.Mailer = mail.NewQueue(
+		mongo.NewCollection("mail_queue", (*mail.QueuedMessage)(nil)),
+		&mail.SMTP{Host: "smtp.example.com", Username: "noreply@example.com", Password: password},
+	)
+	mail.Config.Mailer.(*mail.Queue).Start(time.Minute)
+
+See the package mailtest for assertions on sent emails in tests.
+*/
+package mail
+
+import (
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/templatesystem"
+)
+
+var Config = Configuration{
+	Mailer:             GoMail{},
+	TemplateSystem:     &templatesystem.Go{},
+	HTMLTemplateSystem: &templatesystem.GoHTML{},
+}
+
+type Configuration struct {
+	// Mailer delivers the emails of Send()
+	Mailer Mailer
+	// From is used for messages without From
+	From string
+	// TemplateSystem is used by NewTemplate() for subject and text
+	TemplateSystem templatesystem.Implementation
+	// HTMLTemplateSystem is used by NewTemplate() for HTML
+	// and should escape its output
+	HTMLTemplateSystem templatesystem.Implementation
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Mailer
+
+// Mailer delivers emails.
+type Mailer interface {
+	Send(message *Message) error
+}
+
+// Send delivers message with Config.Mailer.
+// Config.From is used if message.From is empty.
+func Send(message *Message) error {
+	if message.From == "" {
+		message.From = Config.From
+	}
+	if len(message.Recipients()) == 0 {
+		return errs.Format("Email '%s' has no recipients", message.Subject)
+	}
+	if Config.Mailer == nil {
+		return errs.Format("mail.Config.Mailer is nil")
+	}
+	return Config.Mailer.Send(message)
+}
+
+// SendAsync calls Send() in a go routine and returns
+// a channel that receives the result.
+func SendAsync(message *Message) <-chan error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- Send(message)
+		close(errChan)
+	}()
+	return errChan
+}
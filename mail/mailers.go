@@ -0,0 +1,150 @@
+package mail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ungerik/go-mail"
+	"github.com/ungerik/go-start/errs"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// GoMail
+
+// GoMail sends emails with github.com/ungerik/go-mail
+// and its configuration. Only To, Subject and Text are supported,
+// an error is returned for messages with HTML, Cc, Bcc or ReplyTo
+// instead of silently dropping them. Use SMTP for such emails.
+type GoMail struct{}
+
+func (self GoMail) Send(message *Message) error {
+	if message.HTML != "" || len(message.Cc) > 0 || len(message.Bcc) > 0 || message.ReplyTo != "" {
+		return errs.Format("mail.GoMail can't send email '%s' with HTML, Cc, Bcc or ReplyTo, use mail.SMTP", message.Subject)
+	}
+	return email.NewBriefMessage(message.Subject, message.Text, message.To...).Send()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// SMTP
+
+// SMTP sends emails with net/smtp.
+// STARTTLS is used if the server supports it.
+type SMTP struct {
+	Host string
+	// Port is 587 if zero
+	Port     int
+	Username string
+	Password string
+}
+
+func (self *SMTP) Send(message *Message) error {
+	port := self.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if self.Username != "" {
+		auth = smtp.PlainAuth("", self.Username, self.Password, self.Host)
+	}
+	recipients := message.Recipients()
+	for i := range recipients {
+		recipients[i] = Address(recipients[i])
+	}
+	addr := net.JoinHostPort(self.Host, strconv.Itoa(port))
+	return smtp.SendMail(addr, auth, Address(message.From), recipients, message.Bytes())
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// FileOutbox
+
+// FileOutbox writes every email as .eml file to Dir
+// instead of sending it. Useful for development.
+type FileOutbox struct {
+	Dir string
+
+	mutex   sync.Mutex
+	counter int
+}
+
+func (self *FileOutbox) Send(message *Message) error {
+	self.mutex.Lock()
+	self.counter++
+	counter := self.counter
+	self.mutex.Unlock()
+
+	err := os.MkdirAll(self.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	filename := fmt.Sprintf("%s_%d.eml", time.Now().UTC().Format("20060102_150405.000000"), counter)
+	return ioutil.WriteFile(filepath.Join(self.Dir, filename), message.Bytes(), 0644)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// MemoryOutbox
+
+// MemoryOutbox keeps the emails in memory instead of sending them.
+// It is safe for concurrent use.
+type MemoryOutbox struct {
+	mutex    sync.Mutex
+	messages []*Message
+	// Err is returned by Send if not nil, the message is not kept then.
+	Err error
+}
+
+func (self *MemoryOutbox) Send(message *Message) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.Err != nil {
+		return self.Err
+	}
+	clone := *message
+	self.messages = append(self.messages, &clone)
+	return nil
+}
+
+// Messages returns all sent messages in the order they were sent.
+func (self *MemoryOutbox) Messages() []*Message {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]*Message(nil), self.messages...)
+}
+
+// SentTo returns the messages with address as recipient.
+func (self *MemoryOutbox) SentTo(address string) []*Message {
+	var result []*Message
+	for _, message := range self.Messages() {
+		if message.HasRecipient(address) {
+			result = append(result, message)
+		}
+	}
+	return result
+}
+
+// Last returns the last sent message.
+func (self *MemoryOutbox) Last() (*Message, error) {
+	messages := self.Messages()
+	if len(messages) == 0 {
+		return nil, errs.Format("No email sent")
+	}
+	return messages[len(messages)-1], nil
+}
+
+func (self *MemoryOutbox) Count() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return len(self.messages)
+}
+
+func (self *MemoryOutbox) Clear() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.messages = nil
+}
@@ -0,0 +1,87 @@
+package mail
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGoMailRejectsUnsupportedFields(t *testing.T) {
+	for name, message := range map[string]*Message{
+		"HTML":    {To: []string{"a@example.com"}, Subject: "Subject", HTML: "<p>HTML</p>"},
+		"Cc":      {To: []string{"a@example.com"}, Cc: []string{"c@example.com"}},
+		"Bcc":     {To: []string{"a@example.com"}, Bcc: []string{"b@example.com"}},
+		"ReplyTo": {To: []string{"a@example.com"}, ReplyTo: "r@example.com"},
+	} {
+		if err := (GoMail{}).Send(message); err == nil {
+			t.Errorf("no error for a message with %s", name)
+		}
+	}
+}
+
+func TestMemoryOutbox(t *testing.T) {
+	outbox := new(MemoryOutbox)
+	message := NewMessage("Subject", "Text", "a@example.com")
+	if err := outbox.Send(message); err != nil {
+		t.Fatal(err)
+	}
+	message.Subject = "Changed"
+	if last, _ := outbox.Last(); last.Subject != "Subject" {
+		t.Error("the outbox doesn't keep a copy of the message")
+	}
+	if n := len(outbox.SentTo("a@example.com")); n != 1 {
+		t.Errorf("%d messages sent to a@example.com", n)
+	}
+
+	outbox.Err = errors.New("offline")
+	if err := outbox.Send(message); err != outbox.Err {
+		t.Errorf("Send returned %v instead of Err", err)
+	}
+	if outbox.Count() != 1 {
+		t.Error("failed message has been kept")
+	}
+	outbox.Clear()
+	if _, err := outbox.Last(); err == nil {
+		t.Error("Last returned a message after Clear")
+	}
+}
+
+func TestFileOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outbox := &FileOutbox{Dir: filepath.Join(dir, "outbox")}
+	for i := 0; i < 2; i++ {
+		if err = outbox.Send(NewMessage("Subject", "Text", "a@example.com")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(outbox.Dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("%d files instead of 2", len(files))
+	}
+}
+
+func TestSend(t *testing.T) {
+	defer func(saved Configuration) { Config = saved }(Config)
+	outbox := new(MemoryOutbox)
+	Config.Mailer = outbox
+	Config.From = "noreply@example.com"
+
+	if err := Send(&Message{Subject: "No recipients"}); err == nil {
+		t.Error("no error for a message without recipients")
+	}
+	if err := <-SendAsync(NewMessage("Subject", "Text", "a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if last, _ := outbox.Last(); last == nil || last.From != "noreply@example.com" {
+		t.Errorf("Config.From not used: %v", last)
+	}
+}
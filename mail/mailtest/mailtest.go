@@ -0,0 +1,94 @@
+/*
+Package mailtest captures the emails sent with mail.Send() in tests.
+
+Example:
+
+	func TestPasswordReset(t *testing.T) {
+		outbox := mailtest.NewOutbox()
+		defer outbox.Restore()
+
+		// ... code that sends an email
+
+		message := outbox.AssertSent(t, "name@example.com", "Reset your password")
+		if !strings.Contains(message.Text, "?code=") {
+			t.Error("no reset link")
+		}
+	}
+*/
+package mailtest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ungerik/go-start/mail"
+)
+
+// Outbox replaces mail.Config.Mailer until Restore() is called.
+type Outbox struct {
+	mail.MemoryOutbox
+	previous mail.Mailer
+}
+
+// NewOutbox sets mail.Config.Mailer to the returned Outbox.
+func NewOutbox() *Outbox {
+	self := &Outbox{previous: mail.Config.Mailer}
+	mail.Config.Mailer = self
+	return self
+}
+
+// Restore sets mail.Config.Mailer back to the Mailer before NewOutbox().
+func (self *Outbox) Restore() {
+	mail.Config.Mailer = self.previous
+}
+
+// Find returns the last message sent to address with a subject
+// that contains subject. An empty address or subject matches all.
+func (self *Outbox) Find(address, subject string) (message *mail.Message, found bool) {
+	messages := self.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if (address == "" || messages[i].HasRecipient(address)) && strings.Contains(messages[i].Subject, subject) {
+			return messages[i], true
+		}
+	}
+	return nil, false
+}
+
+// AssertSent fails the test if no message was sent to address
+// with a subject that contains subject.
+func (self *Outbox) AssertSent(t testing.TB, address, subject string) *mail.Message {
+	t.Helper()
+	message, found := self.Find(address, subject)
+	if !found {
+		t.Errorf("No email to '%s' with subject '%s' sent, sent: %s", address, subject, self.summary())
+	}
+	return message
+}
+
+// AssertNotSent fails the test if a message was sent to address
+// with a subject that contains subject.
+func (self *Outbox) AssertNotSent(t testing.TB, address, subject string) {
+	t.Helper()
+	if _, found := self.Find(address, subject); found {
+		t.Errorf("Email to '%s' with subject '%s' sent", address, subject)
+	}
+}
+
+// AssertCount fails the test if not count messages were sent.
+func (self *Outbox) AssertCount(t testing.TB, count int) {
+	t.Helper()
+	if n := self.Count(); n != count {
+		t.Errorf("%d emails sent instead of %d: %s", n, count, self.summary())
+	}
+}
+
+func (self *Outbox) summary() string {
+	var list []string
+	for _, message := range self.Messages() {
+		list = append(list, "'"+message.Subject+"' to "+strings.Join(message.Recipients(), ", "))
+	}
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, "; ")
+}
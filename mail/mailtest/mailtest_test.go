@@ -0,0 +1,60 @@
+package mailtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ungerik/go-start/mail"
+)
+
+// recorder records failures instead of failing the test.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (self *recorder) Helper() {}
+
+func (self *recorder) Errorf(format string, args ...interface{}) {
+	self.errors = append(self.errors, fmt.Sprintf(format, args...))
+}
+
+func TestOutbox(t *testing.T) {
+	previous := mail.Config.Mailer
+	outbox := NewOutbox()
+	if mail.Config.Mailer != outbox {
+		t.Fatal("NewOutbox didn't replace mail.Config.Mailer")
+	}
+
+	if err := mail.Send(mail.NewMessage("Reset your password", "Text", "Erik <erik@example.com>")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mail.Send(mail.NewMessage("Welcome", "Text", "other@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := new(recorder)
+	if message := outbox.AssertSent(r, "erik@example.com", "password"); message == nil || message.Subject != "Reset your password" {
+		t.Errorf("AssertSent returned %v", message)
+	}
+	outbox.AssertNotSent(r, "erik@example.com", "Welcome")
+	outbox.AssertCount(r, 2)
+	if _, found := outbox.Find("", "Welcome"); !found {
+		t.Error("empty address doesn't match all")
+	}
+	if len(r.errors) != 0 {
+		t.Errorf("unexpected failures: %v", r.errors)
+	}
+
+	outbox.AssertSent(r, "erik@example.com", "Welcome")
+	outbox.AssertNotSent(r, "other@example.com", "")
+	outbox.AssertCount(r, 3)
+	if len(r.errors) != 3 {
+		t.Errorf("%d failures instead of 3: %v", len(r.errors), r.errors)
+	}
+
+	outbox.Restore()
+	if mail.Config.Mailer != previous {
+		t.Error("Restore didn't reset mail.Config.Mailer")
+	}
+}
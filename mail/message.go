@@ -0,0 +1,149 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Message
+
+// Message is an email with a plain text and/or a HTML body.
+// If both are set, the email is sent as multipart/alternative.
+type Message struct {
+	From    string
+	To      []string
+	Cc      []string
+	Bcc     []string
+	ReplyTo string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// NewMessage returns a plain text message.
+func NewMessage(subject, text string, to ...string) *Message {
+	return &Message{To: to, Subject: subject, Text: text}
+}
+
+// Recipients returns all addresses of To, Cc and Bcc.
+func (self *Message) Recipients() []string {
+	recipients := make([]string, 0, len(self.To)+len(self.Cc)+len(self.Bcc))
+	recipients = append(recipients, self.To...)
+	recipients = append(recipients, self.Cc...)
+	return append(recipients, self.Bcc...)
+}
+
+// HasRecipient returns true if address is in To, Cc or Bcc.
+// Names are ignored and the comparison is case insensitive.
+func (self *Message) HasRecipient(address string) bool {
+	address = Address(address)
+	for _, recipient := range self.Recipients() {
+		if strings.EqualFold(Address(recipient), address) {
+			return true
+		}
+	}
+	return false
+}
+
+// Address returns the address of an email address
+// with optional name like "Name <name@example.com>".
+func Address(address string) string {
+	parsed, err := netmail.ParseAddress(address)
+	if err != nil {
+		return strings.TrimSpace(address)
+	}
+	return parsed.Address
+}
+
+// Bytes returns the message in MIME format without the Bcc header.
+func (self *Message) Bytes() []byte {
+	var buf bytes.Buffer
+	self.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// WriteTo writes the message in MIME format without the Bcc header.
+func (self *Message) WriteTo(writer io.Writer) (n int64, err error) {
+	var buf bytes.Buffer
+	// Prevent header injection, also before encoding
+	// because encoded words could contain line breaks
+	removeLineBreaks := strings.NewReplacer("\r", "", "\n", "").Replace
+	header := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&buf, "%s: %s\r\n", key, removeLineBreaks(value))
+		}
+	}
+	header("From", formatAddresses(self.From))
+	header("To", formatAddresses(self.To...))
+	header("Cc", formatAddresses(self.Cc...))
+	header("Reply-To", formatAddresses(self.ReplyTo))
+	header("Subject", mime.QEncoding.Encode("utf-8", removeLineBreaks(self.Subject)))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+
+	switch {
+	case self.Text != "" && self.HTML != "":
+		parts := multipart.NewWriter(&buf)
+		header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+		buf.WriteString("\r\n")
+		for _, part := range []struct{ contentType, body string }{
+			{"text/plain", self.Text},
+			{"text/html", self.HTML},
+		} {
+			partHeader := textproto.MIMEHeader{}
+			partHeader.Set("Content-Type", part.contentType+"; charset=utf-8")
+			partHeader.Set("Content-Transfer-Encoding", "quoted-printable")
+			partWriter, err := parts.CreatePart(partHeader)
+			if err != nil {
+				return 0, err
+			}
+			writeQuotedPrintable(partWriter, part.body)
+		}
+		parts.Close()
+
+	case self.HTML != "":
+		header("Content-Type", "text/html; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		writeQuotedPrintable(&buf, self.HTML)
+
+	default:
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		writeQuotedPrintable(&buf, self.Text)
+	}
+
+	return buf.WriteTo(writer)
+}
+
+// formatAddresses encodes non ASCII names of addresses for headers.
+// Addresses that can't be parsed are used as they are.
+func formatAddresses(addresses ...string) string {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if address == "" {
+			continue
+		}
+		if parsed, err := netmail.ParseAddress(address); err == nil {
+			address = parsed.String()
+		}
+		formatted = append(formatted, address)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func writeQuotedPrintable(writer io.Writer, text string) {
+	qp := quotedprintable.NewWriter(writer)
+	qp.Write([]byte(text))
+	qp.Close()
+}
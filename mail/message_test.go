@@ -0,0 +1,127 @@
+package mail
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"strings"
+	"testing"
+)
+
+func readMessage(t *testing.T, message *Message) *netmail.Message {
+	t.Helper()
+	parsed, err := netmail.ReadMessage(strings.NewReader(string(message.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestMessageHeaders(t *testing.T) {
+	message := &Message{
+		From:    "Jörg Müller <joerg@example.com>",
+		To:      []string{"a@example.com", "B <b@example.com>"},
+		Cc:      []string{"c@example.com"},
+		Bcc:     []string{"secret@example.com"},
+		ReplyTo: "reply@example.com",
+		Subject: "Grüße\r\nBcc: injected@example.com",
+		Text:    "Hello",
+	}
+	parsed := readMessage(t, message)
+	header := parsed.Header
+
+	from, err := header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Name != "Jörg Müller" || from[0].Address != "joerg@example.com" {
+		t.Errorf("From header %q parsed as %v, %v", header.Get("From"), from, err)
+	}
+	if strings.Contains(header.Get("From"), "ö") {
+		t.Errorf("From header %q is not encoded", header.Get("From"))
+	}
+	to, err := header.AddressList("To")
+	if err != nil || len(to) != 2 || to[1].Address != "b@example.com" {
+		t.Errorf("To header %q parsed as %v, %v", header.Get("To"), to, err)
+	}
+	if header.Get("Cc") != "<c@example.com>" {
+		t.Errorf("Cc header is %q", header.Get("Cc"))
+	}
+	if header.Get("Bcc") != "" || strings.Contains(string(message.Bytes()), "secret@example.com") {
+		t.Error("Bcc recipients are visible in the message")
+	}
+	if header.Get("Reply-To") != "<reply@example.com>" {
+		t.Errorf("Reply-To header is %q", header.Get("Reply-To"))
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "GrüßeBcc: injected@example.com" {
+		t.Errorf("Subject decoded as %q", subject)
+	}
+	if len(header["Bcc"]) != 0 {
+		t.Error("header injection through the subject")
+	}
+}
+
+func TestMessagePlainText(t *testing.T) {
+	message := NewMessage("Subject", "Grüße,\nline two", "a@example.com")
+	parsed := readMessage(t, message)
+	if contentType := parsed.Header.Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type is %q", contentType)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Quoted-printable text uses CRLF line breaks
+	if string(body) != "Grüße,\r\nline two" {
+		t.Errorf("body decoded as %q", body)
+	}
+}
+
+func TestMessageAlternative(t *testing.T) {
+	message := &Message{To: []string{"a@example.com"}, Subject: "Subject", Text: "Text", HTML: "<p>HTML</p>"}
+	parsed := readMessage(t, message)
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type is %q", parsed.Header.Get("Content-Type"))
+	}
+	parts := multipart.NewReader(parsed.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", "Text"},
+		{"text/html; charset=utf-8", "<p>HTML</p>"},
+	} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// multipart.Reader decodes quoted-printable parts
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Type") != want.contentType || string(body) != want.body {
+			t.Errorf("part %q with body %q, want %q with %q", part.Header.Get("Content-Type"), body, want.contentType, want.body)
+		}
+	}
+	if _, err := parts.NextPart(); err == nil {
+		t.Error("more than two parts")
+	}
+}
+
+func TestMessageRecipients(t *testing.T) {
+	message := &Message{To: []string{"A <a@example.com>"}, Cc: []string{"c@example.com"}, Bcc: []string{"b@example.com"}}
+	if n := len(message.Recipients()); n != 3 {
+		t.Errorf("%d recipients instead of 3", n)
+	}
+	for _, address := range []string{"a@example.com", "A@Example.com", "Other Name <c@example.com>", "b@example.com"} {
+		if !message.HasRecipient(address) {
+			t.Errorf("%s is not a recipient", address)
+		}
+	}
+	if message.HasRecipient("d@example.com") {
+		t.Error("d@example.com is a recipient")
+	}
+}
@@ -0,0 +1,224 @@
+package mail
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ungerik/go-start/config"
+	"github.com/ungerik/go-start/model"
+	"github.com/ungerik/go-start/mongo"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// QueuedMessage
+
+// QueuedMessage is the document type of the collection of a Queue.
+type QueuedMessage struct {
+	mongo.DocumentBase `bson:",inline"`
+	From               model.String
+	To                 []model.String
+	Cc                 []model.String
+	Bcc                []model.String
+	ReplyTo            model.String
+	Subject            model.String
+	Text               model.Text
+	HTML               model.Text
+	Created            model.DateTime
+	Attempts           model.Int
+	NextAttempt        model.DateTime
+	LastError          model.String
+	// Failed is set after Queue.MaxAttempts failed deliveries
+	Failed model.Bool
+}
+
+func (self *QueuedMessage) Message() *Message {
+	return &Message{
+		From:    self.From.Get(),
+		To:      stringsOf(self.To),
+		Cc:      stringsOf(self.Cc),
+		Bcc:     stringsOf(self.Bcc),
+		ReplyTo: self.ReplyTo.Get(),
+		Subject: self.Subject.Get(),
+		Text:    self.Text.Get(),
+		HTML:    self.HTML.Get(),
+	}
+}
+
+func (self *QueuedMessage) setMessage(message *Message) {
+	self.From.Set(message.From)
+	self.To = modelStrings(message.To)
+	self.Cc = modelStrings(message.Cc)
+	self.Bcc = modelStrings(message.Bcc)
+	self.ReplyTo.Set(message.ReplyTo)
+	self.Subject.Set(message.Subject)
+	self.Text.Set(message.Text)
+	self.HTML.Set(message.HTML)
+}
+
+func stringsOf(values []model.String) []string {
+	result := make([]string, len(values))
+	for i := range values {
+		result[i] = values[i].Get()
+	}
+	return result
+}
+
+func modelStrings(values []string) []model.String {
+	result := make([]model.String, len(values))
+	for i := range values {
+		result[i].Set(values[i])
+	}
+	return result
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Queue
+
+/*
+Queue is a Mailer that stores the emails in a mongo collection
+with the document type QueuedMessage and delivers them with Mailer
+in Process(). Failed deliveries are retried with a delay of RetryDelay
+that doubles with every attempt until MaxAttempts is reached.
+
+Process() is called periodically after Start(). Only one process
+should run Process() for a collection.
+*/
+type Queue struct {
+	Collection  *mongo.Collection
+	Mailer      Mailer
+	MaxAttempts int
+	RetryDelay  time.Duration
+
+	// mutex serializes Process()
+	mutex sync.Mutex
+	// runMutex protects the go routine of Start() and Stop()
+	runMutex sync.Mutex
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewQueue returns a Queue with 10 attempts and a RetryDelay of one minute.
+func NewQueue(collection *mongo.Collection, mailer Mailer) *Queue {
+	return &Queue{
+		Collection:  collection,
+		Mailer:      mailer,
+		MaxAttempts: 10,
+		RetryDelay:  time.Minute,
+	}
+}
+
+// Send adds message to the queue, it will be delivered by Process().
+func (self *Queue) Send(message *Message) error {
+	doc := self.Collection.NewDocument().(*QueuedMessage)
+	doc.setMessage(message)
+	doc.Created.SetNowUTC()
+	doc.NextAttempt.SetNowUTC()
+	doc.Failed.Set(false)
+	return doc.Save()
+}
+
+// Pending returns the messages that have not been delivered yet.
+func (self *Queue) Pending() mongo.Query {
+	return self.Collection.Filter("Failed", false).Sort("NextAttempt")
+}
+
+// Failed returns the messages that could not be delivered
+// after MaxAttempts.
+func (self *Queue) Failed() mongo.Query {
+	return self.Collection.Filter("Failed", true)
+}
+
+// Process delivers all messages whose next attempt is due.
+// Delivered messages are removed from the collection.
+// err is only returned for database errors.
+func (self *Queue) Process() (sent int, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	var now model.DateTime
+	now.SetNowUTC()
+	var due []*QueuedMessage
+	i := self.Collection.Filter("Failed", false).FilterLessEqual("NextAttempt", now.Get()).Iterator()
+	for doc := i.Next(); doc != nil; doc = i.Next() {
+		due = append(due, doc.(*QueuedMessage))
+	}
+	if i.Err() != nil {
+		return 0, i.Err()
+	}
+
+	for _, doc := range due {
+		sendErr := self.Mailer.Send(doc.Message())
+		if sendErr == nil {
+			if err = doc.Remove(); err != nil {
+				return sent, err
+			}
+			sent++
+			continue
+		}
+		attempts := doc.Attempts.Get() + 1
+		doc.Attempts.Set(attempts)
+		doc.LastError.Set(sendErr.Error())
+		if self.MaxAttempts > 0 && attempts >= int64(self.MaxAttempts) {
+			doc.Failed.Set(true)
+			config.Logger.Printf("mail: Giving up on email '%s' after %d attempts: %s", doc.Subject, attempts, sendErr)
+		} else {
+			delay := self.RetryDelay
+			for n := int64(1); n < attempts && delay < 24*time.Hour; n++ {
+				delay *= 2
+			}
+			doc.NextAttempt.SetTime(time.Now().UTC().Add(delay))
+		}
+		if err = doc.Save(); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Start calls Process() every interval in a go routine until Stop() is called.
+// A previously started go routine is stopped first.
+// Start and Stop can be called concurrently.
+func (self *Queue) Start(interval time.Duration) {
+	self.runMutex.Lock()
+	defer self.runMutex.Unlock()
+
+	self.stopRunning()
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	self.stop = stop
+	self.stopped = stopped
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := self.Process(); err != nil {
+				config.Logger.Printf("mail: Error while processing queue %s: %s", self.Collection.Name, err)
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the go routine of Start() and waits
+// until a running Process() has returned.
+func (self *Queue) Stop() {
+	self.runMutex.Lock()
+	defer self.runMutex.Unlock()
+
+	self.stopRunning()
+}
+
+// stopRunning has to be called with runMutex locked.
+func (self *Queue) stopRunning() {
+	if self.stop != nil {
+		close(self.stop)
+		<-self.stopped
+		self.stop = nil
+		self.stopped = nil
+	}
+}
@@ -0,0 +1,115 @@
+package mail
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ungerik/go-start/mongo"
+)
+
+var queueCollection = mongo.NewCollection("mail_queue", (*QueuedMessage)(nil))
+
+func newTestQueue() (*Queue, *MemoryOutbox) {
+	mongo.InitMemory()
+	outbox := new(MemoryOutbox)
+	return NewQueue(queueCollection, outbox), outbox
+}
+
+func TestQueueDelivery(t *testing.T) {
+	queue, outbox := newTestQueue()
+	message := &Message{To: []string{"a@example.com"}, Cc: []string{"c@example.com"}, Subject: "Subject", Text: "Text", HTML: "<p>HTML</p>"}
+	if err := queue.Send(message); err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Count() != 0 {
+		t.Fatal("Send delivered the message before Process")
+	}
+	sent, err := queue.Process()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 {
+		t.Fatalf("%d messages sent instead of 1", sent)
+	}
+	delivered, _ := outbox.Last()
+	if delivered.HTML != message.HTML || len(delivered.Cc) != 1 || delivered.Subject != message.Subject {
+		t.Errorf("delivered message %#v differs from %#v", delivered, message)
+	}
+	if n, _ := queue.Collection.Count(); n != 0 {
+		t.Errorf("%d messages left in the queue", n)
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	queue, outbox := newTestQueue()
+	queue.MaxAttempts = 2
+	queue.RetryDelay = time.Hour
+	outbox.Err = errors.New("offline")
+	if err := queue.Send(NewMessage("Subject", "Text", "a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent, err := queue.Process(); sent != 0 || err != nil {
+		t.Fatalf("sent=%d err=%v", sent, err)
+	}
+	doc, err := queue.Pending().One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := doc.(*QueuedMessage)
+	if queued.Attempts.Get() != 1 || queued.LastError.Get() != "offline" {
+		t.Errorf("Attempts=%d LastError=%q", queued.Attempts.Get(), queued.LastError.Get())
+	}
+	if time.Until(queued.NextAttempt.Time()) < 59*time.Minute {
+		t.Errorf("next attempt at %s is before RetryDelay", queued.NextAttempt.Get())
+	}
+
+	// Not due yet
+	if sent, _ := queue.Process(); sent != 0 {
+		t.Fatal("message sent before the next attempt")
+	}
+	queued.NextAttempt.SetTime(time.Now().UTC().Add(-time.Minute))
+	if err = queued.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = queue.Process(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := queue.Failed().Count(); n != 1 {
+		t.Errorf("message not failed after MaxAttempts")
+	}
+	if n, _ := queue.Pending().Count(); n != 0 {
+		t.Errorf("failed message is still pending")
+	}
+}
+
+func TestQueueStartStop(t *testing.T) {
+	queue, outbox := newTestQueue()
+	if err := queue.Send(NewMessage("Subject", "Text", "a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			queue.Start(time.Hour)
+		}()
+		go func() {
+			defer wg.Done()
+			queue.Stop()
+		}()
+	}
+	wg.Wait()
+	queue.Start(time.Hour)
+	queue.Stop()
+
+	// Start processes immediately and Stop waits for it
+	if outbox.Count() != 1 {
+		t.Errorf("%d messages sent instead of 1", outbox.Count())
+	}
+	queue.Stop()
+}
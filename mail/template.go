@@ -0,0 +1,116 @@
+package mail
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/ungerik/go-start/templatesystem"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Template
+
+/*
+Template renders the subject, text and HTML of emails.
+HTML is optional, if it is set the email has a text and a HTML part.
+
+Example:
+
+	var welcome = mail.MustNewTemplate(
+		"Welcome to {{.Site}}",
+		"Hello {{.Name}},\n\nwelcome to {{.Site}}!",
+		"<p>Hello {{.Name}},</p><p>welcome to <b>{{.Site}}</b>!</p>",
+	)
+
+	message, err := welcome.Render(data, "name@example.com")
+*/
+type Template struct {
+	Subject templatesystem.Template
+	Text    templatesystem.Template
+	HTML    templatesystem.Template
+}
+
+// NewTemplate parses subject and text with Config.TemplateSystem
+// and html with Config.HTMLTemplateSystem. html can be empty.
+func NewTemplate(subject, text, html string) (*Template, error) {
+	var err error
+	self := new(Template)
+	self.Subject, err = Config.TemplateSystem.ParseString(subject, "subject")
+	if err != nil {
+		return nil, err
+	}
+	self.Text, err = Config.TemplateSystem.ParseString(text, "text")
+	if err != nil {
+		return nil, err
+	}
+	if html != "" {
+		self.HTML, err = Config.HTMLTemplateSystem.ParseString(html, "html")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return self, nil
+}
+
+// MustNewTemplate is like NewTemplate but panics on errors.
+func MustNewTemplate(subject, text, html string) *Template {
+	self, err := NewTemplate(subject, text, html)
+	if err != nil {
+		panic(err)
+	}
+	return self
+}
+
+// NewTemplateFiles is like NewTemplate, but parses files.
+// htmlFile can be empty.
+func NewTemplateFiles(subjectFile, textFile, htmlFile string) (*Template, error) {
+	var err error
+	self := new(Template)
+	self.Subject, err = Config.TemplateSystem.ParseFile(subjectFile)
+	if err != nil {
+		return nil, err
+	}
+	self.Text, err = Config.TemplateSystem.ParseFile(textFile)
+	if err != nil {
+		return nil, err
+	}
+	if htmlFile != "" {
+		self.HTML, err = Config.HTMLTemplateSystem.ParseFile(htmlFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return self, nil
+}
+
+// Render returns a message for to with the templates rendered with context.
+func (self *Template) Render(context interface{}, to ...string) (*Message, error) {
+	message := &Message{To: to}
+	subject, err := render(self.Subject, context)
+	if err != nil {
+		return nil, err
+	}
+	// Line breaks from the template would break the header
+	message.Subject = strings.Join(strings.Fields(subject), " ")
+	message.Text, err = render(self.Text, context)
+	if err != nil {
+		return nil, err
+	}
+	message.HTML, err = render(self.HTML, context)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func render(templ templatesystem.Template, context interface{}) (string, error) {
+	if templ == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	err := templ.Render(&buf, context)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,54 @@
+package mail
+
+import (
+	"testing"
+)
+
+func TestTemplateRender(t *testing.T) {
+	template := MustNewTemplate(
+		"Welcome to\n{{.Site}}",
+		"Hello {{.Name}}, welcome to {{.Site}}!",
+		"<p>Hello {{.Name}}</p>",
+	)
+	context := struct{ Name, Site string }{"<Erik>", "Example"}
+	message, err := template.Render(context, "erik@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Subject != "Welcome to Example" {
+		t.Errorf("Subject is %q, line breaks have to be removed", message.Subject)
+	}
+	if message.Text != "Hello <Erik>, welcome to Example!" {
+		t.Errorf("Text is %q, it must not be escaped", message.Text)
+	}
+	if message.HTML != "<p>Hello &lt;Erik&gt;</p>" {
+		t.Errorf("HTML is %q, it has to be escaped", message.HTML)
+	}
+	if len(message.To) != 1 || message.To[0] != "erik@example.com" {
+		t.Errorf("To is %v", message.To)
+	}
+}
+
+func TestTemplateWithoutHTML(t *testing.T) {
+	template, err := NewTemplate("Subject", "Text", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := template.Render(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.HTML != "" {
+		t.Errorf("HTML is %q", message.HTML)
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	if _, err := NewTemplate("{{.Subject", "Text", ""); err == nil {
+		t.Error("no error for an invalid subject template")
+	}
+	template := MustNewTemplate("{{.Missing.Field}}", "Text", "")
+	if _, err := template.Render(struct{ Missing *struct{ Field string } }{}); err == nil {
+		t.Error("no error for a failing template")
+	}
+}
@@ -1307,3 +1307,10 @@ func BenchmarkUnmarhsalMap(b *testing.B) {
 		panic(err)
 	}
 }
+
+func (s *S) TestIsObjectIdHex(c *C) {
+	c.Assert(bson.IsObjectIdHex("4d88e15b60f486e428412dc9"), Equals, true)
+	c.Assert(bson.IsObjectIdHex("4d88e15b60f486e428412dc"), Equals, false)
+	c.Assert(bson.IsObjectIdHex("4d88e15b60f486e428412dcz"), Equals, false)
+	c.Assert(bson.IsObjectIdHex(""), Equals, false)
+}
@@ -51,10 +51,11 @@ type mongoCluster struct {
 	direct       bool
 	cachedIndex  map[string]bool
 	sync         chan bool
+	dialer       dialer
 }
 
-func newCluster(userSeeds []string, direct bool) *mongoCluster {
-	cluster := &mongoCluster{userSeeds: userSeeds, references: 1, direct: direct}
+func newCluster(userSeeds []string, direct bool, dialer dialer) *mongoCluster {
+	cluster := &mongoCluster{userSeeds: userSeeds, references: 1, direct: direct, dialer: dialer}
 	cluster.serverSynced.L = cluster.RWMutex.RLocker()
 	cluster.sync = make(chan bool, 1)
 	go cluster.syncServersLoop()
@@ -115,6 +116,7 @@ type isMasterResult struct {
 	Primary   string
 	Hosts     []string
 	Passives  []string
+	SetName   string "setName"
 }
 
 func (cluster *mongoCluster) syncServer(server *mongoServer) (hosts []string, err error) {
@@ -152,6 +154,13 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (hosts []string, er
 		break
 	}
 
+	if setName := cluster.dialer.setName; setName != "" && result.SetName != setName {
+		logf("SYNC %s is member of replica set %q instead of %q.", addr, result.SetName, setName)
+		// Made an incorrect assumption above, so fix stats.
+		stats.conn(-1, false)
+		return nil, errors.New(addr + " is not a member of replica set " + setName)
+	}
+
 	if result.IsMaster {
 		debugf("SYNC %s is a master.", addr)
 		// Made an incorrect assumption above, so fix stats.
@@ -328,7 +337,7 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 		go func() {
 			defer wg.Done()
 
-			server, err := newServer(addr, cluster.sync)
+			server, err := newServer(addr, cluster.sync, cluster.dialer)
 			if err != nil {
 				log("SYNC Failed to start sync of ", addr, ": ", err.Error())
 				return
@@ -411,9 +420,10 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 var socketsPerServer = 4096
 
 // AcquireSocket returns a socket to a server in the cluster.  If slaveOk is
-// true, it will attempt to return a socket to a slave server.  If it is
+// true, it will attempt to return a socket to a slave server, unless
+// preferMaster is also true and a master server is known.  If slaveOk is
 // false, the socket will necessarily be to a master server.
-func (cluster *mongoCluster) AcquireSocket(slaveOk bool, syncTimeout time.Duration) (s *mongoSocket, err error) {
+func (cluster *mongoCluster) AcquireSocket(slaveOk, preferMaster bool, syncTimeout time.Duration) (s *mongoSocket, err error) {
 	started := time.Now()
 	warnedLimit := false
 	for {
@@ -436,12 +446,7 @@ func (cluster *mongoCluster) AcquireSocket(slaveOk bool, syncTimeout time.Durati
 			cluster.serverSynced.Wait()
 		}
 
-		var server *mongoServer
-		if slaveOk {
-			server = cluster.servers.MostAvailable()
-		} else {
-			server = cluster.masters.MostAvailable()
-		}
+		server := cluster.selectServer(slaveOk, preferMaster)
 		cluster.RUnlock()
 
 		s, err = server.AcquireSocket(socketsPerServer)
@@ -462,6 +467,15 @@ func (cluster *mongoCluster) AcquireSocket(slaveOk bool, syncTimeout time.Durati
 	panic("unreached")
 }
 
+// selectServer picks the server for AcquireSocket. It must be called
+// with the cluster lock held and at least one suitable server known.
+func (cluster *mongoCluster) selectServer(slaveOk, preferMaster bool) *mongoServer {
+	if slaveOk && !(preferMaster && cluster.masters.Len() > 0) {
+		return cluster.servers.MostAvailable()
+	}
+	return cluster.masters.MostAvailable()
+}
+
 func (cluster *mongoCluster) CacheIndex(cacheKey string, exists bool) {
 	cluster.Lock()
 	if cluster.cachedIndex == nil {
@@ -0,0 +1,57 @@
+package mgo
+
+import (
+	"strconv"
+	"testing"
+)
+
+func newTestCluster(masters, slaves int) *mongoCluster {
+	cluster := &mongoCluster{}
+	for i := 0; i < masters+slaves; i++ {
+		server := &mongoServer{master: i < masters}
+		server.Addr = "localhost:" + strconv.Itoa(27017+i)
+		server.ResolvedAddr = server.Addr
+		cluster.servers.Add(server)
+		if server.master {
+			cluster.masters.Add(server)
+		}
+	}
+	return cluster
+}
+
+func TestSelectServer(t *testing.T) {
+	tests := []struct {
+		name         string
+		masters      int
+		slaves       int
+		slaveOk      bool
+		preferMaster bool
+		wantMaster   bool
+	}{
+		{"strong", 1, 2, false, false, true},
+		{"eventual", 1, 2, true, false, false},
+		{"primary preferred", 1, 2, true, true, true},
+		{"primary preferred without master", 0, 2, true, true, false},
+	}
+	for _, test := range tests {
+		cluster := newTestCluster(test.masters, test.slaves)
+		server := cluster.selectServer(test.slaveOk, test.preferMaster)
+		if server.master != test.wantMaster {
+			t.Errorf("%s: selected master %v, want %v", test.name, server.master, test.wantMaster)
+		}
+	}
+}
+
+func TestIterCloseWithoutCursor(t *testing.T) {
+	iter := &Iter{}
+	iter.gotReply.L = &iter.m
+	if err := iter.Close(); err != nil {
+		t.Fatalf("Close returned %v", err)
+	}
+	if iter.Next(&struct{}{}) {
+		t.Fatal("Next returned true after Close")
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("Err returned %v after Close", err)
+	}
+}
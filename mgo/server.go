@@ -31,6 +31,7 @@ import (
 	"net"
 	"sort"
 	"sync"
+	"time"
 )
 
 // ---------------------------------------------------------------------------
@@ -46,9 +47,18 @@ type mongoServer struct {
 	closed        bool
 	master        bool
 	sync          chan bool
+	dialer        dialer
 }
 
-func newServer(addr string, sync chan bool) (server *mongoServer, err error) {
+// dialer holds the connection settings of a cluster from DialInfo.
+type dialer struct {
+	timeout       time.Duration
+	socketTimeout time.Duration
+	setName       string
+	dial          func(addr net.Addr) (net.Conn, error)
+}
+
+func newServer(addr string, sync chan bool, dialer dialer) (server *mongoServer, err error) {
 	tcpaddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		log("Failed to resolve ", addr, ": ", err.Error())
@@ -64,6 +74,7 @@ func newServer(addr string, sync chan bool) (server *mongoServer, err error) {
 		ResolvedAddr: resolvedAddr,
 		tcpaddr:      tcpaddr,
 		sync:         sync,
+		dialer:       dialer,
 	}
 	return
 }
@@ -115,10 +126,20 @@ func (server *mongoServer) Connect() (*mongoSocket, error) {
 	addr := server.Addr
 	tcpaddr := server.tcpaddr
 	master := server.master
+	dialer := server.dialer
 	server.RUnlock()
 
 	log("Establishing new connection to ", addr, "...")
-	conn, err := net.DialTCP("tcp", nil, tcpaddr)
+	var conn net.Conn
+	var err error
+	switch {
+	case dialer.dial != nil:
+		conn, err = dialer.dial(tcpaddr)
+	case dialer.timeout > 0:
+		conn, err = net.DialTimeout("tcp", tcpaddr.String(), dialer.timeout)
+	default:
+		conn, err = net.DialTCP("tcp", nil, tcpaddr)
+	}
 	if err != nil {
 		log("Connection to ", addr, " failed: ", err.Error())
 		return nil, err
@@ -126,7 +147,7 @@ func (server *mongoServer) Connect() (*mongoSocket, error) {
 	log("Connection to ", addr, " established.")
 
 	stats.conn(+1, master)
-	return newSocket(server, conn), nil
+	return newSocket(server, conn, dialer.socketTimeout), nil
 }
 
 // Close forces closing all sockets that are alive, whether
@@ -33,6 +33,7 @@ import (
 	"fmt"
 	"github.com/ungerik/go-start/mgo/bson"
 	"math"
+	"net"
 	"reflect"
 	"runtime"
 	"sort"
@@ -45,9 +46,10 @@ import (
 type mode int
 
 const (
-	Eventual  mode = 0
-	Monotonic mode = 1
-	Strong    mode = 2
+	Eventual         mode = 0
+	Monotonic        mode = 1
+	Strong           mode = 2
+	PrimaryPreferred mode = 3
 )
 
 // When changing the Session type, check if newSession and copySession
@@ -165,6 +167,11 @@ const defaultPrefetch = 0.25
 //         that to talk to a slave you'll need to relax the consistency
 //         requirements using a Monotonic or Eventual mode via SetMode.
 //
+//     replicaSet=<setname>
+//
+//         Only servers that are members of the replica set with the
+//         given name are used.
+//
 // Relevant documentation:
 //
 //     http://www.mongodb.org/display/DOCS/Connections
@@ -188,12 +195,20 @@ func DialWithTimeout(url string, timeout time.Duration) (session *Session, err e
 	if err != nil {
 		return nil, err
 	}
-	direct := false
+	info := DialInfo{
+		Addrs:    servers,
+		Timeout:  timeout,
+		Database: auth.db,
+		Username: auth.user,
+		Password: auth.pass,
+	}
 	for k, v := range options {
 		switch k {
+		case "replicaSet":
+			info.ReplicaSetName = v
 		case "connect":
 			if v == "direct" {
-				direct = true
+				info.Direct = true
 				break
 			}
 			if v == "replicaSet" {
@@ -205,9 +220,77 @@ func DialWithTimeout(url string, timeout time.Duration) (session *Session, err e
 			return
 		}
 	}
-	cluster := newCluster(servers, direct)
-	session = newSession(Eventual, cluster, nil, timeout)
-	if auth.user != "" {
+	return DialWithInfo(&info)
+}
+
+// DialInfo holds options for establishing a session with a MongoDB cluster.
+// To use a URL, see the Dial function.
+type DialInfo struct {
+	// Addrs holds the addresses for the seed servers.
+	// If the port number is not provided, it defaults to 27017.
+	Addrs []string
+
+	// Direct informs whether to establish connections only with the
+	// specified seed servers, or to obtain information for the whole
+	// cluster and establish connections with further servers too.
+	Direct bool
+
+	// Timeout is the amount of time to wait for a server to respond when
+	// first connecting and on follow up operations in the session. If
+	// timeout is zero, the call may block forever waiting for a connection
+	// to be established.
+	Timeout time.Duration
+
+	// SocketTimeout is the amount of time to wait for a reply of the
+	// server before the connection is closed. Zero means no timeout.
+	// It has to be longer than the slowest expected query.
+	SocketTimeout time.Duration
+
+	// ReplicaSetName, if specified, prevents the obtained session from
+	// communicating with any server which is not part of a replica set
+	// with the given name.
+	ReplicaSetName string
+
+	// Database is the database name used during the initial
+	// authentication. It is ignored without Username.
+	Database string
+
+	// Username and Password inform the credentials for the initial
+	// authentication done against Database, or "admin" if Database
+	// is empty. The authentication information will persist in
+	// sessions obtained through the New method as well.
+	Username string
+	Password string
+
+	// Dial optionally specifies the dial function for creating connections
+	// with the cluster, for example to use TLS with tls.Client().
+	Dial func(addr net.Addr) (net.Conn, error)
+}
+
+// DialWithInfo establishes a new session to the cluster identified by info.
+func DialWithInfo(info *DialInfo) (session *Session, err error) {
+	servers := make([]string, len(info.Addrs))
+	for i, addr := range info.Addrs {
+		p := strings.LastIndexAny(addr, "]:")
+		if p == -1 || addr[p] != ':' {
+			addr += ":27017"
+		}
+		servers[i] = addr
+	}
+	dialer := dialer{
+		timeout:       info.Timeout,
+		socketTimeout: info.SocketTimeout,
+		setName:       info.ReplicaSetName,
+		dial:          info.Dial,
+	}
+	cluster := newCluster(servers, info.Direct, dialer)
+	session = newSession(Eventual, cluster, nil, info.Timeout)
+	if info.Username != "" {
+		db := info.Database
+		if db == "" {
+			db = "admin"
+		}
+		auth := authInfo{db: db, user: info.Username, pass: info.Password}
 		session.urlauth = &auth
 		session.auth = []authInfo{auth}
 	}
@@ -878,6 +961,11 @@ func (s *Session) Refresh() {
 // also the one offering the least guarantees about ordering of the data
 // read and written.
 //
+// In the PrimaryPreferred consistency mode reads are made to the master
+// server whenever one is known, and only to a slave if the cluster
+// has no reachable master. Like in the Eventual mode, no connection
+// is reserved, so every read checks again if a master is available.
+//
 // If refresh is true, in addition to ensuring the session is in the given
 // consistency mode, the consistency guarantees will also be reset (e.g.
 // a Monotonic session will be allowed to read from slaves again).  This is
@@ -1224,6 +1312,15 @@ func (c *Collection) Find(query interface{}) *Query {
 	return q
 }
 
+// With returns a copy of the query that will be executed with session s,
+// for example to read with a different consistency mode.
+func (q *Query) With(s *Session) *Query {
+	q.m.Lock()
+	c := &Query{session: s, query: q.query}
+	q.m.Unlock()
+	return c
+}
+
 type LastError struct {
 	Err             string
 	Code, N, Waited int
@@ -1949,6 +2046,41 @@ func (iter *Iter) Err() error {
 	return err
 }
 
+// Close kills the cursor of the iterator on the server if the result set
+// has not been exhausted yet, so that the server can release it.
+// Next returns false after Close. The error of the iteration or of
+// killing the cursor is returned.
+func (iter *Iter) Close() error {
+	iter.m.Lock()
+	// Wait for requested replies, they can change the cursor
+	for iter.pendingDocs > 0 && iter.err == nil {
+		iter.gotReply.Wait()
+	}
+	cursorId := iter.op.cursorId
+	iter.op.cursorId = 0
+	if iter.err == nil {
+		iter.err = NotFound
+	}
+	err := iter.err
+	iter.m.Unlock()
+
+	if err == NotFound {
+		err = nil
+	}
+	if cursorId == 0 {
+		return err
+	}
+	socket, killErr := iter.session.acquireSocket(true)
+	if killErr == nil {
+		killErr = socket.Query(&killCursorsOp{[]int64{cursorId}})
+		socket.Release()
+	}
+	if err == nil {
+		err = killErr
+	}
+	return err
+}
+
 // Timeout returns true if Next returned false due to a timeout of
 // a tailable cursor. In those cases, Next may be called again to continue
 // the iteration at the previous cursor position.
@@ -2575,7 +2707,7 @@ func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
 	}
 
 	// Still not good.  We need a new socket.
-	sock, err := s.cluster().AcquireSocket(slaveOk && s.slaveOk, s.syncTimeout)
+	sock, err := s.cluster().AcquireSocket(slaveOk && s.slaveOk, s.consistency == PrimaryPreferred, s.syncTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -2594,7 +2726,7 @@ func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
 	// not refreshed (socket != nil), it means the developer asked
 	// to preserve an existing reserved socket, so we'll keep the
 	// master one around too before a Refresh happens.
-	if s.consistency != Eventual || s.socket != nil {
+	if s.consistency != Eventual && s.consistency != PrimaryPreferred || s.socket != nil {
 		s.setSocket(sock)
 	}
 
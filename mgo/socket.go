@@ -31,6 +31,7 @@ import (
 	"github.com/ungerik/go-start/mgo/bson"
 	"net"
 	"sync"
+	"time"
 )
 
 type replyFunc func(err error, reply *replyOp, docNum int, docData []byte)
@@ -38,8 +39,9 @@ type replyFunc func(err error, reply *replyOp, docNum int, docData []byte)
 type mongoSocket struct {
 	sync.Mutex
 	server        *mongoServer // nil when cached
-	conn          *net.TCPConn
-	addr          string // For debugging only.
+	conn          net.Conn
+	timeout       time.Duration // Read and write timeout, zero for none
+	addr          string        // For debugging only.
 	nextRequestId uint32
 	replyFuncs    map[uint32]replyFunc
 	references    int
@@ -67,6 +69,10 @@ type getMoreOp struct {
 	replyFunc  replyFunc
 }
 
+type killCursorsOp struct {
+	cursorIds []int64
+}
+
 type replyOp struct {
 	flags     uint32
 	cursorId  int64
@@ -97,8 +103,8 @@ type requestInfo struct {
 	replyFunc replyFunc
 }
 
-func newSocket(server *mongoServer, conn *net.TCPConn) *mongoSocket {
-	socket := &mongoSocket{conn: conn, addr: server.Addr}
+func newSocket(server *mongoServer, conn net.Conn, timeout time.Duration) *mongoSocket {
+	socket := &mongoSocket{conn: conn, timeout: timeout, addr: server.Addr}
 	socket.gotNonce.L = &socket.Mutex
 	socket.replyFuncs = make(map[uint32]replyFunc)
 	socket.server = server
@@ -299,6 +305,14 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			buf = addInt64(buf, op.cursorId)
 			replyFunc = op.replyFunc
 
+		case *killCursorsOp:
+			buf = addHeader(buf, 2007)
+			buf = addInt32(buf, 0) // Reserved
+			buf = addInt32(buf, int32(len(op.cursorIds)))
+			for _, cursorId := range op.cursorIds {
+				buf = addInt64(buf, cursorId)
+			}
+
 		case *deleteOp:
 			buf = addHeader(buf, 2006)
 			buf = addInt32(buf, 0) // Reserved
@@ -357,12 +371,33 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 	debugf("Socket %p to %s: sending %d op(s) (%d bytes)", socket, socket.addr, len(ops), len(buf))
 	stats.sentOps(len(ops))
 
+	if socket.timeout > 0 {
+		deadline := time.Now().Add(socket.timeout)
+		socket.conn.SetWriteDeadline(deadline)
+		if requestCount > 0 {
+			socket.conn.SetReadDeadline(deadline)
+		}
+	}
 	_, err = socket.conn.Write(buf)
 	socket.Unlock()
 	return err
 }
 
-func fill(r *net.TCPConn, b []byte) error {
+// updateReadDeadline extends the read deadline while replies are
+// expected and removes it for idle sockets, which would otherwise be
+// killed by the readLoop. The socket must be locked.
+func (socket *mongoSocket) updateReadDeadline() {
+	if socket.timeout == 0 || socket.dead != nil {
+		return
+	}
+	if len(socket.replyFuncs) > 0 {
+		socket.conn.SetReadDeadline(time.Now().Add(socket.timeout))
+	} else {
+		socket.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func fill(r net.Conn, b []byte) error {
 	l := len(b)
 	n, err := r.Read(b)
 	for n != l && err == nil {
@@ -460,6 +495,7 @@ func (socket *mongoSocket) readLoop() {
 		if replyFuncFound {
 			delete(socket.replyFuncs, uint32(responseTo))
 		}
+		socket.updateReadDeadline()
 		socket.Unlock()
 
 		// XXX Do bound checking against totalLen.
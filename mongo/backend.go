@@ -0,0 +1,244 @@
+package mongo
+
+import (
+	"github.com/ungerik/go-start/mgo"
+	"github.com/ungerik/go-start/mgo/bson"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Backend interfaces
+
+// collectionBackend is the storage of a Collection.
+// It is implemented by mgoCollection for MongoDB
+// and by memoryCollection for tests without a database.
+type collectionBackend interface {
+	Find(query interface{}) queryBackend
+	Count() (n int, err error)
+	Insert(documents ...interface{}) error
+	Upsert(selector interface{}, change interface{}) (id interface{}, err error)
+	Update(selector interface{}, change interface{}) error
+	UpdateAll(selector interface{}, change interface{}) error
+	Remove(selector interface{}) error
+	RemoveAll(selector interface{}) error
+	// UpsertBatch executes the upserts of selectors[i] with documents[i]
+	// with a single request. If ordered is true, the execution stops
+	// at the first failing upsert. itemErrors is nil or has
+	// the error of every failed upsert at its index.
+	UpsertBatch(selectors, documents []bson.M, ordered bool) (itemErrors []error, err error)
+	// UpdateBatch updates all documents matching selector
+	// and returns the number of matched documents.
+	UpdateBatch(selector interface{}, change interface{}) (updated int, err error)
+	// RemoveBatch removes all documents matching selector
+	// and returns the number of removed documents.
+	RemoveBatch(selector interface{}) (removed int, err error)
+}
+
+// queryBackend is a query of a collectionBackend.
+// The methods have the same semantics as the methods of mgo.Query.
+type queryBackend interface {
+	Skip(n int) queryBackend
+	Limit(n int) queryBackend
+	// Sort fields can be prefixed with '-' for descending order
+	Sort(fields ...string) queryBackend
+	Select(selector interface{}) queryBackend
+	// ReadPreference is not a method of mgo.Query,
+	// it executes the query with the session for pref.
+	ReadPreference(pref ReadPreference) queryBackend
+	One(result interface{}) error
+	Iter() iterBackend
+	Count() (n int, err error)
+	Explain(result interface{}) error
+}
+
+// iterBackend is implemented by mgo.Iter
+type iterBackend interface {
+	Next(result interface{}) bool
+	Err() error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// mgoCollection
+
+type mgoCollection struct {
+	*mgo.Collection
+}
+
+func (self mgoCollection) Find(query interface{}) queryBackend {
+	return mgoQuery{self.Collection.Find(query)}
+}
+
+// mgoMaxBatchBytes is the maximum size of the updates of an update command,
+// MongoDB limits the whole command to 16 MB
+const mgoMaxBatchBytes = 15 * 1024 * 1024
+
+// UpsertBatch uses the update command of MongoDB 2.6+.
+// Batches are split if the documents exceed mgoMaxBatchBytes.
+func (self mgoCollection) UpsertBatch(selectors, documents []bson.M, ordered bool) (itemErrors []error, err error) {
+	for start := 0; start < len(selectors); {
+		var updates []bson.M
+		size := 0
+		end := start
+		for ; end < len(selectors); end++ {
+			update := bson.M{"q": selectors[end], "u": documents[end], "upsert": true}
+			data, err := bson.Marshal(update)
+			if err != nil {
+				return nil, err
+			}
+			if end > start && size+len(data) > mgoMaxBatchBytes {
+				break
+			}
+			size += len(data)
+			updates = append(updates, update)
+		}
+
+		var result struct {
+			WriteErrors []struct {
+				Index  int
+				Code   int
+				ErrMsg string
+			} `bson:"writeErrors"`
+		}
+		command := bson.D{
+			{Name: "update", Value: self.Name},
+			{Name: "updates", Value: updates},
+			{Name: "ordered", Value: ordered},
+		}
+		if writeConcern := mgoWriteConcern(self.Database.Session.Safe()); writeConcern != nil {
+			command = append(command, bson.DocElem{Name: "writeConcern", Value: writeConcern})
+		}
+		if err = self.Database.Run(command, &result); err != nil {
+			return nil, err
+		}
+		if len(result.WriteErrors) > 0 {
+			if itemErrors == nil {
+				itemErrors = make([]error, len(selectors))
+			}
+			for _, writeErr := range result.WriteErrors {
+				itemErrors[start+writeErr.Index] = &mgo.LastError{Code: writeErr.Code, Err: writeErr.ErrMsg}
+			}
+			if ordered {
+				return itemErrors, nil
+			}
+		}
+		start = end
+	}
+	return itemErrors, nil
+}
+
+// UpdateBatch uses the update command of MongoDB 2.6+,
+// because mgo.Collection.UpdateAll() doesn't return the number
+// of updated documents.
+func (self mgoCollection) UpdateBatch(selector interface{}, change interface{}) (updated int, err error) {
+	var result struct {
+		N int
+	}
+	command := bson.D{
+		{Name: "update", Value: self.Name},
+		{Name: "updates", Value: []bson.M{{"q": selector, "u": change, "multi": true}}},
+	}
+	if writeConcern := mgoWriteConcern(self.Database.Session.Safe()); writeConcern != nil {
+		command = append(command, bson.DocElem{Name: "writeConcern", Value: writeConcern})
+	}
+	err = self.Database.Run(command, &result)
+	return result.N, err
+}
+
+// RemoveBatch uses the delete command of MongoDB 2.6+,
+// because mgo.Collection.RemoveAll() doesn't return the number
+// of removed documents.
+func (self mgoCollection) RemoveBatch(selector interface{}) (removed int, err error) {
+	var result struct {
+		N int
+	}
+	command := bson.D{
+		{Name: "delete", Value: self.Name},
+		{Name: "deletes", Value: []bson.M{{"q": selector, "limit": 0}}},
+	}
+	if writeConcern := mgoWriteConcern(self.Database.Session.Safe()); writeConcern != nil {
+		command = append(command, bson.DocElem{Name: "writeConcern", Value: writeConcern})
+	}
+	err = self.Database.Run(command, &result)
+	return result.N, err
+}
+
+// mgoWriteConcern returns the writeConcern document of a command for safe
+// or nil for the default write concern of the server.
+// Unacknowledged writes are not possible with commands that return results.
+func mgoWriteConcern(safe *mgo.Safe) bson.M {
+	if safe == nil {
+		return nil
+	}
+	writeConcern := bson.M{}
+	switch {
+	case safe.WMode != "":
+		writeConcern["w"] = safe.WMode
+	case safe.W > 0:
+		writeConcern["w"] = safe.W
+	}
+	if safe.WTimeout > 0 {
+		writeConcern["wtimeout"] = safe.WTimeout
+	}
+	if safe.J || safe.FSync {
+		writeConcern["j"] = true
+	}
+	if len(writeConcern) == 0 {
+		return nil
+	}
+	return writeConcern
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// mgoQuery
+
+type mgoQuery struct {
+	*mgo.Query
+}
+
+func (self mgoQuery) Skip(n int) queryBackend {
+	return mgoQuery{self.Query.Skip(n)}
+}
+
+func (self mgoQuery) Limit(n int) queryBackend {
+	return mgoQuery{self.Query.Limit(n)}
+}
+
+func (self mgoQuery) Sort(fields ...string) queryBackend {
+	if len(fields) == 0 {
+		return self
+	}
+	return mgoQuery{self.Query.Sort(fields[0], fields[1:]...)}
+}
+
+func (self mgoQuery) Select(selector interface{}) queryBackend {
+	return mgoQuery{self.Query.Select(selector)}
+}
+
+func (self mgoQuery) ReadPreference(pref ReadPreference) queryBackend {
+	return mgoQuery{self.Query.With(mgoSession(pref, nil))}
+}
+
+func (self mgoQuery) Iter() iterBackend {
+	return self.Query.Iter()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// bsonIter
+
+// bsonIter iterates over already loaded documents
+type bsonIter struct {
+	documents []bson.M
+	err       error
+}
+
+func (self *bsonIter) Next(result interface{}) bool {
+	if self.err != nil || len(self.documents) == 0 {
+		return false
+	}
+	self.err = memoryDecode(self.documents[0], result)
+	self.documents = self.documents[1:]
+	return self.err == nil
+}
+
+func (self *bsonIter) Err() error {
+	return self.err
+}
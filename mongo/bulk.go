@@ -0,0 +1,501 @@
+package mongo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/mgo/bson"
+)
+
+// bulkBatchSize is the maximum number of documents
+// written with a single database request
+const bulkBatchSize = 1000
+
+///////////////////////////////////////////////////////////////////////////////
+// BulkResult
+
+// BulkResult is returned by Bulk.Run().
+type BulkResult struct {
+	// IDs of the inserted and upserted documents by operation index.
+	// The IDs of failed, remove and purge operations are empty.
+	IDs      []bson.ObjectId
+	Inserted int
+	Upserted int // Documents inserted by upserts
+	Replaced int // Existing documents replaced by upserts
+	Removed  int // Documents removed or marked as deleted by remove and purge operations
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// BulkError
+
+// BulkItemError is the error of a single operation of a Bulk.
+type BulkItemError struct {
+	Index int // Index of the operation in the order it was added to the Bulk
+	Err   error
+}
+
+func (self *BulkItemError) Error() string {
+	return fmt.Sprintf("Bulk operation %d: %s", self.Index, self.Err)
+}
+
+// BulkError is returned by Bulk.Run() if operations failed.
+type BulkError struct {
+	Items []BulkItemError
+}
+
+func (self *BulkError) Error() string {
+	return fmt.Sprintf("%d bulk operations failed, first error: %s", len(self.Items), self.Items[0].Error())
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Bulk
+
+type bulkOpKind int
+
+const (
+	bulkInsert bulkOpKind = iota
+	bulkUpsert
+	bulkRemove
+	bulkPurge
+)
+
+type bulkOp struct {
+	kind     bulkOpKind
+	document interface{}
+	key      []string
+	id       bson.ObjectId
+}
+
+// sameBatch returns true if op can be executed
+// in the same batch as other.
+func (self *bulkOp) sameBatch(other *bulkOp) bool {
+	if self.kind != other.kind {
+		return false
+	}
+	return self.kind != bulkUpsert || strings.Join(self.key, ",") == strings.Join(other.key, ",")
+}
+
+/*
+Bulk collects insert, upsert, remove and purge operations for a collection
+and writes them in batches with Run().
+
+Documents are initialized with InitDocument() and get new IDs
+like with Collection.Insert(), BeforeSave() and AfterSave() hooks are called.
+Consecutive inserts, upserts, removes and purges are sent as a single
+request per batch. The IDs of existing documents of consecutive upserts
+are looked up with a single query per batch.
+Upserts, removes and purges need MongoDB 2.6 or newer.
+
+If ordered is true, Run() stops at the first failing operation
+like MongoDB does. Else all operations are tried and the
+errors of all failed operations are returned.
+
+Example:
+
+	bulk := models.Users.Bulk(false)
+	for _, record := range records {
+		user := models.Users.NewDocument().(*models.User)
+		...
+		bulk.Upsert([]string{"Email"}, user)
+	}
+	result, err := bulk.Run()
+	if bulkErr, ok := err.(*mongo.BulkError); ok {
+		for _, item := range bulkErr.Items {
+			log.Printf("Record %d: %s", item.Index, item.Err)
+		}
+	}
+*/
+type Bulk struct {
+	collection *Collection
+	ordered    bool
+	ops        []bulkOp
+
+	// Set by Run()
+	result *BulkResult
+	errors []BulkItemError
+}
+
+// Bulk returns a new Bulk for the collection.
+func (self *Collection) Bulk(ordered bool) *Bulk {
+	return &Bulk{collection: self, ordered: ordered}
+}
+
+// Insert adds insert operations for documents.
+func (self *Bulk) Insert(documents ...interface{}) *Bulk {
+	for _, document := range documents {
+		self.ops = append(self.ops, bulkOp{kind: bulkInsert, document: document})
+	}
+	return self
+}
+
+// Upsert adds operations that replace the existing documents
+// with the same values of the key selectors with documents,
+// or insert documents if no such document exists.
+// The ID of an existing document is kept.
+func (self *Bulk) Upsert(key []string, documents ...interface{}) *Bulk {
+	for _, document := range documents {
+		self.ops = append(self.ops, bulkOp{kind: bulkUpsert, document: document, key: key})
+	}
+	return self
+}
+
+// Remove adds remove operations for the documents with ids.
+// Like Collection.Remove() no remove hooks are called and documents
+// of soft delete collections are only marked as deleted.
+func (self *Bulk) Remove(ids ...bson.ObjectId) *Bulk {
+	for _, id := range ids {
+		self.ops = append(self.ops, bulkOp{kind: bulkRemove, id: id})
+	}
+	return self
+}
+
+// Purge adds operations that remove the documents with ids
+// from the database like Collection.Purge(),
+// also from soft delete collections.
+func (self *Bulk) Purge(ids ...bson.ObjectId) *Bulk {
+	for _, id := range ids {
+		self.ops = append(self.ops, bulkOp{kind: bulkPurge, id: id})
+	}
+	return self
+}
+
+// Len returns the number of operations.
+func (self *Bulk) Len() int {
+	return len(self.ops)
+}
+
+/*
+Run executes all operations and returns a *BulkError
+if operations failed. The result is returned in both cases.
+The operations are removed from the Bulk,
+so it can be re-used for further operations.
+*/
+func (self *Bulk) Run() (result *BulkResult, err error) {
+	for _, op := range self.ops {
+		if op.kind == bulkUpsert {
+			if _, err = self.keyPaths(op.key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	self.collection.checkDBConnection()
+	// The written documents are only known after the run
+	defer self.collection.textIndexChanged()
+
+	self.result = &BulkResult{IDs: make([]bson.ObjectId, len(self.ops))}
+	self.errors = nil
+	for start := 0; start < len(self.ops); {
+		end := start + 1
+		for end < len(self.ops) && end-start < bulkBatchSize && self.ops[end].sameBatch(&self.ops[start]) {
+			end++
+		}
+		var stop bool
+		switch self.ops[start].kind {
+		case bulkInsert:
+			stop = self.runInserts(start, end)
+		case bulkUpsert:
+			stop = self.runUpserts(start, end)
+		case bulkRemove:
+			stop = self.runRemoves(start, end, self.collection.softDelete)
+		case bulkPurge:
+			stop = self.runRemoves(start, end, false)
+		}
+		if stop {
+			break
+		}
+		start = end
+	}
+
+	result = self.result
+	if len(self.errors) > 0 {
+		err = &BulkError{Items: self.errors}
+	}
+	self.ops = nil
+	self.result = nil
+	self.errors = nil
+	return result, err
+}
+
+// fail records the error of the operation with index
+// and returns true if the execution has to stop.
+func (self *Bulk) fail(index int, err error) bool {
+	self.errors = append(self.errors, BulkItemError{Index: index, Err: err})
+	return self.ordered
+}
+
+// succeed records the ID of the operation with index and
+// calls the AfterSave() hook of its document.
+func (self *Bulk) succeed(index int, id bson.ObjectId) bool {
+	self.result.IDs[index] = id
+	if err := callAfterSave(self.ops[index].document); err != nil {
+		return self.fail(index, err)
+	}
+	return false
+}
+
+func (self *Bulk) keyPaths(key []string) (paths []string, err error) {
+	if len(key) == 0 {
+		return nil, errs.Format("Bulk upsert into collection '%s' needs key selectors", self.collection.Name)
+	}
+	paths = make([]string, len(key))
+	for i, selector := range key {
+		if _, paths[i], err = self.collection.subDocumentPath([]string{strings.ToLower(selector)}); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// prepare initializes document like Collection.NewDocument(),
+// calls its BeforeSave() hook and returns it as bson.M.
+func (self *Bulk) prepare(document interface{}) (bson.M, error) {
+	if doc, ok := document.(Document); ok {
+		if c := doc.Collection(); c != nil && c != self.collection {
+			return nil, errs.Format("Document of collection '%s' can't be written to collection '%s'", c.Name, self.collection.Name)
+		}
+		self.collection.InitDocument(doc)
+	}
+	if isPartialDocument(document) {
+		return nil, errs.Format("Can't write a partially loaded document to collection '%s'", self.collection.Name)
+	}
+	if err := callBeforeSave(document); err != nil {
+		return nil, err
+	}
+	return memoryNormalize(document)
+}
+
+// setID sets id as ID of the document of the operation with index
+// and as _id of its bson.M.
+func (self *Bulk) setID(index int, doc bson.M, id bson.ObjectId) {
+	if document, ok := self.ops[index].document.(Document); ok {
+		document.SetObjectId(id)
+	}
+	doc["_id"] = id
+}
+
+// existingIDs returns the IDs of ids that are in the collection.
+func (self *Bulk) existingIDs(ids []bson.ObjectId) (existing map[bson.ObjectId]bool, err error) {
+	existing = make(map[bson.ObjectId]bool, len(ids))
+	i := self.collection.backend.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1}).Iter()
+	doc := bson.M{}
+	for i.Next(&doc) {
+		if id, ok := doc["_id"].(bson.ObjectId); ok {
+			existing[id] = true
+		}
+		doc = bson.M{}
+	}
+	return existing, i.Err()
+}
+
+func (self *Bulk) runInserts(start, end int) (stop bool) {
+	var indices []int
+	var docs []interface{}
+	var ids []bson.ObjectId
+	for index := start; index < end; index++ {
+		doc, err := self.prepare(self.ops[index].document)
+		if err != nil {
+			if self.fail(index, err) {
+				// Insert the documents before the failed one
+				stop = true
+				break
+			}
+			continue
+		}
+		// Like Collection.Insert(), documents are always inserted with new IDs.
+		// Unique IDs are also needed to find out which documents
+		// have been inserted if the batch fails.
+		id := bson.NewObjectId()
+		self.setID(index, doc, id)
+		indices = append(indices, index)
+		docs = append(docs, doc)
+		ids = append(ids, id)
+	}
+	if len(docs) == 0 {
+		return stop
+	}
+
+	insertErr := self.collection.backend.Insert(docs...)
+	if insertErr == nil {
+		for k, index := range indices {
+			self.result.Inserted++
+			if self.succeed(index, ids[k]) {
+				return true
+			}
+		}
+		return stop
+	}
+
+	// MongoDB stops at the first failing document,
+	// so find out which documents have been inserted
+	existing, err := self.existingIDs(ids)
+	if err != nil {
+		for _, index := range indices {
+			if self.fail(index, insertErr) {
+				return true
+			}
+		}
+		return stop
+	}
+	for k, index := range indices {
+		if existing[ids[k]] {
+			self.result.Inserted++
+			if self.succeed(index, ids[k]) {
+				return true
+			}
+			continue
+		}
+		if self.ordered {
+			// The first missing document is the failed one
+			return self.fail(index, insertErr)
+		}
+		if err = self.collection.backend.Insert(docs[k]); err != nil {
+			self.fail(index, err)
+			continue
+		}
+		self.result.Inserted++
+		self.succeed(index, ids[k])
+	}
+	return stop
+}
+
+// runUpserts executes upserts with the same key
+func (self *Bulk) runUpserts(start, end int) (stop bool) {
+	paths, _ := self.keyPaths(self.ops[start].key) // validated by Run()
+	fields := bson.M{"_id": 1}
+	for _, path := range paths {
+		fields[path] = 1
+	}
+
+	type upsert struct {
+		index    int
+		doc      bson.M
+		selector bson.M
+		key      string
+	}
+	var upserts []upsert
+	var or []bson.M
+	for index := start; index < end; index++ {
+		doc, err := self.prepare(self.ops[index].document)
+		if err == nil {
+			selector := bson.M{}
+			for _, path := range paths {
+				selector[path], _ = bsonPathValue(doc, path)
+			}
+			var key string
+			if key, err = bulkKey(doc, paths); err == nil {
+				upserts = append(upserts, upsert{index, doc, selector, key})
+				or = append(or, selector)
+				continue
+			}
+		}
+		if self.fail(index, err) {
+			stop = true
+			break
+		}
+	}
+	if len(upserts) == 0 {
+		return stop
+	}
+
+	// Look up the IDs of the existing documents with the keys
+	existing := make(map[string]bson.ObjectId)
+	i := self.collection.backend.Find(bson.M{"$or": or}).Select(fields).Iter()
+	doc := bson.M{}
+	for i.Next(&doc) {
+		if id, ok := doc["_id"].(bson.ObjectId); ok {
+			if key, err := bulkKey(doc, paths); err == nil {
+				existing[key] = id
+			}
+		}
+		doc = bson.M{}
+	}
+	if i.Err() != nil {
+		for _, u := range upserts {
+			if self.fail(u.index, i.Err()) {
+				return true
+			}
+		}
+		return stop
+	}
+
+	selectors := make([]bson.M, len(upserts))
+	docs := make([]bson.M, len(upserts))
+	found := make([]bool, len(upserts))
+	for k, u := range upserts {
+		id, ok := existing[u.key]
+		if !ok {
+			id = bson.NewObjectId()
+			// Later documents with the same key replace this one
+			existing[u.key] = id
+		}
+		found[k] = ok
+		self.setID(u.index, u.doc, id)
+		selectors[k] = u.selector
+		docs[k] = u.doc
+	}
+	itemErrors, err := self.collection.backend.UpsertBatch(selectors, docs, self.ordered)
+	if err != nil {
+		for _, u := range upserts {
+			if self.fail(u.index, err) {
+				return true
+			}
+		}
+		return stop
+	}
+	for k, u := range upserts {
+		if itemErrors != nil && itemErrors[k] != nil {
+			if self.fail(u.index, itemErrors[k]) {
+				// The following upserts have not been executed
+				return true
+			}
+			continue
+		}
+		if found[k] {
+			self.result.Replaced++
+		} else {
+			self.result.Upserted++
+		}
+		if self.succeed(u.index, u.doc["_id"].(bson.ObjectId)) {
+			return true
+		}
+	}
+	return stop
+}
+
+// bulkKey returns a string that is equal for equal values at paths of doc.
+func bulkKey(doc bson.M, paths []string) (string, error) {
+	values := make([]interface{}, len(paths))
+	for i, path := range paths {
+		values[i], _ = bsonPathValue(doc, path)
+	}
+	data, err := bson.Marshal(bson.M{"v": values})
+	return string(data), err
+}
+
+// runRemoves removes the documents of the operations
+// or only marks them as deleted if softDelete is true.
+func (self *Bulk) runRemoves(start, end int, softDelete bool) (stop bool) {
+	ids := make([]bson.ObjectId, 0, end-start)
+	for index := start; index < end; index++ {
+		ids = append(ids, self.ops[index].id)
+	}
+	selector := bson.M{"_id": bson.M{"$in": ids}}
+	var removed int
+	var err error
+	if softDelete {
+		removed, err = self.collection.backend.UpdateBatch(softDeleteSelector(selector), softDeleteUpdate().Bson())
+	} else {
+		removed, err = self.collection.backend.RemoveBatch(selector)
+	}
+	if err != nil {
+		for index := start; index < end; index++ {
+			if self.fail(index, err) {
+				return true
+			}
+		}
+		return false
+	}
+	self.result.Removed += removed
+	return false
+}
@@ -0,0 +1,143 @@
+package mongo
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ungerik/go-start/mgo/bson"
+)
+
+func newBulkTestDocuments(names ...string) (docs []interface{}) {
+	for _, name := range names {
+		doc := hookDocuments.NewDocument().(*hookDocument)
+		doc.Name.Set(name)
+		if name == "fail" {
+			doc.fail = "BeforeSave"
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func bulkErrorIndices(t *testing.T, err error) (indices []int) {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	bulkErr, ok := err.(*BulkError)
+	if !ok {
+		t.Fatalf("error is not a *BulkError: %s", err)
+	}
+	for _, item := range bulkErr.Items {
+		indices = append(indices, item.Index)
+	}
+	return indices
+}
+
+func TestBulkInsert(t *testing.T) {
+	for _, ordered := range []bool{true, false} {
+		InitMemory()
+		docs := newBulkTestDocuments("a", "fail", "b")
+		result, err := hookDocuments.Bulk(ordered).Insert(docs...).Run()
+		if indices := bulkErrorIndices(t, err); !reflect.DeepEqual(indices, []int{1}) {
+			t.Errorf("ordered=%v: failed operations %v instead of [1]", ordered, indices)
+		}
+		inserted := 2
+		if ordered {
+			// Execution stops at the failed operation
+			inserted = 1
+		}
+		if result.Inserted != inserted {
+			t.Errorf("ordered=%v: %d inserted instead of %d", ordered, result.Inserted, inserted)
+		}
+		if n, _ := hookDocuments.Count(); n != inserted {
+			t.Errorf("ordered=%v: %d documents in the collection", ordered, n)
+		}
+		if !result.IDs[0].Valid() || result.IDs[1].Valid() || result.IDs[2].Valid() != !ordered {
+			t.Errorf("ordered=%v: IDs %v", ordered, result.IDs)
+		}
+		if calls := docs[0].(*hookDocument).takeCalls(); calls != "BeforeSave,AfterSave" {
+			t.Errorf("ordered=%v: hooks %s", ordered, calls)
+		}
+	}
+}
+
+func TestBulkUpsert(t *testing.T) {
+	InitMemory()
+	existing := newBulkTestDocuments("a")[0].(*hookDocument)
+	saveTestDocument(t, existing)
+
+	docs := newBulkTestDocuments("a", "b", "fail", "b")
+	result, err := hookDocuments.Bulk(false).Upsert([]string{"Name"}, docs...).Run()
+	if indices := bulkErrorIndices(t, err); !reflect.DeepEqual(indices, []int{2}) {
+		t.Errorf("failed operations %v instead of [2]", indices)
+	}
+	// The second "b" replaces the first one
+	if result.Replaced != 2 || result.Upserted != 1 {
+		t.Errorf("Replaced=%d Upserted=%d", result.Replaced, result.Upserted)
+	}
+	if result.IDs[0] != existing.ID {
+		t.Error("ID of the existing document has not been kept")
+	}
+	if result.IDs[1] != result.IDs[3] {
+		t.Error("upserts with the same key created different documents")
+	}
+	if n, _ := hookDocuments.Count(); n != 2 {
+		t.Errorf("%d documents instead of 2", n)
+	}
+
+	if _, err = hookDocuments.Bulk(true).Upsert(nil, docs[0]).Run(); err == nil {
+		t.Error("no error for an upsert without key")
+	}
+	if _, err = hookDocuments.Bulk(true).Upsert([]string{"Street"}, docs[0]).Run(); err == nil {
+		t.Error("no error for an invalid key selector")
+	}
+}
+
+func TestBulkRemove(t *testing.T) {
+	InitMemory()
+	var ids []bson.ObjectId
+	for _, doc := range newBulkTestDocuments("a", "b", "c") {
+		saveTestDocument(t, doc.(Document))
+		ids = append(ids, doc.(Document).ObjectId())
+	}
+	result, err := hookDocuments.Bulk(true).Remove(ids[0], bson.NewObjectId(), ids[2]).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only actually removed documents are counted
+	if result.Removed != 2 {
+		t.Errorf("Removed is %d instead of 2", result.Removed)
+	}
+	if n, _ := hookDocuments.Count(); n != 1 {
+		t.Errorf("%d documents instead of 1", n)
+	}
+}
+
+func TestBulkMixed(t *testing.T) {
+	InitMemory()
+	docs := newBulkTestDocuments("a", "b", "fail", "c")
+	bulk := hookDocuments.Bulk(true).
+		Insert(docs[0]).
+		Upsert([]string{"Name"}, docs[1]).
+		Insert(docs[2], docs[3])
+	if bulk.Len() != 4 {
+		t.Errorf("Len() is %d", bulk.Len())
+	}
+	result, err := bulk.Run()
+	if indices := bulkErrorIndices(t, err); !reflect.DeepEqual(indices, []int{2}) {
+		t.Errorf("failed operations %v instead of [2]", indices)
+	}
+	if result.Inserted != 1 || result.Upserted != 1 {
+		t.Errorf("Inserted=%d Upserted=%d", result.Inserted, result.Upserted)
+	}
+	if bulk.Len() != 0 {
+		t.Error("operations have not been removed by Run()")
+	}
+
+	// Documents of other collections are rejected
+	other := testDocuments.NewDocument().(*testDocument)
+	if _, err = hookDocuments.Bulk(false).Insert(other).Run(); err == nil {
+		t.Error("no error for a document of another collection")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ungerik/go-start/config"
 	"github.com/ungerik/go-start/debug"
@@ -34,6 +35,13 @@ func NewCollection(name string, documentPrototype interface{}) *Collection {
 ///////////////////////////////////////////////////////////////////////////////
 // Collection
 
+// softDeleter is implemented by TrackedDocumentBase
+type softDeleter interface {
+	softDeleteDocument()
+}
+
+var softDeleterType = reflect.TypeOf((*softDeleter)(nil)).Elem()
+
 /*
 Collection represents a MongoDB collection and implements mongo.Query for all
 documents in the collection.
@@ -52,31 +60,67 @@ type Collection struct {
 	queryBase
 	Name         string
 	DocumentType reflect.Type
-	collection   *mgo.Collection
-	// foreignRefs  []ForeignRef
+	backend      collectionBackend
+	softDelete   bool
+	textIndex    *textIndex
+	writeConcern *mgo.Safe
 }
 
+// Init registers the collection. It panics if the "ondelete"
+// rules of the mongo.Ref fields of DocumentType are invalid.
 func (self *Collection) Init() {
 	self.thisQuery = self
+	if self.DocumentType != nil {
+		self.softDelete = reflect.PtrTo(self.DocumentType).Implements(softDeleterType)
+		if _, err := self.ForeignRefs(); err != nil {
+			panic(err)
+		}
+	}
 	Collections[self.Name] = self
+	self.initBackend()
+}
+
+func (self *Collection) initBackend() {
 	if Database != nil {
-		self.collection = Database.C(self.Name)
+		self.backend = mgoCollection{Database.C(self.Name).With(mgoSession("", self.writeConcern))}
+	} else if memoryDatabase != nil {
+		self.backend = memoryDatabase.collection(self.Name)
 	}
-	// self.foreignRefs = []ForeignRef{}
+}
+
+// SetWriteConcern sets the write concern for all writes to the collection.
+// nil uses Config.Safe.
+func (self *Collection) SetWriteConcern(safe *mgo.Safe) {
+	self.writeConcern = safe
+	self.initBackend()
+}
+
+/*
+WithWriteConcern returns a copy of the collection that writes with
+the write concern safe. Documents created or loaded with the copy
+are saved with safe too.
+The copy is not registered in Collections and has to be created
+after mongo has been initialized.
+
+Example:
+
+	_, err := models.Payments.WithWriteConcern(&mgo.Safe{WMode: "majority", J: true}).Insert(payment)
+*/
+func (self *Collection) WithWriteConcern(safe *mgo.Safe) *Collection {
+	collection := new(Collection)
+	*collection = *self
+	collection.thisQuery = collection
+	collection.writeConcern = safe
+	collection.initBackend()
+	return collection
 }
 
 func (self *Collection) checkDBConnection() {
 	if self == nil {
 		panic("mongo.Collection is nil")
 	}
-	if self.collection == nil {
-		panic("mongo.Collection.collection is nil")
-	}
-	if self.collection.Database == nil {
-		panic("mongo.Collection.collection.Database is nil")
-	}
-	if self.collection.Database.Session == nil {
-		panic("mongo.Collection.collection.Database.Session is nil")
+	if self.backend == nil {
+		panic("mongo.Collection.backend is nil, mongo not initialized")
 	}
 }
 
@@ -92,14 +136,43 @@ func (self *Collection) bsonSelector() bson.M {
 	return bson.M{}
 }
 
-func (self *Collection) mongoQuery() (q *mgo.Query, err error) {
+func (self *Collection) mongoQuery() (q queryBackend, err error) {
 	self.checkDBConnection()
-	return self.collection.Find(nil), nil
+	if self.softDelete {
+		return self.backend.Find(bson.M{"deleted": excludeDeleted.deletedSelector()}), nil
+	}
+	return self.backend.Find(nil), nil
 }
 
-func (self *Collection) subDocumentType(docType reflect.Type, fieldName string, subDocSelectors []string) (reflect.Type, error) {
+// textIndexChanged updates the in-process text index for the documents
+// with ids. Without ids the whole index is marked as outdated.
+// It has to be called after the write, else a concurrent search
+// could index the old documents.
+func (self *Collection) textIndexChanged(ids ...bson.ObjectId) {
+	if self.textIndex == nil {
+		return
+	}
+	if len(ids) == 0 {
+		self.textIndex.setDirty()
+		return
+	}
+	self.textIndex.update(self, ids)
+}
+
+// SoftDelete returns true if the documents of the collection
+// embed TrackedDocumentBase and are only marked as deleted by Remove().
+func (self *Collection) SoftDelete() bool {
+	return self.softDelete
+}
+
+// subDocumentType returns the type and the BSON key of the field
+// with fieldName of docType.
+// Array and slice elements can be selected by index or the wildcard "$",
+// other field names are looked up in the element type
+// like MongoDB does with its dot notation.
+func (self *Collection) subDocumentType(docType reflect.Type, fieldName string, subDocSelectors []string) (reflect.Type, string, error) {
 	if fieldName == "" {
-		return docType, errs.Format("Collection '%s', selector '%s': Empty field name", self.Name, strings.Join(subDocSelectors, "."))
+		return nil, "", errs.Format("Collection '%s', selector '%s': Empty field name", self.Name, strings.Join(subDocSelectors, "."))
 	}
 
 	switch docType.Kind() {
@@ -107,68 +180,79 @@ func (self *Collection) subDocumentType(docType reflect.Type, fieldName string,
 		bsonName := strings.ToLower(fieldName)
 		field := reflection.FindFlattenedStructField(docType, MatchBsonField(bsonName))
 		if field != nil {
-			return field.Type, nil
+			return field.Type, bsonName, nil
 		}
-		return nil, errs.Format("Collection '%s', selector '%s': Struct has no field '%s'", self.Name, strings.Join(subDocSelectors, "."), fieldName)
+		return nil, "", errs.Format("Collection '%s', selector '%s': Struct %s has no field '%s'", self.Name, strings.Join(subDocSelectors, "."), docType, fieldName)
 
 	case reflect.Array, reflect.Slice:
 		_, numberErr := strconv.Atoi(fieldName)
 		if numberErr == nil || fieldName == "$" {
-			return docType, nil
+			return docType.Elem(), fieldName, nil
 		}
-		return docType.Elem(), nil
+		return self.subDocumentType(docType.Elem(), fieldName, subDocSelectors)
+
+	case reflect.Map:
+		return docType.Elem(), fieldName, nil
+
+	case reflect.Interface:
+		// The dynamic type is unknown, so the field can't be checked
+		return docType, fieldName, nil
 
-	case reflect.Ptr, reflect.Interface:
+	case reflect.Ptr:
 		return self.subDocumentType(docType.Elem(), fieldName, subDocSelectors)
 	}
 
-	return nil, errs.Format("Collection '%s', selector '%s': Can't select sub-document '%s' of type '%s'", self.Name, strings.Join(subDocSelectors, "."), fieldName, docType.String())
+	return nil, "", errs.Format("Collection '%s', selector '%s': Can't select sub-document '%s' of type '%s'", self.Name, strings.Join(subDocSelectors, "."), fieldName, docType.String())
 }
 
-func (self *Collection) ValidateSelector(subDocSelectors ...string) (err error) {
-	return nil // todo remove
-
-	if len(subDocSelectors) == 0 {
-		return nil
-	}
-	docType := self.DocumentType
+// subDocumentPath returns the type of the sub-document
+// selected by subDocSelectors and its path in MongoDB dot notation.
+func (self *Collection) subDocumentPath(subDocSelectors []string) (docType reflect.Type, path string, err error) {
+	docType = self.DocumentType
+	keys := make([]string, 0, len(subDocSelectors))
 	for _, selector := range subDocSelectors {
-		fields := strings.Split(selector, ".")
-		if selector == "" || len(fields) == 0 {
-			return errs.Format("Invalid empty selector in '%s'", strings.Join(subDocSelectors, "."))
+		if selector == "" {
+			return nil, "", errs.Format("Collection '%s': Invalid empty selector in '%s'", self.Name, strings.Join(subDocSelectors, "."))
 		}
-		for _, field := range fields {
-			docType, err = self.subDocumentType(docType, field, subDocSelectors)
+		for _, field := range strings.Split(selector, ".") {
+			var key string
+			docType, key, err = self.subDocumentType(docType, field, subDocSelectors)
 			if err != nil {
-				return err
+				return nil, "", err
 			}
+			keys = append(keys, key)
 		}
 	}
-	return nil
+	return docType, strings.Join(keys, "."), nil
 }
 
-// return error?
-func (self *Collection) NewDocument(subDocSelectors ...string) interface{} {
-	if len(subDocSelectors) > 0 {
-		panic("Sub document selectors are not implemented")
+// ValidateSelector returns an error if subDocSelectors
+// don't select an existing field of DocumentType.
+func (self *Collection) ValidateSelector(subDocSelectors ...string) error {
+	if len(subDocSelectors) == 0 || self.DocumentType == nil {
+		return nil
 	}
-	docType := self.DocumentType
-	for _, selector := range subDocSelectors {
-		for _, field := range strings.Split(selector, ".") {
-			var err error
-			docType, err = self.subDocumentType(docType, field, subDocSelectors)
-			errs.PanicOnError(err)
-		}
+	_, _, err := self.subDocumentPath(subDocSelectors)
+	return err
+}
+
+// NewDocument creates a new initialized document of the collection
+// or the sub-document selected by subDocSelectors.
+// It panics if subDocSelectors are invalid.
+func (self *Collection) NewDocument(subDocSelectors ...string) interface{} {
+	docType, _, err := self.subDocumentPath(subDocSelectors)
+	errs.PanicOnError(err)
+	for docType.Kind() == reflect.Ptr {
+		docType = docType.Elem()
 	}
 	doc := reflect.New(docType).Interface()
-	self.InitDocument(doc)
+	self.InitDocument(doc, subDocSelectors...)
 	return doc
 }
 
+// InitDocument initializes doc as document of the collection
+// or as the sub-document selected by subDocSelectors.
 func (self *Collection) InitDocument(doc interface{}, subDocSelectors ...string) {
-	if len(subDocSelectors) > 0 {
-		panic("Sub document selectors are not implemented")
-	}
 	switch s := doc.(type) {
 	case Document:
 		if len(subDocSelectors) > 0 {
@@ -180,13 +264,93 @@ func (self *Collection) InitDocument(doc interface{}, subDocSelectors ...string)
 		if len(subDocSelectors) == 0 {
 			panic("Need subDocSelectors to initialize mongo.SubDocument")
 		}
-		selector := strings.Join(subDocSelectors, ".")
-		s.Init(self, selector, doc)
+		_, path, err := self.subDocumentPath(subDocSelectors)
+		errs.PanicOnError(err)
+		s.Init(self, path, doc)
+
+	case *Ref:
+		// A single ref has no struct tag with its collection
+
+	default:
+		if len(subDocSelectors) > 0 {
+			InitRefs(doc)
+		}
+	}
+}
+
+// initLoadedDocument initializes a document that has been
+// loaded from the database, resets its change tracking
+// and calls its AfterLoad() hook.
+func (self *Collection) initLoadedDocument(document interface{}, subDocSelectors ...string) error {
+	// document has to be initialized again,
+	// because mgo zeros the struct while unmarshalling.
+	// Newly created slice elements need to be initialized too
+	self.InitDocument(document, subDocSelectors...)
+	if tracker, ok := document.(changeTracker); ok {
+		tracker.ResetChanges()
+	}
+	return callAfterLoad(document)
+}
+
+// decodeSubDocument decodes the sub-document selected by subDocSelectors
+// from root into subDocument. subDocument stays unchanged
+// if root doesn't contain the sub-document.
+func (self *Collection) decodeSubDocument(root bson.M, subDocSelectors []string, subDocument interface{}) error {
+	_, path, err := self.subDocumentPath(subDocSelectors)
+	if err != nil {
+		return err
+	}
+	if value, ok := bsonPathValue(root, path); ok {
+		data, err := bson.Marshal(bson.M{"v": value})
+		if err != nil {
+			return err
+		}
+		var wrapper struct {
+			V bson.Raw `bson:"v"`
+		}
+		if err = bson.Unmarshal(data, &wrapper); err != nil {
+			return err
+		}
+		if err = wrapper.V.Unmarshal(subDocument); err != nil {
+			return err
+		}
+	}
+	if s, ok := subDocument.(SubDocument); ok {
+		if id, ok := root["_id"].(bson.ObjectId); ok {
+			s.RootDocumentSetObjectId(id)
+		}
+	}
+	return nil
+}
+
+// loadDocument creates a new document or sub-document
+// for subDocSelectors and loads it with load,
+// which has to work like mgo.Query.One().
+// If projection is not nil, the document is flagged as partial.
+func (self *Collection) loadDocument(load func(result interface{}) error, subDocSelectors []string, projection *fieldProjection) (document interface{}, err error) {
+	document = self.NewDocument(subDocSelectors...)
+	if len(subDocSelectors) == 0 {
+		err = load(document)
+	} else {
+		var root bson.M
+		if err = load(&root); err == nil {
+			err = self.decodeSubDocument(root, subDocSelectors, document)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = self.initLoadedDocument(document, subDocSelectors...); err != nil {
+		return nil, err
 	}
+	if partial, ok := document.(partialDocument); ok && projection != nil {
+		partial.setProjection(projection)
+	}
+	return document, nil
 }
 
 func (self *Collection) Ref(id bson.ObjectId) Ref {
-	return Ref{id, self.Name}
+	return Ref{ID: id, CollectionName: self.Name}
 }
 
 // betterError returns a better error description
@@ -203,9 +367,6 @@ func (self *Collection) logIdNotFoundError(id bson.ObjectId) {
 }
 
 func (self *Collection) documentWithID(id bson.ObjectId, subDocSelectors ...string) (document interface{}, err error) {
-	if len(subDocSelectors) > 0 {
-		panic("Sub document selectors are not implemented")
-	}
 	if id == "" {
 		return nil, errs.Format("mongo.Collection %s: Can't get document with empty id", self.Name)
 	}
@@ -214,23 +375,16 @@ func (self *Collection) documentWithID(id bson.ObjectId, subDocSelectors ...stri
 	}
 
 	self.checkDBConnection()
-	document = self.NewDocument(subDocSelectors...)
-	q := self.collection.Find(bson.M{"_id": id})
-	if len(subDocSelectors) == 0 {
-		err = q.One(document)
-	} else {
-		err = q.Select(strings.Join(subDocSelectors, ".")).One(document)
-	}
-	if err != nil {
-		return nil, err
+	q := self.backend.Find(bson.M{"_id": id})
+	if len(subDocSelectors) > 0 {
+		_, path, _ := self.subDocumentPath(subDocSelectors)
+		q = q.Select(bson.M{projectionPath(path): 1})
 	}
-	// document has to be initialized again,
-	// because mgo zeros the struct while unmarshalling.
-	// Newly created slice elements need to be initialized too
-	self.InitDocument(document)
-	return document, nil
+	return self.loadDocument(q.One, subDocSelectors, nil)
 }
 
+// DocumentWithID returns the document with id or the sub-document
+// of it selected by subDocSelectors.
 func (self *Collection) DocumentWithID(id bson.ObjectId, subDocSelectors ...string) (document interface{}, err error) {
 	document, err = self.documentWithID(id, subDocSelectors...)
 	if err == mgo.NotFound {
@@ -239,10 +393,10 @@ func (self *Collection) DocumentWithID(id bson.ObjectId, subDocSelectors ...stri
 	return document, err
 }
 
+// TryDocumentWithID returns the document with id or the sub-document
+// of it selected by subDocSelectors.
+// found is false if there is no document with id.
 func (self *Collection) TryDocumentWithID(id bson.ObjectId, subDocSelectors ...string) (document interface{}, found bool, err error) {
-	if len(subDocSelectors) > 0 {
-		panic("Sub document selectors are not implemented")
-	}
 	if id == "" {
 		return nil, false, nil
 	}
@@ -254,16 +408,10 @@ func (self *Collection) TryDocumentWithID(id bson.ObjectId, subDocSelectors ...s
 }
 
 func (self *Collection) DocumentWithIDIterator(id bson.ObjectId, subDocSelectors ...string) model.Iterator {
-	if len(subDocSelectors) > 0 {
-		panic("Sub document selectors are not implemented")
-	}
 	return model.NewObjectOrErrorOnlyIterator(self.DocumentWithID(id, subDocSelectors...))
 }
 
 func (self *Collection) TryDocumentWithIDIterator(id bson.ObjectId, subDocSelectors ...string) model.Iterator {
-	if len(subDocSelectors) > 0 {
-		panic("Sub document selectors are not implemented")
-	}
 	document, ok, err := self.TryDocumentWithID(id, subDocSelectors...)
 	if err != nil {
 		return model.NewErrorOnlyIterator(err)
@@ -279,20 +427,39 @@ func (self *Collection) FilterReferenced(refs ...Ref) Query {
 }
 
 func (self *Collection) Count() (n int, err error) {
-	return self.collection.Count()
+	if self.softDelete {
+		return self.queryBase.Count()
+	}
+	self.checkDBConnection()
+	start := time.Now()
+	n, err = self.backend.Count()
+	traceQuery(self, "Count", time.Since(start), err)
+	return n, err
 }
 
 // Inserts document regardless if it's already in the collection
 // If document has a DocumentBase, the ID will be updated to the
-// newly created one
+// newly created one.
+// BeforeSave() and AfterSave() hooks of document are called.
 func (self *Collection) Insert(document interface{}) (id bson.ObjectId, err error) {
+	if err = callBeforeSave(document); err != nil {
+		return "", err
+	}
+	id, err = self.insert(document)
+	if err != nil {
+		return id, err
+	}
+	return id, callAfterSave(document)
+}
+
+func (self *Collection) insert(document interface{}) (id bson.ObjectId, err error) {
 	self.checkDBConnection()
 	// Need to set a valid ID, even if Upsert() returns another ID	
 	id = bson.NewObjectId()
 	if doc, ok := document.(Document); ok {
 		doc.SetObjectId(id)
 	}
-	newId, err := self.collection.Upsert(bson.M{"_id": id}, document)
+	newId, err := self.backend.Upsert(bson.M{"_id": id}, document)
 	if err != nil {
 		if err == mgo.NotFound {
 			self.logIdNotFoundError(id)
@@ -303,26 +470,102 @@ func (self *Collection) Insert(document interface{}) (id bson.ObjectId, err erro
 	if doc, ok := document.(Document); ok {
 		doc.SetObjectId(id)
 	}
+	self.textIndexChanged(id)
 	return id, nil
 }
 
+// Update replaces the document with id.
+// BeforeSave() and AfterSave() hooks of document are called.
 func (self *Collection) Update(id bson.ObjectId, document interface{}) (err error) {
+	if err = callBeforeSave(document); err != nil {
+		return err
+	}
+	if err = self.update(id, document); err != nil {
+		return err
+	}
+	return callAfterSave(document)
+}
+
+func (self *Collection) update(id bson.ObjectId, document interface{}) (err error) {
+	if isPartialDocument(document) {
+		return errs.Format("Can't replace document %s of collection '%s' with a partially loaded document", id.Hex(), self.Name)
+	}
 	self.checkDBConnection()
-	err = self.collection.Update(bson.M{"_id": id}, document)
+	err = self.backend.Update(bson.M{"_id": id}, document)
 	if err == mgo.NotFound {
 		self.logIdNotFoundError(id)
 	}
+	if err == nil {
+		self.textIndexChanged(id)
+	}
 	return err
 }
 
-func (self *Collection) Remove(ids ...bson.ObjectId) (err error) {
+// UpdateWith applies update to the document with id.
+func (self *Collection) UpdateWith(id bson.ObjectId, update *Update) (err error) {
+	if update.IsEmpty() {
+		return nil
+	}
 	self.checkDBConnection()
-	return self.collection.Remove(bson.M{"_id": bson.M{"$in": ids}})
+	err = self.backend.Update(bson.M{"_id": id}, update.Bson())
+	if err == mgo.NotFound {
+		self.logIdNotFoundError(id)
+	}
+	if err == nil {
+		self.textIndexChanged(id)
+	}
+	return err
+}
+
+// Remove removes the documents with ids.
+// Documents of collections with TrackedDocumentBase documents
+// are only marked as deleted, use Purge() to remove them.
+// Remove hooks and "ondelete" rules are not applied.
+func (self *Collection) Remove(ids ...bson.ObjectId) (err error) {
+	err = self.remove(bson.M{"_id": bson.M{"$in": ids}}, self.softDelete)
+	self.textIndexChanged(ids...)
+	return err
 }
 
+// Purge removes the documents with ids from the database,
+// also from collections with TrackedDocumentBase documents.
+// Remove hooks and "ondelete" rules are not applied.
+func (self *Collection) Purge(ids ...bson.ObjectId) (err error) {
+	err = self.remove(bson.M{"_id": bson.M{"$in": ids}}, false)
+	self.textIndexChanged(ids...)
+	return err
+}
+
+// PurgeDeleted removes all documents that have been marked as deleted
+// by TrackedDocumentBase.Remove() from the database.
+func (self *Collection) PurgeDeleted() error {
+	if !self.softDelete {
+		return nil
+	}
+	defer self.textIndexChanged()
+	return self.remove(bson.M{"deleted": onlyDeleted.deletedSelector()}, false)
+}
+
+// RemoveAllNotIn removes all documents except the ones with ids
+// like Remove().
 func (self *Collection) RemoveAllNotIn(ids ...bson.ObjectId) error {
+	defer self.textIndexChanged()
+	return self.remove(bson.M{"_id": bson.M{"$nin": ids}}, self.softDelete)
+}
+
+// remove removes all documents matching selector from the database
+// or only marks them as deleted if softDelete is true.
+func (self *Collection) remove(selector bson.M, softDelete bool) error {
 	self.checkDBConnection()
-	return self.collection.Remove(bson.M{"_id": bson.M{"$nin": ids}})
+	if !softDelete {
+		return self.backend.RemoveAll(selector)
+	}
+	err := self.backend.UpdateAll(softDeleteSelector(selector), softDeleteUpdate().Bson())
+	if err == mgo.NotFound {
+		// Nothing to mark as deleted
+		return nil
+	}
+	return err
 }
 
 // RemoveInvalidRefs removes invalid refs from all documents and saves
@@ -369,13 +612,5 @@ func (self *Collection) RemoveInvalidRefs() (invalidRefs []InvalidRefData, err e
 //		Unique:     unique,
 //		Background: true,
 //	}
-//	return self.collection.EnsureIndex(index)
+//	return self.backend.EnsureIndex(index)
 //}
-
-///////////////////////////////////////////////////////////////////////////////
-// ForeignRef
-
-type ForeignRef struct {
-	Collection *Collection
-	Selector   string
-}
@@ -1,7 +1,12 @@
 package mongo
 
 import (
-	"fmt"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/ungerik/go-start/mgo"
 )
 
@@ -15,58 +20,199 @@ var Database *mgo.Database
 var Collections = map[string]*Collection{}
 
 type Configuration struct {
-	Host                string
-	Database            string
-	User                string
-	Password            string
+	// Host is used if Hosts is empty.
+	// Multiple hosts can be separated by commas.
+	// Default is "localhost".
+	Host string
+	// Hosts are the seed servers of a replica set or sharded cluster
+	// in the format "host[:port]". The other members of a replica set
+	// are discovered automatically.
+	Hosts []string
+	// ReplicaSet is the name of the replica set.
+	// If set, servers of other replica sets are not used.
+	ReplicaSet string
+	Database   string
+	User       string
+	Password   string
+	// ConnectTimeout is the timeout for connecting to a server.
+	// Default is 10 seconds.
+	ConnectTimeout time.Duration
+	// SocketTimeout is the timeout for the reply of a server.
+	// It has to be longer than the slowest query.
+	// Zero means no timeout.
+	SocketTimeout time.Duration
+	// TLS enables encrypted connections if not nil.
+	// TLS.ServerName must match the certificates of all hosts,
+	// or TLS.InsecureSkipVerify must be set.
+	TLS *tls.Config
+	// ReadPreference sets from which members of a replica set
+	// documents are read. Default is ReadPrimary.
+	// See Query.ReadPreference()
+	ReadPreference ReadPreference
+	// Safe is the write concern of all collections.
+	// See Collection.SetWriteConcern() and Collection.WithWriteConcern()
 	Safe                mgo.Safe
 	CheckQuerySelectors bool
+	// ServerTextSearch enables the MongoDB text index for Query.Search()
+	// instead of the in-process inverted index.
+	// See Collection.SetTextIndex() and Collection.EnsureTextIndex()
+	ServerTextSearch bool
+	// Queries that take longer than SlowQueryThreshold are logged
+	// to config.Logger with their explain output.
+	// Zero disables logging of slow queries.
+	SlowQueryThreshold time.Duration
 }
 
 func (self *Configuration) Name() string {
 	return "mongo"
 }
 
-func (self *Configuration) Init() error {
-	login := ""
-	if Config.User != "" {
-		login = Config.User + ":" + Config.Password + "@"
+func (self *Configuration) dialInfo() *mgo.DialInfo {
+	hosts := Config.Hosts
+	if len(hosts) == 0 {
+		host := "localhost"
+		if Config.Host != "" {
+			host = Config.Host
+		}
+		hosts = strings.Split(host, ",")
 	}
-
-	host := "localhost"
-	if Config.Host != "" {
-		host = Config.Host
+	timeout := Config.ConnectTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	info := &mgo.DialInfo{
+		Addrs:          hosts,
+		Timeout:        timeout,
+		SocketTimeout:  Config.SocketTimeout,
+		ReplicaSetName: Config.ReplicaSet,
+		Database:       Config.Database,
+		Username:       Config.User,
+		Password:       Config.Password,
 	}
+	if Config.TLS != nil {
+		tlsConfig := Config.TLS
+		info.Dial = func(addr net.Addr) (net.Conn, error) {
+			conn, err := net.DialTimeout("tcp", addr.String(), timeout)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		}
+	}
+	return info
+}
 
-	// http://goneat.org/pkg/github.com/ungerik/go-start/mgo/#Session.Mongo
-	// [mongodb://][user:pass@]host1[:port1][,host2[:port2],...][/database][?options]
-	url := fmt.Sprintf("mongodb://%s%s/%s", login, host, Config.Database)
+func (self *Configuration) Init() error {
+	if err := Config.ReadPreference.validate(); err != nil {
+		return err
+	}
 
-	session, err := mgo.Dial(url)
+	session, err := mgo.DialWithInfo(Config.dialInfo())
 	if err != nil {
 		return err
 	}
+	session.SetSyncTimeout(time.Minute)
+	Config.ReadPreference.setMode(session)
 	session.SetSafe(&Config.Safe)
 
 	Database = session.DB(Config.Database)
+	memoryDatabase = nil
+	sessionsMutex.Lock()
+	sessions = map[sessionKey]*mgo.Session{defaultSessionKey(): session}
+	sessionsMutex.Unlock()
 
 	for _, collection := range Collections {
-		collection.collection = Database.C(collection.Name)
+		collection.initBackend()
 	}
 
 	return nil
 }
 
 func (self *Configuration) Close() error {
-	if Database.Session != nil {
-		Database.Session.Close()
+	sessionsMutex.Lock()
+	for _, session := range sessions {
+		session.Close()
 	}
+	sessions = map[sessionKey]*mgo.Session{}
+	sessionsMutex.Unlock()
 	return nil
 }
 
+///////////////////////////////////////////////////////////////////////////////
+// Sessions
+
+// sessionKey identifies the session for a read preference and write concern
+type sessionKey struct {
+	pref ReadPreference
+	safe mgo.Safe
+}
+
+var (
+	sessionsMutex sync.Mutex
+	sessions      = map[sessionKey]*mgo.Session{}
+)
+
+func defaultSessionKey() sessionKey {
+	pref := Config.ReadPreference
+	if pref == "" {
+		pref = ReadPrimary
+	}
+	return sessionKey{pref, Config.Safe}
+}
+
+// mgoSession returns the session for the read preference pref
+// and the write concern safe. The sessions are created once
+// as copies of Database.Session and shared.
+// Empty pref or nil safe use the settings of Config.
+func mgoSession(pref ReadPreference, safe *mgo.Safe) *mgo.Session {
+	key := defaultSessionKey()
+	if pref != "" {
+		key.pref = pref
+	}
+	if safe != nil {
+		key.safe = *safe
+	}
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	session, ok := sessions[key]
+	if !ok {
+		session = Database.Session.Copy()
+		key.pref.setMode(session)
+		session.SetSafe(&key.safe)
+		sessions[key] = session
+	}
+	return session
+}
+
 func InitLocalhost(database, user, password string) (err error) {
 	Config.Database = database
 	Config.User = user
 	Config.Password = password
 	return Config.Init()
 }
+
+/*
+InitMemory initializes all collections with an in-memory backend
+instead of a MongoDB connection. Every call starts with empty collections,
+which makes it useful for tests:
+
+	func TestUser(t *testing.T) {
+		mongo.InitMemory()
+		...
+	}
+
+The memory backend supports the queries and updates of this package,
+but not GridFS or other direct uses of mongo.Database, which is nil.
+*/
+func InitMemory() {
+	Database = nil
+	memoryDatabase = newMemoryDB()
+	for _, collection := range Collections {
+		collection.initBackend()
+	}
+}
@@ -0,0 +1,72 @@
+package mongo
+
+import (
+	"github.com/ungerik/go-start/mgo/bson"
+	"github.com/ungerik/go-start/model"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// deletedQuery
+
+type deletedMode int
+
+const (
+	excludeDeleted deletedMode = iota
+	includeDeleted
+	onlyDeleted
+)
+
+// deletedSelector returns the selector value for the "deleted" field
+// of TrackedDocumentBase or nil if no filtering is needed.
+func (self deletedMode) deletedSelector() interface{} {
+	switch self {
+	case excludeDeleted:
+		return bson.M{"$in": []interface{}{nil, ""}}
+	case onlyDeleted:
+		return bson.M{"$nin": []interface{}{nil, ""}}
+	}
+	return nil
+}
+
+// softDeleteSelector restricts selector to the documents
+// that are not marked as deleted yet, so that removing them
+// again doesn't change their Deleted timestamp.
+func softDeleteSelector(selector bson.M) bson.M {
+	notDeleted := excludeDeleted.deletedSelector()
+	if _, hasKey := selector["deleted"]; hasKey {
+		return bson.M{"$and": []interface{}{selector, bson.M{"deleted": notDeleted}}}
+	}
+	result := bson.M{"deleted": notDeleted}
+	for key, value := range selector {
+		result[key] = value
+	}
+	return result
+}
+
+// softDeleteUpdate returns the update that marks documents as deleted.
+func softDeleteUpdate() *Update {
+	var deleted model.DateTime
+	deleted.SetNowUTC()
+	return NewUpdate().Set("deleted", deleted)
+}
+
+// deletedQuery changes how soft deleted documents of a collection
+// with TrackedDocumentBase documents are handled by its query chain.
+type deletedQuery struct {
+	queryBase
+	mode deletedMode
+}
+
+func (self *deletedQuery) mongoQuery() (q queryBackend, err error) {
+	bsonQuery, err := bsonQuery(self.thisQuery)
+	if err != nil {
+		return nil, err
+	}
+	collection := self.Collection()
+	collection.checkDBConnection()
+	return selectFields(self.thisQuery, collection.backend.Find(bsonQuery))
+}
+
+func (self *deletedQuery) Selector() string {
+	return ""
+}
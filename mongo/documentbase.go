@@ -13,6 +13,12 @@ type DocumentBase struct {
 	ID              bson.ObjectId `bson:"_id,omitempty" gostart:"-"`
 	collection      *Collection   `gostart:"-"`
 	embeddingStruct interface{}   `gostart:"-"`
+	// loaded holds the state of the document when it was
+	// loaded or saved the last time. Used for change tracking.
+	loaded bson.M `gostart:"-"`
+	// projection is set if the document has been loaded
+	// by a query with Select() or Exclude()
+	projection *fieldProjection `gostart:"-"`
 }
 
 func (self *DocumentBase) Init(collection *Collection, embeddingStruct interface{}) {
@@ -52,27 +58,157 @@ func (self *DocumentBase) Iterator() model.Iterator {
 }
 
 func (self *DocumentBase) Ref() Ref {
-	return Ref{self.ID, self.collection.Name}
+	return Ref{ID: self.ID, CollectionName: self.collection.Name}
 }
 
+// Save inserts the document if it has no valid ID, else it updates it.
+// If the document has been loaded from the database, only the changed
+// fields will be written.
 func (self *DocumentBase) Save() error {
 	if self.embeddingStruct == nil {
 		return errs.Format("Can't save uninitialized mongo.Document. embeddingStruct is nil.")
 	}
 
+	err := callBeforeSave(self.embeddingStruct)
+	if err != nil {
+		return err
+	}
+
 	if !self.ID.Valid() {
-		id, err := self.collection.Insert(self.embeddingStruct)
-		if err == nil {
-			self.ID = id
+		id, err := self.collection.insert(self.embeddingStruct)
+		if err != nil {
+			return err
 		}
-		return err
+		self.ID = id
+	} else if self.loaded != nil {
+		update, err := self.Changes()
+		if err != nil {
+			return err
+		}
+		if self.projection != nil {
+			for _, selector := range update.Selectors() {
+				if !self.projection.covers(selector) {
+					return errs.Format("Can't save partially loaded mongo.Document %s: Field '%s' has not been loaded", self.ID.Hex(), selector)
+				}
+			}
+		}
+		if err = self.collection.UpdateWith(self.ID, update); err != nil {
+			return err
+		}
+	} else {
+		if err = self.collection.update(self.ID, self.embeddingStruct); err != nil {
+			return err
+		}
+	}
+	self.ResetChanges()
+
+	return callAfterSave(self.embeddingStruct)
+}
+
+// IsPartial returns true if the document has been loaded by a query
+// with Select() or Exclude(). Save() of a partial document only writes
+// changed fields and returns an error if they have not been loaded.
+func (self *DocumentBase) IsPartial() bool {
+	return self.projection != nil
+}
+
+func (self *DocumentBase) setProjection(projection *fieldProjection) {
+	self.projection = projection
+}
+
+// Update applies update to the document in the database.
+// The fields of the document in memory are not changed.
+func (self *DocumentBase) Update(update *Update) error {
+	if !self.ID.Valid() {
+		return errs.Format("Can't update mongo.Document with invalid ID.")
+	}
+	return self.collection.UpdateWith(self.ID, update)
+}
+
+// Changes returns an Update with all fields that have been changed
+// since the document was loaded or saved the last time.
+// If the document was never loaded or saved, all fields are returned.
+func (self *DocumentBase) Changes() (update *Update, err error) {
+	if self.embeddingStruct == nil {
+		return nil, errs.Format("Can't get changes of uninitialized mongo.Document. embeddingStruct is nil.")
+	}
+	current, err := documentSnapshot(self.embeddingStruct)
+	if err != nil {
+		return nil, err
 	}
+	update = NewUpdate()
+	diffSnapshots(update, "", self.loaded, current)
+	return update, nil
+}
+
+// ChangedSelectors returns the selectors of all fields that have been
+// changed since the document was loaded or saved the last time.
+func (self *DocumentBase) ChangedSelectors() (selectors []string, err error) {
+	update, err := self.Changes()
+	if err != nil {
+		return nil, err
+	}
+	return update.Selectors(), nil
+}
 
-	return self.collection.Update(self.ID, self.embeddingStruct)
+// ResetChanges marks the current state of the document as unchanged.
+// It is called after the document has been loaded or saved.
+func (self *DocumentBase) ResetChanges() {
+	if self.embeddingStruct == nil {
+		return
+	}
+	snapshot, err := documentSnapshot(self.embeddingStruct)
+	if err != nil {
+		// Without snapshot Save() falls back to updating the whole document
+		self.loaded = nil
+		return
+	}
+	self.loaded = snapshot
+}
+
+// resetFieldChange marks only the top level field with key as unchanged,
+// changes of other fields are still written by the next Save().
+func (self *DocumentBase) resetFieldChange(key string) {
+	if self.loaded == nil {
+		return
+	}
+	current, err := documentSnapshot(self.embeddingStruct)
+	if err != nil {
+		self.loaded = nil
+		return
+	}
+	if value, ok := current[key]; ok {
+		self.loaded[key] = value
+	} else {
+		delete(self.loaded, key)
+	}
 }
 
+// Remove removes the document from the database.
+// BeforeRemove() and AfterRemove() hooks of the document are called.
+// The "ondelete" rules of all mongo.Ref fields in all registered
+// collections referencing the document are applied.
 func (self *DocumentBase) Remove() error {
-	return self.collection.Remove(self.ID)
+	return self.remove(nil)
+}
+
+func (self *DocumentBase) remove(visited map[string]bool) error {
+	if err := callBeforeRemove(self.embeddingStruct); err != nil {
+		return err
+	}
+	if err := applyOnDeleteRules(self.Ref(), visited); err != nil {
+		return err
+	}
+	if err := self.collection.Purge(self.ID); err != nil {
+		return err
+	}
+	return callAfterRemove(self.embeddingStruct)
+}
+
+// ReferencingDocuments returns an iterator for all documents
+// of all registered collections that reference this document.
+func (self *DocumentBase) ReferencingDocuments() model.Iterator {
+	return ReferencingDocuments(self.Ref())
 }
 
 func (self *DocumentBase) RemoveInvalidRefs() (invalidRefs []InvalidRefData, err error) {
@@ -0,0 +1,641 @@
+package mongo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/mgo/bson"
+	"github.com/ungerik/go-start/model"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// DumpFormat
+
+// DumpFormat is the file format used by ExportCollections()
+// and ImportCollections().
+type DumpFormat string
+
+const (
+	// DumpJSONLines writes one JSON document per line.
+	// ObjectIds, dates, binary data and regular expressions
+	// are written as MongoDB extended JSON: {"$oid": "..."}, {"$date": "..."},
+	// {"$binary": "..."} and {"$regex": "...", "$options": "..."}
+	DumpJSONLines DumpFormat = "jsonl"
+	// DumpBSON writes concatenated BSON documents like mongodump.
+	DumpBSON DumpFormat = "bson"
+)
+
+func (self DumpFormat) validate() error {
+	if self != DumpJSONLines && self != DumpBSON {
+		return errs.Format("Invalid dump format '%s', use '%s' or '%s'", self, DumpJSONLines, DumpBSON)
+	}
+	return nil
+}
+
+// FileName returns the file name for the dump of collection.
+func (self DumpFormat) FileName(collection *Collection) string {
+	return collection.Name + "." + string(self)
+}
+
+// dumpCollections returns the collections by name or all registered
+// collections sorted by name if no names are given.
+func dumpCollections(names []string) (collections []*Collection, err error) {
+	if len(names) == 0 {
+		for name := range Collections {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		collection, ok := Collections[name]
+		if !ok {
+			return nil, errs.Format("Collection '%s' not registered", name)
+		}
+		collections = append(collections, collection)
+	}
+	return collections, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Export
+
+/*
+ExportCollection writes all documents of collection sorted by ID to w
+and returns the number of written documents.
+Documents marked as deleted by TrackedDocumentBase are exported too.
+*/
+func ExportCollection(w io.Writer, collection *Collection, format DumpFormat) (count int, err error) {
+	if err = format.validate(); err != nil {
+		return 0, err
+	}
+	collection.checkDBConnection()
+	writer := bufio.NewWriter(w)
+	i := collection.backend.Find(nil).Sort("_id").Iter()
+	doc := bson.M{}
+	for i.Next(&doc) {
+		var data []byte
+		if format == DumpBSON {
+			data, err = bson.Marshal(doc)
+		} else {
+			data, err = json.Marshal(dumpToJSON(doc))
+			data = append(data, '\n')
+		}
+		if err != nil {
+			return count, err
+		}
+		if _, err = writer.Write(data); err != nil {
+			return count, err
+		}
+		count++
+		doc = bson.M{}
+	}
+	if i.Err() != nil {
+		return count, i.Err()
+	}
+	return count, writer.Flush()
+}
+
+/*
+ExportCollections exports the collections with names
+or all registered collections if no names are given
+to one file per collection in dir.
+See DumpFormat.FileName() for the file names.
+*/
+func ExportCollections(dir string, format DumpFormat, names ...string) error {
+	if err := format.validate(); err != nil {
+		return err
+	}
+	collections, err := dumpCollections(names)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		file, err := os.Create(filepath.Join(dir, format.FileName(collection)))
+		if err != nil {
+			return err
+		}
+		_, err = ExportCollection(file, collection, format)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errs.Format("Export of collection '%s' failed: %s", collection.Name, err)
+		}
+	}
+	return nil
+}
+
+// dumpToJSON converts a value decoded from BSON to a value
+// that is marshalled as MongoDB extended JSON.
+func dumpToJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.M:
+		result := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			result[key] = dumpToJSON(val)
+		}
+		return result
+	case bson.D:
+		result := make(map[string]interface{}, len(v))
+		for _, elem := range v {
+			result[elem.Name] = dumpToJSON(elem.Value)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, val := range v {
+			result[i] = dumpToJSON(val)
+		}
+		return result
+	case []bson.M:
+		result := make([]interface{}, len(v))
+		for i, val := range v {
+			result[i] = dumpToJSON(val)
+		}
+		return result
+	case bson.ObjectId:
+		return map[string]interface{}{"$oid": v.Hex()}
+	case time.Time:
+		return map[string]interface{}{"$date": v.UTC().Format(time.RFC3339Nano)}
+	case []byte:
+		return map[string]interface{}{"$binary": base64.StdEncoding.EncodeToString(v)}
+	case bson.RegEx:
+		return map[string]interface{}{"$regex": v.Pattern, "$options": v.Options}
+	}
+	return value
+}
+
+// dumpFromJSON converts a value unmarshalled from MongoDB extended JSON
+// with json.Decoder.UseNumber() to a value that can be marshalled as BSON.
+func dumpFromJSON(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 1 {
+			if s, ok := v["$oid"].(string); ok {
+				if _, err := hex.DecodeString(s); err != nil || len(s) != 24 {
+					return nil, errs.Format("Invalid ObjectId '%s'", s)
+				}
+				return bson.ObjectIdHex(s), nil
+			}
+			if s, ok := v["$date"].(string); ok {
+				return time.Parse(time.RFC3339Nano, s)
+			}
+			if s, ok := v["$binary"].(string); ok {
+				return base64.StdEncoding.DecodeString(s)
+			}
+		}
+		if pattern, ok := v["$regex"].(string); ok && len(v) == 2 {
+			options, _ := v["$options"].(string)
+			return bson.RegEx{Pattern: pattern, Options: options}, nil
+		}
+		result := make(bson.M, len(v))
+		for key, val := range v {
+			converted, err := dumpFromJSON(val)
+			if err != nil {
+				return nil, errs.Format("%s: %s", key, err)
+			}
+			result[key] = converted
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, val := range v {
+			converted, err := dumpFromJSON(val)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = converted
+		}
+		return result, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	}
+	return value, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Import
+
+type importedDocument struct {
+	id       bson.ObjectId
+	document interface{}
+	// refsMapped is true if the refs have been changed to the new IDs
+	refsMapped bool
+}
+
+/*
+Importer reads documents exported by ExportCollection() with Read()
+and validates and inserts them into their collections with Write().
+
+Unless KeepIDs is true, all imported documents get new IDs
+and the mongo.Ref fields of all documents read by the Importer are changed
+to the new IDs, so fixtures with hand-written IDs can be imported
+into a database that already contains documents.
+Refs to documents that are not imported keep their IDs.
+bson.ObjectId fields that are not mongo.Refs are not changed.
+
+Example:
+
+	importer := &mongo.Importer{Format: mongo.DumpJSONLines}
+	for _, collection := range []*mongo.Collection{models.Users, models.Posts} {
+		...
+		_, err = importer.Read(collection, file)
+	}
+	err = importer.Write()
+*/
+type Importer struct {
+	Format  DumpFormat
+	KeepIDs bool
+
+	ids         map[bson.ObjectId]bson.ObjectId
+	collections []*Collection
+	documents   map[*Collection][]importedDocument
+}
+
+// mapID returns the new ID for id.
+func (self *Importer) mapID(id bson.ObjectId) bson.ObjectId {
+	if self.KeepIDs {
+		return id
+	}
+	if self.ids == nil {
+		self.ids = make(map[bson.ObjectId]bson.ObjectId)
+	}
+	newID, ok := self.ids[id]
+	if !ok {
+		newID = bson.NewObjectId()
+		self.ids[id] = newID
+	}
+	return newID
+}
+
+// maxBSONDocumentSize is the maximum size of a MongoDB document
+const maxBSONDocumentSize = 16 * 1024 * 1024
+
+// readDocuments calls add for every document read from r.
+func (self *Importer) readDocuments(r io.Reader, add func(doc bson.M) error) error {
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		var doc bson.M
+		if self.Format == DumpBSON {
+			var size [4]byte
+			if _, err := io.ReadFull(reader, size[:]); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			// Check the size before allocating,
+			// so that corrupt files can't allocate up to 4 GB
+			n := binary.LittleEndian.Uint32(size[:])
+			if n < 5 || n > maxBSONDocumentSize {
+				return errs.Format("Invalid BSON document %d with size %d", line, n)
+			}
+			data := make([]byte, n)
+			copy(data, size[:])
+			if _, err := io.ReadFull(reader, data[4:]); err != nil {
+				return err
+			}
+			if err := bson.Unmarshal(data, &doc); err != nil {
+				return errs.Format("Document %d: %s", line, err)
+			}
+		} else {
+			data, err := reader.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if len(bytes.TrimSpace(data)) > 0 {
+				decoder := json.NewDecoder(bytes.NewReader(data))
+				decoder.UseNumber()
+				var value map[string]interface{}
+				if err := decoder.Decode(&value); err != nil {
+					return errs.Format("Line %d: %s", line, err)
+				}
+				converted, err := dumpFromJSON(value)
+				if err != nil {
+					return errs.Format("Line %d: %s", line, err)
+				}
+				doc = converted.(bson.M)
+			}
+			if err == io.EOF && doc == nil {
+				return nil
+			}
+		}
+		if doc == nil {
+			continue
+		}
+		if err := add(doc); err != nil {
+			return errs.Format("Document %d: %s", line, err)
+		}
+	}
+}
+
+// Read reads the documents of collection from r and returns
+// the number of read documents. Nothing is written before Write().
+func (self *Importer) Read(collection *Collection, r io.Reader) (count int, err error) {
+	if err = self.Format.validate(); err != nil {
+		return 0, err
+	}
+	if self.documents == nil {
+		self.documents = make(map[*Collection][]importedDocument)
+	}
+	if _, ok := self.documents[collection]; !ok {
+		self.collections = append(self.collections, collection)
+	}
+	documents := self.documents[collection]
+	err = self.readDocuments(r, func(doc bson.M) error {
+		id, _ := doc["_id"].(bson.ObjectId)
+		if id.Valid() {
+			id = self.mapID(id)
+		} else {
+			id = bson.NewObjectId()
+		}
+		doc["_id"] = id
+
+		document := collection.NewDocument()
+		if err := memoryDecode(doc, document); err != nil {
+			return err
+		}
+		// Unmarshalling zeros the document
+		collection.InitDocument(document)
+		documents = append(documents, importedDocument{id: id, document: document})
+		count++
+		return nil
+	})
+	self.documents[collection] = documents
+	return count, err
+}
+
+// validate returns the validation errors of all fields of document.
+// Refs to imported documents are valid.
+func (self *Importer) validate(document interface{}, imported map[string]map[bson.ObjectId]bool) (errors errs.ErrSlice) {
+	model.Visit(document, model.FieldOnlyVisitor(
+		func(field *model.MetaData) error {
+			var err error
+			if field.Value.Type() == refType && field.Value.CanAddr() {
+				ref := field.Value.Addr().Interface().(*Ref)
+				if ref.IsEmpty() || !imported[ref.CollectionName][ref.ID] {
+					err = ref.Validate(field)
+				}
+			} else if validator, ok := field.ModelValidator(); ok {
+				err = validator.Validate(field)
+			}
+			if err != nil {
+				errors = append(errors, errs.Format("%s: %s", field.Selector(), err))
+			}
+			return nil
+		},
+	))
+	return errors
+}
+
+/*
+Write validates all documents read by Read() with the model.Validator
+interface of their fields and inserts them if there are no errors.
+Validation errors of all documents are returned as errs.ErrSlice.
+Save hooks of the documents are not called.
+
+Nothing is written if validation fails or if the ID of a document
+is already used. The collections are inserted one after another
+in batches without a transaction, so if an insert fails anyway,
+the documents inserted before stay in the database.
+They are removed from the Importer and the error names the collections
+that have been written completely. Calling Write() again continues
+with the documents that have not been inserted.
+*/
+func (self *Importer) Write() error {
+	imported := make(map[string]map[bson.ObjectId]bool)
+	for _, collection := range self.collections {
+		ids := make(map[bson.ObjectId]bool)
+		for _, doc := range self.documents[collection] {
+			ids[doc.id] = true
+		}
+		imported[collection.Name] = ids
+	}
+
+	if !self.KeepIDs {
+		// All documents have been read, so the new IDs are known
+		for _, collection := range self.collections {
+			documents := self.documents[collection]
+			for i := range documents {
+				if documents[i].refsMapped {
+					continue
+				}
+				err := model.Visit(documents[i].document, model.FieldTypeVisitor(
+					func(ref *Ref, metaData *model.MetaData) {
+						if newID, ok := self.ids[ref.ID]; ok {
+							ref.ID = newID
+						}
+					},
+				))
+				if err != nil {
+					return err
+				}
+				documents[i].refsMapped = true
+			}
+		}
+	}
+
+	var errors errs.ErrSlice
+	for _, collection := range self.collections {
+		for i, doc := range self.documents[collection] {
+			for _, err := range self.validate(doc.document, imported) {
+				errors = append(errors, errs.Format("Collection '%s', document %d: %s", collection.Name, i+1, err))
+			}
+		}
+	}
+	if len(errors) > 0 {
+		return errors
+	}
+	if errors = self.checkIDs(); len(errors) > 0 {
+		return errors
+	}
+
+	var written []string
+	for len(self.collections) > 0 {
+		collection := self.collections[0]
+		collection.checkDBConnection()
+		defer collection.textIndexChanged()
+		for documents := self.documents[collection]; len(documents) > 0; documents = self.documents[collection] {
+			end := bulkBatchSize
+			if end > len(documents) {
+				end = len(documents)
+			}
+			batch := make([]interface{}, end)
+			for i := range batch {
+				batch[i] = documents[i].document
+			}
+			if err := collection.backend.Insert(batch...); err != nil {
+				self.removeInserted(collection, end)
+				return errs.Format("Import into collection '%s' failed after writing the collections %v: %s", collection.Name, written, err)
+			}
+			self.documents[collection] = documents[end:]
+		}
+		delete(self.documents, collection)
+		self.collections = self.collections[1:]
+		written = append(written, collection.Name)
+	}
+	self.ids = nil
+	return nil
+}
+
+// checkIDs returns an error for every document that would fail
+// to be inserted because its ID is already used.
+func (self *Importer) checkIDs() (errors errs.ErrSlice) {
+	for _, collection := range self.collections {
+		collection.checkDBConnection()
+		documents := self.documents[collection]
+		read := make(map[bson.ObjectId]bool, len(documents))
+		for start := 0; start < len(documents); start += bulkBatchSize {
+			end := start + bulkBatchSize
+			if end > len(documents) {
+				end = len(documents)
+			}
+			ids := make([]bson.ObjectId, 0, end-start)
+			for _, doc := range documents[start:end] {
+				if read[doc.id] {
+					errors = append(errors, errs.Format("Collection '%s': Document %s has been read twice", collection.Name, doc.id.Hex()))
+				}
+				read[doc.id] = true
+				ids = append(ids, doc.id)
+			}
+			i := collection.backend.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1}).Iter()
+			doc := bson.M{}
+			for i.Next(&doc) {
+				if id, ok := doc["_id"].(bson.ObjectId); ok {
+					errors = append(errors, errs.Format("Collection '%s': Document %s already exists", collection.Name, id.Hex()))
+				}
+				doc = bson.M{}
+			}
+			if i.Err() != nil {
+				return append(errors, i.Err())
+			}
+		}
+	}
+	return errors
+}
+
+// removeInserted removes the documents of a failed batch of the first
+// batchSize documents of collection that have been inserted anyway.
+// checkIDs() made sure that none of them existed before.
+func (self *Importer) removeInserted(collection *Collection, batchSize int) {
+	documents := self.documents[collection]
+	ids := make([]bson.ObjectId, batchSize)
+	for i := range ids {
+		ids[i] = documents[i].id
+	}
+	inserted := make(map[bson.ObjectId]bool, batchSize)
+	i := collection.backend.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1}).Iter()
+	doc := bson.M{}
+	for i.Next(&doc) {
+		if id, ok := doc["_id"].(bson.ObjectId); ok {
+			inserted[id] = true
+		}
+		doc = bson.M{}
+	}
+	if i.Err() != nil {
+		// Inserting them again fails with a duplicate key error
+		return
+	}
+	remaining := make([]importedDocument, 0, len(documents))
+	for _, document := range documents {
+		if !inserted[document.id] {
+			remaining = append(remaining, document)
+		}
+	}
+	self.documents[collection] = remaining
+}
+
+/*
+ImportCollections imports the files written by ExportCollections()
+from dir into the collections with names.
+If no names are given, all registered collections with a file
+in dir are imported.
+IDs are changed like described for Importer unless keepIDs is true.
+*/
+func ImportCollections(dir string, format DumpFormat, keepIDs bool, names ...string) error {
+	if err := format.validate(); err != nil {
+		return err
+	}
+	collections, err := dumpCollections(names)
+	if err != nil {
+		return err
+	}
+	importer := &Importer{Format: format, KeepIDs: keepIDs}
+	for _, collection := range collections {
+		file, err := os.Open(filepath.Join(dir, format.FileName(collection)))
+		if os.IsNotExist(err) && len(names) == 0 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = importer.Read(collection, file)
+		file.Close()
+		if err != nil {
+			return errs.Format("Import of collection '%s' failed: %s", collection.Name, err)
+		}
+	}
+	return importer.Write()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// DumpCommand
+
+/*
+DumpCommand is a command line interface for ExportCollections()
+and ImportCollections(). It has to be called by the main function
+of an application after mongo has been initialized,
+because the collections are registered by the application.
+
+Usage:
+
+	export|import [-dir=dump] [-format=jsonl|bson] [-keep-ids] [collection ...]
+
+Example:
+
+	if len(os.Args) > 1 && os.Args[1] == "dump" {
+		err := mongo.DumpCommand(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+*/
+func DumpCommand(args []string) error {
+	const usage = "Usage: export|import [-dir=dump] [-format=jsonl|bson] [-keep-ids] [collection ...]"
+	if len(args) == 0 {
+		return errs.Format(usage)
+	}
+	command := args[0]
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	dir := flags.String("dir", "dump", "Directory of the dump files")
+	format := flags.String("format", string(DumpJSONLines), "File format: jsonl or bson")
+	keepIDs := flags.Bool("keep-ids", false, "Import documents with their exported IDs")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	switch strings.ToLower(command) {
+	case "export":
+		return ExportCollections(*dir, DumpFormat(*format), flags.Args()...)
+	case "import":
+		return ImportCollections(*dir, DumpFormat(*format), *keepIDs, flags.Args()...)
+	}
+	return errs.Format("Invalid command '%s'. %s", command, usage)
+}
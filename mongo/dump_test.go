@@ -0,0 +1,164 @@
+package mongo
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ungerik/go-start/mgo/bson"
+)
+
+func exportTestCollections(t *testing.T, format DumpFormat, collections ...*Collection) []*bytes.Buffer {
+	t.Helper()
+	buffers := make([]*bytes.Buffer, len(collections))
+	for i, collection := range collections {
+		buffers[i] = new(bytes.Buffer)
+		if _, err := ExportCollection(buffers[i], collection, format); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buffers
+}
+
+func readTestCollections(t *testing.T, importer *Importer, buffers []*bytes.Buffer, collections ...*Collection) {
+	t.Helper()
+	for i, collection := range collections {
+		if _, err := importer.Read(collection, buffers[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []DumpFormat{DumpJSONLines, DumpBSON} {
+		InitMemory()
+		author := refAuthors.NewDocument().(*refAuthor)
+		author.Name.Set("Erik")
+		saveTestDocument(t, author)
+		post := refPosts.NewDocument().(*refPost)
+		post.Author = author.Ref()
+		post.Review.Reviewer = author.Ref()
+		saveTestDocument(t, post)
+		comment := refComments.NewDocument().(*refComment)
+		comment.Post = post.Ref()
+		comment.Likes = []Ref{author.Ref()}
+		saveTestDocument(t, comment)
+
+		// Comments are read before the documents they reference
+		collections := []*Collection{refComments, refPosts, refAuthors}
+		buffers := exportTestCollections(t, format, collections...)
+		InitMemory()
+		importer := &Importer{Format: format}
+		readTestCollections(t, importer, buffers, collections...)
+		if err := importer.Write(); err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+
+		result, err := refAuthors.One()
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		newAuthor := result.(*refAuthor)
+		if newAuthor.ID == author.ID || newAuthor.Name != "Erik" {
+			t.Errorf("%s: imported author %+v", format, newAuthor)
+		}
+		result, err = refPosts.One()
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		newPost := result.(*refPost)
+		if newPost.ID == post.ID || newPost.Author.ID != newAuthor.ID || newPost.Review.Reviewer.ID != newAuthor.ID {
+			t.Errorf("%s: refs of the post have not been remapped: %+v", format, newPost)
+		}
+		result, err = refComments.One()
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		newComment := result.(*refComment)
+		if newComment.Post.ID != newPost.ID || len(newComment.Likes) != 1 || newComment.Likes[0].ID != newAuthor.ID {
+			t.Errorf("%s: refs of the comment have not been remapped: %+v", format, newComment)
+		}
+	}
+}
+
+func TestImportInvalidRef(t *testing.T) {
+	InitMemory()
+	post := refPosts.NewDocument().(*refPost)
+	post.Author = Ref{ID: bson.NewObjectId(), CollectionName: refAuthors.Name}
+	refPosts.checkDBConnection()
+	if err := refPosts.backend.Insert(post); err != nil {
+		t.Fatal(err)
+	}
+	buffers := exportTestCollections(t, DumpJSONLines, refPosts)
+
+	InitMemory()
+	importer := &Importer{Format: DumpJSONLines}
+	readTestCollections(t, importer, buffers, refPosts)
+	if err := importer.Write(); err == nil {
+		t.Error("no error for a ref to a document that is not imported")
+	}
+	if n, _ := refPosts.Count(); n != 0 {
+		t.Errorf("%d documents written although validation failed", n)
+	}
+}
+
+func TestImportRetry(t *testing.T) {
+	InitMemory()
+	authors := make([]*refAuthor, 3)
+	for i := range authors {
+		authors[i] = refAuthors.NewDocument().(*refAuthor)
+		saveTestDocument(t, authors[i])
+	}
+	post := refPosts.NewDocument().(*refPost)
+	post.Author = authors[0].Ref()
+	saveTestDocument(t, post)
+	collections := []*Collection{refAuthors, refPosts}
+	buffers := exportTestCollections(t, DumpBSON, collections...)
+
+	InitMemory()
+	importer := &Importer{Format: DumpBSON, KeepIDs: true}
+	readTestCollections(t, importer, buffers, collections...)
+	// The ID of the second author is already used
+	refAuthors.checkDBConnection()
+	if err := refAuthors.backend.Insert(bson.M{"_id": authors[1].ID}); err != nil {
+		t.Fatal(err)
+	}
+	err := importer.Write()
+	if err == nil || !strings.Contains(err.Error(), authors[1].ID.Hex()) {
+		t.Fatalf("Write() returned %v", err)
+	}
+	if n, _ := refAuthors.Count(); n != 1 {
+		t.Errorf("%d authors after the failed import", n)
+	}
+	if n, _ := refPosts.Count(); n != 0 {
+		t.Errorf("%d posts after the failed import", n)
+	}
+
+	// The importer keeps its documents for another Write()
+	if err = refAuthors.Purge(authors[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = importer.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := refAuthors.Count(); n != len(authors) {
+		t.Errorf("%d authors instead of %d", n, len(authors))
+	}
+	for _, author := range authors {
+		if _, err = refAuthors.DocumentWithID(author.ID); err != nil {
+			t.Errorf("author %s: %s", author.ID.Hex(), err)
+		}
+	}
+	if n, _ := refPosts.Count(); n != 1 {
+		t.Errorf("%d posts instead of 1", n)
+	}
+
+	// Documents read twice are rejected
+	buffers = exportTestCollections(t, DumpBSON, refAuthors, refAuthors)
+	InitMemory()
+	importer = &Importer{Format: DumpBSON, KeepIDs: true}
+	readTestCollections(t, importer, buffers, refAuthors, refAuthors)
+	if err = importer.Write(); err == nil || !strings.Contains(err.Error(), "read twice") {
+		t.Errorf("Write() returned %v for documents that have been read twice", err)
+	}
+}
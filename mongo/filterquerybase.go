@@ -1,8 +1,9 @@
 package mongo
 
 import (
+	"strings"
+
 	"github.com/ungerik/go-start/errs"
-	"github.com/ungerik/go-start/mgo"
 	"github.com/ungerik/go-start/mgo/bson"
 
 //	"github.com/ungerik/go-start/debug"
@@ -16,31 +17,44 @@ type filterQueryBase struct {
 }
 
 func bsonQuery(query Query) (bsonQuery bson.M, err error) {
-	chainedFilters := []Query{query}
-
+	var chainedFilters []Query
+	deleted, deletedModified := excludeDeleted, false
 	orChained := false
-	for parent := query.ParentQuery(); parent != nil; parent = parent.ParentQuery() {
-		if parent.IsFilter() {
-			chainedFilters = append(chainedFilters, parent)
+	for q := query; q != nil; q = q.ParentQuery() {
+		if q.IsFilter() {
+			chainedFilters = append(chainedFilters, q)
 		}
-		if _, or := parent.(*orQuery); or {
+		if _, or := q.(*orQuery); or {
 			// todo check if filter and or interleave
 			orChained = true
 		}
+		if d, ok := q.(*deletedQuery); ok && !deletedModified {
+			// The last WithDeleted() or OnlyDeleted() of the chain wins
+			deleted, deletedModified = d.mode, true
+		}
 	}
 
-	if len(chainedFilters) == 1 {
-		bsonQuery = query.bsonSelector()
-	} else if orChained {
-		bsonQueries := make([]bson.M, len(chainedFilters))
-		for i, filter := range chainedFilters {
-			bsonQueries[i] = filter.bsonSelector()
+	// Selectors of filters following a SubDocument() query
+	// are relative to the sub-document
+	filterSelectors := make([]bson.M, len(chainedFilters))
+	for i, filter := range chainedFilters {
+		prefix, err := subDocumentPrefix(filter)
+		if err != nil {
+			return nil, err
 		}
-		bsonQuery = bson.M{"$or": bsonQueries}
+		filterSelectors[i] = prefixBsonSelector(prefix, filter.bsonSelector())
+	}
+
+	if len(chainedFilters) == 0 {
+		bsonQuery = bson.M{}
+	} else if len(chainedFilters) == 1 {
+		bsonQuery = filterSelectors[0]
+	} else if orChained {
+		bsonQuery = bson.M{"$or": filterSelectors}
 	} else {
 		bsonQuery = bson.M{}
-		for _, filter := range chainedFilters {
-			for key, value := range filter.bsonSelector() {
+		for _, filterSelector := range filterSelectors {
+			for key, value := range filterSelector {
 				if existingValue, hasKey := bsonQuery[key]; hasKey {
 					return nil, errs.Format("Can't filter %s for %v and %v", key, existingValue, value)
 				}
@@ -49,17 +63,43 @@ func bsonQuery(query Query) (bsonQuery bson.M, err error) {
 		}
 	}
 
+	// Soft deleted documents are only filtered if the
+	// "deleted" field is not already used by a filter
+	if collection := query.Collection(); collection != nil && collection.softDelete {
+		if _, hasKey := bsonQuery["deleted"]; !hasKey {
+			if selector := deleted.deletedSelector(); selector != nil {
+				bsonQuery["deleted"] = selector
+			}
+		}
+	}
+
 	return bsonQuery, nil
 }
 
-func (self *filterQueryBase) mongoQuery() (q *mgo.Query, err error) {
+// prefixBsonSelector returns selector with prefix added
+// to all keys that are not MongoDB operators.
+func prefixBsonSelector(prefix string, selector bson.M) bson.M {
+	if prefix == "" {
+		return selector
+	}
+	result := make(bson.M, len(selector))
+	for key, value := range selector {
+		if !strings.HasPrefix(key, "$") {
+			key = prefix + key
+		}
+		result[key] = value
+	}
+	return result
+}
+
+func (self *filterQueryBase) mongoQuery() (q queryBackend, err error) {
 	bsonQuery, err := bsonQuery(self.thisQuery)
 	if err != nil {
 		return nil, err
 	}
 	collection := self.Collection()
 	collection.checkDBConnection()
-	return collection.collection.Find(bsonQuery), nil
+	return selectFields(self.thisQuery, collection.backend.Find(bsonQuery))
 }
 
 func (self *filterQueryBase) IsFilter() bool {
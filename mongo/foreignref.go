@@ -0,0 +1,353 @@
+package mongo
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/model"
+)
+
+// Values for the "ondelete" attribute of mongo.Ref fields.
+// Without the attribute nothing happens with refs to removed documents.
+//
+// Example:
+//
+//	type Comment struct {
+//		mongo.DocumentBase `bson:",inline"`
+//		Post               mongo.Ref   `model:"to=posts|ondelete=cascade"`
+//		Author             mongo.Ref   `model:"to=users|ondelete=restrict"`
+//		Likes              []mongo.Ref `model:"to=users|ondelete=set-empty"`
+//	}
+const (
+	// OnDeleteRestrict prevents the removal of referenced documents.
+	OnDeleteRestrict = "restrict"
+	// OnDeleteCascade removes referencing documents together
+	// with the referenced document.
+	OnDeleteCascade = "cascade"
+	// OnDeleteSetEmpty sets refs to removed documents to empty.
+	// Refs in slices are removed from the slice.
+	OnDeleteSetEmpty = "set-empty"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// ForeignRef
+
+// ForeignRef describes a mongo.Ref field of the documents in Collection.
+// Selector uses MongoDB dot notation without array indices,
+// so it can be used to query documents that contain a ref in any
+// array element.
+type ForeignRef struct {
+	Collection *Collection
+	Selector   string
+	To         string
+	OnDelete   string
+	// wildcardSelector is the model.MetaData.WildcardSelector() of the ref
+	wildcardSelector string
+}
+
+// Query returns a query for all documents of the collection
+// where the field of the ForeignRef references the document with ref.
+func (self *ForeignRef) Query(ref Ref) Query {
+	return self.Collection.Filter(self.Selector, ref.ID)
+}
+
+var (
+	refType      = reflect.TypeOf(Ref{})
+	refSliceType = reflect.TypeOf([]Ref(nil))
+)
+
+// bsonTag returns the bson tag of field like the bson package.
+// Old-style tags without key like `_id` are used as bson tag.
+func bsonTag(field *reflect.StructField) string {
+	tag := field.Tag.Get("bson")
+	if tag == "" && !strings.Contains(string(field.Tag), ":") {
+		tag = string(field.Tag)
+	}
+	return tag
+}
+
+// bsonFieldName returns the key used by the bson package for field.
+func bsonFieldName(field *reflect.StructField) string {
+	if tag := strings.Split(bsonTag(field), ",")[0]; tag != "" {
+		return tag
+	}
+	return strings.ToLower(field.Name)
+}
+
+func joinSelector(selector, field string) string {
+	if selector == "" {
+		return field
+	}
+	return selector + "." + field
+}
+
+func (self *Collection) findForeignRefs(t reflect.Type, selector, wildcardSelector string, attribs map[string]string, depth int, foreignRefs []ForeignRef) ([]ForeignRef, error) {
+	if depth > 32 {
+		return nil, errs.Format("Collection '%s': Can't find refs of recursive type %s", self.Name, t)
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return self.findForeignRefs(t.Elem(), selector, wildcardSelector, attribs, depth+1, foreignRefs)
+
+	case reflect.Array, reflect.Slice:
+		// MongoDB dot notation matches array elements without index
+		return self.findForeignRefs(t.Elem(), selector, joinSelector(wildcardSelector, "$"), attribs, depth+1, foreignRefs)
+
+	case reflect.Struct:
+		if t == refType {
+			to := attribs["to"]
+			if to == "" {
+				return nil, errs.Format("Collection '%s': mongo.Ref '%s' is missing the 'to' meta-data tag", self.Name, selector)
+			}
+			switch attribs["ondelete"] {
+			case "", OnDeleteRestrict, OnDeleteCascade, OnDeleteSetEmpty:
+			default:
+				return nil, errs.Format("Collection '%s': Invalid ondelete value '%s' for mongo.Ref '%s'", self.Name, attribs["ondelete"], selector)
+			}
+			foreignRef := ForeignRef{
+				Collection:       self,
+				Selector:         selector,
+				To:               to,
+				OnDelete:         attribs["ondelete"],
+				wildcardSelector: wildcardSelector,
+			}
+			return append(foreignRefs, foreignRef), nil
+		}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" || field.Tag.Get("gostart") == "-" || bsonTag(&field) == "-" {
+				continue
+			}
+			var err error
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				// Anonymous structs are inlined by go-start
+				foreignRefs, err = self.findForeignRefs(field.Type, selector, wildcardSelector, attribs, depth+1, foreignRefs)
+			} else {
+				fieldAttribs := model.ParseTagAttribs(field.Tag.Get(model.StructTagKey))
+				foreignRefs, err = self.findForeignRefs(field.Type, joinSelector(selector, bsonFieldName(&field)), joinSelector(wildcardSelector, field.Name), fieldAttribs, depth+1, foreignRefs)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return foreignRefs, nil
+}
+
+// ForeignRefs returns all mongo.Ref fields of the documents
+// of the collection. An error is returned for refs without
+// "to" meta-data tag or with an invalid "ondelete" value.
+func (self *Collection) ForeignRefs() ([]ForeignRef, error) {
+	return self.findForeignRefs(self.DocumentType, "", "", nil, 0, nil)
+}
+
+// ForeignRefsTo returns all mongo.Ref fields of all registered
+// collections that can reference documents of the collection
+// with collectionName.
+func ForeignRefsTo(collectionName string) (foreignRefs []ForeignRef, err error) {
+	for _, collection := range Collections {
+		refs, err := collection.ForeignRefs()
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			if ref.To == collectionName {
+				foreignRefs = append(foreignRefs, ref)
+			}
+		}
+	}
+	return foreignRefs, nil
+}
+
+// ReferencingDocuments returns an iterator for all documents
+// of all registered collections that reference ref.
+func ReferencingDocuments(ref Ref) model.Iterator {
+	foreignRefs, err := ForeignRefsTo(ref.CollectionName)
+	if err != nil {
+		return model.NewErrorOnlyIterator(err)
+	}
+	var docs []interface{}
+	visited := map[string]bool{}
+	for i := range foreignRefs {
+		iter := foreignRefs[i].Query(ref).Iterator()
+		for doc := iter.Next(); doc != nil; doc = iter.Next() {
+			if document, ok := doc.(Document); ok {
+				key := document.Collection().Name + "/" + document.ObjectId().Hex()
+				if visited[key] {
+					continue
+				}
+				visited[key] = true
+			}
+			docs = append(docs, doc)
+		}
+		if iter.Err() != nil {
+			return model.NewErrorOnlyIterator(iter.Err())
+		}
+	}
+	return model.NewObjectIterator(docs...)
+}
+
+// cascadeRemover is implemented by DocumentBase and TrackedDocumentBase
+// to remove a document as part of a cascade with the already visited documents.
+type cascadeRemover interface {
+	remove(visited map[string]bool) error
+}
+
+func refKey(ref Ref) string {
+	return ref.CollectionName + "/" + ref.ID.Hex()
+}
+
+// applyOnDeleteRules enforces the "ondelete" rules of all mongo.Ref fields
+// that reference the document with ref before it is removed.
+// visited is nil for the document where the remove started, then the
+// restrict rules of the whole cascade are checked before any document
+// is modified. Documents in visited are not removed again,
+// so cyclic cascades terminate.
+func applyOnDeleteRules(ref Ref, visited map[string]bool) error {
+	if !ref.ID.Valid() {
+		return nil
+	}
+	if visited == nil {
+		if err := checkOnDeleteRestrict(ref, map[string]bool{}); err != nil {
+			return err
+		}
+		visited = map[string]bool{refKey(ref): true}
+	}
+	foreignRefs, err := ForeignRefsTo(ref.CollectionName)
+	if err != nil {
+		return err
+	}
+
+	for i := range foreignRefs {
+		foreignRef := &foreignRefs[i]
+		switch foreignRef.OnDelete {
+		case OnDeleteCascade:
+			// Collect first, because removing changes the query result
+			var docs []interface{}
+			iter := foreignRef.Query(ref).Iterator()
+			for doc := iter.Next(); doc != nil; doc = iter.Next() {
+				docs = append(docs, doc)
+			}
+			if iter.Err() != nil {
+				return iter.Err()
+			}
+			for _, doc := range docs {
+				document := doc.(Document)
+				key := refKey(Ref{ID: document.ObjectId(), CollectionName: document.Collection().Name})
+				if visited[key] {
+					continue
+				}
+				visited[key] = true
+				if remover, ok := doc.(cascadeRemover); ok {
+					err = remover.remove(visited)
+				} else {
+					err = document.Remove()
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+		case OnDeleteSetEmpty:
+			iter := foreignRef.Query(ref).Iterator()
+			for doc := iter.Next(); doc != nil; doc = iter.Next() {
+				if visited[refKey(Ref{ID: doc.(Document).ObjectId(), CollectionName: foreignRef.Collection.Name})] {
+					continue
+				}
+				if err = removeRefsFromDocument(doc, ref, foreignRef.wildcardSelector); err != nil {
+					return err
+				}
+				if err = doc.(Document).Save(); err != nil {
+					return err
+				}
+			}
+			if iter.Err() != nil {
+				return iter.Err()
+			}
+
+		case "", OnDeleteRestrict:
+			// checked by checkOnDeleteRestrict()
+
+		default:
+			return errs.Format("Invalid ondelete value '%s' for '%s' in collection '%s'", foreignRef.OnDelete, foreignRef.Selector, foreignRef.Collection.Name)
+		}
+	}
+
+	return nil
+}
+
+// checkOnDeleteRestrict returns an error if the document with ref
+// or any document that would be removed with it by a cascade
+// is referenced by a Ref with a restrict rule.
+func checkOnDeleteRestrict(ref Ref, visited map[string]bool) error {
+	visited[refKey(ref)] = true
+	foreignRefs, err := ForeignRefsTo(ref.CollectionName)
+	if err != nil {
+		return err
+	}
+	for i := range foreignRefs {
+		foreignRef := &foreignRefs[i]
+		switch foreignRef.OnDelete {
+		case OnDeleteRestrict:
+			count, err := foreignRef.Query(ref).Count()
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return errs.Format("Can't remove document %s from collection '%s' because it is referenced by %d document(s) of collection '%s' in '%s'", ref.ID.Hex(), ref.CollectionName, count, foreignRef.Collection.Name, foreignRef.Selector)
+			}
+
+		case OnDeleteCascade:
+			iter := foreignRef.Query(ref).Iterator()
+			for doc := iter.Next(); doc != nil; doc = iter.Next() {
+				child := Ref{ID: doc.(Document).ObjectId(), CollectionName: foreignRef.Collection.Name}
+				if visited[refKey(child)] {
+					continue
+				}
+				if err = checkOnDeleteRestrict(child, visited); err != nil {
+					return err
+				}
+			}
+			if iter.Err() != nil {
+				return iter.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// removeRefsFromDocument sets all refs to ref at wildcardSelector
+// to empty or removes them if they are elements of a []mongo.Ref slice.
+func removeRefsFromDocument(document interface{}, ref Ref, wildcardSelector string) error {
+	var refSlices []reflect.Value
+	err := model.Visit(document, model.FieldOnlyVisitor(
+		func(field *model.MetaData) error {
+			if field.Value.Type() != refType || field.WildcardSelector() != wildcardSelector {
+				return nil
+			}
+			if field.Parent.Value.Type() == refSliceType {
+				if field.Index == 0 {
+					refSlices = append(refSlices, field.Parent.Value)
+				}
+				return nil
+			}
+			r := field.Value.Addr().Interface().(*Ref)
+			if r.ID == ref.ID {
+				r.Set(nil)
+			}
+			return nil
+		},
+	))
+	if err != nil {
+		return err
+	}
+	for _, refSlice := range refSlices {
+		refs := refSlice.Interface().([]Ref)
+		for found := true; found; {
+			refs, found = RemoveRefWithIDFromSlice(refs, ref.ID)
+		}
+		refSlice.Set(reflect.ValueOf(refs))
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package mongo
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ungerik/go-start/model"
+)
+
+type refAuthor struct {
+	DocumentBase `bson:",inline"`
+	Name         model.String
+}
+
+type refReview struct {
+	Reviewer Ref `model:"to=test_ref_authors|ondelete=set-empty"`
+}
+
+type refPost struct {
+	DocumentBase `bson:",inline"`
+	Author       Ref `model:"to=test_ref_authors|ondelete=restrict"`
+	Review       refReview
+}
+
+type refComment struct {
+	DocumentBase `bson:",inline"`
+	Post         Ref   `model:"to=test_ref_posts|ondelete=cascade"`
+	Likes        []Ref `model:"to=test_ref_authors|ondelete=set-empty"`
+}
+
+var (
+	refAuthors  = NewCollection("test_ref_authors", (*refAuthor)(nil))
+	refPosts    = NewCollection("test_ref_posts", (*refPost)(nil))
+	refComments = NewCollection("test_ref_comments", (*refComment)(nil))
+)
+
+func saveTestDocument(t *testing.T, doc Document) {
+	t.Helper()
+	if err := doc.Save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnDelete(t *testing.T) {
+	InitMemory()
+	author := refAuthors.NewDocument().(*refAuthor)
+	fan := refAuthors.NewDocument().(*refAuthor)
+	saveTestDocument(t, author)
+	saveTestDocument(t, fan)
+
+	post := refPosts.NewDocument().(*refPost)
+	post.Author = author.Ref()
+	post.Review.Reviewer = fan.Ref()
+	saveTestDocument(t, post)
+	comments := make([]*refComment, 2)
+	for i := range comments {
+		comments[i] = refComments.NewDocument().(*refComment)
+		comments[i].Post = post.Ref()
+		comments[i].Likes = []Ref{fan.Ref(), author.Ref()}
+		saveTestDocument(t, comments[i])
+	}
+
+	// restrict
+	if err := author.Remove(); err == nil {
+		t.Fatal("author referenced by a post with ondelete=restrict has been removed")
+	}
+	if n, _ := refAuthors.Count(); n != 2 {
+		t.Fatal("author has been removed")
+	}
+	if doc, err := refComments.DocumentWithID(comments[0].ID); err != nil || len(doc.(*refComment).Likes) != 2 {
+		t.Fatal("set-empty has been applied before the restrict rule failed")
+	}
+
+	// set-empty
+	if err := fan.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	for _, comment := range comments {
+		doc, err := refComments.DocumentWithID(comment.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		likes := doc.(*refComment).Likes
+		if len(likes) != 1 || likes[0].ID != author.ID {
+			t.Errorf("likes after removing the fan: %v", likes)
+		}
+	}
+	doc, err := refPosts.DocumentWithID(post.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !doc.(*refPost).Review.Reviewer.IsEmpty() {
+		t.Error("ref in sub-document has not been set to empty")
+	}
+
+	// cascade
+	if err = post.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := refComments.Count(); n != 0 {
+		t.Errorf("%d comments left after removing the post", n)
+	}
+	if err = author.Remove(); err != nil {
+		t.Errorf("author can't be removed without posts: %s", err)
+	}
+}
+
+func TestForeignRefs(t *testing.T) {
+	foreignRefs, err := ForeignRefsTo("test_ref_authors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selectors := map[string]string{}
+	for _, foreignRef := range foreignRefs {
+		selectors[foreignRef.Collection.Name+":"+foreignRef.Selector] = foreignRef.OnDelete
+	}
+	want := map[string]string{
+		"test_ref_posts:author":          OnDeleteRestrict,
+		"test_ref_posts:review.reviewer": OnDeleteSetEmpty,
+		"test_ref_comments:likes":        OnDeleteSetEmpty,
+	}
+	if !reflect.DeepEqual(selectors, want) {
+		t.Errorf("foreign refs %v, want %v", selectors, want)
+	}
+}
+
+func TestBsonFieldName(t *testing.T) {
+	tests := []struct {
+		field reflect.StructField
+		name  string
+	}{
+		{reflect.StructField{Name: "Name"}, "name"},
+		{reflect.StructField{Name: "Name", Tag: `bson:"n,omitempty"`}, "n"},
+		{reflect.StructField{Name: "Name", Tag: `bson:",omitempty"`}, "name"},
+		{reflect.StructField{Name: "Name", Tag: `model:"to=x"`}, "name"},
+		// Old-style tags without key are used by the bson package
+		{reflect.StructField{Name: "ID", Tag: `_id`}, "_id"},
+		{reflect.StructField{Name: "Name", Tag: `n,omitempty`}, "n"},
+	}
+	for _, test := range tests {
+		if name := bsonFieldName(&test.field); name != test.name {
+			t.Errorf("bsonFieldName(%s `%s`) is %q, want %q", test.field.Name, test.field.Tag, name, test.name)
+		}
+	}
+}
+
+type invalidOnDeleteDocument struct {
+	DocumentBase `bson:",inline"`
+	Author       Ref `model:"to=test_ref_authors|ondelete=remove"`
+}
+
+func TestInvalidOnDelete(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewCollection() didn't panic for an invalid ondelete value")
+		}
+		if _, ok := Collections["test_invalid_ondelete"]; ok {
+			t.Error("collection with invalid ondelete value has been registered")
+		}
+	}()
+	NewCollection("test_invalid_ondelete", (*invalidOnDeleteDocument)(nil))
+}
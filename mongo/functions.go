@@ -3,6 +3,7 @@ package mongo
 import (
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/ungerik/go-start/config"
@@ -72,13 +73,90 @@ func checkQuery(query Query) Query {
 	return query
 }
 
+// subDocumentPrefix returns the path of the sub-document
+// selected by the query chain with a trailing dot,
+// or an empty string if there is no sub-document selected.
+func subDocumentPrefix(query Query) (string, error) {
+	collection, selectors := collectionAndSubDocumentSelectors(query)
+	if len(selectors) == 0 {
+		return "", nil
+	}
+	_, path, err := collection.subDocumentPath(selectors)
+	if err != nil {
+		return "", err
+	}
+	return path + ".", nil
+}
+
+// projectionPath returns path up to the first array index,
+// because MongoDB can't project array elements with dot notation.
+func projectionPath(path string) string {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		if _, err := strconv.Atoi(part); (err == nil || part == "$") && i > 0 {
+			return strings.Join(parts[:i], ".")
+		}
+	}
+	return path
+}
+
+// bsonPathValue returns the value at path in MongoDB dot notation
+// of document. Array elements have to be selected by index.
+func bsonPathValue(document bson.M, path string) (value interface{}, ok bool) {
+	value = document
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case bson.M:
+			if value, ok = v[part]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// bsonPathValues returns all values at path of value.
+// Arrays on the path are traversed like MongoDB does,
+// missing fields are not included in values.
+func bsonPathValues(value interface{}, path []string) (values []interface{}) {
+	if len(path) == 0 {
+		return []interface{}{value}
+	}
+	switch v := value.(type) {
+	case bson.M:
+		if child, ok := v[path[0]]; ok {
+			return bsonPathValues(child, path[1:])
+		}
+	case []interface{}:
+		if index, err := strconv.Atoi(path[0]); err == nil {
+			if index >= 0 && index < len(v) {
+				return bsonPathValues(v[index], path[1:])
+			}
+			return nil
+		}
+		for _, element := range v {
+			values = append(values, bsonPathValues(element, path)...)
+		}
+	}
+	return values
+}
+
 func MatchBsonField(bsonName string) reflection.MatchStructFieldFunc {
 	return func(field *reflect.StructField) bool {
 		var name string
 		bsonTag := field.Tag.Get("bson")
 		if bsonTag != "" {
-			name = strings.SplitN(bsonTag, ",", 1)[0]
-		} else {
+			name = strings.SplitN(bsonTag, ",", 2)[0]
+		}
+		if name == "" {
 			name = strings.ToLower(field.Name)
 		}
 		return name == bsonName
@@ -0,0 +1,84 @@
+package mongo
+
+///////////////////////////////////////////////////////////////////////////////
+// Document lifecycle hooks
+
+/*
+Documents can implement the following optional interfaces to run code
+before or after they are written to or removed from the database.
+
+Save hooks are called by Collection.Insert(), Collection.Update(), Bulk.Run()
+and DocumentBase.Save(). Remove hooks are called by DocumentBase.Remove().
+AfterLoad is called for every document loaded by a query or
+Collection.DocumentWithID().
+
+An error returned by a Before hook aborts the operation.
+An error returned by an After hook is returned by the operation,
+but the database has already been modified.
+
+Collection.Remove(), Collection.Purge(), Query.RemoveAll() and
+Query.PurgeAll() work on IDs and queries and don't call remove hooks
+because the documents are not loaded.
+
+Example:
+
+	func (self *Post) BeforeSave() error {
+		self.Modified.SetNowUTC()
+		return nil
+	}
+*/
+
+type BeforeSaver interface {
+	BeforeSave() error
+}
+
+type AfterSaver interface {
+	AfterSave() error
+}
+
+type BeforeRemover interface {
+	BeforeRemove() error
+}
+
+type AfterRemover interface {
+	AfterRemove() error
+}
+
+type AfterLoader interface {
+	AfterLoad() error
+}
+
+func callBeforeSave(document interface{}) error {
+	if hook, ok := document.(BeforeSaver); ok {
+		return hook.BeforeSave()
+	}
+	return nil
+}
+
+func callAfterSave(document interface{}) error {
+	if hook, ok := document.(AfterSaver); ok {
+		return hook.AfterSave()
+	}
+	return nil
+}
+
+func callBeforeRemove(document interface{}) error {
+	if hook, ok := document.(BeforeRemover); ok {
+		return hook.BeforeRemove()
+	}
+	return nil
+}
+
+func callAfterRemove(document interface{}) error {
+	if hook, ok := document.(AfterRemover); ok {
+		return hook.AfterRemove()
+	}
+	return nil
+}
+
+func callAfterLoad(document interface{}) error {
+	if hook, ok := document.(AfterLoader); ok {
+		return hook.AfterLoad()
+	}
+	return nil
+}
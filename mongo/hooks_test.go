@@ -0,0 +1,123 @@
+package mongo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ungerik/go-start/model"
+)
+
+type hookDocument struct {
+	DocumentBase `bson:",inline"`
+	Name         model.String
+	Saved        model.Int
+	calls        []string
+	fail         string
+}
+
+var hookDocuments = NewCollection("test_hook_documents", (*hookDocument)(nil))
+
+func (self *hookDocument) hook(name string) error {
+	self.calls = append(self.calls, name)
+	if self.fail == name {
+		return errors.New(name + " failed")
+	}
+	return nil
+}
+
+func (self *hookDocument) BeforeSave() error {
+	self.Saved++
+	return self.hook("BeforeSave")
+}
+
+func (self *hookDocument) AfterSave() error    { return self.hook("AfterSave") }
+func (self *hookDocument) BeforeRemove() error { return self.hook("BeforeRemove") }
+func (self *hookDocument) AfterRemove() error  { return self.hook("AfterRemove") }
+func (self *hookDocument) AfterLoad() error    { return self.hook("AfterLoad") }
+
+func (self *hookDocument) takeCalls() string {
+	calls := strings.Join(self.calls, ",")
+	self.calls = nil
+	return calls
+}
+
+func TestHooks(t *testing.T) {
+	InitMemory()
+	doc := hookDocuments.NewDocument().(*hookDocument)
+	doc.Name.Set("Erik")
+	if err := doc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := doc.takeCalls(); calls != "BeforeSave,AfterSave" {
+		t.Errorf("insert called %s", calls)
+	}
+
+	loaded, err := hookDocuments.DocumentWithID(doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc = loaded.(*hookDocument)
+	if calls := doc.takeCalls(); calls != "AfterLoad" {
+		t.Errorf("DocumentWithID called %s", calls)
+	}
+	if doc.Saved != 1 {
+		t.Errorf("change of BeforeSave has not been saved: Saved=%d", doc.Saved)
+	}
+
+	doc.Name.Set("Unger")
+	if err = doc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := doc.takeCalls(); calls != "BeforeSave,AfterSave" {
+		t.Errorf("update called %s", calls)
+	}
+
+	var iterated int
+	iterator := hookDocuments.Iterator()
+	for loaded := iterator.Next(); loaded != nil; loaded = iterator.Next() {
+		if calls := loaded.(*hookDocument).takeCalls(); calls != "AfterLoad" {
+			t.Errorf("iterator called %s", calls)
+		}
+		iterated++
+	}
+	if iterator.Err() != nil || iterated != 1 {
+		t.Fatalf("iterated %d documents, %v", iterated, iterator.Err())
+	}
+
+	if err = doc.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := doc.takeCalls(); calls != "BeforeRemove,AfterRemove" {
+		t.Errorf("remove called %s", calls)
+	}
+}
+
+func TestHookErrors(t *testing.T) {
+	InitMemory()
+	doc := hookDocuments.NewDocument().(*hookDocument)
+	doc.fail = "BeforeSave"
+	if err := doc.Save(); err == nil {
+		t.Fatal("no error from BeforeSave")
+	}
+	if n, _ := hookDocuments.Count(); n != 0 || doc.ID.Valid() {
+		t.Fatal("BeforeSave error didn't abort the insert")
+	}
+
+	// An AfterSave error is returned, but the document has been written
+	doc.fail = "AfterSave"
+	if err := doc.Save(); err == nil {
+		t.Error("no error from AfterSave")
+	}
+	if n, _ := hookDocuments.Count(); n != 1 {
+		t.Error("document has not been inserted")
+	}
+
+	doc.fail = "BeforeRemove"
+	if err := doc.Remove(); err == nil {
+		t.Error("no error from BeforeRemove")
+	}
+	if n, _ := hookDocuments.Count(); n != 1 {
+		t.Error("BeforeRemove error didn't abort the remove")
+	}
+}
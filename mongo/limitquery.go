@@ -1,7 +1,5 @@
 package mongo
 
-import "github.com/ungerik/go-start/mgo"
-
 ///////////////////////////////////////////////////////////////////////////////
 // limitQuery
 
@@ -10,7 +8,7 @@ type limitQuery struct {
 	limit int
 }
 
-func (self *limitQuery) mongoQuery() (q *mgo.Query, err error) {
+func (self *limitQuery) mongoQuery() (q queryBackend, err error) {
 	q, err = self.parentQuery.mongoQuery()
 	if err != nil {
 		return nil, err
@@ -0,0 +1,1182 @@
+package mongo
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/mgo"
+	"github.com/ungerik/go-start/mgo/bson"
+)
+
+// memoryDatabase is set by InitMemory()
+var memoryDatabase *memoryDB
+
+///////////////////////////////////////////////////////////////////////////////
+// memoryDB
+
+type memoryDB struct {
+	mutex       sync.Mutex
+	collections map[string]*memoryCollection
+}
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{collections: map[string]*memoryCollection{}}
+}
+
+func (self *memoryDB) collection(name string) *memoryCollection {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	collection, ok := self.collections[name]
+	if !ok {
+		collection = &memoryCollection{}
+		self.collections[name] = collection
+	}
+	return collection
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// memoryCollection
+
+// memoryCollection stores documents as normalized bson.M in insertion order.
+// Stored documents are never modified, updates replace them with
+// modified copies, so query results can share them without locking.
+type memoryCollection struct {
+	mutex     sync.RWMutex
+	documents []bson.M
+
+	// changes holds the last memoryMaxChanges changes for subscriptions
+	changes   []memoryChange
+	changeSeq int64
+	// changed is closed and replaced at every change
+	// to wake up subscriptions
+	changed chan struct{}
+}
+
+// memoryMaxChanges is the number of changes that can be resumed
+const memoryMaxChanges = 10000
+
+type memoryChange struct {
+	seq        int64
+	changeType ChangeType
+	id         interface{}
+}
+
+// recordChange adds a change for subscriptions.
+// The caller has to hold the mutex.
+func (self *memoryCollection) recordChange(changeType ChangeType, id interface{}) {
+	self.changeSeq++
+	self.changes = append(self.changes, memoryChange{self.changeSeq, changeType, id})
+	if len(self.changes) > memoryMaxChanges {
+		self.changes = self.changes[len(self.changes)-memoryMaxChanges:]
+	}
+	if self.changed != nil {
+		close(self.changed)
+		self.changed = nil
+	}
+}
+
+func (self *memoryCollection) Find(query interface{}) queryBackend {
+	return memoryQuery{collection: self, query: query}
+}
+
+func (self *memoryCollection) Count() (n int, err error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	return len(self.documents), nil
+}
+
+// matchingIndices returns the indices of the documents matching selector.
+// If one is true, at most one index is returned.
+// The caller has to hold the mutex.
+func (self *memoryCollection) matchingIndices(selector interface{}, one bool) (indices []int, err error) {
+	query, err := memoryNormalize(selector)
+	if err != nil {
+		return nil, err
+	}
+	for i, document := range self.documents {
+		match, err := memoryMatch(document, query)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			indices = append(indices, i)
+			if one {
+				break
+			}
+		}
+	}
+	return indices, nil
+}
+
+// Insert inserts documents in order and stops at the first error
+// like MongoDB does. Documents without an _id get a new one.
+func (self *memoryCollection) Insert(documents ...interface{}) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, doc := range documents {
+		document, err := memoryNormalize(doc)
+		if err != nil {
+			return err
+		}
+		id, ok := document["_id"]
+		if !ok {
+			id = bson.NewObjectId()
+			document["_id"] = id
+		}
+		for _, existing := range self.documents {
+			if memoryCompare(existing["_id"], id) == 0 {
+				return &mgo.LastError{Code: 11000, Err: fmt.Sprintf("E11000 duplicate key error _id: %v", id)}
+			}
+		}
+		self.documents = append(self.documents, document)
+		self.recordChange(ChangeInsert, id)
+	}
+	return nil
+}
+
+func (self *memoryCollection) Upsert(selector interface{}, change interface{}) (id interface{}, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	indices, err := self.matchingIndices(selector, true)
+	if err != nil {
+		return nil, err
+	}
+	update, err := memoryNormalize(change)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(indices) > 0 {
+		query, err := memoryNormalize(selector)
+		if err != nil {
+			return nil, err
+		}
+		document, err := memoryApplyUpdate(self.documents[indices[0]], query, update)
+		if err != nil {
+			return nil, err
+		}
+		self.documents[indices[0]] = document
+		self.recordChange(ChangeUpdate, document["_id"])
+		return document["_id"], nil
+	}
+
+	// Like MongoDB, start the new document with the
+	// equality fields of the selector if change uses update operators
+	document := bson.M{}
+	if memoryIsOperatorDoc(update) {
+		query, err := memoryNormalize(selector)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range query {
+			if strings.HasPrefix(key, "$") {
+				continue
+			}
+			if ops, ok := value.(bson.M); ok && memoryIsOperatorDoc(ops) {
+				continue
+			}
+			if err = memorySetPath(document, key, value); err != nil {
+				return nil, err
+			}
+		}
+	} else if query, err := memoryNormalize(selector); err == nil {
+		if id, ok := query["_id"]; ok {
+			if _, isOp := id.(bson.M); !isOp {
+				document["_id"] = id
+			}
+		}
+	}
+	document, err = memoryApplyUpdate(document, nil, update)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := document["_id"]; !ok {
+		document["_id"] = bson.NewObjectId()
+	}
+	self.documents = append(self.documents, document)
+	self.recordChange(ChangeInsert, document["_id"])
+	return document["_id"], nil
+}
+
+func (self *memoryCollection) update(selector interface{}, change interface{}, one bool) (updated int, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	indices, err := self.matchingIndices(selector, one)
+	if err != nil {
+		return 0, err
+	}
+	if len(indices) == 0 {
+		return 0, nil
+	}
+	query, err := memoryNormalize(selector)
+	if err != nil {
+		return 0, err
+	}
+	update, err := memoryNormalize(change)
+	if err != nil {
+		return 0, err
+	}
+	for _, i := range indices {
+		document, err := memoryApplyUpdate(self.documents[i], query, update)
+		if err != nil {
+			return updated, err
+		}
+		self.documents[i] = document
+		self.recordChange(ChangeUpdate, document["_id"])
+		updated++
+	}
+	return updated, nil
+}
+
+func (self *memoryCollection) Update(selector interface{}, change interface{}) error {
+	updated, err := self.update(selector, change, true)
+	if err == nil && updated == 0 {
+		return mgo.NotFound
+	}
+	return err
+}
+
+func (self *memoryCollection) UpdateAll(selector interface{}, change interface{}) error {
+	updated, err := self.update(selector, change, false)
+	if err == nil && updated == 0 {
+		return mgo.NotFound
+	}
+	return err
+}
+
+func (self *memoryCollection) remove(selector interface{}, one bool) (removed int, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	indices, err := self.matchingIndices(selector, one)
+	if err != nil {
+		return 0, err
+	}
+	removed = len(indices)
+	if removed == 0 {
+		return 0, nil
+	}
+	documents := make([]bson.M, 0, len(self.documents)-len(indices))
+	for i, document := range self.documents {
+		if len(indices) > 0 && indices[0] == i {
+			indices = indices[1:]
+			self.recordChange(ChangeRemove, document["_id"])
+			continue
+		}
+		documents = append(documents, document)
+	}
+	self.documents = documents
+	return removed, nil
+}
+
+func (self *memoryCollection) Remove(selector interface{}) error {
+	_, err := self.remove(selector, true)
+	return err
+}
+
+func (self *memoryCollection) RemoveAll(selector interface{}) error {
+	_, err := self.remove(selector, false)
+	return err
+}
+
+func (self *memoryCollection) UpsertBatch(selectors, documents []bson.M, ordered bool) (itemErrors []error, err error) {
+	for i := range selectors {
+		if _, err := self.Upsert(selectors[i], documents[i]); err != nil {
+			if itemErrors == nil {
+				itemErrors = make([]error, len(selectors))
+			}
+			itemErrors[i] = err
+			if ordered {
+				break
+			}
+		}
+	}
+	return itemErrors, nil
+}
+
+func (self *memoryCollection) UpdateBatch(selector interface{}, change interface{}) (updated int, err error) {
+	return self.update(selector, change, false)
+}
+
+func (self *memoryCollection) RemoveBatch(selector interface{}) (removed int, err error) {
+	return self.remove(selector, false)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// memoryQuery
+
+type memoryQuery struct {
+	collection *memoryCollection
+	query      interface{}
+	skip       int
+	limit      int
+	sort       []string
+	selector   interface{}
+}
+
+func (self memoryQuery) Skip(n int) queryBackend {
+	self.skip = n
+	return self
+}
+
+func (self memoryQuery) Limit(n int) queryBackend {
+	self.limit = n
+	return self
+}
+
+func (self memoryQuery) Sort(fields ...string) queryBackend {
+	self.sort = fields
+	return self
+}
+
+func (self memoryQuery) Select(selector interface{}) queryBackend {
+	self.selector = selector
+	return self
+}
+
+// ReadPreference returns self, there are no replicas in memory.
+func (self memoryQuery) ReadPreference(pref ReadPreference) queryBackend {
+	return self
+}
+
+// matching returns all documents matching the query in sort order,
+// without applying skip and limit.
+func (self memoryQuery) matching() (documents []bson.M, err error) {
+	self.collection.mutex.RLock()
+	indices, err := self.collection.matchingIndices(self.query, false)
+	if err != nil {
+		self.collection.mutex.RUnlock()
+		return nil, err
+	}
+	documents = make([]bson.M, len(indices))
+	for i, index := range indices {
+		documents[i] = self.collection.documents[index]
+	}
+	self.collection.mutex.RUnlock()
+
+	if len(self.sort) > 0 {
+		sort.Stable(&memorySorter{documents, self.sort})
+	}
+	return documents, nil
+}
+
+func (self memoryQuery) results() (documents []bson.M, err error) {
+	documents, err = self.matching()
+	if err != nil {
+		return nil, err
+	}
+	if self.skip > 0 {
+		if self.skip >= len(documents) {
+			return nil, nil
+		}
+		documents = documents[self.skip:]
+	}
+	// Like mgo, a negative limit is a limit too
+	limit := self.limit
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < len(documents) {
+		documents = documents[:limit]
+	}
+	if self.selector != nil {
+		fields, err := memoryNormalize(self.selector)
+		if err != nil {
+			return nil, err
+		}
+		for i := range documents {
+			if documents[i], err = memoryProject(documents[i], fields); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return documents, nil
+}
+
+func (self memoryQuery) One(result interface{}) error {
+	documents, err := self.results()
+	if err != nil {
+		return err
+	}
+	if len(documents) == 0 {
+		return mgo.NotFound
+	}
+	return memoryDecode(documents[0], result)
+}
+
+func (self memoryQuery) Iter() iterBackend {
+	documents, err := self.results()
+	return &bsonIter{documents: documents, err: err}
+}
+
+func (self memoryQuery) Count() (n int, err error) {
+	documents, err := self.results()
+	return len(documents), err
+}
+
+func (self memoryQuery) Explain(result interface{}) error {
+	documents, err := self.results()
+	if err != nil {
+		return err
+	}
+	total, _ := self.collection.Count()
+	explain := bson.M{
+		"cursor":   "MemoryCursor",
+		"n":        len(documents),
+		"nscanned": total,
+		"millis":   0,
+	}
+	return memoryDecode(explain, result)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// memorySorter
+
+type memorySorter struct {
+	documents []bson.M
+	fields    []string
+}
+
+func (self *memorySorter) Len() int {
+	return len(self.documents)
+}
+
+func (self *memorySorter) Swap(i, j int) {
+	self.documents[i], self.documents[j] = self.documents[j], self.documents[i]
+}
+
+func (self *memorySorter) Less(i, j int) bool {
+	for _, field := range self.fields {
+		descending := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		a, _ := bsonPathValue(self.documents[i], field)
+		b, _ := bsonPathValue(self.documents[j], field)
+		c := memoryCompare(a, b)
+		if descending {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Conversion helpers
+
+// memoryNormalize converts value via BSON to a bson.M,
+// so that Getter, struct tags and model types are handled like by mgo.
+func memoryNormalize(value interface{}) (bson.M, error) {
+	if value == nil {
+		return bson.M{}, nil
+	}
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	m := bson.M{}
+	if err = bson.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func memoryDecode(document bson.M, result interface{}) error {
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
+
+// memoryCopy returns a deep copy of document.
+func memoryCopy(document bson.M) (bson.M, error) {
+	return memoryNormalize(document)
+}
+
+func memoryIsOperatorDoc(doc bson.M) bool {
+	if len(doc) == 0 {
+		return false
+	}
+	for key := range doc {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Paths in dot notation
+
+// memoryExpand returns values plus the elements of all arrays in values.
+func memoryExpand(values []interface{}) (expanded []interface{}) {
+	for _, value := range values {
+		if array, ok := value.([]interface{}); ok {
+			expanded = append(expanded, array...)
+		}
+		expanded = append(expanded, value)
+	}
+	return expanded
+}
+
+// memorySetPath sets value at path and creates missing sub-documents.
+func memorySetPath(document bson.M, path string, value interface{}) error {
+	parts := strings.Split(path, ".")
+	var container interface{} = document
+	for i, part := range parts {
+		last := i == len(parts)-1
+		switch c := container.(type) {
+		case bson.M:
+			if last {
+				c[part] = value
+				return nil
+			}
+			child, ok := c[part]
+			if !ok || child == nil {
+				child = bson.M{}
+				c[part] = child
+			}
+			container = child
+		case []interface{}:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(c) {
+				return errs.Format("mongo: Can't set '%s', invalid array index '%s'", path, part)
+			}
+			if last {
+				c[index] = value
+				return nil
+			}
+			if c[index] == nil {
+				c[index] = bson.M{}
+			}
+			container = c[index]
+		default:
+			return errs.Format("mongo: Can't set '%s', '%s' is not a document or array", path, part)
+		}
+	}
+	return nil
+}
+
+func memoryUnsetPath(document bson.M, path string) {
+	parts := strings.Split(path, ".")
+	parent, ok := interface{}(document), true
+	if len(parts) > 1 {
+		parent, ok = bsonPathValue(document, strings.Join(parts[:len(parts)-1], "."))
+		if !ok {
+			return
+		}
+	}
+	last := parts[len(parts)-1]
+	switch p := parent.(type) {
+	case bson.M:
+		delete(p, last)
+	case []interface{}:
+		// MongoDB sets unset array elements to null
+		if index, err := strconv.Atoi(last); err == nil && index >= 0 && index < len(p) {
+			p[index] = nil
+		}
+	}
+}
+
+// memoryProject applies a MongoDB field selection to document
+// and returns the result as new document.
+func memoryProject(document bson.M, fields bson.M) (bson.M, error) {
+	include := false
+	for key, value := range fields {
+		if key != "_id" && memoryTruthy(value) {
+			include = true
+			break
+		}
+	}
+	if !include {
+		result, err := memoryCopy(document)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range fields {
+			if !memoryTruthy(value) {
+				memoryUnsetPath(result, key)
+			}
+		}
+		return result, nil
+	}
+
+	result := bson.M{}
+	if value, ok := fields["_id"]; !ok || memoryTruthy(value) {
+		if id, ok := document["_id"]; ok {
+			result["_id"] = id
+		}
+	}
+	for key, value := range fields {
+		if key == "_id" || !memoryTruthy(value) {
+			continue
+		}
+		if v, ok := bsonPathValue(document, key); ok {
+			if err := memorySetPath(result, key, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return memoryCopy(result)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Value comparison
+
+func memoryTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	if f, ok := memoryNumber(value); ok {
+		return f != 0
+	}
+	return true
+}
+
+func memoryNumber(value interface{}) (f float64, ok bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// memoryTypeOrder returns the BSON sort order of the type of value.
+func memoryTypeOrder(value interface{}) int {
+	if _, ok := memoryNumber(value); ok {
+		return 1
+	}
+	switch value.(type) {
+	case nil:
+		return 0
+	case string, bson.Symbol:
+		return 2
+	case bson.M:
+		return 3
+	case []interface{}:
+		return 4
+	case bson.Binary, []byte:
+		return 5
+	case bson.ObjectId:
+		return 6
+	case bool:
+		return 7
+	case time.Time:
+		return 8
+	case bson.RegEx:
+		return 9
+	}
+	return 10
+}
+
+func memoryCompareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func memoryCompareStrings(a, b string) int {
+	return strings.Compare(a, b)
+}
+
+// memoryCompare returns -1, 0 or 1 like MongoDB compares a and b.
+func memoryCompare(a, b interface{}) int {
+	orderA, orderB := memoryTypeOrder(a), memoryTypeOrder(b)
+	if orderA != orderB {
+		return memoryCompareInts(orderA, orderB)
+	}
+	switch orderA {
+	case 0:
+		return 0
+	case 1:
+		fa, _ := memoryNumber(a)
+		fb, _ := memoryNumber(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case 2:
+		return memoryCompareStrings(fmt.Sprint(a), fmt.Sprint(b))
+	case 4:
+		arrayA, arrayB := a.([]interface{}), b.([]interface{})
+		for i := 0; i < len(arrayA) && i < len(arrayB); i++ {
+			if c := memoryCompare(arrayA[i], arrayB[i]); c != 0 {
+				return c
+			}
+		}
+		return memoryCompareInts(len(arrayA), len(arrayB))
+	case 6:
+		return memoryCompareStrings(string(a.(bson.ObjectId)), string(b.(bson.ObjectId)))
+	case 7:
+		boolA, boolB := a.(bool), b.(bool)
+		if boolA == boolB {
+			return 0
+		}
+		if boolB {
+			return -1
+		}
+		return 1
+	case 8:
+		timeA, timeB := a.(time.Time), b.(time.Time)
+		switch {
+		case timeA.Before(timeB):
+			return -1
+		case timeA.After(timeB):
+			return 1
+		}
+		return 0
+	}
+	// Documents and other types are only compared for equality
+	return memoryCompareStrings(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func memoryRegexp(regex bson.RegEx) (*regexp.Regexp, error) {
+	flags := ""
+	for _, option := range regex.Options {
+		if strings.ContainsRune("ims", option) {
+			flags += string(option)
+		}
+	}
+	if flags != "" {
+		return regexp.Compile("(?" + flags + ")" + regex.Pattern)
+	}
+	return regexp.Compile(regex.Pattern)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Query matching
+
+func memoryMatch(document bson.M, query bson.M) (bool, error) {
+	for key, condition := range query {
+		var match bool
+		var err error
+		switch key {
+		case "$or", "$and", "$nor":
+			conditions, ok := condition.([]interface{})
+			if !ok {
+				return false, errs.Format("mongo: %s needs an array", key)
+			}
+			match = key != "$or"
+			for _, c := range conditions {
+				subQuery, ok := c.(bson.M)
+				if !ok {
+					return false, errs.Format("mongo: %s needs an array of documents", key)
+				}
+				m, err := memoryMatch(document, subQuery)
+				if err != nil {
+					return false, err
+				}
+				if key == "$or" && m {
+					match = true
+					break
+				}
+				if key == "$and" && !m {
+					match = false
+					break
+				}
+				if key == "$nor" && m {
+					match = false
+					break
+				}
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, errs.Format("mongo: Query operator %s is not supported by the memory backend", key)
+			}
+			match, err = memoryMatchField(bsonPathValues(document, strings.Split(key, ".")), condition)
+			if err != nil {
+				return false, err
+			}
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func memoryMatchValue(values []interface{}, value interface{}) (bool, error) {
+	if len(values) == 0 {
+		return value == nil, nil
+	}
+	if regex, ok := value.(bson.RegEx); ok {
+		re, err := memoryRegexp(regex)
+		if err != nil {
+			return false, err
+		}
+		for _, v := range memoryExpand(values) {
+			if s, ok := v.(string); ok && re.MatchString(s) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	for _, v := range memoryExpand(values) {
+		if memoryCompare(v, value) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func memoryMatchAny(values []interface{}, list interface{}) (bool, error) {
+	array, ok := list.([]interface{})
+	if !ok {
+		return false, errs.Format("mongo: $in, $nin and $all need an array")
+	}
+	for _, value := range array {
+		match, err := memoryMatchValue(values, value)
+		if match || err != nil {
+			return match, err
+		}
+	}
+	return false, nil
+}
+
+func memoryMatchField(values []interface{}, condition interface{}) (bool, error) {
+	ops, ok := condition.(bson.M)
+	if !ok || !memoryIsOperatorDoc(ops) {
+		return memoryMatchValue(values, condition)
+	}
+	for op, arg := range ops {
+		match, err := memoryMatchOperator(values, op, arg)
+		if err != nil || !match {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func memoryMatchOperator(values []interface{}, op string, arg interface{}) (bool, error) {
+	switch op {
+	case "$in":
+		return memoryMatchAny(values, arg)
+
+	case "$nin":
+		match, err := memoryMatchAny(values, arg)
+		return !match, err
+
+	case "$ne":
+		match, err := memoryMatchValue(values, arg)
+		return !match, err
+
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range memoryExpand(values) {
+			if memoryTypeOrder(v) != memoryTypeOrder(arg) {
+				continue
+			}
+			c := memoryCompare(v, arg)
+			if op == "$gt" && c > 0 || op == "$gte" && c >= 0 || op == "$lt" && c < 0 || op == "$lte" && c <= 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "$exists":
+		return (len(values) > 0) == memoryTruthy(arg), nil
+
+	case "$all":
+		array, ok := arg.([]interface{})
+		if !ok {
+			return false, errs.Format("mongo: $all needs an array")
+		}
+		for _, value := range array {
+			match, err := memoryMatchValue(values, value)
+			if err != nil || !match {
+				return false, err
+			}
+		}
+		return len(array) > 0, nil
+
+	case "$size":
+		size, ok := memoryNumber(arg)
+		if !ok {
+			return false, errs.Format("mongo: $size needs a number")
+		}
+		for _, v := range values {
+			if array, ok := v.([]interface{}); ok && len(array) == int(size) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "$mod":
+		array, ok := arg.([]interface{})
+		if !ok || len(array) != 2 {
+			return false, errs.Format("mongo: $mod needs an array with divisor and remainder")
+		}
+		divisor, ok1 := memoryNumber(array[0])
+		remainder, ok2 := memoryNumber(array[1])
+		if !ok1 || !ok2 || divisor == 0 {
+			return false, errs.Format("mongo: Invalid $mod arguments %v", array)
+		}
+		for _, v := range memoryExpand(values) {
+			if f, ok := memoryNumber(v); ok && int64(f)%int64(divisor) == int64(remainder) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "$not":
+		match, err := memoryMatchField(values, arg)
+		return !match, err
+	}
+	return false, errs.Format("mongo: Query operator %s is not supported by the memory backend", op)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Updates
+
+// memoryApplyUpdate returns a copy of document modified by update.
+// update is either a replacement document or uses update operators.
+// The positional operator "$" in paths of update refers to the
+// first array element that matches query, see memoryPositionalPath().
+func memoryApplyUpdate(document bson.M, query bson.M, update bson.M) (bson.M, error) {
+	if !memoryIsOperatorDoc(update) {
+		result, err := memoryCopy(update)
+		if err != nil {
+			return nil, err
+		}
+		if id, ok := document["_id"]; ok {
+			result["_id"] = id
+		}
+		return result, nil
+	}
+
+	result, err := memoryCopy(document)
+	if err != nil {
+		return nil, err
+	}
+	for op, arg := range update {
+		fields, ok := arg.(bson.M)
+		if !ok {
+			return nil, errs.Format("mongo: %s needs a document", op)
+		}
+		for path, value := range fields {
+			if path, err = memoryPositionalPath(document, query, path); err != nil {
+				return nil, err
+			}
+			if err = memoryApplyOperator(result, op, path, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// memoryPositionalPath replaces the positional operator "$" in path
+// with the index of the first array element that matches the
+// conditions of query for that array, like MongoDB does.
+func memoryPositionalPath(document bson.M, query bson.M, path string) (string, error) {
+	parts := strings.Split(path, ".")
+	position := -1
+	for i, part := range parts {
+		if part == "$" && i > 0 {
+			position = i
+			break
+		}
+	}
+	if position == -1 {
+		return path, nil
+	}
+	arrayPath := strings.Join(parts[:position], ".")
+	value, _ := bsonPathValue(document, arrayPath)
+	array, ok := value.([]interface{})
+	if !ok {
+		return "", errs.Format("mongo: Can't apply the positional operator to non array field '%s'", arrayPath)
+	}
+	for index, element := range array {
+		matched := false
+		for key, condition := range query {
+			var elementPath []string
+			switch {
+			case key == arrayPath:
+			case strings.HasPrefix(key, arrayPath+"."):
+				elementPath = strings.Split(key[len(arrayPath)+1:], ".")
+			default:
+				continue
+			}
+			match, err := memoryMatchField(bsonPathValues(element, elementPath), condition)
+			if err != nil {
+				return "", err
+			}
+			if !match {
+				matched = false
+				break
+			}
+			matched = true
+		}
+		if matched {
+			parts[position] = strconv.Itoa(index)
+			return strings.Join(parts, "."), nil
+		}
+	}
+	return "", errs.Format("mongo: The positional operator did not find the match needed from the query for '%s'", path)
+}
+
+func memoryArray(document bson.M, op, path string) ([]interface{}, error) {
+	value, ok := bsonPathValue(document, path)
+	if !ok || value == nil {
+		return nil, nil
+	}
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil, errs.Format("mongo: Can't apply %s to non array field '%s'", op, path)
+	}
+	return array, nil
+}
+
+func memoryContains(array []interface{}, value interface{}) bool {
+	for _, element := range array {
+		if memoryCompare(element, value) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func memoryEach(value interface{}) []interface{} {
+	if m, ok := value.(bson.M); ok {
+		if each, ok := m["$each"].([]interface{}); ok && len(m) == 1 {
+			return each
+		}
+	}
+	return []interface{}{value}
+}
+
+func memoryApplyOperator(document bson.M, op, path string, value interface{}) error {
+	switch op {
+	case "$set":
+		return memorySetPath(document, path, value)
+
+	case "$unset":
+		memoryUnsetPath(document, path)
+		return nil
+
+	case "$inc":
+		increment, ok := memoryNumber(value)
+		if !ok {
+			return errs.Format("mongo: $inc needs a number for '%s'", path)
+		}
+		current, exists := bsonPathValue(document, path)
+		if !exists {
+			return memorySetPath(document, path, value)
+		}
+		f, ok := memoryNumber(current)
+		if !ok {
+			return errs.Format("mongo: Can't apply $inc to non number field '%s'", path)
+		}
+		var sum interface{}
+		_, currentFloat := current.(float64)
+		_, valueFloat := value.(float64)
+		switch {
+		case currentFloat || valueFloat:
+			sum = f + increment
+		case f+increment > math.MaxInt32 || f+increment < math.MinInt32:
+			sum = int64(f) + int64(increment)
+		default:
+			sum = int(f) + int(increment)
+		}
+		return memorySetPath(document, path, sum)
+
+	case "$min", "$max":
+		current, exists := bsonPathValue(document, path)
+		c := memoryCompare(value, current)
+		if !exists || op == "$min" && c < 0 || op == "$max" && c > 0 {
+			return memorySetPath(document, path, value)
+		}
+		return nil
+
+	case "$push", "$pushAll", "$addToSet":
+		array, err := memoryArray(document, op, path)
+		if err != nil {
+			return err
+		}
+		var values []interface{}
+		if op == "$pushAll" {
+			if values, _ = value.([]interface{}); values == nil {
+				return errs.Format("mongo: $pushAll needs an array for '%s'", path)
+			}
+		} else {
+			values = memoryEach(value)
+		}
+		for _, v := range values {
+			if op != "$addToSet" || !memoryContains(array, v) {
+				array = append(array, v)
+			}
+		}
+		return memorySetPath(document, path, array)
+
+	case "$pull", "$pullAll":
+		array, err := memoryArray(document, op, path)
+		if err != nil || array == nil {
+			return err
+		}
+		var result []interface{}
+		for _, element := range array {
+			var remove bool
+			if op == "$pullAll" {
+				values, _ := value.([]interface{})
+				remove = memoryContains(values, element)
+			} else if condition, ok := value.(bson.M); ok && !memoryIsOperatorDoc(condition) {
+				if doc, ok := element.(bson.M); ok {
+					if remove, err = memoryMatch(doc, condition); err != nil {
+						return err
+					}
+				}
+			} else if remove, err = memoryMatchField([]interface{}{element}, value); err != nil {
+				return err
+			}
+			if !remove {
+				result = append(result, element)
+			}
+		}
+		if result == nil {
+			result = []interface{}{}
+		}
+		return memorySetPath(document, path, result)
+
+	case "$pop":
+		array, err := memoryArray(document, op, path)
+		if err != nil || len(array) == 0 {
+			return err
+		}
+		if f, _ := memoryNumber(value); f < 0 {
+			array = array[1:]
+		} else {
+			array = array[:len(array)-1]
+		}
+		return memorySetPath(document, path, array)
+	}
+	return errs.Format("mongo: Update operator %s is not supported by the memory backend", op)
+}
@@ -0,0 +1,457 @@
+package mongo
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ungerik/go-start/mgo"
+	"github.com/ungerik/go-start/mgo/bson"
+)
+
+// The expected results follow the semantics of MongoDB and mgo,
+// so that tests with InitMemory() behave like tests with a database.
+
+func newTestMemoryCollection(t *testing.T, documents ...bson.M) *memoryCollection {
+	collection := newMemoryDB().collection("test")
+	for _, document := range documents {
+		if err := collection.Insert(document); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return collection
+}
+
+func memoryTestIDs(t *testing.T, query queryBackend) (ids []int) {
+	iter := query.Iter()
+	var document bson.M
+	for iter.Next(&document) {
+		ids = append(ids, document["_id"].(int))
+		document = nil
+	}
+	if iter.Err() != nil {
+		t.Fatal(iter.Err())
+	}
+	return ids
+}
+
+var memoryTestDocuments = []bson.M{
+	{"_id": 1, "name": "Alice", "age": 30, "tags": []interface{}{"a", "b"}, "address": bson.M{"city": "Vienna"}},
+	{"_id": 2, "name": "Bob", "age": 25, "tags": []interface{}{"b"}, "address": bson.M{"city": "Berlin"}},
+	{"_id": 3, "name": "carol", "age": 35.5, "tags": []interface{}{}, "items": []interface{}{bson.M{"sku": "x", "qty": 2}, bson.M{"sku": "y", "qty": 5}}},
+	{"_id": 4, "name": "Dave", "age": "unknown"},
+	{"_id": 5, "name": "Eve", "age": nil},
+}
+
+func TestMemoryFind(t *testing.T) {
+	collection := newTestMemoryCollection(t, memoryTestDocuments...)
+
+	tests := []struct {
+		name  string
+		query bson.M
+		ids   []int
+	}{
+		{"all", nil, []int{1, 2, 3, 4, 5}},
+		{"equal", bson.M{"name": "Bob"}, []int{2}},
+		{"equal is case sensitive", bson.M{"name": "Carol"}, nil},
+		{"dotted path", bson.M{"address.city": "Vienna"}, []int{1}},
+		{"array element", bson.M{"tags": "b"}, []int{1, 2}},
+		{"whole array", bson.M{"tags": []interface{}{"b"}}, []int{2}},
+		{"path into array of documents", bson.M{"items.sku": "y"}, []int{3}},
+		{"null matches missing and null", bson.M{"address": nil}, []int{3, 4, 5}},
+		{"$ne matches missing", bson.M{"address.city": bson.M{"$ne": "Vienna"}}, []int{2, 3, 4, 5}},
+		{"$in", bson.M{"name": bson.M{"$in": []interface{}{"Alice", "Eve", "Zoe"}}}, []int{1, 5}},
+		{"$in with array field", bson.M{"tags": bson.M{"$in": []interface{}{"a"}}}, []int{1}},
+		{"$nin", bson.M{"tags": bson.M{"$nin": []interface{}{"b"}}}, []int{3, 4, 5}},
+		{"$gt only compares same type", bson.M{"age": bson.M{"$gt": 26}}, []int{1, 3}},
+		{"$gte and $lt", bson.M{"age": bson.M{"$gte": 25, "$lt": 31}}, []int{1, 2}},
+		{"$lte string", bson.M{"age": bson.M{"$lte": "z"}}, []int{4}},
+		{"$gt in array of documents", bson.M{"items.qty": bson.M{"$gt": 4}}, []int{3}},
+		{"$exists true", bson.M{"items": bson.M{"$exists": true}}, []int{3}},
+		{"$exists false", bson.M{"address": bson.M{"$exists": false}}, []int{3, 4, 5}},
+		{"$exists with null value", bson.M{"age": bson.M{"$exists": true}}, []int{1, 2, 3, 4, 5}},
+		{"$all", bson.M{"tags": bson.M{"$all": []interface{}{"a", "b"}}}, []int{1}},
+		{"$size", bson.M{"tags": bson.M{"$size": 1}}, []int{2}},
+		{"$size 0", bson.M{"tags": bson.M{"$size": 0}}, []int{3}},
+		{"$mod", bson.M{"age": bson.M{"$mod": []interface{}{10, 5}}}, []int{2, 3}},
+		{"$not", bson.M{"age": bson.M{"$not": bson.M{"$gt": 26}}}, []int{2, 4, 5}},
+		{"regex", bson.M{"name": bson.RegEx{Pattern: "^[a-c]", Options: "i"}}, []int{1, 2, 3}},
+		{"regex without options", bson.M{"name": bson.RegEx{Pattern: "^[a-c]"}}, []int{3}},
+		{"$or", bson.M{"$or": []interface{}{bson.M{"name": "Bob"}, bson.M{"age": "unknown"}}}, []int{2, 4}},
+		{"$and", bson.M{"$and": []interface{}{bson.M{"tags": "b"}, bson.M{"age": bson.M{"$lt": 30}}}}, []int{2}},
+		{"$nor", bson.M{"$nor": []interface{}{bson.M{"tags": "b"}, bson.M{"age": nil}}}, []int{3, 4}},
+		{"multiple fields", bson.M{"tags": "b", "name": "Alice"}, []int{1}},
+		{"_id", bson.M{"_id": 3}, []int{3}},
+		{"no match", bson.M{"name": "Zoe"}, nil},
+	}
+	for _, test := range tests {
+		ids := memoryTestIDs(t, collection.Find(test.query))
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s: %v returned %v instead of %v", test.name, test.query, ids, test.ids)
+		}
+	}
+
+	if _, err := collection.Find(bson.M{"$where": "true"}).Count(); err == nil {
+		t.Error("Unsupported query operator must return an error")
+	}
+}
+
+func TestMemorySortSkipLimit(t *testing.T) {
+	collection := newTestMemoryCollection(t, memoryTestDocuments...)
+	collection.Insert(bson.M{"_id": 6, "name": "Alice", "age": 20})
+
+	tests := []struct {
+		name  string
+		sort  []string
+		skip  int
+		limit int
+		ids   []int
+	}{
+		{"insertion order", nil, 0, 0, []int{1, 2, 3, 4, 5, 6}},
+		// null < numbers < strings, strings are compared by bytes
+		{"ascending by type order", []string{"age"}, 0, 0, []int{5, 6, 2, 1, 3, 4}},
+		{"descending", []string{"-age"}, 0, 0, []int{4, 3, 1, 2, 6, 5}},
+		{"bytewise strings", []string{"name"}, 0, 0, []int{1, 6, 2, 4, 5, 3}},
+		{"multiple fields", []string{"name", "-age"}, 0, 0, []int{1, 6, 2, 4, 5, 3}},
+		{"multiple fields ascending", []string{"name", "age"}, 0, 0, []int{6, 1, 2, 4, 5, 3}},
+		{"missing field sorts like null", []string{"address.city", "_id"}, 0, 0, []int{3, 4, 5, 6, 2, 1}},
+		{"skip", []string{"_id"}, 2, 0, []int{3, 4, 5, 6}},
+		{"limit", []string{"_id"}, 0, 2, []int{1, 2}},
+		{"negative limit", []string{"_id"}, 0, -2, []int{1, 2}},
+		{"skip and limit", []string{"-_id"}, 1, 2, []int{5, 4}},
+		{"skip beyond end", []string{"_id"}, 10, 0, nil},
+		{"limit beyond end", []string{"_id"}, 4, 10, []int{5, 6}},
+	}
+	for _, test := range tests {
+		query := collection.Find(nil).Sort(test.sort...).Skip(test.skip).Limit(test.limit)
+		ids := memoryTestIDs(t, query)
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s: returned %v instead of %v", test.name, ids, test.ids)
+		}
+		if count, err := query.Count(); err != nil || count != len(test.ids) {
+			t.Errorf("%s: Count() returned %d, %v instead of %d", test.name, count, err, len(test.ids))
+		}
+	}
+}
+
+func TestMemorySelect(t *testing.T) {
+	collection := newTestMemoryCollection(t, memoryTestDocuments...)
+
+	tests := []struct {
+		fields   bson.M
+		expected bson.M
+	}{
+		{bson.M{"name": 1}, bson.M{"_id": 1, "name": "Alice"}},
+		{bson.M{"name": 1, "_id": 0}, bson.M{"name": "Alice"}},
+		{bson.M{"address.city": 1}, bson.M{"_id": 1, "address": bson.M{"city": "Vienna"}}},
+		{bson.M{"tags": 0, "address": 0, "age": 0}, bson.M{"_id": 1, "name": "Alice"}},
+	}
+	for _, test := range tests {
+		var result bson.M
+		if err := collection.Find(bson.M{"_id": 1}).Select(test.fields).One(&result); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("Select(%v) returned %v instead of %v", test.fields, result, test.expected)
+		}
+	}
+}
+
+func TestMemoryUpdateOperators(t *testing.T) {
+	document := bson.M{
+		"_id":    1,
+		"n":      1,
+		"f":      1.5,
+		"s":      "text",
+		"tags":   []interface{}{"a", "b", "a"},
+		"nested": bson.M{"x": 1},
+		"items":  []interface{}{bson.M{"sku": "x", "qty": 2}, bson.M{"sku": "y", "qty": 5}},
+	}
+
+	tests := []struct {
+		name     string
+		update   bson.M
+		expected bson.M // only the changed fields
+		unset    []string
+	}{
+		{"$set", bson.M{"$set": bson.M{"s": "new"}}, bson.M{"s": "new"}, nil},
+		{"$set creates nested documents", bson.M{"$set": bson.M{"a.b.c": 1}}, bson.M{"a": bson.M{"b": bson.M{"c": 1}}}, nil},
+		{"$set nested field", bson.M{"$set": bson.M{"nested.y": 2}}, bson.M{"nested": bson.M{"x": 1, "y": 2}}, nil},
+		{"$unset", bson.M{"$unset": bson.M{"s": 1, "missing": 1}}, nil, []string{"s"}},
+		{"$unset nested", bson.M{"$unset": bson.M{"nested.x": 1}}, bson.M{"nested": bson.M{}}, nil},
+		{"$inc int", bson.M{"$inc": bson.M{"n": 2}}, bson.M{"n": 3}, nil},
+		{"$inc negative", bson.M{"$inc": bson.M{"n": -3}}, bson.M{"n": -2}, nil},
+		{"$inc float", bson.M{"$inc": bson.M{"f": 1}}, bson.M{"f": 2.5}, nil},
+		{"$inc int by float", bson.M{"$inc": bson.M{"n": 0.5}}, bson.M{"n": 1.5}, nil},
+		{"$inc missing field", bson.M{"$inc": bson.M{"count": 1}}, bson.M{"count": 1}, nil},
+		{"$inc overflow to int64", bson.M{"$inc": bson.M{"n": int64(1 << 31)}}, bson.M{"n": int64(1<<31 + 1)}, nil},
+		{"$min lower", bson.M{"$min": bson.M{"n": 0}}, bson.M{"n": 0}, nil},
+		{"$min higher", bson.M{"$min": bson.M{"n": 5}}, nil, nil},
+		{"$max higher", bson.M{"$max": bson.M{"n": 5}}, bson.M{"n": 5}, nil},
+		{"$max missing field", bson.M{"$max": bson.M{"m": 5}}, bson.M{"m": 5}, nil},
+		{"$push", bson.M{"$push": bson.M{"tags": "c"}}, bson.M{"tags": []interface{}{"a", "b", "a", "c"}}, nil},
+		{"$push array as one element", bson.M{"$push": bson.M{"tags": []interface{}{"c", "d"}}}, bson.M{"tags": []interface{}{"a", "b", "a", []interface{}{"c", "d"}}}, nil},
+		{"$push $each", bson.M{"$push": bson.M{"tags": bson.M{"$each": []interface{}{"c", "a"}}}}, bson.M{"tags": []interface{}{"a", "b", "a", "c", "a"}}, nil},
+		{"$push missing field", bson.M{"$push": bson.M{"list": 1}}, bson.M{"list": []interface{}{1}}, nil},
+		{"$pushAll", bson.M{"$pushAll": bson.M{"tags": []interface{}{"c", "d"}}}, bson.M{"tags": []interface{}{"a", "b", "a", "c", "d"}}, nil},
+		{"$addToSet", bson.M{"$addToSet": bson.M{"tags": "a"}}, nil, nil},
+		{"$addToSet $each", bson.M{"$addToSet": bson.M{"tags": bson.M{"$each": []interface{}{"a", "c", "c"}}}}, bson.M{"tags": []interface{}{"a", "b", "a", "c"}}, nil},
+		{"$pull", bson.M{"$pull": bson.M{"tags": "a"}}, bson.M{"tags": []interface{}{"b"}}, nil},
+		{"$pull condition", bson.M{"$pull": bson.M{"items": bson.M{"qty": bson.M{"$gt": 3}}}}, bson.M{"items": []interface{}{bson.M{"sku": "x", "qty": 2}}}, nil},
+		{"$pullAll", bson.M{"$pullAll": bson.M{"tags": []interface{}{"a", "b"}}}, bson.M{"tags": []interface{}{}}, nil},
+		{"multiple operators", bson.M{"$set": bson.M{"s": "x"}, "$inc": bson.M{"n": 1}}, bson.M{"s": "x", "n": 2}, nil},
+		{"replacement keeps _id", bson.M{"only": true}, nil, nil},
+	}
+	for _, test := range tests {
+		collection := newTestMemoryCollection(t, document)
+		if err := collection.Update(bson.M{"_id": 1}, test.update); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		var result bson.M
+		if err := collection.Find(bson.M{"_id": 1}).One(&result); err != nil {
+			t.Fatal(err)
+		}
+
+		var expected bson.M
+		if test.name == "replacement keeps _id" {
+			expected = bson.M{"_id": 1, "only": true}
+		} else {
+			expected, _ = memoryCopy(document)
+			for key, value := range test.expected {
+				expected[key] = value
+			}
+			for _, key := range test.unset {
+				delete(expected, key)
+			}
+		}
+		expected, _ = memoryNormalize(expected)
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("%s: result is\n%v instead of\n%v", test.name, result, expected)
+		}
+	}
+
+	errorTests := []struct {
+		name   string
+		update bson.M
+	}{
+		{"$inc string field", bson.M{"$inc": bson.M{"s": 1}}},
+		{"$inc with string", bson.M{"$inc": bson.M{"n": "1"}}},
+		{"$push to non array", bson.M{"$push": bson.M{"s": 1}}},
+		{"$pull from non array", bson.M{"$pull": bson.M{"n": 1}}},
+	}
+	for _, test := range errorTests {
+		collection := newTestMemoryCollection(t, document)
+		if err := collection.Update(bson.M{"_id": 1}, test.update); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestMemoryPositionalUpdate(t *testing.T) {
+	document := bson.M{
+		"_id":   1,
+		"tags":  []interface{}{"a", "b"},
+		"items": []interface{}{bson.M{"sku": "x", "qty": 2}, bson.M{"sku": "y", "qty": 5}, bson.M{"sku": "y", "qty": 7}},
+	}
+
+	tests := []struct {
+		name     string
+		selector bson.M
+		update   bson.M
+		expected bson.M // only the changed fields
+	}{
+		{"first matching document", bson.M{"items.sku": "y"}, bson.M{"$set": bson.M{"items.$.qty": 1}}, bson.M{"items": []interface{}{bson.M{"sku": "x", "qty": 2}, bson.M{"sku": "y", "qty": 1}, bson.M{"sku": "y", "qty": 7}}}},
+		{"element value", bson.M{"_id": 1, "tags": "b"}, bson.M{"$set": bson.M{"tags.$": "c"}}, bson.M{"tags": []interface{}{"a", "c"}}},
+	}
+	for _, test := range tests {
+		collection := newTestMemoryCollection(t, document)
+		if err := collection.Update(test.selector, test.update); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		var result bson.M
+		if err := collection.Find(bson.M{"_id": 1}).One(&result); err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := memoryCopy(document)
+		for key, value := range test.expected {
+			expected[key] = value
+		}
+		expected, _ = memoryNormalize(expected)
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("%s: result is\n%v instead of\n%v", test.name, result, expected)
+		}
+	}
+
+	// The query has no condition for the array
+	collection := newTestMemoryCollection(t, document)
+	if err := collection.Update(bson.M{"_id": 1}, bson.M{"$set": bson.M{"items.$.qty": 1}}); err == nil {
+		t.Error("no error for a positional update without array condition")
+	}
+}
+
+func TestMemoryUpdateBuilder(t *testing.T) {
+	collection := newTestMemoryCollection(t, bson.M{"_id": 1, "tags": []interface{}{"a"}})
+	if err := collection.Update(bson.M{"_id": 1}, NewUpdate().Push("Tags", "b", "c").Bson()); err != nil {
+		t.Fatal(err)
+	}
+	var result bson.M
+	collection.Find(bson.M{"_id": 1}).One(&result)
+	if expected := []interface{}{"a", "b", "c"}; !reflect.DeepEqual(result["tags"], expected) {
+		t.Errorf("Push() result is %v instead of %v", result["tags"], expected)
+	}
+}
+
+func TestMemoryUpdateAll(t *testing.T) {
+	collection := newTestMemoryCollection(t, memoryTestDocuments...)
+
+	if err := collection.Update(bson.M{"tags": "b"}, bson.M{"$set": bson.M{"flag": true}}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := memoryTestIDs(t, collection.Find(bson.M{"flag": true})); !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("Update() changed %v instead of only the first match", ids)
+	}
+
+	if err := collection.UpdateAll(bson.M{"tags": "b"}, bson.M{"$set": bson.M{"flag": true}}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := memoryTestIDs(t, collection.Find(bson.M{"flag": true})); !reflect.DeepEqual(ids, []int{1, 2}) {
+		t.Errorf("UpdateAll() changed %v instead of [1 2]", ids)
+	}
+
+	if err := collection.Update(bson.M{"name": "Zoe"}, bson.M{"$set": bson.M{"flag": true}}); err != mgo.NotFound {
+		t.Errorf("Update() without match returned %v instead of mgo.NotFound", err)
+	}
+	if err := collection.UpdateAll(bson.M{"name": "Zoe"}, bson.M{"$set": bson.M{"flag": true}}); err != mgo.NotFound {
+		t.Errorf("UpdateAll() without match returned %v instead of mgo.NotFound", err)
+	}
+}
+
+func TestMemoryUpsert(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector bson.M
+		change   bson.M
+		expected bson.M // nil if the _id is generated
+		inserted bool
+	}{
+		{
+			"update existing",
+			bson.M{"name": "Bob"},
+			bson.M{"$inc": bson.M{"age": 1}},
+			bson.M{"_id": 2, "name": "Bob", "age": 26, "tags": []interface{}{"b"}, "address": bson.M{"city": "Berlin"}},
+			false,
+		},
+		{
+			"insert with equality fields of selector",
+			bson.M{"_id": 10, "name": "Zoe", "age": bson.M{"$gt": 18}, "address.city": "Rome"},
+			bson.M{"$set": bson.M{"score": 1}},
+			bson.M{"_id": 10, "name": "Zoe", "score": 1, "address": bson.M{"city": "Rome"}},
+			true,
+		},
+		{
+			"insert replacement with _id of selector",
+			bson.M{"_id": 11, "name": "Zoe"},
+			bson.M{"score": 2},
+			bson.M{"_id": 11, "score": 2},
+			true,
+		},
+		{
+			"insert replacement without _id",
+			bson.M{"name": "Zoe"},
+			bson.M{"score": 3},
+			nil,
+			true,
+		},
+	}
+	for _, test := range tests {
+		collection := newTestMemoryCollection(t, memoryTestDocuments...)
+		id, err := collection.Upsert(test.selector, test.change)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		count, _ := collection.Count()
+		if inserted := count > len(memoryTestDocuments); inserted != test.inserted {
+			t.Errorf("%s: inserted is %v", test.name, inserted)
+		}
+		var result bson.M
+		if err = collection.Find(bson.M{"_id": id}).One(&result); err != nil {
+			t.Errorf("%s: can't find upserted document with returned id %v: %s", test.name, id, err)
+			continue
+		}
+		expected := test.expected
+		if expected == nil {
+			if _, ok := id.(bson.ObjectId); !ok {
+				t.Errorf("%s: generated _id %v is not a bson.ObjectId", test.name, id)
+			}
+			expected = bson.M{"_id": id, "score": 3}
+		}
+		expected, _ = memoryNormalize(expected)
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("%s: result is\n%v instead of\n%v", test.name, result, expected)
+		}
+	}
+}
+
+func TestMemoryRemove(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector bson.M
+		all      bool
+		ids      []int
+	}{
+		{"remove first match", bson.M{"tags": "b"}, false, []int{2, 3, 4, 5}},
+		{"remove all matches", bson.M{"tags": "b"}, true, []int{3, 4, 5}},
+		{"remove by _id", bson.M{"_id": 4}, false, []int{1, 2, 3, 5}},
+		{"remove without match", bson.M{"name": "Zoe"}, true, []int{1, 2, 3, 4, 5}},
+		{"remove all", nil, true, nil},
+	}
+	for _, test := range tests {
+		collection := newTestMemoryCollection(t, memoryTestDocuments...)
+		var err error
+		if test.all {
+			err = collection.RemoveAll(test.selector)
+		} else {
+			err = collection.Remove(test.selector)
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if ids := memoryTestIDs(t, collection.Find(nil)); !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s: remaining documents are %v instead of %v", test.name, ids, test.ids)
+		}
+	}
+}
+
+func TestMemoryInsert(t *testing.T) {
+	collection := newTestMemoryCollection(t, bson.M{"_id": 1})
+	if err := collection.Insert(bson.M{"_id": 2}, bson.M{"_id": 1}, bson.M{"_id": 3}); err == nil {
+		t.Error("Insert() of a duplicate _id must return an error")
+	}
+	// Like MongoDB, documents before the error are inserted
+	if ids := memoryTestIDs(t, collection.Find(nil)); !reflect.DeepEqual(ids, []int{1, 2}) {
+		t.Errorf("Documents are %v instead of [1 2]", ids)
+	}
+
+	if err := collection.Insert(bson.M{"name": "generated"}); err != nil {
+		t.Fatal(err)
+	}
+	var result bson.M
+	if err := collection.Find(bson.M{"name": "generated"}).One(&result); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := result["_id"].(bson.ObjectId); !ok {
+		t.Errorf("Generated _id is %#v instead of a bson.ObjectId", result["_id"])
+	}
+
+	// Stored documents must not change with the inserted value
+	document := bson.M{"_id": 10, "tags": []interface{}{"a"}}
+	collection.Insert(document)
+	document["tags"].([]interface{})[0] = "changed"
+	collection.Find(bson.M{"_id": 10}).One(&result)
+	if result["tags"].([]interface{})[0] != "a" {
+		t.Error("Stored document shares memory with the inserted document")
+	}
+}
@@ -1,44 +1,103 @@
 package mongo
 
 import (
-	"github.com/ungerik/go-start/model"
+	"time"
+
 	"github.com/ungerik/go-start/mgo"
+	"github.com/ungerik/go-start/model"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
 // MongoIterator
 
 func newIterator(query Query) model.Iterator {
-	mgoQuery, err := query.mongoQuery()
+	start := time.Now()
+	q, err := query.mongoQuery()
+	if err != nil {
+		return model.NewErrorOnlyIterator(err)
+	}
+	projection, err := queryProjection(query)
 	if err != nil {
 		return model.NewErrorOnlyIterator(err)
 	}
-	mgoIter := mgoQuery.Iter()
 	collection, selectors := collectionAndSubDocumentSelectors(query)
-	return &MongoIterator{collection: collection, selectors: selectors, iter: mgoIter}
+	i := &MongoIterator{query: query, collection: collection, selectors: selectors, projection: projection, iter: q.Iter()}
+	i.duration = time.Since(start)
+	// The trace of the goroutine that created the iterator,
+	// the iteration can happen in another goroutine
+	if i.queryTrace = currentQueryTrace(); i.queryTrace != nil {
+		i.queryTrace.addIterator(i)
+	}
+	if preloads := preloadSelectors(query); len(preloads) > 0 {
+		return preloadIterator(i, preloads)
+	}
+	return i
 }
 
 type MongoIterator struct {
+	query      Query
 	collection *Collection
 	selectors  []string
-	iter       *mgo.Iter
+	projection *fieldProjection
+	iter       iterBackend
+	err        error
+	// duration of the query without the time between Next() calls
+	duration   time.Duration
+	traced     bool
+	queryTrace *QueryTrace
 }
 
 func (self *MongoIterator) Next() interface{} {
+	if self.err != nil {
+		return nil
+	}
 	if self.iter.Err() != nil {
 		return self.iter.Err()
 	}
-	document := self.collection.NewDocument(self.selectors...)
-	if ok := self.iter.Next(document); !ok {
+	start := time.Now()
+	document, err := self.collection.loadDocument(self.next, self.selectors, self.projection)
+	self.duration += time.Since(start)
+	if err != nil {
+		if err != mgo.NotFound {
+			self.err = err
+		}
+		self.trace()
 		return nil
 	}
-	// document has to be initialized again,
-	// because mgo zeros the struct while unmarshalling.
-	// Newly created slice elements need to be initialized too
-	self.collection.InitDocument(document)
 	return document
 }
 
+// Close records the query for QueryMetrics() and QueryTrace
+// if the iteration is stopped before the last document.
+// Iterators of a QueryTrace are closed by QueryTrace.Stop().
+func (self *MongoIterator) Close() {
+	self.trace()
+}
+
+// trace records the query after the last document
+// has been iterated, an error occurred or Close() was called.
+func (self *MongoIterator) trace() {
+	if self.traced || self.query == nil {
+		return
+	}
+	self.traced = true
+	if self.queryTrace != nil {
+		self.queryTrace.removeIterator(self)
+	}
+	traceQueryTo(self.queryTrace, self.query, "Iterator", self.duration, self.Err())
+}
+
+// next has the semantics of mgo.Query.One() for loadDocument()
+func (self *MongoIterator) next(result interface{}) error {
+	if !self.iter.Next(result) {
+		return mgo.NotFound
+	}
+	return nil
+}
+
 func (self *MongoIterator) Err() error {
+	if self.err != nil {
+		return self.err
+	}
 	return self.iter.Err()
 }
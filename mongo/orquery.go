@@ -1,9 +1,6 @@
 package mongo
 
-import (
-	"github.com/ungerik/go-start/errs"
-	"github.com/ungerik/go-start/mgo"
-)
+import "github.com/ungerik/go-start/errs"
 
 ///////////////////////////////////////////////////////////////////////////////
 // orQuery
@@ -12,7 +9,7 @@ type orQuery struct {
 	queryBase
 }
 
-func (self *orQuery) mongoQuery() (q *mgo.Query, err error) {
+func (self *orQuery) mongoQuery() (q queryBackend, err error) {
 	return nil, errs.Format("Can't create a mongo query. orQuery needs a filterQuery chained after it")
 }
 
@@ -0,0 +1,256 @@
+package mongo
+
+import (
+	"encoding/base64"
+
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/mgo/bson"
+	"github.com/ungerik/go-start/model"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Page
+
+// Page is one page of the documents of a query returned by Query.Page().
+type Page struct {
+	Documents []interface{}
+	// NextCursor is the cursor for the next page
+	// or empty if there is no next page.
+	NextCursor string
+	// PrevCursor is the cursor for the previous page
+	// or empty if this is the first page.
+	PrevCursor string
+}
+
+// Iterator returns an iterator for the documents of the page.
+func (self *Page) Iterator() model.Iterator {
+	return model.NewObjectIterator(self.Documents...)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Page cursor
+
+// pageCursor is the content of the opaque cursor strings of Page.
+type pageCursor struct {
+	// Prev is true if the cursor points to the previous page
+	Prev bool `bson:"p,omitempty"`
+	// Values of the sort keys and _id of the first document
+	// of the previous page or the last document of the next page
+	Values []interface{} `bson:"v"`
+}
+
+func (self *pageCursor) String() string {
+	data, err := bson.Marshal(self)
+	if err != nil {
+		return ""
+	}
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+func parsePageCursor(cursor string) (*pageCursor, error) {
+	data, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errs.Format("Invalid page cursor '%s'", cursor)
+	}
+	var result pageCursor
+	if err = bson.Unmarshal(data, &result); err != nil {
+		return nil, errs.Format("Invalid page cursor '%s'", cursor)
+	}
+	return &result, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Keyset pagination
+
+// pageSortKey is a field of the sort order used for pagination
+type pageSortKey struct {
+	path       string
+	descending bool
+}
+
+// pageSortKeys returns the sort order of query for pagination.
+// "_id" is always the last key to make the order unique.
+func pageSortKeys(query Query) (keys []pageSortKey, err error) {
+	for q := query; q != nil; q = q.ParentQuery() {
+		if s, ok := q.(*sortQuery); ok {
+			field, err := s.sortField()
+			if err != nil {
+				return nil, err
+			}
+			if s.descending {
+				field = field[1:]
+			}
+			keys = append([]pageSortKey{{field, s.descending}}, keys...)
+		}
+	}
+	for _, key := range keys {
+		if key.path == "_id" {
+			return keys, nil
+		}
+	}
+	return append(keys, pageSortKey{path: "_id"}), nil
+}
+
+// pageKeysetSelector returns a query selector for all documents
+// that come after the values of the sort keys in the sort order,
+// or before them if prev is true.
+func pageKeysetSelector(keys []pageSortKey, values []interface{}, prev bool) bson.M {
+	or := make([]bson.M, len(keys))
+	for i, key := range keys {
+		selector := bson.M{}
+		for j := 0; j < i; j++ {
+			selector[keys[j].path] = values[j]
+		}
+		operator := "$gt"
+		if key.descending != prev {
+			operator = "$lt"
+		}
+		selector[key.path] = bson.M{operator: values[i]}
+		or[i] = selector
+	}
+	return bson.M{"$or": or}
+}
+
+// pageCursorValues returns the values of the sort keys of document.
+func pageCursorValues(document interface{}, keys []pageSortKey) ([]interface{}, error) {
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	if err = bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		values[i], _ = bsonPathValue(doc, key.path)
+	}
+	return values, nil
+}
+
+/*
+Page returns up to pageSize documents of the query starting at cursor
+and the cursors for the next and previous page.
+An empty cursor returns the first page.
+
+Pagination uses the sort keys of the query and the document ID
+instead of skipping documents, so it stays fast on large collections
+and doesn't shift when documents are inserted.
+Skip() and Limit() of the query are ignored.
+Documents with missing sort key fields are not found by pages
+after the first one.
+
+Example:
+
+	query := models.Users.Sort("Name.Last")
+	page, err := query.Page(ctx.Request.Params["cursor"], 20)
+*/
+func (self *queryBase) Page(cursor string, pageSize int) (page *Page, err error) {
+	if pageSize <= 0 {
+		return nil, errs.Format("Invalid page size: %d", pageSize)
+	}
+	collection, subDocSelectors := collectionAndSubDocumentSelectors(self.thisQuery)
+	if len(subDocSelectors) > 0 {
+		return nil, errs.Format("Can't paginate sub-documents")
+	}
+	for q := self.thisQuery; q != nil; q = q.ParentQuery() {
+		if _, ok := q.(*searchQuery); ok {
+			return nil, errs.Format("Can't paginate search results by cursor, use Skip() and Limit()")
+		}
+	}
+	keys, err := pageSortKeys(self.thisQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var current *pageCursor
+	selector, err := bsonQuery(self.thisQuery)
+	if err != nil {
+		return nil, err
+	}
+	if cursor != "" {
+		if current, err = parsePageCursor(cursor); err != nil {
+			return nil, err
+		}
+		if len(current.Values) != len(keys) {
+			return nil, errs.Format("Page cursor doesn't match the sort order of the query")
+		}
+		keyset := pageKeysetSelector(keys, current.Values, current.Prev)
+		if len(selector) == 0 {
+			selector = keyset
+		} else {
+			selector = bson.M{"$and": []bson.M{selector, keyset}}
+		}
+	}
+	prev := current != nil && current.Prev
+
+	sortFields := make([]string, len(keys))
+	for i, key := range keys {
+		if key.descending != prev {
+			sortFields[i] = "-" + key.path
+		} else {
+			sortFields[i] = key.path
+		}
+	}
+
+	collection.checkDBConnection()
+	q := collection.backend.Find(selector).Sort(sortFields...).Limit(pageSize + 1)
+	projection, err := queryProjection(self.thisQuery)
+	if err != nil {
+		return nil, err
+	}
+	if projection != nil {
+		fields := projection.bson()
+		if !projection.exclude {
+			// The sort keys are needed for the cursors
+			for _, key := range keys {
+				fields[key.path] = 1
+			}
+		}
+		q = q.Select(fields)
+	}
+
+	page = &Page{}
+	i := &MongoIterator{query: self.thisQuery, collection: collection, projection: projection, iter: q.Iter()}
+	for doc := i.Next(); doc != nil; doc = i.Next() {
+		page.Documents = append(page.Documents, doc)
+	}
+	if i.Err() != nil {
+		return nil, i.Err()
+	}
+	more := len(page.Documents) > pageSize
+	if more {
+		page.Documents = page.Documents[:pageSize]
+	}
+	if prev {
+		// Documents have been loaded in reverse order
+		for l, r := 0, len(page.Documents)-1; l < r; l, r = l+1, r-1 {
+			page.Documents[l], page.Documents[r] = page.Documents[r], page.Documents[l]
+		}
+	}
+	if preloads := preloadSelectors(self.thisQuery); len(preloads) > 0 {
+		if err = PreloadRefs(page.Documents, preloads...); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(page.Documents) > 0 {
+		// There is a next page if more documents have been found
+		// or if this page has been reached from its next page
+		if more && !prev || current != nil && prev {
+			values, err := pageCursorValues(page.Documents[len(page.Documents)-1], keys)
+			if err != nil {
+				return nil, err
+			}
+			page.NextCursor = (&pageCursor{Values: values}).String()
+		}
+		if more && prev || current != nil && !prev {
+			values, err := pageCursorValues(page.Documents[0], keys)
+			if err != nil {
+				return nil, err
+			}
+			page.PrevCursor = (&pageCursor{Prev: true, Values: values}).String()
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,125 @@
+package mongo
+
+import (
+	"strings"
+	"testing"
+)
+
+func pageNames(page *Page) string {
+	names := make([]string, len(page.Documents))
+	for i, doc := range page.Documents {
+		names[i] = doc.(*testDocument).Name.Get()
+	}
+	return strings.Join(names, ",")
+}
+
+func newPageTestDocuments(t *testing.T) {
+	InitMemory()
+	// Equal ages are ordered by ID, which is the insert order
+	for i, name := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		doc := testDocuments.NewDocument().(*testDocument)
+		doc.Name.Set(name)
+		doc.Age.Set(int64(i / 2))
+		saveTestDocument(t, doc)
+	}
+}
+
+func TestPageForwardAndBack(t *testing.T) {
+	newPageTestDocuments(t)
+	tests := []struct {
+		name  string
+		query Query
+		pages []string
+	}{
+		{"by ID", testDocuments, []string{"a,b,c", "d,e,f", "g"}},
+		{"ascending", testDocuments.Sort("Age"), []string{"a,b,c", "d,e,f", "g"}},
+		{"descending", testDocuments.SortReverse("Age"), []string{"g,e,f", "c,d,a", "b"}},
+		{"filtered", testDocuments.FilterGreater("Age", 0).SortReverse("Age").Sort("Name"), []string{"g,e,f", "c,d"}},
+	}
+	for _, test := range tests {
+		var pages []*Page
+		cursor := ""
+		for {
+			page, err := test.query.Page(cursor, 3)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			pages = append(pages, page)
+			if page.NextCursor == "" {
+				break
+			}
+			cursor = page.NextCursor
+		}
+		if len(pages) != len(test.pages) {
+			t.Errorf("%s: %d pages instead of %d", test.name, len(pages), len(test.pages))
+			continue
+		}
+		for i, page := range pages {
+			if names := pageNames(page); names != test.pages[i] {
+				t.Errorf("%s: page %d is %s instead of %s", test.name, i, names, test.pages[i])
+			}
+			if (page.PrevCursor == "") != (i == 0) {
+				t.Errorf("%s: page %d has PrevCursor %q", test.name, i, page.PrevCursor)
+			}
+		}
+
+		// Back from the last page
+		page := pages[len(pages)-1]
+		for i := len(pages) - 2; i >= 0; i-- {
+			var err error
+			page, err = test.query.Page(page.PrevCursor, 3)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			if names := pageNames(page); names != test.pages[i] {
+				t.Errorf("%s: page %d backwards is %s instead of %s", test.name, i, names, test.pages[i])
+			}
+			if page.NextCursor == "" {
+				t.Errorf("%s: page %d backwards has no NextCursor", test.name, i)
+			}
+		}
+		if page.PrevCursor != "" {
+			t.Errorf("%s: first page reached backwards has a PrevCursor", test.name)
+		}
+	}
+}
+
+func TestPageInsertDoesNotShift(t *testing.T) {
+	newPageTestDocuments(t)
+	query := testDocuments.Sort("Name")
+	first, err := query.Page("", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := testDocuments.NewDocument().(*testDocument)
+	doc.Name.Set("0")
+	saveTestDocument(t, doc)
+
+	second, err := query.Page(first.NextCursor, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := pageNames(second); names != "d,e,f" {
+		t.Errorf("second page is %s after inserting before the cursor", names)
+	}
+}
+
+func TestPageErrors(t *testing.T) {
+	newPageTestDocuments(t)
+	first, err := testDocuments.Sort("Age").Page("", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = testDocuments.Page("", 0); err == nil {
+		t.Error("no error for page size 0")
+	}
+	if _, err = testDocuments.Page("not a cursor", 3); err == nil {
+		t.Error("no error for an invalid cursor")
+	}
+	if _, err = testDocuments.Sort("Age").Sort("Name").Page(first.NextCursor, 3); err == nil {
+		t.Error("no error for a cursor of another sort order")
+	}
+	if _, err = testDocuments.SubDocument("Address").Page("", 3); err == nil {
+		t.Error("no error for paginating sub-documents")
+	}
+}
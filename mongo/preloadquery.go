@@ -0,0 +1,139 @@
+package mongo
+
+import (
+	"strings"
+
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/mgo/bson"
+	"github.com/ungerik/go-start/model"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// preloadQuery
+
+// preloadQuery doesn't change the MongoDB query, but marks the query chain
+// so that the refs at selectors of all loaded documents are preloaded.
+type preloadQuery struct {
+	queryBase
+	selectors []string
+}
+
+func (self *preloadQuery) mongoQuery() (q queryBackend, err error) {
+	return self.parentQuery.mongoQuery()
+}
+
+func (self *preloadQuery) Selector() string {
+	return ""
+}
+
+// preloadSelectors returns the selectors of all Preload() calls
+// in the query chain.
+func preloadSelectors(query Query) (selectors []string) {
+	for ; query != nil; query = query.ParentQuery() {
+		if q, ok := query.(*preloadQuery); ok {
+			selectors = append(selectors, q.selectors...)
+		}
+		if _, ok := query.(*QueryError); ok {
+			break
+		}
+	}
+	return selectors
+}
+
+func preloadIterator(i model.Iterator, selectors []string) model.Iterator {
+	var docs []interface{}
+	for doc := i.Next(); doc != nil; doc = i.Next() {
+		docs = append(docs, doc)
+	}
+	if i.Err() != nil {
+		return model.NewErrorOnlyIterator(i.Err())
+	}
+	if err := PreloadRefs(docs, selectors...); err != nil {
+		return model.NewErrorOnlyIterator(err)
+	}
+	return model.NewObjectIterator(docs...)
+}
+
+// preloadSelectorMatches returns true if selector matches the
+// wildcard selector of a ref or a slice of refs.
+func preloadSelectorMatches(selector string, field *model.MetaData) bool {
+	if strings.EqualFold(selector, field.WildcardSelector()) {
+		return true
+	}
+	return field.Parent != nil && field.Parent.Value.Type() == refSliceType &&
+		strings.EqualFold(selector, field.Parent.WildcardSelector())
+}
+
+/*
+PreloadRefs loads the documents referenced by the mongo.Ref fields
+at selectors of all documents with one query per referenced collection.
+After that Ref.Get() returns the preloaded document without a
+database query.
+
+Use the wildcard "$" for array and slice elements.
+Refs in slices can also be selected by the selector of the slice.
+
+Example:
+
+	err := mongo.PreloadRefs(docs, "Author", "Tags.$")
+*/
+func PreloadRefs(documents []interface{}, selectors ...string) error {
+	if len(selectors) == 0 {
+		return nil
+	}
+
+	// Find all refs to preload grouped by collection
+	refs := map[string][]*Ref{}
+	for _, document := range documents {
+		err := model.Visit(document, model.FieldTypeVisitor(
+			func(ref *Ref, metaData *model.MetaData) error {
+				if ref.IsEmpty() {
+					return nil
+				}
+				for _, selector := range selectors {
+					if preloadSelectorMatches(selector, metaData) {
+						refs[ref.CollectionName] = append(refs[ref.CollectionName], ref)
+						break
+					}
+				}
+				return nil
+			},
+		))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Query referenced documents with one $in query per collection
+	for collectionName, collectionRefs := range refs {
+		ids := make([]interface{}, 0, len(collectionRefs))
+		idAdded := map[bson.ObjectId]bool{}
+		for _, ref := range collectionRefs {
+			if !idAdded[ref.ID] {
+				ids = append(ids, ref.ID)
+				idAdded[ref.ID] = true
+			}
+		}
+		collection, ok := CollectionByName(collectionName)
+		if !ok {
+			return errs.Format("Collection '%s' not registered", collectionName)
+		}
+		loaded := make(map[bson.ObjectId]interface{}, len(ids))
+		i := collection.FilterIn("_id", ids...).WithDeleted().Iterator()
+		for doc := i.Next(); doc != nil; doc = i.Next() {
+			if document, ok := doc.(Document); ok {
+				loaded[document.ObjectId()] = doc
+			}
+		}
+		if i.Err() != nil {
+			return i.Err()
+		}
+		for _, ref := range collectionRefs {
+			if doc, ok := loaded[ref.ID]; ok {
+				ref.preload(doc)
+			}
+		}
+	}
+
+	return nil
+}
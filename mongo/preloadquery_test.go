@@ -0,0 +1,121 @@
+package mongo
+
+import (
+	"testing"
+)
+
+// newPreloadTestData creates two authors, a post and
+// three comments on the post liked by both authors.
+func newPreloadTestData(t *testing.T) (authors []*refAuthor, post *refPost) {
+	InitMemory()
+	for _, name := range []string{"Erik", "Jo"} {
+		author := refAuthors.NewDocument().(*refAuthor)
+		author.Name.Set(name)
+		saveTestDocument(t, author)
+		authors = append(authors, author)
+	}
+	post = refPosts.NewDocument().(*refPost)
+	post.Author = authors[0].Ref()
+	saveTestDocument(t, post)
+	for i := 0; i < 3; i++ {
+		comment := refComments.NewDocument().(*refComment)
+		comment.Post = post.Ref()
+		comment.Likes = []Ref{authors[0].Ref(), authors[1].Ref()}
+		saveTestDocument(t, comment)
+	}
+	return authors, post
+}
+
+func TestPreload(t *testing.T) {
+	authors, post := newPreloadTestData(t)
+
+	trace := StartQueryTrace("preload")
+	var comments []*refComment
+	i := refComments.Preload("Post", "Likes").Iterator()
+	for doc := i.Next(); doc != nil; doc = i.Next() {
+		comments = append(comments, doc.(*refComment))
+	}
+	trace.Stop()
+	if i.Err() != nil {
+		t.Fatal(i.Err())
+	}
+	if len(comments) != 3 {
+		t.Fatalf("%d comments instead of 3", len(comments))
+	}
+	// One query for the comments and one per referenced collection
+	if n := len(trace.Stats()); n != 3 {
+		t.Errorf("%d queries instead of 3: %v", n, trace.Stats())
+	}
+
+	for _, comment := range comments {
+		doc, ok := comment.Post.Preloaded()
+		if !ok || doc.(*refPost).ID != post.ID {
+			t.Errorf("post not preloaded: %v", doc)
+		}
+		for k, like := range comment.Likes {
+			doc, ok := like.Preloaded()
+			if !ok || doc.(*refAuthor).Name != authors[k].Name {
+				t.Errorf("like %d not preloaded: %v", k, doc)
+			}
+		}
+	}
+
+	// Get() uses the preloaded document without a query
+	trace = StartQueryTrace("get")
+	if doc, err := comments[0].Likes[1].Get(); err != nil || doc.(*refAuthor).ID != authors[1].ID {
+		t.Errorf("Get() returned %v, %v", doc, err)
+	}
+	trace.Stop()
+	if n := len(trace.Stats()); n != 0 {
+		t.Errorf("Get() of a preloaded ref executed %d queries", n)
+	}
+
+	// Changing the ID invalidates the preloaded document
+	comments[0].Likes[1].ID = authors[0].ID
+	if _, ok := comments[0].Likes[1].Preloaded(); ok {
+		t.Error("preloaded document of another ID returned")
+	}
+}
+
+func TestPreloadSelectors(t *testing.T) {
+	newPreloadTestData(t)
+
+	doc, err := refComments.Preload("Likes.$").One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	comment := doc.(*refComment)
+	if _, ok := comment.Likes[0].Preloaded(); !ok {
+		t.Error("wildcard selector didn't preload slice elements")
+	}
+	if _, ok := comment.Post.Preloaded(); ok {
+		t.Error("ref that was not selected has been preloaded")
+	}
+
+	doc, err = refPosts.Preload("author").One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc.(*refPost).Author.Preloaded(); !ok {
+		t.Error("selectors are not case insensitive")
+	}
+}
+
+func TestPreloadRemovedDocument(t *testing.T) {
+	authors, _ := newPreloadTestData(t)
+	// Purge() doesn't apply ondelete rules
+	if err := refAuthors.Purge(authors[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := refComments.Preload("Likes").One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	likes := doc.(*refComment).Likes
+	if _, ok := likes[0].Preloaded(); !ok {
+		t.Error("existing document not preloaded")
+	}
+	if _, ok := likes[1].Preloaded(); ok {
+		t.Error("removed document preloaded")
+	}
+}
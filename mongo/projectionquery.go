@@ -0,0 +1,142 @@
+package mongo
+
+import (
+	"strings"
+
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/mgo/bson"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// fieldProjection
+
+// fieldProjection describes which fields of the documents
+// of a query with Select() or Exclude() are loaded.
+type fieldProjection struct {
+	// paths in MongoDB dot notation
+	paths   []string
+	exclude bool
+}
+
+func (self *fieldProjection) bson() bson.M {
+	value := 1
+	if self.exclude {
+		value = 0
+	}
+	projection := make(bson.M, len(self.paths))
+	for _, path := range self.paths {
+		projection[path] = value
+	}
+	return projection
+}
+
+// covers returns true if the field at path has been completely loaded.
+func (self *fieldProjection) covers(path string) bool {
+	if path == "_id" {
+		return true
+	}
+	for _, p := range self.paths {
+		if self.exclude {
+			if path == p || strings.HasPrefix(path, p+".") || strings.HasPrefix(p, path+".") {
+				return false
+			}
+		} else if path == p || strings.HasPrefix(path, p+".") {
+			return true
+		}
+	}
+	return self.exclude
+}
+
+// partialDocument is implemented by DocumentBase and SubDocumentBase
+// to flag documents that have been loaded with Select() or Exclude().
+type partialDocument interface {
+	setProjection(projection *fieldProjection)
+	IsPartial() bool
+}
+
+func isPartialDocument(document interface{}) bool {
+	partial, ok := document.(partialDocument)
+	return ok && partial.IsPartial()
+}
+
+// queryProjection returns the fields selected by all Select()
+// or Exclude() calls of the query chain,
+// or nil if the whole documents are loaded.
+func queryProjection(query Query) (projection *fieldProjection, err error) {
+	for q := query; q != nil; q = q.ParentQuery() {
+		if _, ok := q.(*QueryError); ok {
+			break
+		}
+		p, ok := q.(*projectionQuery)
+		if !ok {
+			continue
+		}
+		if projection == nil {
+			projection = &fieldProjection{exclude: p.exclude}
+		} else if projection.exclude != p.exclude {
+			return nil, errs.Format("Can't combine Select() and Exclude() in one query")
+		}
+		collection, subDocSelectors := collectionAndSubDocumentSelectors(p)
+		for _, selector := range p.selectors {
+			_, path, err := collection.subDocumentPath(append(subDocSelectors, selector))
+			if err != nil {
+				return nil, err
+			}
+			projection.paths = append(projection.paths, path)
+		}
+	}
+	if projection != nil && !projection.exclude {
+		// The timestamps of TrackedDocumentBase are always loaded,
+		// because they are written by every Save()
+		collection, subDocSelectors := collectionAndSubDocumentSelectors(query)
+		if collection.softDelete && len(subDocSelectors) == 0 {
+			projection.paths = append(projection.paths, "created", "modified", "deleted")
+		}
+	}
+	return projection, nil
+}
+
+// selectFields adds the projection of the fields selected
+// by the query chain to q.
+func selectFields(query Query, q queryBackend) (queryBackend, error) {
+	projection, err := queryProjection(query)
+	if err != nil {
+		return nil, err
+	}
+	if projection != nil {
+		return q.Select(projection.bson()), nil
+	}
+	collection, selectors := collectionAndSubDocumentSelectors(query)
+	if len(selectors) == 0 {
+		return q, nil
+	}
+	_, path, err := collection.subDocumentPath(selectors)
+	if err != nil {
+		return nil, err
+	}
+	return q.Select(bson.M{projectionPath(path): 1}), nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// projectionQuery
+
+// projectionQuery restricts the loaded fields of the documents
+// of its query chain. Selectors following a SubDocument() query
+// are relative to the sub-document.
+type projectionQuery struct {
+	queryBase
+	selectors []string
+	exclude   bool
+}
+
+func (self *projectionQuery) mongoQuery() (q queryBackend, err error) {
+	q, err = self.parentQuery.mongoQuery()
+	if err != nil {
+		return nil, err
+	}
+	return selectFields(self.thisQuery, q)
+}
+
+func (self *projectionQuery) Selector() string {
+	return ""
+}
@@ -0,0 +1,119 @@
+package mongo
+
+import (
+	"testing"
+
+	"github.com/ungerik/go-start/model"
+)
+
+func newProjectionTestDocument(t *testing.T) *testDocument {
+	t.Helper()
+	InitMemory()
+	doc := testDocuments.NewDocument().(*testDocument)
+	doc.Name.Set("Erik")
+	doc.Age.Set(42)
+	doc.Tags = []model.String{"a"}
+	doc.Address.City.Set("Vienna")
+	doc.Address.Zip.Set("1010")
+	saveTestDocument(t, doc)
+	return doc
+}
+
+func TestSelect(t *testing.T) {
+	newProjectionTestDocument(t)
+	result, err := testDocuments.Select("Name", "Address.City").One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := result.(*testDocument)
+	if doc.Name != "Erik" || doc.Address.City != "Vienna" || !doc.ID.Valid() {
+		t.Errorf("selected fields not loaded: %+v", doc)
+	}
+	if doc.Age != 0 || doc.Address.Zip != "" || len(doc.Tags) != 0 {
+		t.Errorf("not selected fields loaded: %+v", doc)
+	}
+	if !doc.IsPartial() {
+		t.Error("document is not partial")
+	}
+
+	// Only selected fields can be saved
+	doc.Name.Set("Unger")
+	if err = doc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	doc.Age.Set(1)
+	if err = doc.Save(); err == nil {
+		t.Error("no error for saving a field that has not been loaded")
+	}
+	loaded := loadTestDocument(t, doc.ID)
+	if loaded.Name != "Unger" || loaded.Age != 42 || loaded.Address.Zip != "1010" {
+		t.Errorf("Save() of a partial document changed other fields: %+v", loaded)
+	}
+}
+
+func TestExclude(t *testing.T) {
+	newProjectionTestDocument(t)
+	result, err := testDocuments.Exclude("Tags", "Address.Zip").One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := result.(*testDocument)
+	if doc.Name != "Erik" || doc.Age != 42 || doc.Address.City != "Vienna" {
+		t.Errorf("not excluded fields not loaded: %+v", doc)
+	}
+	if doc.Address.Zip != "" || len(doc.Tags) != 0 {
+		t.Errorf("excluded fields loaded: %+v", doc)
+	}
+
+	doc.Address.City.Set("Berlin")
+	if err = doc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	doc.Address.Zip.Set("10115")
+	if err = doc.Save(); err == nil {
+		t.Error("no error for saving an excluded field")
+	}
+	loaded := loadTestDocument(t, doc.ID)
+	if loaded.Address.City != "Berlin" || loaded.Address.Zip != "1010" || len(loaded.Tags) != 1 {
+		t.Errorf("Save() of a partial document changed other fields: %+v", loaded)
+	}
+}
+
+func TestProjectionErrors(t *testing.T) {
+	newProjectionTestDocument(t)
+	if _, err := testDocuments.Select("Street").One(); err == nil {
+		t.Error("no error for selecting a field that doesn't exist")
+	}
+	if _, err := testDocuments.Select("Name").Exclude("Age").One(); err == nil {
+		t.Error("no error for combining Select() and Exclude()")
+	}
+}
+
+func TestProjectionSubDocument(t *testing.T) {
+	newProjectionTestDocument(t)
+	result, err := testDocuments.SubDocument("Address").Select("City").One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := result.(*testAddress)
+	if address.City != "Vienna" || address.Zip != "" {
+		t.Errorf("selectors are not relative to the sub-document: %+v", address)
+	}
+}
+
+func TestProjectionTrackedDocument(t *testing.T) {
+	InitMemory()
+	newTrackedDocuments(t, "a")
+	result, err := trackedDocuments.Select("Name").One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := result.(*trackedDocument)
+	if doc.Created.IsEmpty() {
+		t.Error("timestamps of TrackedDocumentBase have not been loaded")
+	}
+	doc.Name.Set("b")
+	if err = doc.Save(); err != nil {
+		t.Errorf("Save() of a partial tracked document failed: %s", err)
+	}
+}
@@ -1,7 +1,6 @@
 package mongo
 
 import (
-	"github.com/ungerik/go-start/mgo"
 	"github.com/ungerik/go-start/mgo/bson"
 	"github.com/ungerik/go-start/model"
 )
@@ -15,7 +14,7 @@ Query is the interface with all query methods for mongo.
 type Query interface {
 	subDocumentSelector() string
 	bsonSelector() bson.M
-	mongoQuery() (q *mgo.Query, err error)
+	mongoQuery() (q queryBackend, err error)
 
 	Selector() string
 
@@ -59,9 +58,40 @@ type Query interface {
 
 	Or() Query
 
+	// WithDeleted and OnlyDeleted change how documents marked as deleted
+	// by TrackedDocumentBase are handled. By default they are excluded.
+	// Must be called on a Collection or after FilterX.
+	WithDeleted() Query
+	OnlyDeleted() Query
+
+	// Search restricts the query to the documents matching
+	// a text search and orders them by relevance.
+	// See Collection.SetTextIndex()
+	Search(text string) Query
+
+	// Preload loads the documents referenced by the mongo.Ref fields
+	// at selectors with one query per referenced collection
+	// after the documents of the query have been loaded.
+	// Use the wildcard "$" for array and slice elements.
+	Preload(selectors ...string) Query
+
+	// ReadPreference sets from which members of a replica set
+	// the query reads, overriding Config.ReadPreference.
+	ReadPreference(pref ReadPreference) Query
+
+	// Select loads only the fields at selectors, Exclude loads
+	// all fields except the ones at selectors.
+	// The loaded documents are flagged as partial and their Save()
+	// method returns an error instead of overwriting fields
+	// that have not been loaded.
+	// Select and Exclude can't be combined in one query.
+	Select(selectors ...string) Query
+	Exclude(selectors ...string) Query
+
 	// Statistics
 	Count() (n int, err error)
 	// Distinct() int
+	// Explain returns the explain output of MongoDB as indented JSON
 	Explain() string
 
 	// Read
@@ -70,6 +100,9 @@ type Query interface {
 	GetOrCreateOne() (document interface{}, found bool, err error)
 
 	Iterator() model.Iterator
+	// Page returns one page of documents starting at cursor
+	// using the sort keys of the query for pagination.
+	Page(cursor string, pageSize int) (page *Page, err error)
 	OneID() (id bson.ObjectId, err error)
 	TryOneID() (id bson.ObjectId, found bool, err error)
 	IDs() (ids []bson.ObjectId, err error)
@@ -78,7 +111,21 @@ type Query interface {
 	// Write
 	UpdateOne(selector string, value interface{}) error
 	UpdateAll(selector string, value interface{}) error
+	UpdateOneWith(update *Update) error
+	UpdateAllWith(update *Update) error
+	// UpsertOneWith applies update to the first document of the query
+	// or inserts a new document with the equality filters of the query
+	// and update applied if there is none, in a single atomic operation.
+	// Hooks of the document are not called.
+	UpsertOneWith(update *Update) (id bson.ObjectId, err error)
 
-	// RemoveAll ignores Skip() and Limit()
+	// RemoveAll removes all documents of the query,
+	// documents of collections with TrackedDocumentBase documents
+	// are only marked as deleted. It ignores Skip() and Limit().
 	RemoveAll() error
+	// PurgeAll removes all documents of the query from the database,
+	// also from collections with TrackedDocumentBase documents.
+	// Use WithDeleted() or OnlyDeleted() to purge deleted documents.
+	// It ignores Skip() and Limit().
+	PurgeAll() error
 }
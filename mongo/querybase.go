@@ -1,8 +1,9 @@
 package mongo
 
 import (
-	"fmt"
+	"encoding/json"
 	"strings"
+	"time"
 
 	"github.com/ungerik/go-start/debug"
 	"github.com/ungerik/go-start/errs"
@@ -53,14 +54,18 @@ func (self *queryBase) Collection() *Collection {
 }
 
 func (self *queryBase) Count() (n int, err error) {
+	start := time.Now()
 	q, err := self.thisQuery.mongoQuery()
 	if err != nil {
 		return 0, err
 	}
-	return q.Count()
+	n, err = q.Count()
+	traceQuery(self.thisQuery, "Count", time.Since(start), err)
+	return n, err
 }
 
 func (self *queryBase) SubDocument(selector string) Query {
+	selector = strings.ToLower(selector)
 	q := &subDocumentQuery{selector: selector}
 	q.init(q, self.thisQuery)
 	return checkQuery(q)
@@ -93,7 +98,7 @@ func (self *queryBase) Sort(selector string) Query {
 
 func (self *queryBase) SortReverse(selector string) Query {
 	selector = strings.ToLower(selector)
-	q := &sortQuery{selector: "-" + selector}
+	q := &sortQuery{selector: selector, descending: true}
 	q.init(q, self.thisQuery)
 	return checkQuery(q)
 }
@@ -112,7 +117,11 @@ func (self *queryBase) Explain() string {
 	if err != nil {
 		return err.Error()
 	}
-	return fmt.Sprintf("Explain: %#v\n", m)
+	data, err := json.MarshalIndent(dumpToJSON(m), "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
 }
 
 func (self *queryBase) IsFilter() bool {
@@ -276,20 +285,104 @@ func (self *queryBase) Or() Query {
 	return q
 }
 
+func (self *queryBase) WithDeleted() Query {
+	q := &deletedQuery{mode: includeDeleted}
+	q.init(q, self.thisQuery)
+	return q
+}
+
+func (self *queryBase) OnlyDeleted() Query {
+	q := &deletedQuery{mode: onlyDeleted}
+	q.init(q, self.thisQuery)
+	return q
+}
+
+func (self *queryBase) Preload(selectors ...string) Query {
+	q := &preloadQuery{selectors: selectors}
+	q.init(q, self.thisQuery)
+	return q
+}
+
+func (self *queryBase) ReadPreference(pref ReadPreference) Query {
+	if err := pref.validate(); err != nil {
+		return &QueryError{self.thisQuery, err}
+	}
+	q := &readPreferenceQuery{pref: pref}
+	q.init(q, self.thisQuery)
+	return q
+}
+
+func (self *queryBase) Select(selectors ...string) Query {
+	return self.projection(selectors, false)
+}
+
+func (self *queryBase) Exclude(selectors ...string) Query {
+	return self.projection(selectors, true)
+}
+
+func (self *queryBase) projection(selectors []string, exclude bool) Query {
+	lowerSelectors := make([]string, len(selectors))
+	for i, selector := range selectors {
+		lowerSelectors[i] = strings.ToLower(selector)
+	}
+	q := &projectionQuery{selectors: lowerSelectors, exclude: exclude}
+	q.init(q, self.thisQuery)
+	if Config.CheckQuerySelectors {
+		collection, subDocSelectors := collectionAndSubDocumentSelectors(q)
+		for _, selector := range lowerSelectors {
+			if err := collection.ValidateSelector(append(subDocSelectors, selector)...); err != nil {
+				return &QueryError{self.thisQuery, err}
+			}
+		}
+	}
+	return q
+}
+
+// Search returns a query for the documents matching the text search.
+// The results are ordered by relevance if no Sort() follows.
+// Needs a text index declared with Collection.SetTextIndex()
+// and must be called after all FilterX() calls.
+//
+// The search syntax is that of MongoDB: words match any word
+// of the text index fields, "quoted phrases" have to match
+// and words prefixed with '-' exclude documents.
+func (self *queryBase) Search(text string) Query {
+	collection := self.Collection()
+	if !collection.HasTextIndex() {
+		return &QueryError{self.thisQuery, errs.Format("Collection '%s' has no text index", collection.Name)}
+	}
+	q := &searchQuery{search: text}
+	q.init(q, self.thisQuery)
+	return q
+}
+
+// preload preloads the refs of document if the query chain contains Preload()
+func (self *queryBase) preload(document interface{}) error {
+	if selectors := preloadSelectors(self.thisQuery); len(selectors) > 0 {
+		return PreloadRefs([]interface{}{document}, selectors...)
+	}
+	return nil
+}
+
 func (self *queryBase) One() (document interface{}, err error) {
+	start := time.Now()
 	q, err := self.thisQuery.mongoQuery()
 	if err != nil {
 		return nil, err
 	}
-	document = self.Collection().NewDocument()
-	err = q.One(document)
+	projection, err := queryProjection(self.thisQuery)
 	if err != nil {
 		return nil, err
 	}
-	// document has to be initialized again,
-	// because mgo zeros the struct while unmarshalling.
-	// Newly created slice elements need to be initialized too
-	self.Collection().InitDocument(document)
+	collection, selectors := collectionAndSubDocumentSelectors(self.thisQuery)
+	document, err = collection.loadDocument(q.One, selectors, projection)
+	traceQuery(self.thisQuery, "One", time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	if err = self.preload(document); err != nil {
+		return nil, err
+	}
 	return document, nil
 }
 
@@ -302,20 +395,28 @@ func (self *queryBase) TryOne() (document interface{}, found bool, err error) {
 }
 
 func (self *queryBase) GetOrCreateOne() (document interface{}, found bool, err error) {
+	start := time.Now()
 	q, err := self.thisQuery.mongoQuery()
 	if err != nil {
 		return nil, false, err
 	}
-	document = self.Collection().NewDocument()
-	err = q.One(document)
-	if err != nil && err != mgo.NotFound {
+	projection, err := queryProjection(self.thisQuery)
+	if err != nil {
+		return nil, false, err
+	}
+	collection, selectors := collectionAndSubDocumentSelectors(self.thisQuery)
+	document, err = collection.loadDocument(q.One, selectors, projection)
+	traceQuery(self.thisQuery, "One", time.Since(start), err)
+	if err == mgo.NotFound {
+		return collection.NewDocument(selectors...), false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if err = self.preload(document); err != nil {
 		return nil, false, err
 	}
-	// document has to be initialized again,
-	// because mgo zeros the struct while unmarshalling.
-	// Newly created slice elements need to be initialized too
-	self.Collection().InitDocument(document)
-	return document, err == nil, nil
+	return document, true, nil
 }
 
 func (self *queryBase) Iterator() model.Iterator {
@@ -373,22 +474,84 @@ func (self *queryBase) Refs() (refs []Ref, err error) {
 	return refs, nil
 }
 
+// UpdateOne sets the field with selector to value.
+// Unlike Update.Set(), the selector is used as given and not lower cased.
 func (self *queryBase) UpdateOne(selector string, value interface{}) error {
+	return self.UpdateOneWith(NewUpdate().add("$set", selector, value))
+}
+
+// UpdateAll sets the field with selector to value for all documents.
+// Unlike Update.Set(), the selector is used as given and not lower cased.
+func (self *queryBase) UpdateAll(selector string, value interface{}) error {
+	return self.UpdateAllWith(NewUpdate().add("$set", selector, value))
+}
+
+func (self *queryBase) UpdateOneWith(update *Update) error {
+	if update.IsEmpty() {
+		return nil
+	}
 	bsonQuery, err := bsonQuery(self.thisQuery)
 	if err != nil {
 		return err
 	}
-	return self.Collection().collection.Update(bsonQuery, bson.M{"$set": bson.M{selector: value}})
+	defer self.Collection().textIndexChanged()
+	return self.Collection().backend.Update(bsonQuery, update.Bson())
 }
 
-func (self *queryBase) UpdateAll(selector string, value interface{}) error {
+func (self *queryBase) UpdateAllWith(update *Update) error {
+	if update.IsEmpty() {
+		return nil
+	}
 	bsonQuery, err := bsonQuery(self.thisQuery)
 	if err != nil {
 		return err
 	}
-	return self.Collection().collection.UpdateAll(bsonQuery, bson.M{"$set": bson.M{selector: value}})
+	start := time.Now()
+	err = self.Collection().backend.UpdateAll(bsonQuery, update.Bson())
+	traceQuery(self.thisQuery, "UpdateAll", time.Since(start), err)
+	self.Collection().textIndexChanged()
+	return err
+}
+
+func (self *queryBase) UpsertOneWith(update *Update) (id bson.ObjectId, err error) {
+	if update.IsEmpty() {
+		// An empty change would replace the whole document
+		return "", errs.Format("mongo.Query.UpsertOneWith() needs a non empty update")
+	}
+	bsonQuery, err := bsonQuery(self.thisQuery)
+	if err != nil {
+		return "", err
+	}
+	collection := self.Collection()
+	collection.checkDBConnection()
+	start := time.Now()
+	newID, err := collection.backend.Upsert(bsonQuery, update.Bson())
+	traceQuery(self.thisQuery, "UpsertOne", time.Since(start), err)
+	if err != nil {
+		return "", err
+	}
+	id, _ = newID.(bson.ObjectId)
+	collection.textIndexChanged(id)
+	return id, nil
 }
 
 func (self *queryBase) RemoveAll() error {
-	return self.Collection().collection.RemoveAll(self.bsonSelector())
+	return self.removeAll("RemoveAll", self.Collection().softDelete)
+}
+
+func (self *queryBase) PurgeAll() error {
+	return self.removeAll("PurgeAll", false)
+}
+
+func (self *queryBase) removeAll(operation string, softDelete bool) error {
+	bsonQuery, err := bsonQuery(self.thisQuery)
+	if err != nil {
+		return err
+	}
+	collection := self.Collection()
+	start := time.Now()
+	err = collection.remove(bsonQuery, softDelete)
+	traceQuery(self.thisQuery, operation, time.Since(start), err)
+	collection.textIndexChanged()
+	return err
 }
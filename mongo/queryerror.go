@@ -1,7 +1,6 @@
 package mongo
 
 import (
-	"github.com/ungerik/go-start/mgo"
 	"github.com/ungerik/go-start/mgo/bson"
 	"github.com/ungerik/go-start/model"
 )
@@ -24,7 +23,7 @@ func (self *QueryError) bsonSelector() bson.M {
 	return nil
 }
 
-func (self *QueryError) mongoQuery() (q *mgo.Query, err error) {
+func (self *QueryError) mongoQuery() (q queryBackend, err error) {
 	return nil, self.Err
 }
 
@@ -166,6 +165,34 @@ func (self *QueryError) Or() Query {
 	return self
 }
 
+func (self *QueryError) WithDeleted() Query {
+	return self
+}
+
+func (self *QueryError) OnlyDeleted() Query {
+	return self
+}
+
+func (self *QueryError) Select(selectors ...string) Query {
+	return self
+}
+
+func (self *QueryError) Exclude(selectors ...string) Query {
+	return self
+}
+
+func (self *QueryError) Search(text string) Query {
+	return self
+}
+
+func (self *QueryError) Preload(selectors ...string) Query {
+	return self
+}
+
+func (self *QueryError) ReadPreference(pref ReadPreference) Query {
+	return self
+}
+
 func (self *QueryError) Count() (n int, err error) {
 	return 0, self.Err
 }
@@ -190,6 +217,10 @@ func (self *QueryError) Iterator() model.Iterator {
 	return model.NewErrorOnlyIterator(self.Err)
 }
 
+func (self *QueryError) Page(cursor string, pageSize int) (page *Page, err error) {
+	return nil, self.Err
+}
+
 func (self *QueryError) OneID() (id bson.ObjectId, err error) {
 	return "", self.Err
 }
@@ -214,6 +245,22 @@ func (self *QueryError) UpdateAll(selector string, value interface{}) error {
 	return self.Err
 }
 
+func (self *QueryError) UpdateOneWith(update *Update) error {
+	return self.Err
+}
+
+func (self *QueryError) UpdateAllWith(update *Update) error {
+	return self.Err
+}
+
+func (self *QueryError) UpsertOneWith(update *Update) (id bson.ObjectId, err error) {
+	return "", self.Err
+}
+
 func (self *QueryError) RemoveAll() error {
 	return self.Err
 }
+
+func (self *QueryError) PurgeAll() error {
+	return self.Err
+}
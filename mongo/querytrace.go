@@ -0,0 +1,320 @@
+package mongo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ungerik/go-start/config"
+	"github.com/ungerik/go-start/mgo"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// QueryStat
+
+// QueryStat is the timing of one query execution.
+type QueryStat struct {
+	Collection string
+	// Operation is "One", "Iterator", "Count", "UpdateAll", "UpsertOne", "RemoveAll" or "PurgeAll"
+	Operation string
+	// Query is the query selector as JSON
+	Query    string
+	Duration time.Duration
+	Err      error
+}
+
+func (self *QueryStat) String() string {
+	s := fmt.Sprintf("%s %s.%s %s", self.Duration, self.Collection, self.Operation, self.Query)
+	if self.Err != nil {
+		s += " Error: " + self.Err.Error()
+	}
+	return s
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// QueryTrace
+
+/*
+QueryTrace collects the QueryStats of all queries executed
+by the goroutine that started the trace.
+Query metrics are attributed to the Label of the trace.
+Tracing slows down every query of the process, because the
+goroutine of a query has to be looked up.
+
+In view.Config.Debug.Mode, view.ViewPath starts a trace for every
+request with the path of the view as label and logs its summary.
+
+Example:
+
+	trace := mongo.StartQueryTrace("import job")
+	defer trace.Stop()
+	...
+	log.Print(trace.Summary())
+*/
+type QueryTrace struct {
+	Label string
+
+	goroutine uint64
+	mutex     sync.Mutex
+	stats     []QueryStat
+	// iterators that have not been iterated to the end yet
+	iterators map[*MongoIterator]struct{}
+}
+
+var (
+	queryTracesMutex sync.Mutex
+	queryTraces      = map[uint64]*QueryTrace{}
+	// numQueryTraces avoids looking up the goroutine ID if there are no traces
+	numQueryTraces int32
+)
+
+// StartQueryTrace starts a trace for the current goroutine.
+// Stop() has to be called when the traced work is done.
+func StartQueryTrace(label string) *QueryTrace {
+	trace := &QueryTrace{Label: label, goroutine: goroutineID()}
+	queryTracesMutex.Lock()
+	if _, exists := queryTraces[trace.goroutine]; !exists {
+		atomic.AddInt32(&numQueryTraces, 1)
+	}
+	queryTraces[trace.goroutine] = trace
+	queryTracesMutex.Unlock()
+	return trace
+}
+
+// Stop stops the trace. The collected stats are kept.
+// Iterators of the trace that have not been iterated
+// to the end are recorded now.
+func (self *QueryTrace) Stop() {
+	queryTracesMutex.Lock()
+	if queryTraces[self.goroutine] == self {
+		delete(queryTraces, self.goroutine)
+		atomic.AddInt32(&numQueryTraces, -1)
+	}
+	queryTracesMutex.Unlock()
+
+	self.mutex.Lock()
+	iterators := self.iterators
+	self.iterators = nil
+	self.mutex.Unlock()
+	for iterator := range iterators {
+		iterator.Close()
+	}
+}
+
+func (self *QueryTrace) addIterator(iterator *MongoIterator) {
+	self.mutex.Lock()
+	if self.iterators == nil {
+		self.iterators = make(map[*MongoIterator]struct{})
+	}
+	self.iterators[iterator] = struct{}{}
+	self.mutex.Unlock()
+}
+
+func (self *QueryTrace) removeIterator(iterator *MongoIterator) {
+	self.mutex.Lock()
+	delete(self.iterators, iterator)
+	self.mutex.Unlock()
+}
+
+func (self *QueryTrace) add(stat QueryStat) {
+	self.mutex.Lock()
+	self.stats = append(self.stats, stat)
+	self.mutex.Unlock()
+}
+
+// Stats returns the stats of all traced queries in execution order.
+func (self *QueryTrace) Stats() []QueryStat {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]QueryStat(nil), self.stats...)
+}
+
+// Total returns the summed up duration of all traced queries.
+func (self *QueryTrace) Total() (total time.Duration) {
+	for _, stat := range self.Stats() {
+		total += stat.Duration
+	}
+	return total
+}
+
+// Summary returns the number and duration of all traced queries
+// followed by one line per query.
+func (self *QueryTrace) Summary() string {
+	stats := self.Stats()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s: %d mongo queries in %s", self.Label, len(stats), self.Total())
+	for i := range stats {
+		buf.WriteString("\n    ")
+		buf.WriteString(stats[i].String())
+	}
+	return buf.String()
+}
+
+// currentQueryTrace returns the trace of the current goroutine or nil.
+func currentQueryTrace() *QueryTrace {
+	if atomic.LoadInt32(&numQueryTraces) == 0 {
+		return nil
+	}
+	id := goroutineID()
+	queryTracesMutex.Lock()
+	defer queryTracesMutex.Unlock()
+	return queryTraces[id]
+}
+
+// goroutineID parses the ID of the current goroutine
+// from the first line of its stack trace: "goroutine 123 [running]:"
+func goroutineID() uint64 {
+	var buf [64]byte
+	s := buf[:runtime.Stack(buf[:], false)]
+	s = bytes.TrimPrefix(s, []byte("goroutine "))
+	if i := bytes.IndexByte(s, ' '); i > 0 {
+		s = s[:i]
+	}
+	id, _ := strconv.ParseUint(string(s), 10, 64)
+	return id
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// QueryMetric
+
+// QueryMetric sums up the executions of an operation on a collection
+// attributed to a trace label.
+type QueryMetric struct {
+	// Label of the QueryTrace, empty for queries without trace
+	Label      string
+	Collection string
+	Operation  string
+	Count      int
+	Errors     int
+	Total      time.Duration
+	Max        time.Duration
+}
+
+// Average returns the average duration of the query executions.
+func (self *QueryMetric) Average() time.Duration {
+	if self.Count == 0 {
+		return 0
+	}
+	return self.Total / time.Duration(self.Count)
+}
+
+type queryMetricKey struct {
+	label      string
+	collection string
+	operation  string
+}
+
+var (
+	queryMetricsMutex sync.Mutex
+	queryMetrics      = map[queryMetricKey]*QueryMetric{}
+)
+
+// QueryMetrics returns the metrics of all queries since the start
+// of the process or the last ResetQueryMetrics(),
+// sorted by total duration in descending order.
+func QueryMetrics() []QueryMetric {
+	queryMetricsMutex.Lock()
+	metrics := make([]QueryMetric, 0, len(queryMetrics))
+	for _, metric := range queryMetrics {
+		metrics = append(metrics, *metric)
+	}
+	queryMetricsMutex.Unlock()
+	sort.Sort(queryMetricsByTotal(metrics))
+	return metrics
+}
+
+// ResetQueryMetrics deletes all query metrics.
+func ResetQueryMetrics() {
+	queryMetricsMutex.Lock()
+	queryMetrics = map[queryMetricKey]*QueryMetric{}
+	queryMetricsMutex.Unlock()
+}
+
+type queryMetricsByTotal []QueryMetric
+
+func (self queryMetricsByTotal) Len() int           { return len(self) }
+func (self queryMetricsByTotal) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self queryMetricsByTotal) Less(i, j int) bool { return self[i].Total > self[j].Total }
+
+///////////////////////////////////////////////////////////////////////////////
+// Query instrumentation
+
+// traceQuery records the execution of operation on query.
+// Queries slower than Config.SlowQueryThreshold are logged
+// with their explain output.
+func traceQuery(query Query, operation string, duration time.Duration, err error) {
+	traceQueryTo(currentQueryTrace(), query, operation, duration, err)
+}
+
+// traceQueryTo records the execution of operation on query
+// in trace, which can be nil.
+func traceQueryTo(trace *QueryTrace, query Query, operation string, duration time.Duration, err error) {
+	if err == mgo.NotFound {
+		err = nil
+	}
+	var collectionName string
+	if collection := query.Collection(); collection != nil {
+		collectionName = collection.Name
+	}
+	var label string
+	if trace != nil {
+		label = trace.Label
+	}
+
+	key := queryMetricKey{label, collectionName, operation}
+	queryMetricsMutex.Lock()
+	metric, ok := queryMetrics[key]
+	if !ok {
+		metric = &QueryMetric{Label: label, Collection: collectionName, Operation: operation}
+		queryMetrics[key] = metric
+	}
+	metric.Count++
+	if err != nil {
+		metric.Errors++
+	}
+	metric.Total += duration
+	if duration > metric.Max {
+		metric.Max = duration
+	}
+	queryMetricsMutex.Unlock()
+
+	slow := Config.SlowQueryThreshold > 0 && duration >= Config.SlowQueryThreshold
+	if trace == nil && !slow {
+		return
+	}
+	stat := QueryStat{
+		Collection: collectionName,
+		Operation:  operation,
+		Query:      queryString(query),
+		Duration:   duration,
+		Err:        err,
+	}
+	if trace != nil {
+		trace.add(stat)
+	}
+	if slow {
+		if label != "" {
+			label = " (" + label + ")"
+		}
+		config.Logger.Printf("Slow mongo query%s: %s\nExplain: %s", label, stat.String(), query.Explain())
+	}
+}
+
+// queryString returns the selector of query as JSON.
+func queryString(query Query) string {
+	selector, err := bsonQuery(query)
+	if err != nil {
+		return err.Error()
+	}
+	data, err := json.Marshal(dumpToJSON(selector))
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
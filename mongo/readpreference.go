@@ -0,0 +1,56 @@
+package mongo
+
+import (
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/mgo"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// ReadPreference
+
+/*
+ReadPreference sets from which members of a replica set documents are read.
+It can be configured globally with Config.ReadPreference
+and per query with Query.ReadPreference().
+
+The read preferences are mapped to the consistency modes of mgo:
+
+	ReadPrimary:            mgo.Strong
+	ReadPrimaryPreferred:   mgo.PrimaryPreferred
+	ReadSecondaryPreferred: mgo.Eventual
+
+Example:
+
+	count, err := models.Visits.ReadPreference(mongo.ReadSecondaryPreferred).Count()
+*/
+type ReadPreference string
+
+const (
+	// ReadPrimary reads always from the primary. This is the default.
+	ReadPrimary ReadPreference = "primary"
+	// ReadPrimaryPreferred reads from the primary whenever it is available
+	// and from a secondary only if there is no reachable primary.
+	ReadPrimaryPreferred ReadPreference = "primaryPreferred"
+	// ReadSecondaryPreferred reads from any member and may return
+	// data that has not been replicated yet.
+	ReadSecondaryPreferred ReadPreference = "secondaryPreferred"
+)
+
+func (self ReadPreference) validate() error {
+	switch self {
+	case "", ReadPrimary, ReadPrimaryPreferred, ReadSecondaryPreferred:
+		return nil
+	}
+	return errs.Format("Invalid mongo read preference '%s'", self)
+}
+
+func (self ReadPreference) setMode(session *mgo.Session) {
+	switch self {
+	case ReadPrimaryPreferred:
+		session.SetMode(mgo.PrimaryPreferred, true)
+	case ReadSecondaryPreferred:
+		session.SetMode(mgo.Eventual, true)
+	default:
+		session.SetMode(mgo.Strong, true)
+	}
+}
@@ -0,0 +1,21 @@
+package mongo
+
+///////////////////////////////////////////////////////////////////////////////
+// readPreferenceQuery
+
+type readPreferenceQuery struct {
+	queryBase
+	pref ReadPreference
+}
+
+func (self *readPreferenceQuery) mongoQuery() (q queryBackend, err error) {
+	q, err = self.parentQuery.mongoQuery()
+	if err != nil {
+		return nil, err
+	}
+	return q.ReadPreference(self.pref), nil
+}
+
+func (self *readPreferenceQuery) Selector() string {
+	return ""
+}
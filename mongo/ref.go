@@ -15,6 +15,8 @@ and convenience functions only.
 type Ref struct {
 	ID             bson.ObjectId `gostart:"-"`
 	CollectionName string        `gostart:"-"`
+	// preloaded holds the referenced document if loaded by PreloadRefs()
+	preloaded interface{} `gostart:"-"`
 }
 
 func (self *Ref) String() string {
@@ -22,6 +24,7 @@ func (self *Ref) String() string {
 }
 
 func (self *Ref) SetString(str string) error {
+	self.preloaded = nil
 	switch len(str) {
 	case 0, 12:
 		self.ID = bson.ObjectId(str)
@@ -47,11 +50,32 @@ func (self *Ref) Get() (doc interface{}, err error) {
 
 // Returns an error if the reference is empty
 func (self *Ref) GetOrError() (doc interface{}, err error) {
+	if doc, ok := self.Preloaded(); ok {
+		return doc, nil
+	}
 	return self.Collection().DocumentWithID(self.ID)
 }
 
+// Preloaded returns the referenced document if it has
+// been preloaded by PreloadRefs() or Query.Preload().
+func (self *Ref) Preloaded() (doc interface{}, ok bool) {
+	if self.preloaded == nil {
+		return nil, false
+	}
+	// ID could have been changed after preloading
+	if document, isDoc := self.preloaded.(Document); isDoc && document.ObjectId() != self.ID {
+		return nil, false
+	}
+	return self.preloaded, true
+}
+
+func (self *Ref) preload(doc interface{}) {
+	self.preloaded = doc
+}
+
 // nil is valid and sets the reference to empty
 func (self *Ref) Set(document Document) {
+	self.preloaded = nil
 	if document == nil {
 		self.ID = ""
 		return
@@ -79,6 +103,7 @@ func (self Ref) GetBSON() (interface{}, error) {
 
 // Implements bson.Setter
 func (self *Ref) SetBSON(raw bson.Raw) error {
+	self.preloaded = nil
 	var id *bson.ObjectId
 	err := raw.Unmarshal(&id)
 	if err != nil {
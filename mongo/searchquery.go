@@ -0,0 +1,184 @@
+package mongo
+
+import (
+	"sort"
+
+	"github.com/ungerik/go-start/mgo"
+	"github.com/ungerik/go-start/mgo/bson"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// searchQuery
+
+// searchQuery restricts its query chain to the documents matching
+// a text search and orders them by relevance,
+// as long as no Sort() follows.
+type searchQuery struct {
+	queryBase
+	search string
+}
+
+func (self *searchQuery) mongoQuery() (q queryBackend, err error) {
+	collection := self.Collection()
+	filter, err := bsonQuery(self.thisQuery)
+	if err != nil {
+		return nil, err
+	}
+	collection.checkDBConnection()
+
+	if _, isMgo := collection.backend.(mgoCollection); isMgo && Config.ServerTextSearch {
+		selector := bson.M{"$text": bson.M{"$search": self.search}}
+		for key, value := range filter {
+			selector[key] = value
+		}
+		scored := &scoredQuery{query: collection.backend.Find(selector), serverScores: true}
+		// Select the score of the documents
+		return selectFields(self.thisQuery, scored.Select(bson.M{}))
+	}
+
+	scores, err := collection.textIndex.search(collection, self.search)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]bson.ObjectId, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	selector := bson.M{"_id": bson.M{"$in": ids}}
+	if len(filter) > 0 {
+		selector = bson.M{"$and": []bson.M{filter, selector}}
+	}
+	scored := &scoredQuery{query: collection.backend.Find(selector), scores: scores}
+	return selectFields(self.thisQuery, scored)
+}
+
+func (self *searchQuery) Selector() string {
+	return ""
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// scoredQuery
+
+// scoredQuery wraps the queryBackend of a searchQuery to order the
+// results by relevance before skip and limit are applied.
+type scoredQuery struct {
+	query queryBackend
+	// scores of the in-process text index by document ID
+	scores map[bson.ObjectId]float64
+	// serverScores is true if the scores are returned
+	// by MongoDB in the textScoreField of the documents
+	serverScores bool
+	// sorted is true if the results are sorted by Sort()
+	// instead of relevance
+	sorted bool
+	skip   int
+	limit  int
+}
+
+const textScoreField = "_textscore"
+
+func (self scoredQuery) Skip(n int) queryBackend {
+	self.skip = n
+	return &self
+}
+
+func (self scoredQuery) Limit(n int) queryBackend {
+	self.limit = n
+	return &self
+}
+
+func (self scoredQuery) Sort(fields ...string) queryBackend {
+	self.query = self.query.Sort(fields...)
+	self.sorted = len(fields) > 0
+	return &self
+}
+
+func (self scoredQuery) Select(selector interface{}) queryBackend {
+	if self.serverScores {
+		fields, err := memoryNormalize(selector)
+		if err == nil {
+			fields[textScoreField] = bson.M{"$meta": "textScore"}
+			selector = fields
+		}
+	}
+	self.query = self.query.Select(selector)
+	return &self
+}
+
+func (self scoredQuery) ReadPreference(pref ReadPreference) queryBackend {
+	self.query = self.query.ReadPreference(pref)
+	return &self
+}
+
+type scoredDocument struct {
+	document bson.M
+	score    float64
+}
+
+type scoredDocuments []scoredDocument
+
+func (self scoredDocuments) Len() int           { return len(self) }
+func (self scoredDocuments) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self scoredDocuments) Less(i, j int) bool { return self[i].score > self[j].score }
+
+func (self *scoredQuery) results() (documents []bson.M, err error) {
+	var scored scoredDocuments
+	i := self.query.Iter()
+	doc := bson.M{}
+	for i.Next(&doc) {
+		var score float64
+		if self.serverScores {
+			score, _ = memoryNumber(doc[textScoreField])
+			delete(doc, textScoreField)
+		} else if id, ok := doc["_id"].(bson.ObjectId); ok {
+			score = self.scores[id]
+		}
+		scored = append(scored, scoredDocument{doc, score})
+		doc = bson.M{}
+	}
+	if i.Err() != nil {
+		return nil, i.Err()
+	}
+	if !self.sorted {
+		sort.Stable(scored)
+	}
+	if self.skip > 0 {
+		if self.skip >= len(scored) {
+			return nil, nil
+		}
+		scored = scored[self.skip:]
+	}
+	if self.limit > 0 && self.limit < len(scored) {
+		scored = scored[:self.limit]
+	}
+	documents = make([]bson.M, len(scored))
+	for i := range scored {
+		documents[i] = scored[i].document
+	}
+	return documents, nil
+}
+
+func (self *scoredQuery) One(result interface{}) error {
+	documents, err := self.results()
+	if err != nil {
+		return err
+	}
+	if len(documents) == 0 {
+		return mgo.NotFound
+	}
+	return memoryDecode(documents[0], result)
+}
+
+func (self *scoredQuery) Iter() iterBackend {
+	documents, err := self.results()
+	return &bsonIter{documents: documents, err: err}
+}
+
+func (self *scoredQuery) Count() (n int, err error) {
+	documents, err := self.results()
+	return len(documents), err
+}
+
+func (self *scoredQuery) Explain(result interface{}) error {
+	return self.query.Explain(result)
+}
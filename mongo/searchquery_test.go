@@ -0,0 +1,149 @@
+package mongo
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ungerik/go-start/model"
+)
+
+type searchDocument struct {
+	DocumentBase `bson:",inline"`
+	Title        model.String
+	Text         model.String
+	Tags         []model.String
+	Draft        model.Bool
+}
+
+var searchDocuments = NewCollection("test_search_documents", (*searchDocument)(nil))
+
+func init() {
+	err := searchDocuments.SetTextIndex(
+		TextIndexField{Selector: "Title", Weight: 10},
+		TextIndexField{Selector: "Text"},
+		TextIndexField{Selector: "Tags", Weight: 5},
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func newSearchDocument(t *testing.T, title, text string, tags ...string) *searchDocument {
+	t.Helper()
+	doc := searchDocuments.NewDocument().(*searchDocument)
+	doc.Title.Set(title)
+	doc.Text.Set(text)
+	for _, tag := range tags {
+		doc.Tags = append(doc.Tags, model.String(tag))
+	}
+	saveTestDocument(t, doc)
+	return doc
+}
+
+func searchTitles(t *testing.T, query Query) string {
+	t.Helper()
+	var titles []string
+	i := query.Iterator()
+	for doc := i.Next(); doc != nil; doc = i.Next() {
+		titles = append(titles, doc.(*searchDocument).Title.Get())
+	}
+	if i.Err() != nil {
+		t.Fatal(i.Err())
+	}
+	return strings.Join(titles, ",")
+}
+
+func TestSearch(t *testing.T) {
+	InitMemory()
+	searchDocuments.RebuildTextIndex()
+	newSearchDocument(t, "Gardening", "How to grow tomatoes in a small garden")
+	newSearchDocument(t, "Tomatoes", "Recipes for sauce")
+	newSearchDocument(t, "Cooking", "Pasta with tomato sauce", "Tomatoes")
+	draft := newSearchDocument(t, "Draft", "Tomatoes and more tomatoes")
+	draft.Draft = true
+	saveTestDocument(t, draft)
+
+	tests := []struct {
+		name   string
+		query  Query
+		titles string
+	}{
+		{"weighted fields", searchDocuments.Search("tomatoes"), "Tomatoes,Cooking,Draft,Gardening"},
+		{"case insensitive", searchDocuments.Search("PASTA"), "Cooking"},
+		{"any word", searchDocuments.Search("pasta gardening"), "Gardening,Cooking"},
+		{"phrase", searchDocuments.Search(`"tomato sauce"`), "Cooking"},
+		{"excluded word", searchDocuments.Search("tomatoes -sauce"), "Draft,Gardening"},
+		{"with filter", searchDocuments.Filter("Draft", false).Search("tomatoes"), "Tomatoes,Cooking,Gardening"},
+		{"sorted", searchDocuments.Search("tomatoes").Sort("Title"), "Cooking,Draft,Gardening,Tomatoes"},
+		{"skip and limit", searchDocuments.Search("tomatoes").Skip(1).Limit(2), "Cooking,Draft"},
+		{"no match", searchDocuments.Search("potatoes"), ""},
+	}
+	for _, test := range tests {
+		if titles := searchTitles(t, test.query); titles != test.titles {
+			t.Errorf("%s: found %q instead of %q", test.name, titles, test.titles)
+		}
+	}
+	if n, err := searchDocuments.Search("sauce").Count(); err != nil || n != 2 {
+		t.Errorf("Count() returned %d, %v", n, err)
+	}
+}
+
+func TestSearchIndexUpdates(t *testing.T) {
+	InitMemory()
+	searchDocuments.RebuildTextIndex()
+	doc := newSearchDocument(t, "Gardening", "Flowers")
+	other := newSearchDocument(t, "Cooking", "Pasta")
+	if titles := searchTitles(t, searchDocuments.Search("flowers")); titles != "Gardening" {
+		t.Fatalf("found %q", titles)
+	}
+
+	// Save() re-indexes the document
+	doc.Text.Set("Roses")
+	saveTestDocument(t, doc)
+	if titles := searchTitles(t, searchDocuments.Search("flowers")); titles != "" {
+		t.Errorf("old text found after Save(): %q", titles)
+	}
+	if titles := searchTitles(t, searchDocuments.Search("roses")); titles != "Gardening" {
+		t.Errorf("new text not found after Save(): %q", titles)
+	}
+
+	// Query writes mark the index for a rebuild
+	if err := searchDocuments.Filter("Title", "Cooking").UpdateAll("text", "Pizza"); err != nil {
+		t.Fatal(err)
+	}
+	if titles := searchTitles(t, searchDocuments.Search("pizza")); titles != "Cooking" {
+		t.Errorf("text not found after UpdateAll(): %q", titles)
+	}
+
+	if err := other.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if titles := searchTitles(t, searchDocuments.Search("pizza")); titles != "" {
+		t.Errorf("removed document found: %q", titles)
+	}
+}
+
+func TestSearchWithoutIndex(t *testing.T) {
+	if _, err := testDocuments.Search("erik").One(); err == nil {
+		t.Error("no error for a search without text index")
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		query string
+		terms []string
+	}{
+		{"", nil},
+		{"Hello World", []string{"hello", "world"}},
+		{`say "Hello,  World!" -bye`, []string{"hello world", "say"}},
+		{"e-mail", []string{"e", "mail"}},
+		{`"unterminated phrase`, []string{"unterminated phrase"}},
+	}
+	for _, test := range tests {
+		if terms := SearchTerms(test.query); !reflect.DeepEqual(terms, test.terms) {
+			t.Errorf("SearchTerms(%q) is %q instead of %q", test.query, terms, test.terms)
+		}
+	}
+}
@@ -1,7 +1,5 @@
 package mongo
 
-import "github.com/ungerik/go-start/mgo"
-
 ///////////////////////////////////////////////////////////////////////////////
 // skipQuery
 
@@ -10,7 +8,7 @@ type skipQuery struct {
 	skip int
 }
 
-func (self *skipQuery) mongoQuery() (q *mgo.Query, err error) {
+func (self *skipQuery) mongoQuery() (q queryBackend, err error) {
 	q, err = self.parentQuery.mongoQuery()
 	if err != nil {
 		return nil, err
@@ -1,8 +1,8 @@
 package mongo
 
 import (
-	"github.com/ungerik/go-start/mgo"
 	"github.com/ungerik/go-start/mgo/bson"
+	"github.com/ungerik/go-start/utils"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -10,25 +10,43 @@ import (
 
 type sortQuery struct {
 	queryBase
-	selector  string
-	direction int
+	selector   string
+	descending bool
 }
 
-func (self *sortQuery) mongoQuery() (q *mgo.Query, err error) {
-	elems := bson.D{{self.selector, self.direction}}
-	for query := self.parentQuery; query != nil; query = query.ParentQuery() {
+func (self *sortQuery) sortField() (string, error) {
+	// Selectors following a SubDocument() query
+	// are relative to the sub-document
+	prefix, err := subDocumentPrefix(self)
+	if err != nil {
+		return "", err
+	}
+	if self.descending {
+		return "-" + prefix + self.selector, nil
+	}
+	return prefix + self.selector, nil
+}
+
+func (self *sortQuery) mongoQuery() (q queryBackend, err error) {
+	var fields []string
+	var query Query = self
+	for ; query != nil; query = query.ParentQuery() {
 		s, ok := query.(*sortQuery)
 		if !ok {
 			break
 		}
-		elems = append(elems, bson.DocElem{s.selector, s.direction})
+		field, err := s.sortField()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
 	}
-	ReverseBsonD(elems)
-	q, err = self.parentQuery.mongoQuery()
+	utils.ReverseStringSlice(fields)
+	q, err = query.mongoQuery()
 	if err != nil {
 		return nil, err
 	}
-	return q.Sort(elems), nil
+	return q.Sort(fields...), nil
 }
 
 func (self *sortQuery) Selector() string {
@@ -2,8 +2,8 @@ package mongo
 
 import (
 	"github.com/ungerik/go-start/errs"
-	"github.com/ungerik/go-start/model"
 	"github.com/ungerik/go-start/mgo/bson"
+	"github.com/ungerik/go-start/model"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -14,6 +14,7 @@ type SubDocumentBase struct {
 	collection      *Collection   `gostart:"-"`
 	selector        string        `gostart:"-"`
 	embeddingStruct interface{}   `gostart:"-"`
+	partial         bool          `gostart:"-"`
 }
 
 func (self *SubDocumentBase) Init(collection *Collection, selector string, embeddingStruct interface{}) {
@@ -51,15 +52,28 @@ func (self *SubDocumentBase) Iterator() model.Iterator {
 	return model.NewObjectIterator(self.embeddingStruct)
 }
 
+// IsPartial returns true if the sub-document has been loaded by a query
+// with Select() or Exclude(). Partial sub-documents can't be saved.
+func (self *SubDocumentBase) IsPartial() bool {
+	return self.partial
+}
+
+func (self *SubDocumentBase) setProjection(projection *fieldProjection) {
+	self.partial = projection != nil
+}
+
 func (self *SubDocumentBase) Save() error {
 	if self.embeddingStruct == nil {
 		return errs.Format("Can't save uninitialized mongo.SubDocument. embeddingStruct is nil.")
 	}
+	if self.partial {
+		return errs.Format("Can't save partially loaded mongo.SubDocument '%s'", self.selector)
+	}
 	if !self.rootDocumentID.Valid() {
 		return errs.Format("Can't save mongo.SubDocument with invalid RootDocumentObjectId.")
 	}
 
-	return self.collection.Update(self.rootDocumentID, bson.M{self.selector: self.embeddingStruct})
+	return self.collection.UpdateWith(self.rootDocumentID, NewUpdate().Set(self.selector, self.embeddingStruct))
 }
 
 func (self *SubDocumentBase) RemoveRootDocument() error {
@@ -1,14 +1,14 @@
 package mongo
 
-import (
-	"github.com/ungerik/go-start/mgo/bson"
-)
-
 ///////////////////////////////////////////////////////////////////////////////
 // subDocumentQuery
 
+// subDocumentQuery selects a sub-document of the documents
+// of the query chain. Its results are sub-documents instead of documents.
+// The selectors of following filter and sort queries are
+// relative to the sub-document.
 type subDocumentQuery struct {
-	filterQueryBase
+	queryBase
 	selector string
 }
 
@@ -16,8 +16,12 @@ func (self *subDocumentQuery) subDocumentSelector() string {
 	return self.selector
 }
 
-func (self *subDocumentQuery) bsonSelector() bson.M {
-	return bson.M{self.selector: 1}
+func (self *subDocumentQuery) mongoQuery() (q queryBackend, err error) {
+	q, err = self.parentQuery.mongoQuery()
+	if err != nil {
+		return nil, err
+	}
+	return selectFields(self.thisQuery, q)
 }
 
 func (self *subDocumentQuery) Selector() string {
@@ -0,0 +1,78 @@
+package mongo
+
+import (
+	"testing"
+
+	"github.com/ungerik/go-start/model"
+)
+
+func TestValidateSelector(t *testing.T) {
+	tests := []struct {
+		selectors []string
+		valid     bool
+	}{
+		{nil, true},
+		{[]string{"name"}, true},
+		{[]string{"Address.City"}, true},
+		{[]string{"address", "city"}, true},
+		{[]string{"tags.1"}, true},
+		{[]string{"tags.$"}, true},
+		{[]string{"address.street"}, false},
+		{[]string{"name.first"}, false},
+		{[]string{"address."}, false},
+		{[]string{"address", ""}, false},
+	}
+	for _, test := range tests {
+		if err := testDocuments.ValidateSelector(test.selectors...); (err == nil) != test.valid {
+			t.Errorf("ValidateSelector(%q) returned %v", test.selectors, err)
+		}
+	}
+}
+
+func TestSubDocument(t *testing.T) {
+	InitMemory()
+	for _, city := range []string{"Vienna", "Berlin", "Vienna"} {
+		doc := testDocuments.NewDocument().(*testDocument)
+		doc.Address.City.Set(city)
+		doc.Address.Zip.Set(city[:1])
+		doc.Tags = []model.String{"first", model.String(city)}
+		saveTestDocument(t, doc)
+	}
+
+	if _, ok := testDocuments.NewDocument("Address").(*testAddress); !ok {
+		t.Error("NewDocument(\"Address\") didn't return a *testAddress")
+	}
+
+	// Filters following SubDocument() are relative to the sub-document
+	query := testDocuments.SubDocument("Address").Filter("City", "Vienna")
+	if n, err := query.Count(); err != nil || n != 2 {
+		t.Errorf("Count() of relative filter returned %d, %v", n, err)
+	}
+	doc, err := query.One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address, ok := doc.(*testAddress); !ok || address.City != "Vienna" || address.Zip != "V" {
+		t.Errorf("One() returned %#v instead of the address", doc)
+	}
+
+	doc, err = testDocuments.SubDocument("Address").Sort("City").One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.(*testAddress).City != "Berlin" {
+		t.Errorf("Sort() is not relative to the sub-document: %v", doc)
+	}
+
+	doc, err = testDocuments.Filter("Address.City", "Berlin").SubDocument("Tags.1").One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, ok := doc.(*model.String); !ok || *tag != "Berlin" {
+		t.Errorf("array element sub-document is %#v", doc)
+	}
+
+	if _, err = testDocuments.SubDocument("Address").Filter("Street", "x").One(); err == nil {
+		t.Error("no error for invalid selector relative to the sub-document")
+	}
+}
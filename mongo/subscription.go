@@ -0,0 +1,424 @@
+package mongo
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/mgo"
+	"github.com/ungerik/go-start/mgo/bson"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// ChangeEvent
+
+type ChangeType string
+
+const (
+	ChangeInsert ChangeType = "insert"
+	ChangeUpdate ChangeType = "update"
+	ChangeRemove ChangeType = "remove"
+)
+
+// ChangeEvent is sent by a Subscription for every change
+// of a document in the collection.
+type ChangeEvent struct {
+	Type ChangeType
+	ID   bson.ObjectId
+	// Document is the current state of the document when the event
+	// is delivered. It is nil for ChangeRemove events and if the
+	// document has been removed before the event was delivered.
+	Document interface{}
+	// ResumeToken can be passed to Collection.Subscribe()
+	// to receive the events after this one.
+	ResumeToken string
+}
+
+// change is an event of a changeBackend without the document
+type change struct {
+	changeType  ChangeType
+	id          bson.ObjectId
+	resumeToken string
+}
+
+// watchFunc calls emit for every change until
+// emit returns false or done is closed.
+type watchFunc func(done <-chan struct{}, emit func(change) bool) error
+
+// changeBackend is implemented by collection backends that support
+// subscriptions. watch determines the start of the changes at the
+// time of the call: after resumeToken or after the current state
+// if resumeToken is empty.
+type changeBackend interface {
+	watch(resumeToken string) (watchFunc, error)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Subscription
+
+/*
+Subscription delivers the changes of the documents of a collection
+as ChangeEvents over the channel Events.
+Events is closed when the subscription is closed or an error occurred.
+
+For MongoDB, capped collections are watched with a tailable cursor
+which delivers only inserts. Other collections are watched by tailing
+the oplog, which needs a replica set and read access to the
+local database. The memory backend of InitMemory() supports
+subscriptions too.
+
+Example:
+
+	subscription, err := models.Comments.Subscribe(lastResumeToken)
+	if err != nil {
+		return err
+	}
+	defer subscription.Close()
+	for event := range subscription.Events {
+		comment, ok := event.Document.(*models.Comment)
+		...
+	}
+	if subscription.Err() != nil {
+		// Resume later with subscription.ResumeToken()
+	}
+*/
+type Subscription struct {
+	Events <-chan *ChangeEvent
+
+	collection *Collection
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	mutex       sync.Mutex
+	err         error
+	resumeToken string
+}
+
+// Subscribe starts a Subscription for the changes after resumeToken
+// or for all future changes if resumeToken is empty.
+func (self *Collection) Subscribe(resumeToken string) (*Subscription, error) {
+	self.checkDBConnection()
+	backend, ok := self.backend.(changeBackend)
+	if !ok {
+		return nil, errs.Format("Collection '%s' doesn't support subscriptions", self.Name)
+	}
+	watch, err := backend.watch(resumeToken)
+	if err != nil {
+		return nil, err
+	}
+	// Unbuffered, so resumeToken is only set for received events
+	events := make(chan *ChangeEvent)
+	subscription := &Subscription{
+		Events:      events,
+		collection:  self,
+		done:        make(chan struct{}),
+		resumeToken: resumeToken,
+	}
+	go func() {
+		defer close(events)
+		err := watch(subscription.done, func(c change) bool {
+			return subscription.deliver(events, c)
+		})
+		if err != nil {
+			subscription.mutex.Lock()
+			if subscription.err == nil {
+				subscription.err = err
+			}
+			subscription.mutex.Unlock()
+		}
+	}()
+	return subscription, nil
+}
+
+// deliver loads the document of c and sends the event.
+// It returns false if the subscription has been closed
+// or the document could not be loaded.
+func (self *Subscription) deliver(events chan<- *ChangeEvent, c change) bool {
+	event := &ChangeEvent{Type: c.changeType, ID: c.id, ResumeToken: c.resumeToken}
+	if c.changeType != ChangeRemove {
+		document, _, err := self.collection.TryDocumentWithID(c.id)
+		if err != nil {
+			self.mutex.Lock()
+			self.err = err
+			self.mutex.Unlock()
+			return false
+		}
+		event.Document = document
+	}
+	select {
+	case events <- event:
+		self.mutex.Lock()
+		self.resumeToken = c.resumeToken
+		self.mutex.Unlock()
+		return true
+	case <-self.done:
+		return false
+	}
+}
+
+// Err returns the error that ended the subscription.
+func (self *Subscription) Err() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.err
+}
+
+// ResumeToken returns the resume token of the last event
+// that has been received from Events.
+func (self *Subscription) ResumeToken() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.resumeToken
+}
+
+// Close stops the subscription. Events will be closed.
+func (self *Subscription) Close() {
+	self.closeOnce.Do(func() { close(self.done) })
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// MongoDB subscriptions
+
+// subscriptionTimeout is the time tailable cursors wait for new documents
+// before checking if the subscription has been closed.
+const subscriptionTimeout = time.Second
+
+// CreateCapped creates the collection in MongoDB as capped collection
+// with a maximum size in bytes and optional maximum number of documents.
+// Subscriptions of capped collections use tailable cursors.
+func (self *Collection) CreateCapped(size int, maxDocuments int) error {
+	if Database == nil {
+		return errs.Format("Collection '%s': Capped collections need a MongoDB connection", self.Name)
+	}
+	command := bson.D{{Name: "create", Value: self.Name}, {Name: "capped", Value: true}, {Name: "size", Value: size}}
+	if maxDocuments > 0 {
+		command = append(command, bson.DocElem{Name: "max", Value: maxDocuments})
+	}
+	return Database.Run(command, nil)
+}
+
+func (self mgoCollection) watch(resumeToken string) (watchFunc, error) {
+	// Tailable cursors block a socket, so use an own session
+	session := self.Database.Session.Copy()
+	collection := self.With(session)
+
+	var stats struct {
+		Capped bool `bson:"capped"`
+	}
+	err := collection.Database.Run(bson.D{{Name: "collStats", Value: collection.Name}}, &stats)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	var watch watchFunc
+	if stats.Capped {
+		watch, err = tailCapped(collection, resumeToken)
+	} else {
+		watch, err = tailOplog(session.DB("local").C("oplog.rs"), collection.FullName, resumeToken)
+	}
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return func(done <-chan struct{}, emit func(change) bool) error {
+		defer session.Close()
+		return watch(done, emit)
+	}, nil
+}
+
+// tailUntilDone returns a watchFunc that iterates the tailable cursors
+// returned by newIter until done is closed. Every cursor is started again
+// if it becomes invalid, for example because a capped collection was empty.
+// next returns ok if it read a result and stop if emit returned false.
+func tailUntilDone(newIter func() *mgo.Iter, next func(iter *mgo.Iter, emit func(change) bool) (ok, stop bool)) watchFunc {
+	return func(done <-chan struct{}, emit func(change) bool) error {
+		for {
+			iter := newIter()
+			for {
+				ok, stop := next(iter, emit)
+				if stop {
+					iter.Close()
+					return nil
+				}
+				if ok {
+					continue
+				}
+				if iter.Err() != nil {
+					return iter.Close()
+				}
+				select {
+				case <-done:
+					iter.Close()
+					return nil
+				default:
+				}
+				if !iter.Timeout() {
+					break
+				}
+			}
+			// Release the invalid cursor before starting a new one
+			iter.Close()
+			select {
+			case <-done:
+				return nil
+			case <-time.After(subscriptionTimeout):
+			}
+		}
+	}
+}
+
+// tailCapped watches the inserts of a capped collection.
+// The resume token is the hex ID of the last document.
+func tailCapped(collection *mgo.Collection, resumeToken string) (watchFunc, error) {
+	var doc struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	if resumeToken == "" {
+		err := collection.Find(nil).Sort("-$natural").One(&doc)
+		if err != nil && err != mgo.NotFound {
+			return nil, err
+		}
+	} else {
+		if !bson.IsObjectIdHex(resumeToken) {
+			return nil, errs.Format("Invalid resume token '%s'", resumeToken)
+		}
+		doc.ID = bson.ObjectIdHex(resumeToken)
+	}
+	lastID := doc.ID
+
+	watch := tailUntilDone(
+		func() *mgo.Iter {
+			query := bson.M{}
+			if lastID != "" {
+				query["_id"] = bson.M{"$gt": lastID}
+			}
+			return collection.Find(query).Sort("$natural").Tail(subscriptionTimeout)
+		},
+		func(iter *mgo.Iter, emit func(change) bool) (ok, stop bool) {
+			if !iter.Next(&doc) {
+				return false, false
+			}
+			lastID = doc.ID
+			return true, !emit(change{ChangeInsert, doc.ID, doc.ID.Hex()})
+		},
+	)
+	return watch, nil
+}
+
+// tailOplog watches the changes of the collection with fullName
+// in the oplog of a replica set.
+// The resume token is the timestamp of the last oplog entry.
+func tailOplog(oplog *mgo.Collection, fullName string, resumeToken string) (watchFunc, error) {
+	var entry struct {
+		TS bson.MongoTimestamp `bson:"ts"`
+		Op string              `bson:"op"`
+		O  bson.M              `bson:"o"`
+		O2 bson.M              `bson:"o2"`
+	}
+	if resumeToken == "" {
+		err := oplog.Find(nil).Sort("-$natural").One(&entry)
+		if err != nil && err != mgo.NotFound {
+			return nil, err
+		}
+	} else {
+		ts, err := strconv.ParseInt(resumeToken, 10, 64)
+		if err != nil {
+			return nil, errs.Format("Invalid resume token '%s'", resumeToken)
+		}
+		entry.TS = bson.MongoTimestamp(ts)
+	}
+	lastTS := entry.TS
+
+	watch := tailUntilDone(
+		func() *mgo.Iter {
+			query := bson.M{"ns": fullName, "ts": bson.M{"$gt": lastTS}}
+			return oplog.Find(query).Sort("$natural").Tail(subscriptionTimeout)
+		},
+		func(iter *mgo.Iter, emit func(change) bool) (ok, stop bool) {
+			entry.O, entry.O2 = nil, nil
+			if !iter.Next(&entry) {
+				return false, false
+			}
+			lastTS = entry.TS
+			var c change
+			switch entry.Op {
+			case "i":
+				c.changeType = ChangeInsert
+				c.id, _ = entry.O["_id"].(bson.ObjectId)
+			case "u":
+				c.changeType = ChangeUpdate
+				c.id, _ = entry.O2["_id"].(bson.ObjectId)
+			case "d":
+				c.changeType = ChangeRemove
+				c.id, _ = entry.O["_id"].(bson.ObjectId)
+			}
+			if c.id == "" {
+				// Commands, no-ops and documents without ObjectId
+				return true, false
+			}
+			c.resumeToken = strconv.FormatInt(int64(entry.TS), 10)
+			return true, !emit(c)
+		},
+	)
+	return watch, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Memory subscriptions
+
+// The resume token of the memory backend is the
+// sequence number of the last change.
+func (self *memoryCollection) watch(resumeToken string) (watchFunc, error) {
+	self.mutex.Lock()
+	lastSeq := self.changeSeq
+	self.mutex.Unlock()
+	if resumeToken != "" {
+		seq, err := strconv.ParseInt(resumeToken, 10, 64)
+		if err != nil || seq > lastSeq {
+			return nil, errs.Format("Invalid resume token '%s'", resumeToken)
+		}
+		lastSeq = seq
+	}
+	return func(done <-chan struct{}, emit func(change) bool) error {
+		return self.watchChanges(lastSeq, done, emit)
+	}, nil
+}
+
+func (self *memoryCollection) watchChanges(lastSeq int64, done <-chan struct{}, emit func(change) bool) error {
+	for {
+		self.mutex.Lock()
+		if len(self.changes) > 0 && self.changes[0].seq > lastSeq+1 {
+			self.mutex.Unlock()
+			return errs.Format("Can't resume at change %d, changes since then are not available anymore", lastSeq)
+		}
+		var changes []memoryChange
+		for _, c := range self.changes {
+			if c.seq > lastSeq {
+				changes = append(changes, c)
+			}
+		}
+		if self.changed == nil {
+			self.changed = make(chan struct{})
+		}
+		changed := self.changed
+		self.mutex.Unlock()
+
+		for _, c := range changes {
+			lastSeq = c.seq
+			id, ok := c.id.(bson.ObjectId)
+			if !ok {
+				continue
+			}
+			if !emit(change{c.changeType, id, strconv.FormatInt(c.seq, 10)}) {
+				return nil
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-done:
+			return nil
+		}
+	}
+}
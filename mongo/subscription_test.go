@@ -0,0 +1,137 @@
+package mongo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ungerik/go-start/mgo/bson"
+)
+
+func nextEvent(t *testing.T, subscription *Subscription) *ChangeEvent {
+	t.Helper()
+	select {
+	case event, ok := <-subscription.Events:
+		if !ok {
+			t.Fatalf("Events closed: %v", subscription.Err())
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	return nil
+}
+
+func expectEvent(t *testing.T, subscription *Subscription, changeType ChangeType, id bson.ObjectId) *ChangeEvent {
+	t.Helper()
+	event := nextEvent(t, subscription)
+	if event.Type != changeType || event.ID != id {
+		t.Fatalf("received %s of %s instead of %s of %s", event.Type, event.ID.Hex(), changeType, id.Hex())
+	}
+	return event
+}
+
+// closeSubscription closes subscription and waits until
+// its goroutine has ended.
+func closeSubscription(t *testing.T, subscription *Subscription) {
+	t.Helper()
+	subscription.Close()
+	for {
+		select {
+		case _, ok := <-subscription.Events:
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Events not closed by Close()")
+		}
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	InitMemory()
+	existing := newTestDocument(t, "existing")
+	subscription, err := testDocuments.Subscribe("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSubscription(t, subscription)
+
+	// Only changes after Subscribe() are delivered
+	doc := newTestDocument(t, "a")
+	event := expectEvent(t, subscription, ChangeInsert, doc.ID)
+	if d, ok := event.Document.(*testDocument); !ok || d.Name != "a" {
+		t.Errorf("inserted document is %#v", event.Document)
+	}
+	if subscription.ResumeToken() != event.ResumeToken {
+		t.Error("ResumeToken() is not the token of the received event")
+	}
+
+	doc.Name.Set("b")
+	saveTestDocument(t, doc)
+	event = expectEvent(t, subscription, ChangeUpdate, doc.ID)
+	if d := event.Document.(*testDocument); d.Name != "b" {
+		t.Errorf("updated document has the name %q", d.Name)
+	}
+
+	if err = existing.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if event = expectEvent(t, subscription, ChangeRemove, existing.ID); event.Document != nil {
+		t.Error("remove event has a document")
+	}
+
+	closeSubscription(t, subscription)
+	if subscription.Err() != nil {
+		t.Error(subscription.Err())
+	}
+}
+
+func TestSubscriptionResume(t *testing.T) {
+	InitMemory()
+	subscription, err := testDocuments.Subscribe("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := newTestDocument(t, "first")
+	expectEvent(t, subscription, ChangeInsert, first.ID)
+	resumeToken := subscription.ResumeToken()
+	closeSubscription(t, subscription)
+
+	// Changes while nobody is subscribed
+	second := newTestDocument(t, "second")
+	third := newTestDocument(t, "third")
+	if err = second.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	subscription, err = testDocuments.Subscribe(resumeToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSubscription(t, subscription)
+	// The document of an event is loaded at delivery
+	if event := expectEvent(t, subscription, ChangeInsert, second.ID); event.Document != nil {
+		t.Error("event of a removed document has a document")
+	}
+	expectEvent(t, subscription, ChangeInsert, third.ID)
+	expectEvent(t, subscription, ChangeRemove, second.ID)
+
+	// Resuming twice from the same token delivers the same events
+	again, err := testDocuments.Subscribe(resumeToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSubscription(t, again)
+	expectEvent(t, again, ChangeInsert, second.ID)
+}
+
+func TestSubscriptionInvalidResumeToken(t *testing.T) {
+	InitMemory()
+	newTestDocument(t, "a")
+	for _, resumeToken := range []string{"abc", "-", "1000"} {
+		if subscription, err := testDocuments.Subscribe(resumeToken); err == nil {
+			closeSubscription(t, subscription)
+			t.Errorf("no error for resume token %q", resumeToken)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package mongo
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/mgo/bson"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// TextIndexField
+
+// TextIndexField is a field of the text index of a collection.
+// Matches in fields with a higher Weight are more relevant.
+type TextIndexField struct {
+	Selector string
+	Weight   int // Default is 1
+}
+
+/*
+SetTextIndex declares the fields of the documents that are searched
+by Query.Search(). Selectors of arrays and slices search all elements.
+
+If Config.ServerTextSearch is true, Search() uses the MongoDB text index
+that has to be created with EnsureTextIndex().
+Else the collection is searched with an in-process inverted index
+that is built at the first search. Documents written by ID are
+re-indexed after the write, writes of queries, bulks and imports
+mark the index for a rebuild at the next search.
+Use RebuildTextIndex() after changes by other processes.
+
+Example:
+
+	err := models.Posts.SetTextIndex(
+		mongo.TextIndexField{Selector: "Title", Weight: 10},
+		mongo.TextIndexField{Selector: "Text"},
+	)
+*/
+func (self *Collection) SetTextIndex(fields ...TextIndexField) error {
+	if len(fields) == 0 {
+		self.textIndex = nil
+		return nil
+	}
+	index := &textIndex{fields: make([]textIndexField, len(fields)), dirty: true}
+	for i, field := range fields {
+		_, path, err := self.subDocumentPath([]string{strings.ToLower(field.Selector)})
+		if err != nil {
+			return err
+		}
+		weight := field.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		index.fields[i] = textIndexField{path: path, weight: weight}
+	}
+	self.textIndex = index
+	return nil
+}
+
+// HasTextIndex returns true if SetTextIndex() has been called
+// with at least one field.
+func (self *Collection) HasTextIndex() bool {
+	return self.textIndex != nil
+}
+
+// EnsureTextIndex creates the MongoDB text index for the fields
+// declared with SetTextIndex(). Needs MongoDB 2.6 or newer.
+func (self *Collection) EnsureTextIndex() error {
+	if self.textIndex == nil {
+		return errs.Format("Collection '%s' has no text index", self.Name)
+	}
+	if Database == nil {
+		return errs.Format("Collection '%s': Text indexes need a MongoDB connection", self.Name)
+	}
+	keys := bson.D{}
+	weights := bson.M{}
+	for _, field := range self.textIndex.fields {
+		keys = append(keys, bson.DocElem{Name: field.path, Value: "text"})
+		weights[field.path] = field.weight
+	}
+	index := bson.M{"key": keys, "name": self.Name + "_text", "weights": weights}
+	return Database.Run(bson.D{{Name: "createIndexes", Value: self.Name}, {Name: "indexes", Value: []bson.M{index}}}, nil)
+}
+
+// RebuildTextIndex marks the in-process text index as outdated,
+// so it is rebuilt at the next search.
+func (self *Collection) RebuildTextIndex() {
+	if self.textIndex != nil {
+		self.textIndex.setDirty()
+	}
+}
+
+// TextIndexValues returns the texts of the text index fields of document.
+func (self *Collection) TextIndexValues(document interface{}) (texts []string) {
+	if self.textIndex == nil {
+		return nil
+	}
+	doc, err := memoryNormalize(document)
+	if err != nil {
+		return nil
+	}
+	for _, field := range self.textIndex.fields {
+		texts = append(texts, textValues(doc, field.path)...)
+	}
+	return texts
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Search terms
+
+// SearchTerms returns the lower case words and quoted phrases
+// of a search query that have to be matched.
+// Words prefixed with '-' are excluded from the results
+// and not returned.
+func SearchTerms(query string) (terms []string) {
+	words, phrases, _ := parseSearch(query)
+	return append(phrases, words...)
+}
+
+// parseSearch parses a search query in the syntax of MongoDB:
+// words, "quoted phrases" and -excluded words.
+func parseSearch(query string) (words, phrases, excluded []string) {
+	parts := strings.Split(query, `"`)
+	for i, part := range parts {
+		if i%2 == 1 {
+			if phrase := strings.Join(textTokens(part), " "); phrase != "" {
+				phrases = append(phrases, phrase)
+			}
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			if strings.HasPrefix(field, "-") {
+				excluded = append(excluded, textTokens(field)...)
+			} else {
+				words = append(words, textTokens(field)...)
+			}
+		}
+	}
+	return words, phrases, excluded
+}
+
+// textTokens splits text into lower case words.
+func textTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// textValues returns all strings at path of doc.
+func textValues(doc bson.M, path string) (texts []string) {
+	for _, value := range memoryExpand(bsonPathValues(doc, strings.Split(path, "."))) {
+		if s, ok := value.(string); ok && s != "" {
+			texts = append(texts, s)
+		}
+	}
+	return texts
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// textIndex
+
+type textIndexField struct {
+	path   string
+	weight int
+}
+
+// textIndex is the in-process inverted index of a collection.
+type textIndex struct {
+	fields []textIndexField
+
+	mutex sync.Mutex
+	dirty bool
+	// postings holds the weighted term frequency
+	// of every word in every document
+	postings map[string]map[bson.ObjectId]float64
+	// texts holds the joined lower case words of every document
+	// for matching phrases
+	texts map[bson.ObjectId]string
+}
+
+func (self *textIndex) setDirty() {
+	self.mutex.Lock()
+	self.dirty = true
+	self.mutex.Unlock()
+}
+
+// build indexes all documents of collection.
+// The caller has to hold the mutex.
+func (self *textIndex) build(collection *Collection) error {
+	collection.checkDBConnection()
+	self.postings = make(map[string]map[bson.ObjectId]float64)
+	self.texts = make(map[bson.ObjectId]string)
+	i := collection.backend.Find(nil).Iter()
+	doc := bson.M{}
+	for i.Next(&doc) {
+		self.add(doc)
+		doc = bson.M{}
+	}
+	if i.Err() != nil {
+		return i.Err()
+	}
+	self.dirty = false
+	return nil
+}
+
+// add indexes doc. The caller has to hold the mutex.
+func (self *textIndex) add(doc bson.M) {
+	id, ok := doc["_id"].(bson.ObjectId)
+	if !ok {
+		return
+	}
+	var words []string
+	for _, field := range self.fields {
+		for _, text := range textValues(doc, field.path) {
+			tokens := textTokens(text)
+			for _, token := range tokens {
+				posting, ok := self.postings[token]
+				if !ok {
+					posting = make(map[bson.ObjectId]float64)
+					self.postings[token] = posting
+				}
+				posting[id] += float64(field.weight)
+			}
+			words = append(words, tokens...)
+			// Phrases must not match across field values
+			words = append(words, "")
+		}
+	}
+	self.texts[id] = " " + strings.Join(words, " ") + " "
+}
+
+// remove removes the document with id from the index.
+// The caller has to hold the mutex.
+func (self *textIndex) remove(id bson.ObjectId) {
+	text, ok := self.texts[id]
+	if !ok {
+		return
+	}
+	for _, word := range strings.Fields(text) {
+		if posting, ok := self.postings[word]; ok {
+			delete(posting, id)
+			if len(posting) == 0 {
+				delete(self.postings, word)
+			}
+		}
+	}
+	delete(self.texts, id)
+}
+
+// update re-indexes the documents with ids after they have been written.
+// An index that is not built yet is built at the next search anyway.
+func (self *textIndex) update(collection *Collection, ids []bson.ObjectId) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.dirty || self.postings == nil {
+		return
+	}
+	for _, id := range ids {
+		self.remove(id)
+	}
+	i := collection.backend.Find(bson.M{"_id": bson.M{"$in": ids}}).Iter()
+	doc := bson.M{}
+	for i.Next(&doc) {
+		self.add(doc)
+		doc = bson.M{}
+	}
+	if i.Err() != nil {
+		self.dirty = true
+	}
+}
+
+// search returns the relevance scores of all documents matching query.
+func (self *textIndex) search(collection *Collection, query string) (scores map[bson.ObjectId]float64, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.dirty || self.postings == nil {
+		if err = self.build(collection); err != nil {
+			return nil, err
+		}
+	}
+
+	words, phrases, excluded := parseSearch(query)
+	for _, phrase := range phrases {
+		words = append(words, strings.Split(phrase, " ")...)
+	}
+
+	scores = make(map[bson.ObjectId]float64)
+	numDocs := float64(len(self.texts))
+	for _, word := range words {
+		posting := self.postings[word]
+		// Rare words are more relevant
+		idf := math.Log(1 + numDocs/float64(len(posting)+1))
+		for id, frequency := range posting {
+			scores[id] += frequency * idf
+		}
+	}
+
+	for id := range scores {
+		text := self.texts[id]
+		for _, phrase := range phrases {
+			if !strings.Contains(text, " "+phrase+" ") {
+				delete(scores, id)
+				break
+			}
+		}
+		for _, word := range excluded {
+			if _, ok := self.postings[word][id]; ok {
+				delete(scores, id)
+				break
+			}
+		}
+	}
+	return scores, nil
+}
@@ -0,0 +1,107 @@
+package mongo
+
+import (
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/model"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// TrackedDocumentBase
+
+/*
+TrackedDocumentBase can be embedded instead of DocumentBase to get
+automatic Created and Modified timestamps and soft deletion.
+
+The timestamps are set by the BeforeSave() hook, so they are maintained
+by Collection.Insert(), Collection.Update() and Save().
+If the embedding struct implements its own BeforeSave() hook,
+it has to call TrackedDocumentBase.BeforeSave() too.
+
+Remove() only sets the Deleted timestamp. Queries of the collection
+exclude deleted documents by default, use Query.WithDeleted() or
+Query.OnlyDeleted() to change this.
+Collection.Remove(), Query.RemoveAll() and Bulk.Remove() also only
+mark documents as deleted. Purge(), Collection.Purge(),
+Query.PurgeAll(), Bulk.Purge() and Collection.PurgeDeleted()
+really remove documents.
+
+Example:
+
+	type Post struct {
+		mongo.TrackedDocumentBase `bson:",inline"`
+		Title                     model.String
+	}
+*/
+type TrackedDocumentBase struct {
+	DocumentBase `bson:",inline"`
+	Created      model.DateTime `view:"disabled"`
+	Modified     model.DateTime `view:"disabled"`
+	Deleted      model.DateTime `view:"disabled"`
+}
+
+// Marker method for Collection to enable soft deletion
+func (self *TrackedDocumentBase) softDeleteDocument() {
+}
+
+// BeforeSave sets the Created timestamp if empty and
+// the Modified timestamp to the current time.
+func (self *TrackedDocumentBase) BeforeSave() error {
+	self.Modified.SetNowUTC()
+	if self.Created.IsEmpty() {
+		self.Created = self.Modified
+	}
+	return nil
+}
+
+func (self *TrackedDocumentBase) IsDeleted() bool {
+	return !self.Deleted.IsEmpty()
+}
+
+// Remove marks the document as deleted without removing it
+// from the database. Only the Deleted field is written,
+// other changes of the document are saved by the next Save().
+// BeforeRemove() and AfterRemove() hooks of the document are called
+// and the "ondelete" rules of refs to the document are applied.
+func (self *TrackedDocumentBase) Remove() error {
+	return self.remove(nil)
+}
+
+func (self *TrackedDocumentBase) remove(visited map[string]bool) error {
+	if !self.ID.Valid() {
+		return errs.Format("Can't remove mongo.Document with invalid ID.")
+	}
+	if err := callBeforeRemove(self.embeddingStruct); err != nil {
+		return err
+	}
+	if err := applyOnDeleteRules(self.Ref(), visited); err != nil {
+		return err
+	}
+	notDeleted := self.Deleted
+	self.Deleted.SetNowUTC()
+	if err := self.collection.UpdateWith(self.ID, NewUpdate().Set("deleted", self.Deleted)); err != nil {
+		self.Deleted = notDeleted
+		return err
+	}
+	self.resetFieldChange("deleted")
+	return callAfterRemove(self.embeddingStruct)
+}
+
+// Restore removes the deleted mark of the document.
+func (self *TrackedDocumentBase) Restore() error {
+	if !self.ID.Valid() {
+		return errs.Format("Can't restore mongo.Document with invalid ID.")
+	}
+	deleted := self.Deleted
+	self.Deleted = ""
+	if err := self.collection.UpdateWith(self.ID, NewUpdate().Set("deleted", self.Deleted)); err != nil {
+		self.Deleted = deleted
+		return err
+	}
+	self.resetFieldChange("deleted")
+	return nil
+}
+
+// Purge removes the document from the database.
+func (self *TrackedDocumentBase) Purge() error {
+	return self.DocumentBase.remove(nil)
+}
@@ -0,0 +1,201 @@
+package mongo
+
+import (
+	"testing"
+
+	"github.com/ungerik/go-start/mgo/bson"
+	"github.com/ungerik/go-start/model"
+)
+
+type trackedDocument struct {
+	TrackedDocumentBase `bson:",inline"`
+	Name                model.String
+}
+
+var trackedDocuments = NewCollection("test_tracked_documents", (*trackedDocument)(nil))
+
+func newTrackedDocuments(t *testing.T, names ...string) (docs []*trackedDocument) {
+	t.Helper()
+	for _, name := range names {
+		doc := trackedDocuments.NewDocument().(*trackedDocument)
+		doc.Name.Set(name)
+		if err := doc.Save(); err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func trackedNames(t *testing.T, query Query) (names []string) {
+	t.Helper()
+	iterator := query.Sort("Name").Iterator()
+	for doc := iterator.Next(); doc != nil; doc = iterator.Next() {
+		names = append(names, doc.(*trackedDocument).Name.Get())
+	}
+	if iterator.Err() != nil {
+		t.Fatal(iterator.Err())
+	}
+	return names
+}
+
+func trackedCount(t *testing.T, query Query) int {
+	t.Helper()
+	n, err := query.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	InitMemory()
+	docs := newTrackedDocuments(t, "a", "b")
+	if docs[0].Created.IsEmpty() || docs[0].Modified.IsEmpty() {
+		t.Error("Created and Modified have not been set")
+	}
+
+	if err := docs[0].Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if !docs[0].IsDeleted() {
+		t.Error("document is not marked as deleted")
+	}
+	if n := trackedCount(t, trackedDocuments); n != 1 {
+		t.Errorf("Count() is %d, deleted documents have to be excluded", n)
+	}
+	if n := trackedCount(t, trackedDocuments.WithDeleted()); n != 2 {
+		t.Errorf("WithDeleted().Count() is %d", n)
+	}
+	if n := trackedCount(t, trackedDocuments.OnlyDeleted()); n != 1 {
+		t.Errorf("OnlyDeleted().Count() is %d", n)
+	}
+
+	if err := docs[0].Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if docs[0].IsDeleted() || trackedCount(t, trackedDocuments) != 2 {
+		t.Error("document has not been restored")
+	}
+
+	if err := docs[1].Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if n := trackedCount(t, trackedDocuments.WithDeleted()); n != 1 {
+		t.Errorf("%d documents after Purge()", n)
+	}
+}
+
+func TestSoftDeleteFailure(t *testing.T) {
+	InitMemory()
+	doc := trackedDocuments.NewDocument().(*trackedDocument)
+	doc.ID = bson.NewObjectId()
+	if err := doc.Remove(); err == nil {
+		t.Fatal("no error for a document that is not in the database")
+	}
+	if doc.IsDeleted() {
+		t.Error("failed Remove() has marked the document as deleted")
+	}
+
+	doc.Deleted.SetNowUTC()
+	if err := doc.Restore(); err == nil {
+		t.Fatal("no error for a document that is not in the database")
+	}
+	if !doc.IsDeleted() {
+		t.Error("failed Restore() has removed the deleted mark")
+	}
+}
+
+func TestSoftDeleteQueries(t *testing.T) {
+	InitMemory()
+	docs := newTrackedDocuments(t, "a", "b", "c", "d", "e")
+
+	if err := trackedDocuments.Remove(docs[0].ID, docs[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	deletedAt := model.DateTime("2000-01-01 00:00:00")
+	if err := trackedDocuments.UpdateWith(docs[0].ID, NewUpdate().Set("Deleted", deletedAt)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chained filters all have to match
+	if err := trackedDocuments.FilterLess("Name", "e").FilterNotEqual("_id", docs[3].ID).RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	if names := trackedNames(t, trackedDocuments); len(names) != 2 || names[0] != "d" || names[1] != "e" {
+		t.Errorf("documents after RemoveAll(): %v", names)
+	}
+	if n := trackedCount(t, trackedDocuments.OnlyDeleted()); n != 3 {
+		t.Errorf("%d documents marked as deleted instead of 3", n)
+	}
+
+	// Removing deleted documents again keeps their timestamp
+	if err := trackedDocuments.WithDeleted().RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := trackedDocuments.WithDeleted().Filter("_id", docs[0].ID).One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.(*trackedDocument).Deleted != deletedAt {
+		t.Error("Deleted timestamp has been changed")
+	}
+
+	if err = trackedDocuments.Purge(docs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = trackedDocuments.OnlyDeleted().FilterLess("Name", "d").PurgeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if names := trackedNames(t, trackedDocuments.WithDeleted()); len(names) != 2 || names[0] != "d" || names[1] != "e" {
+		t.Errorf("documents after PurgeAll(): %v", names)
+	}
+	if err = trackedDocuments.PurgeDeleted(); err != nil {
+		t.Fatal(err)
+	}
+	if n := trackedCount(t, trackedDocuments.WithDeleted()); n != 0 {
+		t.Errorf("%d documents after PurgeDeleted()", n)
+	}
+}
+
+func TestRemoveAllUsesAllFilters(t *testing.T) {
+	InitMemory()
+	newTestDocument(t, "a")
+	newTestDocument(t, "b", "x")
+	newTestDocument(t, "c", "x")
+
+	if err := testDocuments.Filter("Tags", "x").Filter("Name", "b").RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := testDocuments.Count(); n != 2 {
+		t.Errorf("%d documents left instead of 2", n)
+	}
+}
+
+func TestSoftDeleteBulk(t *testing.T) {
+	InitMemory()
+	docs := newTrackedDocuments(t, "a", "b", "c")
+
+	result, err := trackedDocuments.Bulk(true).Remove(docs[0].ID, docs[1].ID).Purge(docs[2].ID).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 3 {
+		t.Errorf("Removed is %d instead of 3", result.Removed)
+	}
+	if n := trackedCount(t, trackedDocuments.OnlyDeleted()); n != 2 {
+		t.Errorf("%d documents marked as deleted instead of 2", n)
+	}
+	if n := trackedCount(t, trackedDocuments.WithDeleted()); n != 2 {
+		t.Errorf("%d documents instead of 2, Purge() has to remove", n)
+	}
+
+	// Documents that are already marked as deleted are not counted again
+	result, err = trackedDocuments.Bulk(true).Remove(docs[0].ID).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 0 {
+		t.Errorf("Removed is %d instead of 0", result.Removed)
+	}
+}
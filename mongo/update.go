@@ -0,0 +1,181 @@
+package mongo
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/ungerik/go-start/mgo/bson"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Update
+
+/*
+Update is a builder for MongoDB update operators.
+It can be applied to a single document with Collection.UpdateWith()
+and DocumentBase.Update() or to all documents of a query with
+Query.UpdateOneWith() and Query.UpdateAllWith().
+
+Selectors are lower cased like in all other mongo queries.
+
+Example:
+
+	update := mongo.NewUpdate().
+		Set("Name.First", "Erik").
+		Inc("LoginCount", 1).
+		AddToSet("Tags", "admin").
+		Unset("TempData")
+
+	err := models.Users.Filter("Name.Last", "Unger").UpdateAllWith(update)
+
+*/
+type Update struct {
+	operators bson.M
+}
+
+func NewUpdate() *Update {
+	return &Update{operators: bson.M{}}
+}
+
+// add adds an operator for selector without lower casing the selector
+func (self *Update) add(operator, selector string, value interface{}) *Update {
+	if self.operators == nil {
+		self.operators = bson.M{}
+	}
+	fields, ok := self.operators[operator].(bson.M)
+	if !ok {
+		fields = bson.M{}
+		self.operators[operator] = fields
+	}
+	fields[selector] = value
+	return self
+}
+
+// Set sets the value of the field with selector.
+func (self *Update) Set(selector string, value interface{}) *Update {
+	return self.add("$set", strings.ToLower(selector), value)
+}
+
+// Unset removes the field with selector.
+func (self *Update) Unset(selector string) *Update {
+	return self.add("$unset", strings.ToLower(selector), 1)
+}
+
+// Inc increments the numeric field with selector by value.
+// Use a negative value to decrement.
+func (self *Update) Inc(selector string, value interface{}) *Update {
+	return self.add("$inc", strings.ToLower(selector), value)
+}
+
+// Push appends values to the array field with selector.
+func (self *Update) Push(selector string, values ...interface{}) *Update {
+	if len(values) == 1 {
+		return self.add("$push", strings.ToLower(selector), values[0])
+	}
+	return self.add("$push", strings.ToLower(selector), bson.M{"$each": values})
+}
+
+// Pull removes all occurrences of values from the array field with selector.
+func (self *Update) Pull(selector string, values ...interface{}) *Update {
+	if len(values) == 1 {
+		return self.add("$pull", strings.ToLower(selector), values[0])
+	}
+	return self.add("$pullAll", strings.ToLower(selector), values)
+}
+
+// AddToSet appends values to the array field with selector
+// if they are not already in the array.
+func (self *Update) AddToSet(selector string, values ...interface{}) *Update {
+	if len(values) == 1 {
+		return self.add("$addToSet", strings.ToLower(selector), values[0])
+	}
+	return self.add("$addToSet", strings.ToLower(selector), bson.M{"$each": values})
+}
+
+// Min sets the field with selector to value if value is less
+// than the current value of the field.
+func (self *Update) Min(selector string, value interface{}) *Update {
+	return self.add("$min", strings.ToLower(selector), value)
+}
+
+// Max sets the field with selector to value if value is greater
+// than the current value of the field.
+func (self *Update) Max(selector string, value interface{}) *Update {
+	return self.add("$max", strings.ToLower(selector), value)
+}
+
+// IsEmpty returns true if no update operators have been added.
+func (self *Update) IsEmpty() bool {
+	return self == nil || len(self.operators) == 0
+}
+
+// Selectors returns the selectors of all fields modified by the update.
+func (self *Update) Selectors() (selectors []string) {
+	if self == nil {
+		return nil
+	}
+	for _, fields := range self.operators {
+		for selector := range fields.(bson.M) {
+			selectors = append(selectors, selector)
+		}
+	}
+	return selectors
+}
+
+// Bson returns the update as MongoDB update document.
+func (self *Update) Bson() bson.M {
+	if self == nil {
+		return bson.M{}
+	}
+	return self.operators
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Change tracking
+
+// documentSnapshot marshals document to a bson.M without the _id field.
+// It is used to compare the loaded state of a document with its current state.
+func documentSnapshot(document interface{}) (snapshot bson.M, err error) {
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	err = bson.Unmarshal(data, &snapshot)
+	if err != nil {
+		return nil, err
+	}
+	delete(snapshot, "_id")
+	return snapshot, nil
+}
+
+// diffSnapshots adds $set and $unset operators to update for all
+// fields that differ between the snapshots from and to.
+// Sub-documents are compared recursively, arrays are compared as a whole.
+func diffSnapshots(update *Update, prefix string, from, to bson.M) {
+	for key, toValue := range to {
+		selector := prefix + key
+		fromValue, ok := from[key]
+		if !ok {
+			update.add("$set", selector, toValue)
+			continue
+		}
+		fromDoc, fromIsDoc := fromValue.(bson.M)
+		toDoc, toIsDoc := toValue.(bson.M)
+		if fromIsDoc && toIsDoc {
+			diffSnapshots(update, selector+".", fromDoc, toDoc)
+		} else if !reflect.DeepEqual(fromValue, toValue) {
+			update.add("$set", selector, toValue)
+		}
+	}
+	for key := range from {
+		if _, ok := to[key]; !ok {
+			update.add("$unset", prefix+key, 1)
+		}
+	}
+}
+
+// changeTracker is implemented by DocumentBase to remember the
+// state of a document after it has been loaded from the database.
+type changeTracker interface {
+	ResetChanges()
+}
@@ -0,0 +1,178 @@
+package mongo
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/ungerik/go-start/mgo/bson"
+	"github.com/ungerik/go-start/model"
+)
+
+type testAddress struct {
+	City model.String
+	Zip  model.String
+}
+
+type testDocument struct {
+	DocumentBase `bson:",inline"`
+	Name         model.String
+	Age          model.Int
+	Tags         []model.String
+	Address      testAddress
+}
+
+var testDocuments = NewCollection("test_documents", (*testDocument)(nil))
+
+func newTestDocument(t *testing.T, name string, tags ...string) *testDocument {
+	t.Helper()
+	doc := testDocuments.NewDocument().(*testDocument)
+	doc.Name.Set(name)
+	for _, tag := range tags {
+		doc.Tags = append(doc.Tags, model.String(tag))
+	}
+	if err := doc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func loadTestDocument(t *testing.T, id bson.ObjectId) *testDocument {
+	t.Helper()
+	doc, err := testDocuments.DocumentWithID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc.(*testDocument)
+}
+
+func TestUpdateChanges(t *testing.T) {
+	InitMemory()
+	doc := loadTestDocument(t, newTestDocument(t, "Erik", "a", "b").ID)
+
+	tests := []struct {
+		name      string
+		change    func(doc *testDocument)
+		selectors []string
+	}{
+		{"unchanged", func(doc *testDocument) {}, nil},
+		{"field", func(doc *testDocument) { doc.Age.Set(42) }, []string{"age"}},
+		{"sub-document field", func(doc *testDocument) { doc.Address.City.Set("Vienna") }, []string{"address.city"}},
+		{"array element", func(doc *testDocument) { doc.Tags[1] = "c" }, []string{"tags"}},
+		{"array append", func(doc *testDocument) { doc.Tags = append(doc.Tags, "c") }, []string{"tags"}},
+		{"several fields", func(doc *testDocument) { doc.Name.Set("Unger"); doc.Address.Zip.Set("1010") }, []string{"address.zip", "name"}},
+	}
+	for _, test := range tests {
+		test.change(doc)
+		selectors, err := doc.ChangedSelectors()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(selectors)
+		if !equalStrings(selectors, test.selectors) {
+			t.Errorf("%s: changed selectors %v, want %v", test.name, selectors, test.selectors)
+		}
+		doc.ResetChanges()
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSaveWritesOnlyChanges(t *testing.T) {
+	InitMemory()
+	id := newTestDocument(t, "Erik", "a").ID
+	first := loadTestDocument(t, id)
+	second := loadTestDocument(t, id)
+
+	first.Age.Set(42)
+	first.Tags = append(first.Tags, "b")
+	if err := first.Save(); err != nil {
+		t.Fatal(err)
+	}
+	second.Address.City.Set("Vienna")
+	if err := second.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := loadTestDocument(t, id)
+	if doc.Age != 42 || doc.Address.City != "Vienna" || len(doc.Tags) != 2 {
+		t.Errorf("concurrent changes have been overwritten: %+v", doc)
+	}
+
+	// Arrays are written as a whole
+	first = loadTestDocument(t, id)
+	second = loadTestDocument(t, id)
+	first.Tags = first.Tags[:1]
+	if err := first.Save(); err != nil {
+		t.Fatal(err)
+	}
+	second.Tags[0] = "c"
+	if err := second.Save(); err != nil {
+		t.Fatal(err)
+	}
+	doc = loadTestDocument(t, id)
+	if len(doc.Tags) != 2 || doc.Tags[0] != "c" || doc.Tags[1] != "b" {
+		t.Errorf("tags are %v, the array of the last Save() has to win", doc.Tags)
+	}
+}
+
+func TestUpdateOneSelector(t *testing.T) {
+	InitMemory()
+	id := newTestDocument(t, "Erik").ID
+
+	if err := testDocuments.Filter("_id", id).UpdateOne("Name", "Upper"); err != nil {
+		t.Fatal(err)
+	}
+	var raw bson.M
+	if err := testDocuments.backend.Find(bson.M{"_id": id}).One(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["Name"] != "Upper" || raw["name"] != "Erik" {
+		t.Errorf("UpdateOne changed the selector: %v", raw)
+	}
+
+	if err := testDocuments.Filter("_id", id).UpdateOneWith(NewUpdate().Set("Name", "Lower")); err != nil {
+		t.Fatal(err)
+	}
+	if loadTestDocument(t, id).Name != "Lower" {
+		t.Error("Update.Set() doesn't lower case the selector")
+	}
+}
+
+func TestUpsertOneWith(t *testing.T) {
+	InitMemory()
+	update := NewUpdate().Inc("Age", 1).Min("Address.City", "Vienna")
+	id, err := testDocuments.Filter("Name", "Erik").UpsertOneWith(update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := loadTestDocument(t, id)
+	if doc.Name != "Erik" || doc.Age != 1 || doc.Address.City != "Vienna" {
+		t.Errorf("inserted document %+v doesn't have the filter and update fields", doc)
+	}
+
+	update = NewUpdate().Inc("Age", 1).Min("Address.City", "Wien")
+	if upsertID, err := testDocuments.Filter("Name", "Erik").UpsertOneWith(update); err != nil || upsertID != id {
+		t.Fatalf("second upsert returned %s, %v", upsertID.Hex(), err)
+	}
+	doc = loadTestDocument(t, id)
+	if doc.Age != 2 || doc.Address.City != "Vienna" {
+		t.Errorf("updated document %+v", doc)
+	}
+	if n, _ := testDocuments.Count(); n != 1 {
+		t.Errorf("%d documents instead of 1", n)
+	}
+
+	if _, err = testDocuments.Filter("Name", "Erik").UpsertOneWith(NewUpdate()); err == nil {
+		t.Error("no error for an empty update")
+	}
+}
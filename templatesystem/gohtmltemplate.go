@@ -0,0 +1,35 @@
+package templatesystem
+
+import (
+	"html/template"
+	"io"
+)
+
+// GoHTMLTemplate is like GoTemplate, but escapes the output for HTML.
+type GoHTMLTemplate struct {
+	templ *template.Template
+}
+
+func (self *GoHTMLTemplate) Render(out io.Writer, context interface{}) (err error) {
+	return self.templ.Execute(out, context)
+}
+
+// GoHTML uses the html/template package that escapes
+// the output depending on the HTML context.
+type GoHTML struct{}
+
+func (self *GoHTML) ParseFile(filename string) (Template, error) {
+	templ, err := template.ParseFiles(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &GoHTMLTemplate{templ}, nil
+}
+
+func (self *GoHTML) ParseString(text, name string) (Template, error) {
+	templ, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &GoHTMLTemplate{templ}, nil
+}
@@ -0,0 +1,366 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/mgo"
+	"github.com/ungerik/go-start/model"
+	"github.com/ungerik/go-start/mongo"
+	"github.com/ungerik/go-start/view"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// APIToken
+
+/*
+APIToken authenticates machine clients as a User with the HTTP header
+"Authorization: Bearer <token>", see APITokenAuth.
+
+Personal access tokens are created by users for their own account,
+service tokens are the tokens of a service account (see NewServiceAccount()).
+Only the SHA-256 hash of a token is stored, the token itself is
+returned once by User.CreateAPIToken().
+
+Scopes limit what a token can be used for, they have the same
+format as permissions, see PermissionMatches().
+*/
+type APIToken struct {
+	// ID is the public part of the token to identify it
+	ID         model.String
+	Name       model.String
+	Hash       model.String
+	Scopes     []model.String
+	Created    model.DateTime
+	Expires    model.DateTime // Empty means the token never expires
+	LastUsed   model.DateTime
+	LastUsedIP model.String
+}
+
+const apiTokenPrefix = "gst_"
+
+func (self *APIToken) Expired() bool {
+	return !self.Expires.IsEmpty() && time.Now().After(self.Expires.Time())
+}
+
+// HasScope returns true if any scope of the token matches scope.
+func (self *APIToken) HasScope(scope string) bool {
+	for i := range self.Scopes {
+		if PermissionMatches(self.Scopes[i].Get(), scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// setLastUsed saves LastUsed and LastUsedIP of the token.
+// Only the token is updated, because saving the whole user would
+// restore tokens that have been revoked in the meantime.
+// mgo.NotFound is returned if the token has been revoked.
+func (self *APIToken) setLastUsed(ip string) error {
+	self.LastUsed.SetNowUTC()
+	self.LastUsedIP.Set(ip)
+	return Config.Collection.Filter("APITokens.ID", self.ID.Get()).UpdateOneWith(mongo.NewUpdate().
+		Set("APITokens.$.LastUsed", self.LastUsed.Get()).
+		Set("APITokens.$.LastUsedIP", ip),
+	)
+}
+
+// apiTokenID returns the ID part of a token or an empty string
+// if token doesn't have the format of CreateAPIToken().
+func apiTokenID(token string) string {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return ""
+	}
+	parts := strings.SplitN(token[len(apiTokenPrefix):], "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ""
+	}
+	return parts[0]
+}
+
+/*
+CreateAPIToken creates a token with scopes that expires after validFor,
+or never if validFor is zero. The token is only returned here,
+so it has to be shown to the user now.
+The user has to be saved after the call.
+*/
+func (self *User) CreateAPIToken(name string, scopes []string, validFor time.Duration) (token string, err error) {
+	var id [6]byte
+	if _, err = rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	apiToken := APIToken{Scopes: make([]model.String, len(scopes))}
+	apiToken.ID.Set(hex.EncodeToString(id[:]))
+	token = apiTokenPrefix + apiToken.ID.Get() + "_" + secret
+	apiToken.Name.Set(name)
+	apiToken.Hash.Set(hashToken(token))
+	for i := range scopes {
+		apiToken.Scopes[i].Set(scopes[i])
+	}
+	apiToken.Created.SetNowUTC()
+	if validFor > 0 {
+		apiToken.Expires.SetTime(time.Now().UTC().Add(validFor))
+	}
+	self.APITokens = append(self.APITokens, apiToken)
+	return token, nil
+}
+
+// APIToken returns the token with id.
+func (self *User) APIToken(id string) *APIToken {
+	for i := range self.APITokens {
+		if self.APITokens[i].ID.Get() == id {
+			return &self.APITokens[i]
+		}
+	}
+	return nil
+}
+
+// RevokeAPIToken removes the token with id and returns if it existed.
+// The user has to be saved after the call.
+func (self *User) RevokeAPIToken(id string) bool {
+	for i := range self.APITokens {
+		if self.APITokens[i].ID.Get() == id {
+			self.APITokens = append(self.APITokens[:i], self.APITokens[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveExpiredAPITokens removes all expired tokens.
+// The user has to be saved after the call.
+func (self *User) RemoveExpiredAPITokens() {
+	tokens := self.APITokens[:0]
+	for _, token := range self.APITokens {
+		if !token.Expired() {
+			tokens = append(tokens, token)
+		}
+	}
+	self.APITokens = tokens
+}
+
+// FindByAPIToken returns the user with the valid token
+// and the APIToken of the user.
+func FindByAPIToken(token string) (userDoc interface{}, apiToken *APIToken, found bool, err error) {
+	id := apiTokenID(token)
+	if id == "" {
+		return nil, nil, false, nil
+	}
+	userDoc, found, err = Config.Collection.Filter("APITokens.Hash", hashToken(token)).TryOne()
+	if !found {
+		return nil, nil, false, err
+	}
+	apiToken = From(userDoc).APIToken(id)
+	if apiToken == nil || apiToken.Hash.Get() != hashToken(token) || apiToken.Expired() {
+		return nil, nil, false, nil
+	}
+	return userDoc, apiToken, true, nil
+}
+
+// NewServiceAccount creates a user for machine clients
+// that authenticate with APITokens instead of a login.
+// Service accounts count as confirmed identities.
+func NewServiceAccount(username string) (userDoc interface{}, err error) {
+	_, found, err := Config.Collection.Filter("Username", username).TryOne()
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return nil, errs.Format("User with username %s already exists", username)
+	}
+	userDoc = Config.Collection.NewDocument()
+	user := From(userDoc)
+	user.Username.Set(username)
+	user.ServiceAccount.Set(true)
+	return userDoc, user.Save()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// APITokenAuth
+
+/*
+APITokenAuth authenticates requests with the HTTP header
+"Authorization: Bearer <token>" and a valid APIToken
+that has all Scopes. ctx.Session.User is set to the user
+of the token without creating a session cookie.
+
+If AllowSession is true, requests without Authorization header
+are authenticated with the logged in user of the session.
+Scopes are not checked for them.
+
+Combine it with RequirePermission() in view.AllAuthenticators
+to check the permissions of the user too.
+
+Example:
+
+	view.ViewPath{Name: "api", Sub: []view.ViewPath{
+		{Name: "invoices", View: invoicesAPI, Auth: user.RequireAPIToken("invoices.read")},
+	}}
+*/
+type APITokenAuth struct {
+	Scopes       []string
+	AllowSession bool
+}
+
+// RequireAPIToken returns an APITokenAuth for scopes.
+func RequireAPIToken(scopes ...string) *APITokenAuth {
+	return &APITokenAuth{Scopes: scopes}
+}
+
+func (self *APITokenAuth) Authenticate(ctx *view.Context) (ok bool, err error) {
+	header := ctx.Request.Header.Get("Authorization")
+	if header == "" && self.AllowSession {
+		userDoc := OfSession(ctx.Session)
+		return userDoc != nil && From(userDoc).IdentityConfirmed(), nil
+	}
+	f := strings.Fields(header)
+	if len(f) != 2 || !strings.EqualFold(f[0], "Bearer") {
+		ctx.Response.Header().Set("WWW-Authenticate", `Bearer realm="`+view.Config.SiteName+`"`)
+		ctx.Response.AuthorizationRequired401()
+		return false, nil
+	}
+
+	ip := clientIP(ctx)
+	userDoc, apiToken, found, err := FindByAPIToken(f[1])
+	if err != nil {
+		return false, err
+	}
+	if !found || !From(userDoc).IdentityConfirmed() {
+		audit(AuditInvalidAPIToken, "", ip, userDoc)
+		ctx.Response.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ctx.Response.AuthorizationRequired401()
+		return false, nil
+	}
+	for _, scope := range self.Scopes {
+		if !apiToken.HasScope(scope) {
+			ctx.Response.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+strings.Join(self.Scopes, " ")+`"`)
+			ctx.Response.Forbidden403("Insufficient scope")
+			return false, nil
+		}
+	}
+
+	if apiToken.LastUsed.IsEmpty() || time.Since(apiToken.LastUsed.Time()) > lastSeenInterval || apiToken.LastUsedIP.Get() != ip {
+		err = apiToken.setLastUsed(ip)
+		if err == mgo.NotFound {
+			audit(AuditInvalidAPIToken, "", ip, userDoc)
+			ctx.Response.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			ctx.Response.AuthorizationRequired401()
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	ctx.Session.User = userDoc
+	return true, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// API token views
+
+// NewCreateAPITokenForm creates a personal access token for the session user.
+// The token is shown once after the form with the class "gostart-api-token".
+func NewCreateAPITokenForm(buttonText, class, errorMessageClass, successMessageClass string) view.View {
+	return view.DynamicView(
+		func(ctx *view.Context) (view.View, error) {
+			userDoc := OfSession(ctx.Session)
+			if userDoc == nil {
+				return view.DIV("error", view.HTML("Please log in first!")), nil
+			}
+			user := From(userDoc)
+			var token string
+			form := &view.Form{
+				Class:               class,
+				ErrorMessageClass:   errorMessageClass,
+				SuccessMessageClass: successMessageClass,
+				SuccessMessage:      "Token created. Copy it now, it won't be shown again:",
+				SubmitButtonText:    buttonText,
+				FormID:              "gostart_user_create_api_token",
+				GetModel: func(form *view.Form, ctx *view.Context) (interface{}, error) {
+					return &APITokenFormModel{}, nil
+				},
+				OnSubmit: func(form *view.Form, formModel interface{}, ctx *view.Context) (string, view.URL, error) {
+					m := formModel.(*APITokenFormModel)
+					validFor := time.Duration(m.ValidDays.Get()) * 24 * time.Hour
+					t, err := user.CreateAPIToken(m.Name.Get(), strings.Fields(m.Scopes.Get()), validFor)
+					if err != nil {
+						return "", nil, err
+					}
+					if err = user.Save(); err != nil {
+						return "", nil, err
+					}
+					token = t
+					return "", nil, nil
+				},
+			}
+			return view.Views{
+				form,
+				// Rendered after the form, so token is set by OnSubmit
+				view.DynamicView(func(ctx *view.Context) (view.View, error) {
+					if token == "" {
+						return nil, nil
+					}
+					return view.DIV("gostart-api-token", view.PRE(view.Escape(token))), nil
+				}),
+			}, nil
+		},
+	)
+}
+
+// NewAPITokensView lists the API tokens of the session user
+// with a button to revoke them.
+func NewAPITokensView(class, buttonClass string) view.View {
+	return view.DynamicView(
+		func(ctx *view.Context) (view.View, error) {
+			userDoc := OfSession(ctx.Session)
+			if userDoc == nil {
+				return view.DIV("error", view.HTML("Please log in first!")), nil
+			}
+			user := From(userDoc)
+			rows := view.ViewsTableModel{
+				{view.HTML("Name"), view.HTML("Scopes"), view.HTML("Expires"), view.HTML("Last used"), view.HTML("")},
+			}
+			for i := range user.APITokens {
+				apiToken := &user.APITokens[i]
+				id := apiToken.ID.Get()
+				scopes := make([]string, len(apiToken.Scopes))
+				for j := range apiToken.Scopes {
+					scopes[j] = apiToken.Scopes[j].Get()
+				}
+				expires := apiToken.Expires.Get()
+				if apiToken.Expired() {
+					expires = "Expired"
+				} else if expires == "" {
+					expires = "Never"
+				}
+				rows = append(rows, view.Views{
+					view.Escape(apiToken.Name.Get()),
+					view.Escape(strings.Join(scopes, " ")),
+					view.Escape(expires),
+					view.Escape(apiToken.LastUsed.Get()),
+					&view.Form{
+						SubmitButtonText:    "Revoke",
+						SubmitButtonClass:   buttonClass,
+						SubmitButtonConfirm: "Revoke this API token?",
+						FormID:              "gostart_user_revoke_api_token_" + id,
+						GetModel:            view.FormModel(&struct{}{}),
+						Redirect:            view.StringURL(ctx.Request.URL.Path),
+						OnSubmit: func(form *view.Form, formModel interface{}, ctx *view.Context) (string, view.URL, error) {
+							user.RevokeAPIToken(id)
+							return "", nil, user.Save()
+						},
+					},
+				})
+			}
+			return &view.Table{Class: class, Model: rows, HeaderRow: true}, nil
+		},
+	)
+}
@@ -0,0 +1,167 @@
+package user
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ungerik/go-start/mgo"
+	"github.com/ungerik/go-start/view"
+)
+
+func TestAPITokenScopes(t *testing.T) {
+	defer setupTest().Restore()
+	_, user := newTestUser(t, "a@example.com", "password")
+	token, err := user.CreateAPIToken("deploy", []string{"invoices.*", "users.view"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = user.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, apiToken, found, err := FindByAPIToken(token)
+	if !found {
+		t.Fatal("token not found", err)
+	}
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{"invoices.view", true},
+		{"invoices.edit", true},
+		{"users.view", true},
+		{"users.edit", false},
+		{"invoicesx.view", false},
+		{"*", false},
+	}
+	for _, test := range tests {
+		if got := apiToken.HasScope(test.scope); got != test.want {
+			t.Errorf("HasScope(%q) returned %v, want %v", test.scope, got, test.want)
+		}
+	}
+
+	request, _ := http.NewRequest("GET", "/api/invoices", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	ctx := &view.Context{Request: &view.Request{Request: request}, Session: newTestSession()}
+	ok, err := RequireAPIToken("invoices.view", "users.view").Authenticate(ctx)
+	if !ok {
+		t.Fatal("token with the required scopes rejected", err)
+	}
+	if ctx.Session.User == nil {
+		t.Error("API token didn't set the session user")
+	}
+}
+
+func TestAPITokenValidity(t *testing.T) {
+	defer setupTest().Restore()
+	_, user := newTestUser(t, "a@example.com", "password")
+	revoked, err := user.CreateAPIToken("revoked", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := user.CreateAPIToken("expired", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.APITokens[1].Expires.SetTime(time.Now().UTC().Add(-time.Minute))
+	user.RevokeAPIToken(user.APITokens[0].ID.Get())
+	if err = user.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{
+		"revoked":  revoked,
+		"expired":  expired,
+		"tampered": expired[:len(expired)-1] + "x",
+		"empty":    "",
+		"no id":    "gst__secret",
+	} {
+		if _, _, found, _ := FindByAPIToken(token); found {
+			t.Errorf("%s token accepted", name)
+		}
+	}
+}
+
+func authenticateAPIToken(token, remoteAddr string) (ok bool, err error) {
+	request, _ := http.NewRequest("GET", "/api", nil)
+	request.RemoteAddr = remoteAddr
+	request.Header.Set("Authorization", "Bearer "+token)
+	ctx := &view.Context{Request: &view.Request{Request: request}, Session: newTestSession()}
+	return RequireAPIToken().Authenticate(ctx)
+}
+
+func TestAPITokenLastUsed(t *testing.T) {
+	defer setupTest().Restore()
+	_, user := newTestUser(t, "a@example.com", "password")
+	token, err := user.CreateAPIToken("used", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = user.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := authenticateAPIToken(token, "192.0.2.1:1234"); !ok {
+		t.Fatal("token rejected", err)
+	}
+	_, apiToken, _, err := FindByAPIToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiToken.LastUsed.IsEmpty() || apiToken.LastUsedIP != "192.0.2.1" {
+		t.Errorf("LastUsed %q and LastUsedIP %q not set", apiToken.LastUsed, apiToken.LastUsedIP)
+	}
+
+	// A token revoked after the lookup of the user stays revoked
+	revoked, err := user.CreateAPIToken("revoked", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = user.Save(); err != nil {
+		t.Fatal(err)
+	}
+	staleDoc, apiToken, _, err := FindByAPIToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedID := From(staleDoc).APITokens[1].ID.Get()
+	doc, err := Config.Collection.DocumentWithID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	From(doc).RevokeAPIToken(revokedID)
+	if err = From(doc).Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err = apiToken.setLastUsed("192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, found, _ := FindByAPIToken(revoked); found {
+		t.Error("revoked token restored by setLastUsed()")
+	}
+	if _, apiToken, _, _ = FindByAPIToken(token); apiToken.LastUsedIP != "192.0.2.2" {
+		t.Errorf("LastUsedIP is %q", apiToken.LastUsedIP)
+	}
+
+	// The token itself has been revoked after the lookup
+	_, apiToken, _, err = FindByAPIToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err = Config.Collection.DocumentWithID(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	From(doc).RevokeAPIToken(apiToken.ID.Get())
+	if err = From(doc).Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err = apiToken.setLastUsed("192.0.2.3"); err != mgo.NotFound {
+		t.Errorf("setLastUsed() of a revoked token returned %v", err)
+	}
+	if doc, err = Config.Collection.DocumentWithID(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(From(doc).APITokens); n != 0 {
+		t.Errorf("%d tokens after revoking all", n)
+	}
+}
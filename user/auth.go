@@ -10,13 +10,9 @@ type Auth struct {
 }
 
 func (self *Auth) Authenticate(ctx *view.Context) (ok bool, err error) {
-	id, ok := ctx.Session.ID()
-	if !ok {
-		return false, nil
-	}
-
-	ok, err = IsConfirmedUserID(id)
-	if !ok && err == nil && self.LoginURL != nil {
+	userDoc := OfSession(ctx.Session)
+	ok = userDoc != nil && From(userDoc).IdentityConfirmed()
+	if !ok && self.LoginURL != nil {
 		err = view.Redirect(self.LoginURL.URL(ctx))
 	}
 	return ok, err
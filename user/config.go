@@ -2,8 +2,11 @@ package user
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/ungerik/go-start/mail"
 	"github.com/ungerik/go-start/mongo"
+	"github.com/ungerik/go-start/view"
 )
 
 var Config = Configuration{
@@ -12,23 +15,133 @@ var Config = Configuration{
 		EmailMessage: "Please confirm your email address for %s by opening the following link:\n\n%s",
 		Sent:         "We sent you an email with a verification link. It might some time to show up, but when it does you will be ready to use this site.",
 	},
+	PasswordResetMessage: ConfirmationMessage{
+		EmailSubject: "Reset your password for %s",
+		EmailMessage: "Somebody requested to reset your password for %s.\nIf it was you, open the following link to set a new password:\n\n%s\n\nOtherwise you can ignore this email.",
+		Sent:         "If there is an account with that email address, we sent you an email with a link to reset your password.",
+	},
+	EmailChangedMessage: ConfirmationMessage{
+		EmailSubject: "Your email address for %s has been changed",
+		EmailMessage: "The primary email address of your account at %s has been changed to %s.\nIf you didn't do this, please reset your password immediately.",
+	},
+	ConfirmationTimeout:   7 * 24 * time.Hour,
+	PasswordResetTimeout:  time.Hour,
+	SessionTimeout:        30 * 24 * time.Hour,
+	TwoFactorLoginTimeout: 5 * time.Minute,
+	LoginThrottling: LoginThrottling{
+		MaxFailures:     10,
+		LockoutDuration: time.Hour,
+		BackoffBase:     time.Second,
+		BackoffMax:      time.Minute,
+		IPWindow:        time.Hour,
+		UnlockTimeout:   24 * time.Hour,
+		UnlockMessage: ConfirmationMessage{
+			EmailSubject: "Your account at %s has been locked",
+			EmailMessage: "Your account at %s has been locked because of too many failed logins.\nIf it was you, open the following link to unlock it:\n\n%s\n\nOtherwise somebody tried to guess your password.",
+		},
+	},
 }
 
+// Init sets the collection of the users and creates
+// the collection of their LoginSessions named collection.Name + "_sessions"
+// if Config.SessionCollection is not set and the collection of the
+// ClientLoginFailures named collection.Name + "_login_failures"
+// if Config.LoginFailureCollection is not set.
 func Init(collection *mongo.Collection) {
 	Config.Collection = collection
 	Config.CollectionName = collection.Name
+	if Config.SessionCollection == nil {
+		Config.SessionCollectionName = collection.Name + "_sessions"
+		Config.SessionCollection = mongo.NewCollection(Config.SessionCollectionName, (*LoginSession)(nil))
+	}
+	if Config.LoginFailureCollection == nil {
+		Config.LoginFailureCollectionName = collection.Name + "_login_failures"
+		Config.LoginFailureCollection = mongo.NewCollection(Config.LoginFailureCollectionName, (*ClientLoginFailures)(nil))
+	}
 }
 
+// ConfirmationMessage is an email with a link.
+// EmailSubject is formatted with view.Config.SiteName,
+// EmailMessage with view.Config.SiteName and the link.
 type ConfirmationMessage struct {
 	EmailSubject string
 	EmailMessage string
 	Sent         string
+	// Template is used instead of EmailSubject and EmailMessage
+	// if not nil, it is rendered with a ConfirmationEmailContext
+	Template *mail.Template
+}
+
+// ConfirmationEmailContext is the template context of ConfirmationMessage.Template
+type ConfirmationEmailContext struct {
+	SiteName string
+	Address  string
+	URL      string
+}
+
+// send sends the email with link to address with mail.SendAsync()
+func (self *ConfirmationMessage) send(address, link string) <-chan error {
+	context := &ConfirmationEmailContext{SiteName: view.Config.SiteName, Address: address, URL: link}
+	return self.sendWith(address, context, link)
+}
+
+// sendWith sends the email to address. Template is rendered with context,
+// otherwise EmailMessage is formatted with view.Config.SiteName and args.
+func (self *ConfirmationMessage) sendWith(address string, context interface{}, args ...interface{}) <-chan error {
+	if self.Template == nil {
+		subject := fmt.Sprintf(self.EmailSubject, view.Config.SiteName)
+		text := fmt.Sprintf(self.EmailMessage, append([]interface{}{view.Config.SiteName}, args...)...)
+		return mail.SendAsync(mail.NewMessage(subject, text, address))
+	}
+	message, err := self.Template.Render(context, address)
+	if err != nil {
+		errChan := make(chan error, 1)
+		errChan <- err
+		close(errChan)
+		return errChan
+	}
+	return mail.SendAsync(message)
 }
 
 type Configuration struct {
 	ConfirmationMessage ConfirmationMessage
-	CollectionName      string
-	Collection          *mongo.Collection
+	// PasswordResetMessage is used by User.SendPasswordResetEmail()
+	PasswordResetMessage ConfirmationMessage
+	// EmailChangedMessage is sent to the old address when the primary
+	// email address has been changed. EmailMessage is formatted with
+	// view.Config.SiteName and the new address, Template is rendered
+	// with an EmailChangedContext.
+	EmailChangedMessage ConfirmationMessage
+	// ConfirmationTimeout is the time an email confirmation link is valid
+	ConfirmationTimeout time.Duration
+	// PasswordResetTimeout is the time a password reset link is valid
+	PasswordResetTimeout time.Duration
+	CollectionName       string
+	Collection           *mongo.Collection
+	// SessionCollection holds the LoginSessions
+	SessionCollectionName string
+	SessionCollection     *mongo.Collection
+	// Sessions that have not been used for longer than SessionTimeout
+	// are expired. Zero means sessions never expire.
+	SessionTimeout time.Duration
+	// TwoFactorIssuer is shown in authenticator apps,
+	// view.Config.SiteName is used if empty
+	TwoFactorIssuer string
+	// TwoFactorURL is the page with NewTwoFactorForm() where logins
+	// of users with two-factor authentication are redirected to
+	TwoFactorURL view.URL
+	// TwoFactorLoginTimeout is the time to enter the second factor
+	// after a successful password check
+	TwoFactorLoginTimeout time.Duration
+	LoginThrottling       LoginThrottling
+	// LoginFailureCollection holds the ClientLoginFailures
+	LoginFailureCollectionName string
+	LoginFailureCollection     *mongo.Collection
+	// OnAuditEvent is called for suspicious login activity,
+	// if nil the events are logged with config.Logger
+	OnAuditEvent func(event *AuditEvent)
+	// Roles maps role names to their permissions, see PermissionMatches()
+	Roles map[string][]string
 }
 
 func (self *Configuration) Name() string {
@@ -41,6 +154,24 @@ func (self *Configuration) Init() error {
 		return fmt.Errorf("Can't find mongo collection with name '%s'", self.CollectionName)
 	}
 	self.Collection = collection
+
+	if self.SessionCollectionName == "" {
+		self.SessionCollectionName = self.CollectionName + "_sessions"
+	}
+	collection, found = mongo.CollectionByName(self.SessionCollectionName)
+	if !found {
+		collection = mongo.NewCollection(self.SessionCollectionName, (*LoginSession)(nil))
+	}
+	self.SessionCollection = collection
+
+	if self.LoginFailureCollectionName == "" {
+		self.LoginFailureCollectionName = self.CollectionName + "_login_failures"
+	}
+	collection, found = mongo.CollectionByName(self.LoginFailureCollectionName)
+	if !found {
+		collection = mongo.NewCollection(self.LoginFailureCollectionName, (*ClientLoginFailures)(nil))
+	}
+	self.LoginFailureCollection = collection
 	return nil
 }
 
@@ -1,12 +1,11 @@
 package user
 
 import (
-	"fmt"
-	"github.com/ungerik/go-mail"
-	"github.com/ungerik/go-start/mgo/bson"
+	"net/url"
+	"time"
+
 	"github.com/ungerik/go-start/model"
 	"github.com/ungerik/go-start/view"
-	"net/url"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -14,33 +13,44 @@ import (
 
 type EmailIdentity struct {
 	//	mongo.SubDocumentBase
-	Address          model.Email
-	Description      model.String
-	Confirmed        model.DateTime
-	ConfirmationCode model.String
+	Address     model.Email
+	Description model.String
+	Confirmed   model.DateTime
+	// Only the hash of the single-use confirmation code is stored
+	ConfirmationCodeHash model.String   `view:"excluded"`
+	ConfirmationExpires  model.DateTime `view:"excluded"`
+	// PrimaryOnConfirm makes the address the primary one
+	// when it is confirmed, see User.ChangeEmail()
+	PrimaryOnConfirm model.Bool `view:"excluded"`
 }
 
-// EmailIdentity has to be saved after a successful call because the confirmation code could have changed
-// confirmationPage needs to be a page with one URL parameter
-func (self *EmailIdentity) SendConfirmationEmail(ctx *view.Context, confirmationURL view.URL) <-chan error {
-	errChan := make(chan error, 1)
-
-	confirmationCode := self.ConfirmationCode.Get()
-	if confirmationCode == "" {
-		confirmationCode = bson.NewObjectId().Hex()
-		self.ConfirmationCode.SetString(confirmationCode)
-	}
+func (self *EmailIdentity) confirmationValid() bool {
+	return !self.ConfirmationCodeHash.IsEmpty() && !self.ConfirmationExpires.IsEmpty() && time.Now().Before(self.ConfirmationExpires.Time())
+}
 
-	subject := fmt.Sprintf(Config.ConfirmationMessage.EmailSubject, view.Config.SiteName)
-	confirm := confirmationURL.URL(ctx) + "?code=" + url.QueryEscape(confirmationCode)
-	message := fmt.Sprintf(Config.ConfirmationMessage.EmailMessage, view.Config.SiteName, confirm)
+func (self *EmailIdentity) clearConfirmation() {
+	self.ConfirmationCodeHash.Set("")
+	self.ConfirmationExpires.SetEmpty()
+}
 
-	go func() {
-		errChan <- email.NewBriefMessage(subject, message, self.Address.Get()).Send()
+// SendConfirmationEmail sends a new confirmation code that expires
+// after Config.ConfirmationTimeout, links sent before are invalidated.
+// The EmailIdentity has to be saved after a successful call.
+// confirmationURL needs to be a page with EmailConfirmationView(),
+// the code is passed in the GET parameter "code".
+func (self *EmailIdentity) SendConfirmationEmail(ctx *view.Context, confirmationURL view.URL) <-chan error {
+	confirmationCode, err := randomToken()
+	if err != nil {
+		errChan := make(chan error, 1)
+		errChan <- err
 		close(errChan)
-	}()
+		return errChan
+	}
+	self.ConfirmationCodeHash.Set(hashToken(confirmationCode))
+	self.ConfirmationExpires.SetTime(time.Now().UTC().Add(Config.ConfirmationTimeout))
 
-	return errChan
+	confirm := confirmationURL.URL(ctx) + "?code=" + url.QueryEscape(confirmationCode)
+	return Config.ConfirmationMessage.send(self.Address.Get(), confirm)
 }
 
 func (self *EmailIdentity) MailtoURL() string {
@@ -0,0 +1,343 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ungerik/go-start/config"
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/model"
+	"github.com/ungerik/go-start/view"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Email addresses
+
+/*
+A user can have multiple email addresses, User.Email[0] is the primary one
+that is used for notifications and password resets.
+
+An email address is owned by a user if it is confirmed.
+Owned addresses can't be added by other users. Other users can add
+an address as unconfirmed primary or secondary address, but only
+the first confirmation counts and removes it from the others.
+*/
+
+// EmailChangedContext is the template context of Config.EmailChangedMessage
+type EmailChangedContext struct {
+	SiteName   string
+	OldAddress string
+	NewAddress string
+}
+
+// EmailInUse returns true if the address is owned by another user than userDoc.
+// userDoc can be nil.
+func EmailInUse(address string, userDoc interface{}) (inUse bool, err error) {
+	i := Config.Collection.FilterEqualCaseInsensitive("Email.Address", address).Iterator()
+	for doc := i.Next(); doc != nil; doc = i.Next() {
+		other := From(doc)
+		if userDoc != nil && other.ID == From(userDoc).ID {
+			continue
+		}
+		if other.ownsEmail(address) {
+			return true, nil
+		}
+	}
+	return false, i.Err()
+}
+
+// releaseEmail removes address from all users except userDoc
+// that added it as unconfirmed primary or secondary address.
+func releaseEmail(address string, userDoc interface{}) error {
+	var others []*User
+	i := Config.Collection.FilterEqualCaseInsensitive("Email.Address", address).Iterator()
+	for doc := i.Next(); doc != nil; doc = i.Next() {
+		if other := From(doc); other.ID != From(userDoc).ID && !other.ownsEmail(address) {
+			others = append(others, other)
+		}
+	}
+	if i.Err() != nil {
+		return i.Err()
+	}
+	for _, other := range others {
+		index := other.EmailIndex(address)
+		other.Email = append(other.Email[:index], other.Email[index+1:]...)
+		if err := other.Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NotifyEmailChanged sends Config.EmailChangedMessage to oldAddress
+// in the background and logs errors.
+func NotifyEmailChanged(oldAddress, newAddress string) {
+	if oldAddress == "" {
+		return
+	}
+	context := &EmailChangedContext{
+		SiteName:   view.Config.SiteName,
+		OldAddress: oldAddress,
+		NewAddress: newAddress,
+	}
+	errChan := Config.EmailChangedMessage.sendWith(oldAddress, context, newAddress)
+	go func() {
+		if err := <-errChan; err != nil {
+			config.Logger.Printf("user: Error while sending email change notification to %s: %s", oldAddress, err)
+		}
+	}()
+}
+
+// SetAddress changes the address. If it is a different address,
+// the confirmation is reset and it has to be confirmed again.
+func (self *EmailIdentity) SetAddress(address string) error {
+	if self.Address.EqualsCaseinsensitive(address) {
+		return self.Address.Set(address)
+	}
+	if err := self.Address.Set(address); err != nil {
+		return err
+	}
+	self.Confirmed.SetEmpty()
+	self.clearConfirmation()
+	self.PrimaryOnConfirm.Set(false)
+	return nil
+}
+
+// EmailIndex returns the index of address in User.Email or -1.
+func (self *User) EmailIndex(address string) int {
+	for i := range self.Email {
+		if self.Email[i].Address.EqualsCaseinsensitive(address) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (self *User) ownsEmail(address string) bool {
+	index := self.EmailIndex(address)
+	return index != -1 && !self.Email[index].Confirmed.IsEmpty()
+}
+
+func (self *User) moveEmailToFront(index int) {
+	email := self.Email[index]
+	copy(self.Email[1:index+1], self.Email[:index])
+	self.Email[0] = email
+}
+
+// SetPrimaryEmail makes the confirmed address the primary one
+// and returns the previous primary address.
+// The user has to be saved after the call,
+// then NotifyEmailChanged() should be called.
+func (self *User) SetPrimaryEmail(address string) (oldAddress string, err error) {
+	index := self.EmailIndex(address)
+	if index == -1 {
+		return "", errs.Format("Email address %s not found", address)
+	}
+	if self.Email[index].Confirmed.IsEmpty() {
+		return "", errs.Format("Email address %s has to be confirmed before it can be the primary address", address)
+	}
+	oldAddress = self.PrimaryEmail()
+	self.moveEmailToFront(index)
+	return oldAddress, nil
+}
+
+// RemoveEmail removes a secondary email address.
+// The user has to be saved after the call.
+func (self *User) RemoveEmail(address string) error {
+	index := self.EmailIndex(address)
+	if index == -1 {
+		return errs.Format("Email address %s not found", address)
+	}
+	if index == 0 {
+		return errs.Format("The primary email address can't be removed")
+	}
+	self.Email = append(self.Email[:index], self.Email[index+1:]...)
+	return nil
+}
+
+/*
+ChangeEmail adds address as unconfirmed email address and sends
+a confirmation email. When the address is confirmed with ConfirmEmail(),
+it becomes the primary address and Config.EmailChangedMessage is sent
+to the old primary address, which remains as secondary address.
+The user has to be saved after a successful call.
+*/
+func (self *User) ChangeEmail(ctx *view.Context, address string, confirmationURL view.URL) <-chan error {
+	index := self.EmailIndex(address)
+	if index == -1 {
+		if err := self.AddEmail(address, "via email change"); err != nil {
+			errChan := make(chan error, 1)
+			errChan <- err
+			close(errChan)
+			return errChan
+		}
+		index = len(self.Email) - 1
+	} else if index == 0 || !self.Email[index].Confirmed.IsEmpty() {
+		errChan := make(chan error, 1)
+		errChan <- errs.Format("Email address %s is already confirmed", address)
+		close(errChan)
+		return errChan
+	}
+	// Only the last requested change is pending
+	for i := range self.Email {
+		self.Email[i].PrimaryOnConfirm.Set(i == index)
+	}
+	return self.Email[index].SendConfirmationEmail(ctx, confirmationURL)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Email views
+
+// NewAddEmailForm adds a secondary email address to the session user
+// and sends a confirmation email to confirmationURL,
+// which must be a page with EmailConfirmationView().
+func NewAddEmailForm(buttonText, class, errorMessageClass, successMessageClass string, confirmationURL view.URL) view.View {
+	return newEmailForm(buttonText, class, errorMessageClass, successMessageClass, "gostart_user_add_email",
+		func(ctx *view.Context, user *User, address string) <-chan error {
+			if err := user.AddEmail(address, "via profile"); err != nil {
+				errChan := make(chan error, 1)
+				errChan <- err
+				close(errChan)
+				return errChan
+			}
+			return user.Email[len(user.Email)-1].SendConfirmationEmail(ctx, confirmationURL)
+		},
+	)
+}
+
+// NewChangeEmailForm changes the primary email address of the session user
+// after the new address has been confirmed, see User.ChangeEmail().
+// confirmationURL must be a page with EmailConfirmationView().
+func NewChangeEmailForm(buttonText, class, errorMessageClass, successMessageClass string, confirmationURL view.URL) view.View {
+	return newEmailForm(buttonText, class, errorMessageClass, successMessageClass, "gostart_user_change_email",
+		func(ctx *view.Context, user *User, address string) <-chan error {
+			return user.ChangeEmail(ctx, address, confirmationURL)
+		},
+	)
+}
+
+func newEmailForm(buttonText, class, errorMessageClass, successMessageClass, formID string, submit func(ctx *view.Context, user *User, address string) <-chan error) view.View {
+	return view.DynamicView(
+		func(ctx *view.Context) (view.View, error) {
+			userDoc := OfSession(ctx.Session)
+			if userDoc == nil {
+				return view.DIV("error", view.HTML("Please log in first!")), nil
+			}
+			user := From(userDoc)
+			return &view.Form{
+				Class:               class,
+				ErrorMessageClass:   errorMessageClass,
+				SuccessMessageClass: successMessageClass,
+				SuccessMessage:      Config.ConfirmationMessage.Sent,
+				SubmitButtonText:    buttonText,
+				FormID:              formID,
+				GetModel: func(form *view.Form, ctx *view.Context) (interface{}, error) {
+					return &EmailFormModel{}, nil
+				},
+				OnSubmit: func(form *view.Form, formModel interface{}, ctx *view.Context) (string, view.URL, error) {
+					address := formModel.(*EmailFormModel).Email.Get()
+					if err := <-submit(ctx, user, address); err != nil {
+						return "", nil, err
+					}
+					return "", nil, user.Save()
+				},
+			}, nil
+		},
+	)
+}
+
+/*
+NewEmailsView lists the email addresses of the session user
+with buttons to make a confirmed address the primary one,
+to resend the confirmation email and to remove an address.
+confirmationURL must be a page with EmailConfirmationView().
+*/
+func NewEmailsView(class, buttonClass string, confirmationURL view.URL) view.View {
+	return view.DynamicView(
+		func(ctx *view.Context) (view.View, error) {
+			userDoc := OfSession(ctx.Session)
+			if userDoc == nil {
+				return view.DIV("error", view.HTML("Please log in first!")), nil
+			}
+			user := From(userDoc)
+			reload := view.StringURL(ctx.Request.URL.Path)
+
+			button := func(action, text string, i int, onSubmit func(address string) error) view.View {
+				address := user.Email[i].Address.Get()
+				return &view.Form{
+					SubmitButtonText:  text,
+					SubmitButtonClass: buttonClass,
+					FormID:            fmt.Sprintf("gostart_user_email_%s_%d", action, i),
+					GetModel: func(form *view.Form, ctx *view.Context) (interface{}, error) {
+						return &EmailFormModel{Email: model.Email(address)}, nil
+					},
+					HiddenFields: []string{"Email"},
+					Redirect:     reload,
+					OnSubmit: func(form *view.Form, formModel interface{}, ctx *view.Context) (string, view.URL, error) {
+						// Don't trust the hidden field
+						if !formModel.(*EmailFormModel).Email.EqualsCaseinsensitive(address) {
+							return "", nil, errors.New("Invalid email address")
+						}
+						return "", nil, onSubmit(address)
+					},
+				}
+			}
+
+			rows := view.ViewsTableModel{
+				{view.HTML("Email"), view.HTML("Status"), view.HTML("")},
+			}
+			for i := range user.Email {
+				email := &user.Email[i]
+				var status string
+				var actions view.Views
+				switch {
+				case i == 0 && email.Confirmed.IsEmpty():
+					status = "Primary, not confirmed"
+				case i == 0:
+					status = "Primary"
+				case email.Confirmed.IsEmpty() && email.PrimaryOnConfirm.Get():
+					status = "Not confirmed, will be primary when confirmed"
+				case email.Confirmed.IsEmpty():
+					status = "Not confirmed"
+				default:
+					status = "Confirmed"
+				}
+				if i > 0 && !email.Confirmed.IsEmpty() {
+					actions = append(actions, button("primary", "Make primary", i, func(address string) error {
+						oldAddress, err := user.SetPrimaryEmail(address)
+						if err != nil {
+							return err
+						}
+						if err = user.Save(); err != nil {
+							return err
+						}
+						NotifyEmailChanged(oldAddress, address)
+						return nil
+					}))
+				}
+				if email.Confirmed.IsEmpty() {
+					actions = append(actions, button("resend", "Resend confirmation", i, func(address string) error {
+						if err := <-user.Email[user.EmailIndex(address)].SendConfirmationEmail(ctx, confirmationURL); err != nil {
+							return err
+						}
+						return user.Save()
+					}))
+				}
+				if i > 0 {
+					actions = append(actions, button("remove", "Remove", i, func(address string) error {
+						if err := user.RemoveEmail(address); err != nil {
+							return err
+						}
+						return user.Save()
+					}))
+				}
+				rows = append(rows, view.Views{
+					view.Escape(email.Address.Get()),
+					view.Escape(status),
+					actions,
+				})
+			}
+			return &view.Table{Class: class, Model: rows, HeaderRow: true}, nil
+		},
+	)
+}
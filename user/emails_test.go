@@ -0,0 +1,113 @@
+package user
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ungerik/go-start/view"
+)
+
+func TestUnconfirmedEmailIsNotOwned(t *testing.T) {
+	outbox := setupTest()
+	defer outbox.Restore()
+	unconfirmed, _, err := New("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = unconfirmed.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := FindByEmail("a@example.com"); found {
+		t.Error("unconfirmed primary address is owned")
+	}
+
+	// Another user can confirm the address and gets it
+	other, _, err := New("a@example.com", "password")
+	if err != nil {
+		t.Fatal("unconfirmed address blocks other users:", err)
+	}
+	err = <-other.Email[0].SendConfirmationEmail(&view.Context{}, view.StringURL("https://example.com/confirm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.Save(); err != nil {
+		t.Fatal(err)
+	}
+	code := linkCode(t, outbox.AssertSent(t, "a@example.com", "Please confirm"))
+	if _, _, confirmed, err := ConfirmEmail(code); !confirmed {
+		t.Fatal("address not confirmed", err)
+	}
+	doc, found, _ := FindByEmail("a@example.com")
+	if !found || From(doc).ID != other.ID {
+		t.Error("confirmed address not owned by the confirming user")
+	}
+	doc, err = Config.Collection.DocumentWithID(unconfirmed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if From(doc).HasEmail("a@example.com") {
+		t.Error("unconfirmed address has not been released")
+	}
+}
+
+func TestConfirmEmail(t *testing.T) {
+	outbox := setupTest()
+	defer outbox.Restore()
+	user, _, err := New("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirmationURL := view.StringURL("https://example.com/confirm")
+	if err = <-user.Email[0].SendConfirmationEmail(&view.Context{}, confirmationURL); err != nil {
+		t.Fatal(err)
+	}
+	oldCode := linkCode(t, outbox.AssertSent(t, "a@example.com", "Please confirm"))
+	if err = <-user.Email[0].SendConfirmationEmail(&view.Context{}, confirmationURL); err != nil {
+		t.Fatal(err)
+	}
+	code := linkCode(t, outbox.AssertSent(t, "a@example.com", "Please confirm"))
+	if err = user.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if user.Email[0].ConfirmationCodeHash.Get() == code {
+		t.Error("confirmation code stored in plaintext")
+	}
+
+	if _, _, confirmed, _ := ConfirmEmail(oldCode); confirmed {
+		t.Error("code of a previous confirmation email accepted")
+	}
+	if _, _, confirmed, err := ConfirmEmail(code); !confirmed {
+		t.Fatal("address not confirmed", err)
+	}
+	// The code can only be used once
+	if _, _, confirmed, _ := ConfirmEmail(code); confirmed {
+		t.Error("confirmation code used twice")
+	}
+	doc, err := Config.Collection.DocumentWithID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email := From(doc).Email[0]; !email.ConfirmationCodeHash.IsEmpty() || !email.ConfirmationExpires.IsEmpty() {
+		t.Error("confirmation code not cleared")
+	}
+}
+
+func TestConfirmEmailExpires(t *testing.T) {
+	outbox := setupTest()
+	defer outbox.Restore()
+	user, _, err := New("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-user.Email[0].SendConfirmationEmail(&view.Context{}, view.StringURL("https://example.com/confirm")); err != nil {
+		t.Fatal(err)
+	}
+	code := linkCode(t, outbox.AssertSent(t, "a@example.com", "Please confirm"))
+	user.Email[0].ConfirmationExpires.SetTime(time.Now().UTC().Add(-time.Minute))
+	if err = user.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, confirmed, _ := ConfirmEmail(code); confirmed {
+		t.Error("expired confirmation code accepted")
+	}
+}
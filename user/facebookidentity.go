@@ -14,7 +14,7 @@ type FacebookIdentity struct {
 	ID          model.String
 	Name        model.String `view:"placeholder=your facebook url"`
 	Confirmed   model.DateTime
-	AccessToken model.String
+	AccessToken model.String `view:"excluded"`
 }
 
 func (self *FacebookIdentity) NameOrID() string {
@@ -22,7 +22,29 @@ type EmailPasswordFormModel struct {
 	PasswordFormModel `bson:",inline" view:"size=20"`
 }
 
+type PasswordResetRequestFormModel struct {
+	Email model.Email `model:"required" view:"size=20"`
+}
+
 type LoginFormModel struct {
 	Email    model.Email    `model:"required" view:"size=20"`
 	Password model.Password `model:"required" view:"size=20"`
 }
+
+type UserRolesFormModel struct {
+	Roles Roles
+}
+
+type TwoFactorCodeFormModel struct {
+	Code model.String `model:"required" view:"label=Code|size=20"`
+}
+
+type EmailFormModel struct {
+	Email model.Email `model:"required" view:"size=20"`
+}
+
+type APITokenFormModel struct {
+	Name      model.String `model:"required" view:"size=20"`
+	Scopes    model.String `view:"label=Scopes (separated by spaces)|size=40"`
+	ValidDays model.Int    `view:"label=Valid for days (0 for no expiry)|size=5"`
+}
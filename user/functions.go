@@ -3,10 +3,10 @@ package user
 import (
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/ungerik/go-start/errs"
 	"github.com/ungerik/go-start/mgo/bson"
-	"github.com/ungerik/go-start/mongo"
 	"github.com/ungerik/go-start/view"
 )
 
@@ -108,31 +108,78 @@ func IsConfirmedUserID(id string) (confirmed bool, err error) {
 ///////////////////////////////////////////////////////////////////////////////
 // Email functions
 
+// FindByEmail returns the user that owns the email address addr,
+// see EmailInUse(). Users that added addr as unconfirmed
+// primary or secondary address are not returned.
 func FindByEmail(addr string) (doc interface{}, found bool, err error) {
-	query := Config.Collection.FilterEqualCaseInsensitive("Email.Address", strings.TrimSpace(addr))
-	return query.TryOne()
+	addr = strings.TrimSpace(addr)
+	i := Config.Collection.FilterEqualCaseInsensitive("Email.Address", addr).Iterator()
+	for doc = i.Next(); doc != nil; doc = i.Next() {
+		if From(doc).ownsEmail(addr) {
+			return doc, true, nil
+		}
+	}
+	return nil, false, i.Err()
 }
 
+/*
+ConfirmEmail confirms the email address with the unexpired confirmationCode
+from EmailIdentity.SendConfirmationEmail(). The code can only be used once.
+An address can't be confirmed if another user has confirmed it before.
+If the address was added with User.ChangeEmail(), it becomes the
+primary address and Config.EmailChangedMessage is sent to the old one.
+*/
 func ConfirmEmail(confirmationCode string) (userDoc interface{}, email string, confirmed bool, err error) {
-	query := Config.Collection.Filter("Email.ConfirmationCode", confirmationCode)
+	if confirmationCode == "" {
+		return nil, "", false, nil
+	}
+	codeHash := hashToken(confirmationCode)
+	query := Config.Collection.Filter("Email.ConfirmationCodeHash", codeHash)
 	userDoc, found, err := query.TryOne()
 	if !found {
 		return nil, "", false, err
 	}
 	user := From(userDoc)
 
+	index := -1
 	for i := range user.Email {
-		if user.Email[i].ConfirmationCode.Get() == confirmationCode {
-			user.Email[i].Confirmed.SetNowUTC()
-			email = user.Email[i].Address.Get()
+		if user.Email[i].ConfirmationCodeHash.Get() == codeHash {
+			index = i
 		}
 	}
-	errs.Assert(email != "", "ConfirmationCode has to be found")
+	errs.Assert(index != -1, "ConfirmationCodeHash has to be found")
+	if !user.Email[index].confirmationValid() {
+		return nil, "", false, nil
+	}
+	email = user.Email[index].Address.Get()
+
+	inUse, err := EmailInUse(email, userDoc)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if inUse {
+		return nil, "", false, errs.Format("Email address %s is already in use", email)
+	}
+	user.Email[index].Confirmed.SetNowUTC()
+	user.Email[index].clearConfirmation()
+
+	oldPrimary := user.PrimaryEmail()
+	changedPrimary := user.Email[index].PrimaryOnConfirm.Get() && index > 0
+	user.Email[index].PrimaryOnConfirm.Set(false)
+	if changedPrimary {
+		user.moveEmailToFront(index)
+	}
 
 	err = user.Save()
 	if err != nil {
 		return nil, "", false, err
 	}
+	if err = releaseEmail(email, userDoc); err != nil {
+		return nil, "", false, err
+	}
+	if changedPrimary {
+		NotifyEmailChanged(oldPrimary, email)
+	}
 
 	return userDoc, email, true, nil
 }
@@ -142,39 +189,137 @@ func ConfirmEmail(confirmationCode string) (userDoc interface{}, email string, c
 
 const ContextCacheKey = "github.com/ungerik/go-start/user.ContextCacheKey"
 
-func Login(session *view.Session, userDoc interface{}) {
-	session.SetID(userDoc.(mongo.Document).ObjectId().Hex())
+// Login starts a new LoginSession for userDoc and sets its
+// random token as session ID. A previous session is revoked.
+func Login(session *view.Session, userDoc interface{}) error {
+	return login(session, userDoc, nil)
+}
+
+func login(session *view.Session, userDoc interface{}, setup func(*LoginSession)) error {
+	token, err := newLoginSession(session.Ctx, userDoc, setup)
+	if err != nil {
+		return err
+	}
+	if err = revokeCurrentSession(session); err != nil {
+		return err
+	}
+	session.SetID(token)
 	session.User = userDoc
+	return nil
 }
 
-func Logout(session *view.Session) {
+// Logout revokes the current LoginSession.
+func Logout(session *view.Session) error {
+	err := revokeCurrentSession(session)
 	session.DeleteID()
 	session.User = nil
+	return err
+}
+
+func revokeCurrentSession(session *view.Session) error {
+	token, ok := session.ID()
+	if !ok {
+		return nil
+	}
+	return Config.SessionCollection.Filter("TokenHash", hashToken(token)).RemoveAll()
 }
 
+// LoginEmailPassword logs in the user with email and password.
+// If the user has two-factor authentication enabled, the login
+// is pending until VerifyTwoFactor(), see TwoFactorPending().
+// Failed logins are throttled according to Config.LoginThrottling,
+// in that case an *ErrLoginThrottled is returned.
 func LoginEmailPassword(session *view.Session, email, password string) (emailPasswdMatch bool, err error) {
+	userDoc, ok, err := CheckEmailPassword(session.Ctx, email, password)
+	if !ok {
+		return false, err
+	}
+	if _, err = BeginLogin(session, userDoc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CheckEmailPassword returns the user with email and password without
+// logging in. Failed checks are throttled like LoginEmailPassword(),
+// an ErrLoginThrottled is returned for throttled checks.
+func CheckEmailPassword(ctx *view.Context, email, password string) (userDoc interface{}, ok bool, err error) {
 	email = strings.TrimSpace(email)
+	ip := clientIP(ctx)
+	if err = checkClientIP(ip); err != nil {
+		return nil, false, err
+	}
 	userDoc, found, err := FindByEmail(email)
+	if err != nil {
+		return nil, false, err
+	}
 	if !found {
-		return false, err
+		audit(AuditUnknownUserLogin, email, ip, nil)
+		return nil, false, clientLoginFailed(ip)
 	}
-	if !From(userDoc).EmailPasswordMatch(email, password) {
-		return false, nil
+	user := From(userDoc)
+	if err = user.LoginFailures.check(); err != nil {
+		audit(AuditLoginThrottled, email, ip, userDoc)
+		return nil, false, err
 	}
-	Login(session, userDoc)
-	return true, nil
+	if !user.EmailPasswordMatch(email, password) {
+		if err = clientLoginFailed(ip); err != nil {
+			return nil, false, err
+		}
+		return nil, false, loginFailed(ctx, userDoc, ip)
+	}
+	if !user.LoginFailures.Count.IsEmpty() {
+		user.LoginFailures.Clear()
+		if err = user.Save(); err != nil {
+			return nil, false, err
+		}
+	}
+	return userDoc, true, nil
 }
 
-// Returns nil if there is no session user
+/*
+NewBasicAuth returns a view.BasicAuth that authenticates users
+with their email address as username and their password.
+ctx.Session.User is set to the user without creating a session cookie.
+Failed logins are throttled like LoginEmailPassword().
+Blocked users and users with two-factor authentication are denied,
+the latter can use an APIToken instead.
+*/
+func NewBasicAuth(realm string) *view.BasicAuth {
+	return &view.BasicAuth{
+		Realm: realm,
+		CheckCredentials: func(ctx *view.Context, username, password string) (ok bool, err error) {
+			userDoc, ok, err := CheckEmailPassword(ctx, username, password)
+			if _, throttled := err.(*ErrLoginThrottled); throttled {
+				return false, nil
+			}
+			if !ok || !From(userDoc).IdentityConfirmed() || From(userDoc).TwoFactor.IsEnabled() {
+				return false, err
+			}
+			ctx.Session.User = userDoc
+			return true, nil
+		},
+	}
+}
+
+// Returns nil if there is no session user.
+// Revoked, expired or two-factor pending sessions have no user.
 func OfSession(session *view.Session) (userDoc interface{}) {
 	if session.User != nil {
 		return session.User
 	}
-	id, ok := session.ID()
-	if !ok {
+	loginSession, found, _ := CurrentSession(session)
+	if !found || loginSession.TwoFactorPending.Get() {
+		return nil
+	}
+	userDoc, found, _ = loginSession.UserDoc()
+	if !found {
 		return nil
 	}
-	userDoc, _, _ = FindByID(id)
+	if time.Since(loginSession.LastSeen.Time()) > lastSeenInterval {
+		loginSession.LastSeen.SetNowUTC()
+		loginSession.Save()
+	}
 	session.User = userDoc
 	return userDoc
 }
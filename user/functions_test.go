@@ -0,0 +1,45 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/ungerik/go-start/view"
+)
+
+func TestBasicAuth(t *testing.T) {
+	defer setupTest().Restore()
+	_, blocked := newTestUser(t, "blocked@example.com", "password")
+	blocked.Blocked.Set(true)
+	if err := blocked.Save(); err != nil {
+		t.Fatal(err)
+	}
+	_, twoFactor := newTestUser(t, "2fa@example.com", "password")
+	enableTestTwoFactor(t, twoFactor)
+	newTestUser(t, "a@example.com", "password")
+
+	tests := []struct {
+		username string
+		password string
+		want     bool
+	}{
+		{"a@example.com", "password", true},
+		{"a@example.com", "wrong", false},
+		{"unknown@example.com", "password", false},
+		{"blocked@example.com", "password", false},
+		{"2fa@example.com", "password", false},
+	}
+	auth := NewBasicAuth("test")
+	for _, test := range tests {
+		ctx := &view.Context{Session: newTestSession()}
+		ok, err := auth.CheckCredentials(ctx, test.username, test.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.want {
+			t.Errorf("%s: CheckCredentials returned %v, want %v", test.username, ok, test.want)
+		}
+		if ok != (ctx.Session.User != nil) {
+			t.Errorf("%s: session user doesn't match the result", test.username)
+		}
+	}
+}
@@ -12,7 +12,7 @@ type GitHubIdentity struct {
 	ID          model.String
 	Name        model.String
 	Confirmed   model.DateTime
-	AccessToken model.String
+	AccessToken model.String `view:"excluded"`
 }
 
 func (self *GitHubIdentity) ProfileURL() string {
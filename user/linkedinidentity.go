@@ -13,7 +13,7 @@ type LinkedInIdentity struct {
 	ID          model.String
 	Name        model.String
 	Confirmed   model.DateTime
-	AccessToken model.String
+	AccessToken model.String `view:"excluded"`
 }
 
 func (self *LinkedInIdentity) ProfileURL() string {
@@ -0,0 +1,381 @@
+package user
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/view"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// OAuth2Provider
+
+// OAuth2Config holds the client credentials and endpoints
+// of an OAuth2 provider.
+type OAuth2Config struct {
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	Scopes       []string
+	// SecretInHeader sends the client credentials with HTTP basic
+	// authentication to TokenURL instead of form parameters.
+	SecretInHeader bool
+	// TrustEmailVerified has to be true to accept OAuth2Identity.EmailVerified
+	// of this provider. Verified addresses are confirmed for new users
+	// and used to link existing users who have confirmed them.
+	TrustEmailVerified bool
+	// Client is used for requests to the provider,
+	// http.DefaultClient if nil.
+	Client *http.Client
+}
+
+func (self *OAuth2Config) client() *http.Client {
+	if self.Client == nil {
+		return http.DefaultClient
+	}
+	return self.Client
+}
+
+// OAuth2Identity is the account of a user at an OAuth2 provider.
+type OAuth2Identity struct {
+	ID string
+	// Username is the login name at the provider
+	Username string
+	// Name is the display name of the user
+	Name  string
+	Email string
+	// EmailVerified is true if the provider guarantees
+	// that Email belongs to the user.
+	EmailVerified bool
+}
+
+/*
+OAuth2Provider is the interface for the provider specific parts of an
+OAuth2 login. See GitHubOAuth2, FacebookOAuth2, LinkedInOAuth2
+and TwitterOAuth2 for implementations that store the identities
+in the corresponding fields of User.
+*/
+type OAuth2Provider interface {
+	// Name is used as path of the views, for example "github"
+	Name() string
+	OAuth2Config() *OAuth2Config
+	// FetchIdentity returns the identity of the owner of accessToken.
+	FetchIdentity(accessToken string) (identity *OAuth2Identity, err error)
+	// FindUser returns the user with a linked identity.
+	FindUser(identity *OAuth2Identity) (userDoc interface{}, found bool, err error)
+	// LinkIdentity adds or updates identity at user.
+	LinkIdentity(user *User, identity *OAuth2Identity, accessToken string)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Authorization code flow with PKCE
+
+// pkceChallenge returns the S256 code challenge for verifier, see RFC 7636
+func pkceChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64URL(hash[:])
+}
+
+func base64URL(data []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+}
+
+// OAuth2AuthURL returns the URL of the provider where the user
+// authorizes the login. state must be checked by the callback
+// and verifier passed to OAuth2Exchange().
+func OAuth2AuthURL(provider OAuth2Provider, redirectURI, state, verifier string) string {
+	config := provider.OAuth2Config()
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", config.ClientID)
+	params.Set("redirect_uri", redirectURI)
+	if len(config.Scopes) > 0 {
+		params.Set("scope", strings.Join(config.Scopes, " "))
+	}
+	params.Set("state", state)
+	params.Set("code_challenge", pkceChallenge(verifier))
+	params.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(config.AuthURL, "?") {
+		separator = "&"
+	}
+	return config.AuthURL + separator + params.Encode()
+}
+
+// OAuth2Exchange exchanges an authorization code
+// for the access token of the user.
+func OAuth2Exchange(provider OAuth2Provider, code, redirectURI, verifier string) (accessToken string, err error) {
+	config := provider.OAuth2Config()
+	params := url.Values{}
+	params.Set("grant_type", "authorization_code")
+	params.Set("code", code)
+	params.Set("redirect_uri", redirectURI)
+	params.Set("code_verifier", verifier)
+	params.Set("client_id", config.ClientID)
+	if !config.SecretInHeader && config.ClientSecret != "" {
+		params.Set("client_secret", config.ClientSecret)
+	}
+	request, err := http.NewRequest("POST", config.TokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if config.SecretInHeader {
+		request.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	}
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = oauth2Do(config.client(), request, &result); err != nil {
+		return "", err
+	}
+	if result.Error != "" {
+		return "", errs.Format("OAuth2 error from %s: %s %s", provider.Name(), result.Error, result.ErrorDescription)
+	}
+	if result.AccessToken == "" {
+		return "", errs.Format("OAuth2 response from %s has no access_token", provider.Name())
+	}
+	return result.AccessToken, nil
+}
+
+// OAuth2GetJSON requests apiURL with accessToken
+// and decodes the JSON response into result.
+func OAuth2GetJSON(provider OAuth2Provider, apiURL, accessToken string, result interface{}) error {
+	request, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	request.Header.Set("Accept", "application/json")
+	return oauth2Do(provider.OAuth2Config().client(), request, result)
+}
+
+func oauth2Do(client *http.Client, request *http.Request, result interface{}) error {
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	// Error responses of the token endpoint are JSON with status 400
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusBadRequest {
+		return errs.Format("OAuth2 request %s returned %s", request.URL, response.Status)
+	}
+	return json.Unmarshal(body, result)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Account linking
+
+/*
+LoginWithOAuth2 links identity to the user of session if there is one
+or logs in the user with the linked identity.
+If there is no user with the identity, a user who has confirmed
+the verified email of the identity is linked or a new user is created.
+The email of the identity is only treated as verified
+if OAuth2Config.TrustEmailVerified of the provider is set.
+Users with two-factor authentication have to finish
+the login with VerifyTwoFactor().
+*/
+func LoginWithOAuth2(session *view.Session, provider OAuth2Provider, identity *OAuth2Identity, accessToken string) (userDoc interface{}, err error) {
+	if identity.ID == "" {
+		return nil, errs.Format("OAuth2 identity from %s has no ID", provider.Name())
+	}
+	linkedDoc, linked, err := provider.FindUser(identity)
+	if err != nil {
+		return nil, err
+	}
+	emailVerified := identity.EmailVerified && provider.OAuth2Config().TrustEmailVerified
+
+	if sessionDoc := OfSession(session); sessionDoc != nil {
+		// Account linking for the logged in user
+		sessionUser := From(sessionDoc)
+		if linked && From(linkedDoc).ID != sessionUser.ID {
+			return nil, errs.Format("This %s account is already linked to another user", provider.Name())
+		}
+		provider.LinkIdentity(sessionUser, identity, accessToken)
+		return sessionDoc, sessionUser.Save()
+	}
+
+	if linked {
+		userDoc = linkedDoc
+	} else if identity.Email != "" {
+		doc, found, err := FindByEmail(identity.Email)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			// Only link automatically if both sides have verified the address
+			user := From(doc)
+			idx := user.EmailIndex(identity.Email)
+			if !emailVerified || idx == -1 || user.Email[idx].Confirmed.IsEmpty() {
+				return nil, errs.Format("There is already an account with the email address %s, please log in to link your %s account", identity.Email, provider.Name())
+			}
+			userDoc = doc
+		}
+	}
+	if userDoc == nil {
+		userDoc = Config.Collection.NewDocument()
+		user := From(userDoc)
+		if identity.Email != "" {
+			if err = user.AddEmail(identity.Email, "via "+provider.Name()); err != nil {
+				return nil, err
+			}
+			if emailVerified {
+				user.Email[0].Confirmed.SetNowUTC()
+			}
+		}
+		if identity.Email != "" {
+			user.Username.Set(identity.Email)
+		} else {
+			user.Username.Set(identity.Username)
+		}
+		user.Name.First.Set(identity.Name)
+	}
+
+	user := From(userDoc)
+	if user.Blocked.Get() {
+		return nil, errs.Format("User is blocked")
+	}
+	provider.LinkIdentity(user, identity, accessToken)
+	if err = user.Save(); err != nil {
+		return nil, err
+	}
+	_, err = BeginLogin(session, userDoc)
+	return userDoc, err
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// OAuth2Views
+
+/*
+OAuth2Views are the login and callback views for an OAuth2Provider.
+Login redirects to the provider and Callback finishes the login
+with LoginWithOAuth2() and redirects to Redirect.
+
+Example:
+
+	github := user.NewOAuth2Views(user.NewGitHubOAuth2(clientID, clientSecret), view.StringURL("/"))
+
+	view.ViewPath{View: homepage, Sub: []view.ViewPath{
+		{Name: "oauth2", Sub: []view.ViewPath{
+			github.ViewPath(),
+		}},
+	}}
+
+	view.A(github.Login, "Login with GitHub")
+
+The URL of Callback has to be registered as redirect URI
+at the provider.
+*/
+type OAuth2Views struct {
+	Provider OAuth2Provider
+	Login    *view.ViewURLWrapper
+	Callback *view.ViewURLWrapper
+	Redirect view.URL // If nil, the redirect will go to "/"
+}
+
+func NewOAuth2Views(provider OAuth2Provider, redirect view.URL) *OAuth2Views {
+	self := &OAuth2Views{Provider: provider, Redirect: redirect}
+	self.Login = view.NewViewURLWrapper(view.RenderView(self.renderLogin))
+	self.Callback = view.NewViewURLWrapper(view.DynamicView(self.callbackView))
+	return self
+}
+
+// ViewPath returns the ViewPath with the name of the provider
+// and the sub paths "login" and "callback".
+func (self *OAuth2Views) ViewPath() view.ViewPath {
+	return view.ViewPath{
+		Name: self.Provider.Name(),
+		Sub: []view.ViewPath{
+			{Name: "login", View: self.Login},
+			{Name: "callback", View: self.Callback},
+		},
+	}
+}
+
+func (self *OAuth2Views) cookieName() string {
+	return "gostart_oauth2_" + self.Provider.Name()
+}
+
+func (self *OAuth2Views) redirectURI(ctx *view.Context) string {
+	return ctx.Request.AddProtocolAndHostToURL(self.Callback.URL(ctx))
+}
+
+// renderLogin redirects to the provider and remembers
+// state and PKCE verifier in a secure cookie.
+func (self *OAuth2Views) renderLogin(ctx *view.Context) error {
+	state, err := randomToken()
+	if err != nil {
+		return err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return err
+	}
+	ctx.Response.SetSecureCookie(self.cookieName(), state+":"+verifier, 600, "/")
+	return view.Redirect(OAuth2AuthURL(self.Provider, self.redirectURI(ctx), state, verifier))
+}
+
+func (self *OAuth2Views) callbackView(ctx *view.Context) (view.View, error) {
+	cookie, ok := ctx.Request.GetSecureCookie(self.cookieName())
+	ctx.Response.SetSecureCookie(self.cookieName(), "", -1, "/")
+	if !ok {
+		return view.DIV("error", view.HTML("OAuth2 login expired, please try again")), nil
+	}
+	message, err := oauth2Callback(ctx.Session, self.Provider, ctx.Request.Params, cookie, self.redirectURI(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if message != "" {
+		return view.DIV("error", view.Escape(message)), nil
+	}
+	if self.Redirect != nil {
+		return nil, view.Redirect(self.Redirect.URL(ctx))
+	}
+	return nil, view.Redirect("/")
+}
+
+// oauth2Callback checks the callback params against the state
+// and PKCE verifier of the cookie set by renderLogin
+// and finishes the login with LoginWithOAuth2().
+// Errors for the user are returned as message.
+func oauth2Callback(session *view.Session, provider OAuth2Provider, params map[string]string, cookie, redirectURI string) (message string, err error) {
+	parts := strings.SplitN(cookie, ":", 2)
+	state := params["state"]
+	if len(parts) != 2 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(state)) != 1 {
+		return "Invalid OAuth2 state", nil
+	}
+	if e := params["error"]; e != "" {
+		return fmt.Sprintf("Login with %s failed: %s", provider.Name(), e), nil
+	}
+
+	accessToken, err := OAuth2Exchange(provider, params["code"], redirectURI, parts[1])
+	if err != nil {
+		return "", err
+	}
+	identity, err := provider.FetchIdentity(accessToken)
+	if err != nil {
+		return "", err
+	}
+	_, err = LoginWithOAuth2(session, provider, identity, accessToken)
+	if err != nil {
+		return err.Error(), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,210 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ungerik/go-start/view"
+)
+
+// testOAuth2Provider is a stand-in OpenID Connect provider
+// for a LinkedInOAuth2.
+type testOAuth2Provider struct {
+	*httptest.Server
+	Provider *LinkedInOAuth2
+	// challenge is the PKCE code challenge of the last auth URL
+	challenge string
+	// UserInfo is returned by the userinfo endpoint
+	UserInfo map[string]interface{}
+}
+
+func newTestOAuth2Provider() *testOAuth2Provider {
+	self := &testOAuth2Provider{
+		UserInfo: map[string]interface{}{
+			"sub":            "linkedin-1",
+			"name":           "Erik",
+			"email":          "a@example.com",
+			"email_verified": true,
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", self.token)
+	mux.HandleFunc("/userinfo", self.userInfo)
+	self.Server = httptest.NewServer(mux)
+	self.Provider = NewLinkedInOAuth2("client", "secret")
+	self.Provider.Config.AuthURL = self.URL + "/authorize"
+	self.Provider.Config.TokenURL = self.URL + "/token"
+	self.Provider.UserInfoURL = self.URL + "/userinfo"
+	return self
+}
+
+func (self *testOAuth2Provider) token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.FormValue("code") != "code" || r.FormValue("client_secret") != "secret" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_grant"}`))
+		return
+	}
+	if pkceChallenge(r.FormValue("code_verifier")) != self.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_grant", "error_description": "PKCE verification failed"}`))
+		return
+	}
+	w.Write([]byte(`{"access_token": "access", "token_type": "bearer"}`))
+}
+
+func (self *testOAuth2Provider) userInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer access" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(self.UserInfo)
+}
+
+// callback starts a login like renderLogin and calls oauth2Callback
+// with params and the cookie of the login.
+func (self *testOAuth2Provider) callback(t *testing.T, session *view.Session, params map[string]string, cookie string) (message string, err error) {
+	t.Helper()
+	authURL, err := url.Parse(OAuth2AuthURL(self.Provider, "https://example.com/callback", "state", "verifier"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	self.challenge = authURL.Query().Get("code_challenge")
+	return oauth2Callback(session, self.Provider, params, cookie, "https://example.com/callback")
+}
+
+func TestOAuth2Login(t *testing.T) {
+	outbox := setupTest()
+	defer outbox.Restore()
+	provider := newTestOAuth2Provider()
+	defer provider.Close()
+
+	session := newTestSession()
+	message, err := provider.callback(t, session, map[string]string{"state": "state", "code": "code"}, "state:verifier")
+	if message != "" || err != nil {
+		t.Fatalf("login failed: %q %v", message, err)
+	}
+	userDoc := sessionUser(session)
+	if userDoc == nil {
+		t.Fatal("not logged in")
+	}
+	user := From(userDoc)
+	if len(user.LinkedIn) != 1 || user.LinkedIn[0].ID != "linkedin-1" || user.LinkedIn[0].AccessToken != "access" {
+		t.Errorf("identity not linked: %+v", user.LinkedIn)
+	}
+	if !user.EmailConfirmed("a@example.com") {
+		t.Error("verified email of a trusted provider not confirmed")
+	}
+
+	// The next login finds the linked user
+	session = newTestSession()
+	if message, err = provider.callback(t, session, map[string]string{"state": "state", "code": "code"}, "state:verifier"); message != "" || err != nil {
+		t.Fatalf("second login failed: %q %v", message, err)
+	}
+	if From(sessionUser(session)).ID != user.ID {
+		t.Error("second login created another user")
+	}
+}
+
+func TestOAuth2CallbackErrors(t *testing.T) {
+	outbox := setupTest()
+	defer outbox.Restore()
+	provider := newTestOAuth2Provider()
+	defer provider.Close()
+
+	tests := []struct {
+		name    string
+		params  map[string]string
+		cookie  string
+		message string
+		err     string
+	}{
+		{"state mismatch", map[string]string{"state": "other", "code": "code"}, "state:verifier", "Invalid OAuth2 state", ""},
+		{"no state", map[string]string{"code": "code"}, "state:verifier", "Invalid OAuth2 state", ""},
+		{"invalid cookie", map[string]string{"state": "state", "code": "code"}, "state", "Invalid OAuth2 state", ""},
+		{"provider error", map[string]string{"state": "state", "error": "access_denied"}, "state:verifier", "Login with linkedin failed: access_denied", ""},
+		{"wrong verifier", map[string]string{"state": "state", "code": "code"}, "state:other", "", "PKCE verification failed"},
+		{"wrong code", map[string]string{"state": "state", "code": "other"}, "state:verifier", "", "invalid_grant"},
+	}
+	for _, test := range tests {
+		session := newTestSession()
+		message, err := provider.callback(t, session, test.params, test.cookie)
+		if message != test.message {
+			t.Errorf("%s: message %q instead of %q", test.name, message, test.message)
+		}
+		if (err == nil) != (test.err == "") || err != nil && !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v instead of %q", test.name, err, test.err)
+		}
+		if sessionUser(session) != nil {
+			t.Errorf("%s: logged in", test.name)
+		}
+	}
+	if n, _ := Config.Collection.Count(); n != 0 {
+		t.Errorf("%d users created by failed logins", n)
+	}
+}
+
+func TestOAuth2LinkExistingUser(t *testing.T) {
+	outbox := setupTest()
+	defer outbox.Restore()
+	provider := newTestOAuth2Provider()
+	defer provider.Close()
+	params := map[string]string{"state": "state", "code": "code"}
+
+	_, user := newTestUser(t, "a@example.com", "password")
+	session := newTestSession()
+
+	// email_verified of the provider is not trusted
+	provider.Provider.Config.TrustEmailVerified = false
+	if message, err := provider.callback(t, session, params, "state:verifier"); message == "" || err != nil {
+		t.Errorf("account linked with an untrusted email_verified: %q %v", message, err)
+	}
+	provider.Provider.Config.TrustEmailVerified = true
+
+	// The address is not verified by the provider
+	provider.UserInfo["email_verified"] = false
+	if message, err := provider.callback(t, session, params, "state:verifier"); message == "" || err != nil {
+		t.Errorf("account linked with an unverified email: %q %v", message, err)
+	}
+	provider.UserInfo["email_verified"] = true
+	if sessionUser(session) != nil {
+		t.Fatal("logged in without linking")
+	}
+
+	if message, err := provider.callback(t, session, params, "state:verifier"); message != "" || err != nil {
+		t.Fatalf("confirmed account not linked: %q %v", message, err)
+	}
+	loggedIn := sessionUser(session)
+	if loggedIn == nil || From(loggedIn).ID != user.ID {
+		t.Fatal("not logged in as the existing user")
+	}
+	if len(From(loggedIn).LinkedIn) != 1 {
+		t.Error("identity not linked to the existing user")
+	}
+
+	// Users who haven't confirmed the address are not linked
+	unconfirmed, _, err := New("b@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = unconfirmed.Save(); err != nil {
+		t.Fatal(err)
+	}
+	provider.UserInfo["sub"] = "linkedin-2"
+	provider.UserInfo["email"] = "b@example.com"
+	session = newTestSession()
+	if message, err := provider.callback(t, session, params, "state:verifier"); message != "" || err != nil {
+		t.Fatalf("login failed: %q %v", message, err)
+	}
+	if loggedIn = sessionUser(session); loggedIn == nil || From(loggedIn).ID == unconfirmed.ID {
+		t.Error("identity linked to a user who hasn't confirmed the address")
+	}
+	if n, _ := Config.Collection.Count(); n != 3 {
+		t.Errorf("%d users instead of 3", n)
+	}
+}
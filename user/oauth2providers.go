@@ -0,0 +1,309 @@
+package user
+
+import (
+	"strconv"
+
+	"github.com/ungerik/go-start/model"
+)
+
+/*
+OAuth2Provider implementations for the identities of User.
+The API endpoints are fields, so they can be pointed
+to a local stand-in server for testing.
+
+Xing supports only OAuth 1.0a, so there is no provider for XingIdentity.
+*/
+
+// linkOAuth2Identity sets the fields of an identity of User
+func linkOAuth2Identity(id, name *model.String, confirmed *model.DateTime, token *model.String, identity *OAuth2Identity, accessToken string) {
+	id.Set(identity.ID)
+	if identity.Username != "" {
+		name.Set(identity.Username)
+	} else if name.IsEmpty() {
+		name.Set(identity.Name)
+	}
+	confirmed.SetNowUTC()
+	token.Set(accessToken)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// GitHubOAuth2
+
+type GitHubOAuth2 struct {
+	Config     OAuth2Config
+	ProfileURL string
+	// EmailsURL is used to find the primary verified email address,
+	// needs the scope "user:email"
+	EmailsURL string
+}
+
+func NewGitHubOAuth2(clientID, clientSecret string) *GitHubOAuth2 {
+	return &GitHubOAuth2{
+		Config: OAuth2Config{
+			ClientID:           clientID,
+			ClientSecret:       clientSecret,
+			AuthURL:            "https://github.com/login/oauth/authorize",
+			TokenURL:           "https://github.com/login/oauth/access_token",
+			Scopes:             []string{"user:email"},
+			TrustEmailVerified: true,
+		},
+		ProfileURL: "https://api.github.com/user",
+		EmailsURL:  "https://api.github.com/user/emails",
+	}
+}
+
+func (self *GitHubOAuth2) Name() string {
+	return "github"
+}
+
+func (self *GitHubOAuth2) OAuth2Config() *OAuth2Config {
+	return &self.Config
+}
+
+func (self *GitHubOAuth2) FetchIdentity(accessToken string) (*OAuth2Identity, error) {
+	var profile struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	err := OAuth2GetJSON(self, self.ProfileURL, accessToken, &profile)
+	if err != nil {
+		return nil, err
+	}
+	identity := &OAuth2Identity{
+		ID:       strconv.FormatInt(profile.ID, 10),
+		Username: profile.Login,
+		Name:     profile.Name,
+	}
+	if self.EmailsURL != "" {
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		err = OAuth2GetJSON(self, self.EmailsURL, accessToken, &emails)
+		if err != nil {
+			return nil, err
+		}
+		for _, email := range emails {
+			if email.Primary && email.Verified {
+				identity.Email = email.Email
+				identity.EmailVerified = true
+			}
+		}
+	}
+	return identity, nil
+}
+
+func (self *GitHubOAuth2) FindUser(identity *OAuth2Identity) (userDoc interface{}, found bool, err error) {
+	return Config.Collection.Filter("GitHub.ID", identity.ID).TryOne()
+}
+
+func (self *GitHubOAuth2) LinkIdentity(user *User, identity *OAuth2Identity, accessToken string) {
+	for i := range user.GitHub {
+		if user.GitHub[i].ID.Get() == identity.ID {
+			i := &user.GitHub[i]
+			linkOAuth2Identity(&i.ID, &i.Name, &i.Confirmed, &i.AccessToken, identity, accessToken)
+			return
+		}
+	}
+	var i GitHubIdentity
+	linkOAuth2Identity(&i.ID, &i.Name, &i.Confirmed, &i.AccessToken, identity, accessToken)
+	user.GitHub = append(user.GitHub, i)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// FacebookOAuth2
+
+type FacebookOAuth2 struct {
+	Config     OAuth2Config
+	ProfileURL string
+}
+
+func NewFacebookOAuth2(clientID, clientSecret string) *FacebookOAuth2 {
+	return &FacebookOAuth2{
+		Config: OAuth2Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			AuthURL:      "https://www.facebook.com/dialog/oauth",
+			TokenURL:     "https://graph.facebook.com/oauth/access_token",
+			Scopes:       []string{"email"},
+		},
+		ProfileURL: "https://graph.facebook.com/me?fields=id,name,email",
+	}
+}
+
+func (self *FacebookOAuth2) Name() string {
+	return "facebook"
+}
+
+func (self *FacebookOAuth2) OAuth2Config() *OAuth2Config {
+	return &self.Config
+}
+
+// FetchIdentity returns the email address as not verified,
+// because Facebook doesn't tell if it is.
+func (self *FacebookOAuth2) FetchIdentity(accessToken string) (*OAuth2Identity, error) {
+	var profile struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	}
+	err := OAuth2GetJSON(self, self.ProfileURL, accessToken, &profile)
+	if err != nil {
+		return nil, err
+	}
+	return &OAuth2Identity{ID: profile.ID, Name: profile.Name, Email: profile.Email}, nil
+}
+
+func (self *FacebookOAuth2) FindUser(identity *OAuth2Identity) (userDoc interface{}, found bool, err error) {
+	return Config.Collection.Filter("Facebook.ID", identity.ID).TryOne()
+}
+
+func (self *FacebookOAuth2) LinkIdentity(user *User, identity *OAuth2Identity, accessToken string) {
+	for i := range user.Facebook {
+		if user.Facebook[i].ID.Get() == identity.ID {
+			i := &user.Facebook[i]
+			linkOAuth2Identity(&i.ID, &i.Name, &i.Confirmed, &i.AccessToken, identity, accessToken)
+			return
+		}
+	}
+	var i FacebookIdentity
+	linkOAuth2Identity(&i.ID, &i.Name, &i.Confirmed, &i.AccessToken, identity, accessToken)
+	user.Facebook = append(user.Facebook, i)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// LinkedInOAuth2
+
+// LinkedInOAuth2 uses "Sign In with LinkedIn using OpenID Connect"
+type LinkedInOAuth2 struct {
+	Config      OAuth2Config
+	UserInfoURL string
+}
+
+func NewLinkedInOAuth2(clientID, clientSecret string) *LinkedInOAuth2 {
+	return &LinkedInOAuth2{
+		Config: OAuth2Config{
+			ClientID:           clientID,
+			ClientSecret:       clientSecret,
+			AuthURL:            "https://www.linkedin.com/oauth/v2/authorization",
+			TokenURL:           "https://www.linkedin.com/oauth/v2/accessToken",
+			Scopes:             []string{"openid", "profile", "email"},
+			TrustEmailVerified: true,
+		},
+		UserInfoURL: "https://api.linkedin.com/v2/userinfo",
+	}
+}
+
+func (self *LinkedInOAuth2) Name() string {
+	return "linkedin"
+}
+
+func (self *LinkedInOAuth2) OAuth2Config() *OAuth2Config {
+	return &self.Config
+}
+
+func (self *LinkedInOAuth2) FetchIdentity(accessToken string) (*OAuth2Identity, error) {
+	var userInfo struct {
+		Sub           string `json:"sub"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	err := OAuth2GetJSON(self, self.UserInfoURL, accessToken, &userInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &OAuth2Identity{
+		ID:            userInfo.Sub,
+		Name:          userInfo.Name,
+		Email:         userInfo.Email,
+		EmailVerified: userInfo.EmailVerified,
+	}, nil
+}
+
+func (self *LinkedInOAuth2) FindUser(identity *OAuth2Identity) (userDoc interface{}, found bool, err error) {
+	return Config.Collection.Filter("LinkedIn.ID", identity.ID).TryOne()
+}
+
+func (self *LinkedInOAuth2) LinkIdentity(user *User, identity *OAuth2Identity, accessToken string) {
+	for i := range user.LinkedIn {
+		if user.LinkedIn[i].ID.Get() == identity.ID {
+			i := &user.LinkedIn[i]
+			linkOAuth2Identity(&i.ID, &i.Name, &i.Confirmed, &i.AccessToken, identity, accessToken)
+			return
+		}
+	}
+	var i LinkedInIdentity
+	linkOAuth2Identity(&i.ID, &i.Name, &i.Confirmed, &i.AccessToken, identity, accessToken)
+	user.LinkedIn = append(user.LinkedIn, i)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// TwitterOAuth2
+
+type TwitterOAuth2 struct {
+	Config     OAuth2Config
+	ProfileURL string
+}
+
+func NewTwitterOAuth2(clientID, clientSecret string) *TwitterOAuth2 {
+	return &TwitterOAuth2{
+		Config: OAuth2Config{
+			ClientID:       clientID,
+			ClientSecret:   clientSecret,
+			AuthURL:        "https://twitter.com/i/oauth2/authorize",
+			TokenURL:       "https://api.twitter.com/2/oauth2/token",
+			Scopes:         []string{"users.read", "tweet.read"},
+			SecretInHeader: true,
+		},
+		ProfileURL: "https://api.twitter.com/2/users/me",
+	}
+}
+
+func (self *TwitterOAuth2) Name() string {
+	return "twitter"
+}
+
+func (self *TwitterOAuth2) OAuth2Config() *OAuth2Config {
+	return &self.Config
+}
+
+// FetchIdentity returns no email address,
+// because the Twitter API doesn't provide one.
+func (self *TwitterOAuth2) FetchIdentity(accessToken string) (*OAuth2Identity, error) {
+	var profile struct {
+		Data struct {
+			ID       string `json:"id"`
+			Name     string `json:"name"`
+			Username string `json:"username"`
+		} `json:"data"`
+	}
+	err := OAuth2GetJSON(self, self.ProfileURL, accessToken, &profile)
+	if err != nil {
+		return nil, err
+	}
+	return &OAuth2Identity{
+		ID:       profile.Data.ID,
+		Username: profile.Data.Username,
+		Name:     profile.Data.Name,
+	}, nil
+}
+
+func (self *TwitterOAuth2) FindUser(identity *OAuth2Identity) (userDoc interface{}, found bool, err error) {
+	return Config.Collection.Filter("Twitter.ID", identity.ID).TryOne()
+}
+
+func (self *TwitterOAuth2) LinkIdentity(user *User, identity *OAuth2Identity, accessToken string) {
+	for i := range user.Twitter {
+		if user.Twitter[i].ID.Get() == identity.ID {
+			i := &user.Twitter[i]
+			linkOAuth2Identity(&i.ID, &i.Name, &i.Confirmed, &i.AccessToken, identity, accessToken)
+			return
+		}
+	}
+	var i TwitterIdentity
+	linkOAuth2Identity(&i.ID, &i.Name, &i.Confirmed, &i.AccessToken, identity, accessToken)
+	user.Twitter = append(user.Twitter, i)
+}
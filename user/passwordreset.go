@@ -0,0 +1,89 @@
+package user
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/ungerik/go-start/model"
+	"github.com/ungerik/go-start/mongo"
+	"github.com/ungerik/go-start/view"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// PasswordReset
+
+// PasswordReset holds the hash of a single-use password reset token
+// and its expiry time. See User.SendPasswordResetEmail()
+type PasswordReset struct {
+	TokenHash model.String
+	Expires   model.DateTime
+}
+
+func (self *PasswordReset) Valid() bool {
+	return !self.TokenHash.IsEmpty() && !self.Expires.IsEmpty() && time.Now().Before(self.Expires.Time())
+}
+
+func (self *PasswordReset) Clear() {
+	self.TokenHash.Set("")
+	self.Expires.SetEmpty()
+}
+
+// SendPasswordResetEmail saves a new reset token of the user
+// before the email is sent, so the link works when it arrives.
+// resetURL needs to be a page with NewPasswordResetForm(),
+// the reset token is passed in the GET parameter "code".
+func (self *User) SendPasswordResetEmail(ctx *view.Context, resetURL view.URL) <-chan error {
+	errChan := make(chan error, 1)
+
+	token, err := randomToken()
+	if err == nil {
+		self.PasswordReset.TokenHash.Set(hashToken(token))
+		self.PasswordReset.Expires.SetTime(time.Now().UTC().Add(Config.PasswordResetTimeout))
+		err = Config.Collection.UpdateWith(self.ID, mongo.NewUpdate().
+			Set("PasswordReset.TokenHash", self.PasswordReset.TokenHash.Get()).
+			Set("PasswordReset.Expires", self.PasswordReset.Expires.Get()),
+		)
+	}
+	if err != nil {
+		errChan <- err
+		close(errChan)
+		return errChan
+	}
+
+	reset := resetURL.URL(ctx) + "?code=" + url.QueryEscape(token)
+	return Config.PasswordResetMessage.send(self.PrimaryEmail(), reset)
+}
+
+// FindByPasswordResetToken returns the user with a valid reset token.
+func FindByPasswordResetToken(token string) (userDoc interface{}, found bool, err error) {
+	if token == "" {
+		return nil, false, nil
+	}
+	query := Config.Collection.Filter("PasswordReset.TokenHash", hashToken(token))
+	userDoc, found, err = query.TryOne()
+	if !found || !From(userDoc).PasswordReset.Valid() {
+		return nil, false, err
+	}
+	return userDoc, true, nil
+}
+
+// ResetPassword sets a new password for the user with the reset token.
+// The token can only be used once, all sessions
+// of the user are logged out and a lockout is cleared.
+func ResetPassword(token, password string) (userDoc interface{}, ok bool, err error) {
+	userDoc, found, err := FindByPasswordResetToken(token)
+	if !found {
+		return nil, false, err
+	}
+	user := From(userDoc)
+	user.Password.SetHashed(password)
+	user.PasswordReset.Clear()
+	user.LoginFailures.Clear()
+	if err = user.Save(); err != nil {
+		return nil, false, err
+	}
+	if err = LogoutEverywhere(userDoc); err != nil {
+		return nil, false, err
+	}
+	return userDoc, true, nil
+}
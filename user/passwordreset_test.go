@@ -0,0 +1,65 @@
+package user
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ungerik/go-start/view"
+)
+
+func TestPasswordResetIsSingleUse(t *testing.T) {
+	outbox := setupTest()
+	defer outbox.Restore()
+	userDoc, user := newTestUser(t, "a@example.com", "old password")
+
+	session := newTestSession()
+	if err := Login(session, userDoc); err != nil {
+		t.Fatal(err)
+	}
+
+	err := <-user.SendPasswordResetEmail(&view.Context{}, view.StringURL("https://example.com/reset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := linkCode(t, outbox.AssertSent(t, "a@example.com", "Reset your password"))
+
+	if _, ok, err := ResetPassword(token, "new password"); !ok {
+		t.Fatal("valid reset token rejected", err)
+	}
+	if sessionUser(session) != nil {
+		t.Error("session is still logged in after the password reset")
+	}
+	if _, ok, _ := CheckEmailPassword(nil, "a@example.com", "new password"); !ok {
+		t.Error("new password doesn't work")
+	}
+
+	if _, ok, err := ResetPassword(token, "attacker password"); ok || err != nil {
+		t.Errorf("reset token used twice: ok=%v err=%v", ok, err)
+	}
+	if _, ok, _ := CheckEmailPassword(nil, "a@example.com", "new password"); !ok {
+		t.Error("second use of the reset token changed the password")
+	}
+}
+
+func TestPasswordResetExpires(t *testing.T) {
+	outbox := setupTest()
+	defer outbox.Restore()
+	_, user := newTestUser(t, "a@example.com", "password")
+
+	err := <-user.SendPasswordResetEmail(&view.Context{}, view.StringURL("https://example.com/reset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.PasswordReset.Expires.SetTime(time.Now().UTC().Add(-time.Minute))
+	if err = user.Save(); err != nil {
+		t.Fatal(err)
+	}
+	token := linkCode(t, outbox.AssertSent(t, "a@example.com", "Reset your password"))
+
+	if _, ok, _ := ResetPassword(token, "new password"); ok {
+		t.Error("expired reset token accepted")
+	}
+	if _, ok, _ := ResetPassword("", "new password"); ok {
+		t.Error("empty reset token accepted")
+	}
+}
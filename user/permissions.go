@@ -0,0 +1,372 @@
+package user
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ungerik/go-start/model"
+	"github.com/ungerik/go-start/view"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Roles and permissions
+
+/*
+Permissions are dot separated names like "invoices.edit".
+A granted permission ending with ".*" includes all permissions
+with that prefix, "*" includes all permissions.
+
+The permissions of a role are defined in Config.Roles,
+users get them by User.Roles or directly by User.Permissions.
+Admin users have all permissions.
+
+Example:
+
+	user.Config.Roles = map[string][]string{
+		"accountant": {"invoices.*"},
+		"support":    {"invoices.view", "users.view"},
+	}
+
+	view.ViewPath{Name: "invoices", View: invoicesPage, Auth: user.RequirePermission("invoices.view")}
+*/
+func PermissionMatches(granted, permission string) bool {
+	if granted == "*" || granted == permission {
+		return true
+	}
+	if strings.HasSuffix(granted, ".*") {
+		return strings.HasPrefix(permission, granted[:len(granted)-1])
+	}
+	return false
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Roles
+
+// Roles is a model.Value for role names of Config.Roles.
+// Use RolesController to edit it in a view.Form.
+type Roles []string
+
+func (self *Roles) Get() []string {
+	return []string(*self)
+}
+
+func (self *Roles) Set(value ...string) {
+	*self = Roles(value)
+}
+
+func (self *Roles) Has(role string) bool {
+	for _, r := range *self {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Roles) String() string {
+	return strings.Join([]string(*self), "|")
+}
+
+func (self *Roles) SetString(str string) error {
+	*self = nil
+	if str != "" {
+		*self = Roles(strings.Split(str, "|"))
+	}
+	return nil
+}
+
+func (self *Roles) IsEmpty() bool {
+	return len(*self) == 0
+}
+
+func (self *Roles) Required(metaData *model.MetaData) bool {
+	return false
+}
+
+// Validate doesn't check if the roles are in Config.Roles,
+// so that users can still be saved after a role has been removed.
+func (self *Roles) Validate(metaData *model.MetaData) error {
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// RolesController
+
+// RolesController is a view.FormFieldController that shows
+// a checkbox for every role of Config.Roles for a Roles field.
+type RolesController struct{}
+
+func (self RolesController) Supports(metaData *model.MetaData, form *view.Form) bool {
+	_, ok := metaData.Value.Addr().Interface().(*Roles)
+	return ok
+}
+
+func (self RolesController) NewInput(withLabel bool, metaData *model.MetaData, form *view.Form) (input view.View, err error) {
+	roles := metaData.Value.Addr().Interface().(*Roles)
+	names := RoleNames()
+	checkboxes := make(view.Views, len(names))
+	for i, name := range names {
+		checkboxes[i] = &view.Checkbox{
+			Label:    name,
+			Class:    form.FieldInputClass(metaData),
+			Name:     roleInputName(metaData, name),
+			Disabled: form.IsFieldDisabled(metaData),
+			Checked:  roles.Has(name),
+		}
+	}
+	if withLabel {
+		return view.AddStandardLabel(form, checkboxes, metaData), nil
+	}
+	return checkboxes, nil
+}
+
+func (self RolesController) SetValue(value string, ctx *view.Context, metaData *model.MetaData, form *view.Form) error {
+	roles := metaData.Value.Addr().Interface().(*Roles)
+	*roles = nil
+	for _, name := range RoleNames() {
+		if ctx.Request.FormValue(roleInputName(metaData, name)) != "" {
+			*roles = append(*roles, name)
+		}
+	}
+	return nil
+}
+
+// roleInputName uses the role name instead of its position,
+// so that changes of Config.Roles between showing and submitting
+// the form can't grant a different role.
+func roleInputName(metaData *model.MetaData, role string) string {
+	return fmt.Sprintf("%s_%s", metaData.Selector(), role)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// User roles and permissions
+
+func (self *User) HasRole(role string) bool {
+	return self.Roles.Has(role)
+}
+
+// AddRole adds role if the user doesn't have it already.
+// The user has to be saved after the call.
+func (self *User) AddRole(role string) {
+	if !self.HasRole(role) {
+		self.Roles = append(self.Roles, role)
+	}
+}
+
+// RemoveRole removes role from the user.
+// The user has to be saved after the call.
+func (self *User) RemoveRole(role string) {
+	for i := range self.Roles {
+		if self.Roles[i] == role {
+			self.Roles = append(self.Roles[:i], self.Roles[i+1:]...)
+			return
+		}
+	}
+}
+
+// GrantPermission grants permission directly to the user.
+// The user has to be saved after the call.
+func (self *User) GrantPermission(permission string) {
+	for i := range self.Permissions {
+		if self.Permissions[i].Get() == permission {
+			return
+		}
+	}
+	self.Permissions = append(self.Permissions, model.String(permission))
+}
+
+// RevokePermission removes a permission granted with GrantPermission().
+// Permissions of roles are not affected.
+// The user has to be saved after the call.
+func (self *User) RevokePermission(permission string) {
+	for i := range self.Permissions {
+		if self.Permissions[i].Get() == permission {
+			self.Permissions = append(self.Permissions[:i], self.Permissions[i+1:]...)
+			return
+		}
+	}
+}
+
+// GrantedPermissions returns the permissions of the roles
+// of the user and the directly granted permissions.
+func (self *User) GrantedPermissions() []string {
+	var granted []string
+	for _, role := range self.Roles {
+		granted = append(granted, Config.Roles[role]...)
+	}
+	for i := range self.Permissions {
+		granted = append(granted, self.Permissions[i].Get())
+	}
+	return granted
+}
+
+// HasPermission returns true if the user is an admin or has
+// a granted permission that matches permission.
+func (self *User) HasPermission(permission string) bool {
+	if self.Admin.Get() {
+		return true
+	}
+	for _, granted := range self.GrantedPermissions() {
+		if PermissionMatches(granted, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleNames returns the sorted names of Config.Roles.
+func RoleNames() []string {
+	names := make([]string, 0, len(Config.Roles))
+	for name := range Config.Roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// PermissionAuth
+
+/*
+PermissionAuth authenticates confirmed session users that have
+all Permissions. It can be combined with view.AnyAuthenticator
+and view.AllAuthenticators and used with view.Form.ModelFieldAuth
+to show form fields only to users with a permission.
+
+If DeniedURL is not nil, denied requests are redirected to it.
+Don't set DeniedURL for view.Form.ModelFieldAuth.
+*/
+type PermissionAuth struct {
+	Permissions []string
+	DeniedURL   view.URL
+}
+
+// RequirePermission returns a PermissionAuth for permissions.
+func RequirePermission(permissions ...string) *PermissionAuth {
+	return &PermissionAuth{Permissions: permissions}
+}
+
+func (self *PermissionAuth) Authenticate(ctx *view.Context) (ok bool, err error) {
+	userDoc := OfSession(ctx.Session)
+	ok = userDoc != nil && From(userDoc).IdentityConfirmed()
+	for i := 0; ok && i < len(self.Permissions); i++ {
+		ok = From(userDoc).HasPermission(self.Permissions[i])
+	}
+	if !ok && self.DeniedURL != nil {
+		err = view.Redirect(self.DeniedURL.URL(ctx))
+	}
+	return ok, err
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// RoleAuth
+
+// RoleAuth authenticates confirmed session users that have
+// any of Roles or are admins.
+// If DeniedURL is not nil, denied requests are redirected to it.
+type RoleAuth struct {
+	Roles     []string
+	DeniedURL view.URL
+}
+
+// RequireRole returns a RoleAuth for roles.
+func RequireRole(roles ...string) *RoleAuth {
+	return &RoleAuth{Roles: roles}
+}
+
+func (self *RoleAuth) Authenticate(ctx *view.Context) (ok bool, err error) {
+	userDoc := OfSession(ctx.Session)
+	if userDoc != nil && From(userDoc).IdentityConfirmed() {
+		user := From(userDoc)
+		ok = user.Admin.Get()
+		for i := 0; !ok && i < len(self.Roles); i++ {
+			ok = user.HasRole(self.Roles[i])
+		}
+	}
+	if !ok && self.DeniedURL != nil {
+		err = view.Redirect(self.DeniedURL.URL(ctx))
+	}
+	return ok, err
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Roles admin UI
+
+/*
+NewUsersRolesTable lists all users with their roles.
+editURL must be a page with NewUserRolesForm() that gets
+the user ID as first URL argument.
+
+Both views should be on pages that are protected with
+an Authenticator like RequirePermission("users.roles").
+*/
+func NewUsersRolesTable(class string, editURL view.URL) view.View {
+	return view.DynamicView(
+		func(ctx *view.Context) (view.View, error) {
+			rows := view.ViewsTableModel{
+				{view.HTML("User"), view.HTML("Email"), view.HTML("Roles"), view.HTML("")},
+			}
+			i := Config.Collection.Sort("Username").Iterator()
+			for doc := i.Next(); doc != nil; doc = i.Next() {
+				user := From(doc)
+				roles := user.Roles.Get()
+				if user.Admin.Get() {
+					roles = append([]string{"admin"}, roles...)
+				}
+				id := user.ID.Hex()
+				rows = append(rows, view.Views{
+					view.Escape(user.Username.Get()),
+					view.Escape(user.PrimaryEmail()),
+					view.Escape(strings.Join(roles, ", ")),
+					view.A(editURL.URL(ctx.ForURLArgs(id)), "Edit"),
+				})
+			}
+			if i.Err() != nil {
+				return nil, i.Err()
+			}
+			return &view.Table{Class: class, Model: rows, HeaderRow: true}, nil
+		},
+	)
+}
+
+// NewUserRolesForm shows a checkbox for every role of Config.Roles
+// to assign the roles of the user with the ID from the first URL argument.
+func NewUserRolesForm(buttonText, class, errorMessageClass, successMessageClass string) view.View {
+	return view.DynamicView(
+		func(ctx *view.Context) (view.View, error) {
+			var id string
+			if len(ctx.URLArgs) > 0 {
+				id = ctx.URLArgs[0]
+			}
+			if _, err := hex.DecodeString(id); err != nil || len(id) != 24 {
+				return view.DIV("error", view.HTML("Invalid user ID!")), nil
+			}
+			userDoc, found, err := FindByID(id)
+			if !found {
+				return view.DIV("error", view.HTML("User not found!")), err
+			}
+			user := From(userDoc)
+			return view.Views{
+				view.H3(view.Escape(user.Username.Get())),
+				&view.Form{
+					Class:               class,
+					ErrorMessageClass:   errorMessageClass,
+					SuccessMessageClass: successMessageClass,
+					SuccessMessage:      "Roles saved",
+					SubmitButtonText:    buttonText,
+					FormID:              "gostart_user_roles",
+					FieldControllers:    view.Config.Form.DefaultFieldControllers.Append(RolesController{}),
+					GetModel: func(form *view.Form, ctx *view.Context) (interface{}, error) {
+						return &UserRolesFormModel{Roles: append(Roles(nil), user.Roles...)}, nil
+					},
+					OnSubmit: func(form *view.Form, formModel interface{}, ctx *view.Context) (string, view.URL, error) {
+						user.Roles = formModel.(*UserRolesFormModel).Roles
+						return "", nil, user.Save()
+					},
+				},
+			}, nil
+		},
+	)
+}
@@ -0,0 +1,163 @@
+package user
+
+import (
+	"time"
+
+	"github.com/ungerik/go-start/mgo/bson"
+	"github.com/ungerik/go-start/model"
+	"github.com/ungerik/go-start/mongo"
+	"github.com/ungerik/go-start/view"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// LoginSession
+
+/*
+LoginSession is the server-side record of a logged in session.
+The session ID stored by view.SessionTracker is a random token
+and only the hash of the token is saved in the database.
+
+Sessions can be revoked individually with RevokeSession(),
+for all devices of a user with LogoutEverywhere()
+and the token of a session is changed with RotateSession().
+
+A session with TwoFactorPending is a login that waits for
+the second factor and has no user, see BeginLogin().
+*/
+type LoginSession struct {
+	mongo.DocumentBase `bson:",inline"`
+	TokenHash          model.String
+	UserID             bson.ObjectId
+	Created            model.DateTime
+	LastSeen           model.DateTime
+	UserAgent          model.String
+	IP                 model.String
+	TwoFactorPending   model.Bool
+	TwoFactorVerified  model.DateTime
+}
+
+// UserDoc returns the user document of the session.
+func (self *LoginSession) UserDoc() (userDoc interface{}, found bool, err error) {
+	return Config.Collection.TryDocumentWithID(self.UserID)
+}
+
+// Expired returns true if the session has not been used
+// for longer than Config.SessionTimeout.
+func (self *LoginSession) Expired() bool {
+	return Config.SessionTimeout > 0 && time.Since(self.LastSeen.Time()) > Config.SessionTimeout
+}
+
+// lastSeenInterval is the minimum time between updates of LoginSession.LastSeen
+const lastSeenInterval = time.Minute
+
+// newLoginSession saves a new LoginSession for userDoc
+// and returns the token of the session.
+// setup can modify the LoginSession before it is saved.
+func newLoginSession(ctx *view.Context, userDoc interface{}, setup func(*LoginSession)) (token string, err error) {
+	token, err = randomToken()
+	if err != nil {
+		return "", err
+	}
+	loginSession := Config.SessionCollection.NewDocument().(*LoginSession)
+	loginSession.TokenHash.Set(hashToken(token))
+	loginSession.UserID = userDoc.(mongo.Document).ObjectId()
+	loginSession.Created.SetNowUTC()
+	loginSession.LastSeen.SetNowUTC()
+	if ctx != nil && ctx.Request != nil {
+		loginSession.UserAgent.Set(ctx.Request.UserAgent())
+		loginSession.IP.Set(clientIP(ctx))
+	}
+	if setup != nil {
+		setup(loginSession)
+	}
+	if err = loginSession.Save(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// FindSession returns the LoginSession for a session token.
+// Expired sessions are removed and not returned.
+func FindSession(token string) (loginSession *LoginSession, found bool, err error) {
+	if token == "" {
+		return nil, false, nil
+	}
+	doc, found, err := Config.SessionCollection.Filter("TokenHash", hashToken(token)).TryOne()
+	if !found {
+		return nil, false, err
+	}
+	loginSession = doc.(*LoginSession)
+	if loginSession.Expired() {
+		return nil, false, loginSession.Remove()
+	}
+	return loginSession, true, nil
+}
+
+// CurrentSession returns the LoginSession of session.
+func CurrentSession(session *view.Session) (loginSession *LoginSession, found bool, err error) {
+	token, ok := session.ID()
+	if !ok {
+		return nil, false, nil
+	}
+	return FindSession(token)
+}
+
+// Sessions returns the active sessions of a user,
+// for example to list the logged in devices.
+func Sessions(userDoc interface{}) (loginSessions []*LoginSession, err error) {
+	id := userDoc.(mongo.Document).ObjectId()
+	i := Config.SessionCollection.Filter("UserID", id).SortReverse("LastSeen").Iterator()
+	for doc := i.Next(); doc != nil; doc = i.Next() {
+		loginSession := doc.(*LoginSession)
+		if !loginSession.Expired() {
+			loginSessions = append(loginSessions, loginSession)
+		}
+	}
+	return loginSessions, i.Err()
+}
+
+// RevokeSession logs out the session with id on whatever device it is used.
+func RevokeSession(id bson.ObjectId) error {
+	return Config.SessionCollection.Remove(id)
+}
+
+// LogoutEverywhere revokes all sessions of a user.
+func LogoutEverywhere(userDoc interface{}) error {
+	id := userDoc.(mongo.Document).ObjectId()
+	return Config.SessionCollection.Filter("UserID", id).RemoveAll()
+}
+
+// RemoveExpiredSessions removes all sessions that have not been
+// used for longer than Config.SessionTimeout.
+func RemoveExpiredSessions() error {
+	if Config.SessionTimeout <= 0 {
+		return nil
+	}
+	var before model.DateTime
+	before.SetTime(time.Now().UTC().Add(-Config.SessionTimeout))
+	return Config.SessionCollection.FilterLess("LastSeen", before.Get()).RemoveAll()
+}
+
+/*
+RotateSession replaces the token of the session with a new one
+and revokes the old token.
+Call it after the privileges of the session user have changed,
+for example after a password change or becoming an admin,
+so that a token that could have leaked earlier can't be used
+with the new privileges.
+*/
+func RotateSession(session *view.Session) error {
+	userDoc := OfSession(session)
+	if userDoc == nil {
+		return nil
+	}
+	loginSession, found, err := CurrentSession(session)
+	if err != nil || !found {
+		// Basic auth, API tokens and revoked sessions
+		// have no login session that could be rotated
+		return err
+	}
+	return login(session, userDoc, func(rotated *LoginSession) {
+		rotated.TwoFactorVerified = loginSession.TwoFactorVerified
+	})
+}
@@ -0,0 +1,98 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/ungerik/go-start/view"
+)
+
+func TestRevokeSession(t *testing.T) {
+	defer setupTest().Restore()
+	userDoc, _ := newTestUser(t, "a@example.com", "password")
+
+	phone, laptop := newTestSession(), newTestSession()
+	for _, session := range []*view.Session{phone, laptop} {
+		if err := Login(session, userDoc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loginSessions, err := Sessions(userDoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loginSessions) != 2 {
+		t.Fatalf("%d sessions instead of 2", len(loginSessions))
+	}
+
+	current, found, err := CurrentSession(phone)
+	if !found {
+		t.Fatal("no session for phone", err)
+	}
+	if err = RevokeSession(current.ID); err != nil {
+		t.Fatal(err)
+	}
+	if sessionUser(phone) != nil {
+		t.Error("revoked session still has a user")
+	}
+	if sessionUser(laptop) == nil {
+		t.Error("revoking one session logged out the other")
+	}
+
+	if err = LogoutEverywhere(userDoc); err != nil {
+		t.Fatal(err)
+	}
+	if sessionUser(laptop) != nil {
+		t.Error("session has a user after LogoutEverywhere")
+	}
+}
+
+func TestLogoutRevokesToken(t *testing.T) {
+	defer setupTest().Restore()
+	userDoc, _ := newTestUser(t, "a@example.com", "password")
+
+	session := newTestSession()
+	if err := Login(session, userDoc); err != nil {
+		t.Fatal(err)
+	}
+	token, _ := session.ID()
+	if err := Logout(session); err != nil {
+		t.Fatal(err)
+	}
+	// A copy of the token, for example a stolen cookie
+	stolen := newTestSession()
+	stolen.SetID(token)
+	if sessionUser(stolen) != nil {
+		t.Error("token is valid after Logout")
+	}
+}
+
+func TestRotateSession(t *testing.T) {
+	defer setupTest().Restore()
+	userDoc, _ := newTestUser(t, "a@example.com", "password")
+
+	session := newTestSession()
+	if err := Login(session, userDoc); err != nil {
+		t.Fatal(err)
+	}
+	oldToken, _ := session.ID()
+	if err := RotateSession(session); err != nil {
+		t.Fatal(err)
+	}
+	newToken, _ := session.ID()
+	if newToken == oldToken {
+		t.Fatal("token has not been changed")
+	}
+	if _, found, _ := FindSession(oldToken); found {
+		t.Error("old token is still valid")
+	}
+	if sessionUser(session) == nil {
+		t.Error("rotated session has no user")
+	}
+
+	// Basic auth and API tokens set the user without a login session
+	withoutLogin := newTestSession()
+	withoutLogin.User = userDoc
+	if err := RotateSession(withoutLogin); err != nil {
+		t.Error(err)
+	}
+}
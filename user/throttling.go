@@ -0,0 +1,406 @@
+package user
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ungerik/go-start/config"
+	"github.com/ungerik/go-start/mgo"
+	"github.com/ungerik/go-start/mgo/bson"
+	"github.com/ungerik/go-start/model"
+	"github.com/ungerik/go-start/mongo"
+	"github.com/ungerik/go-start/view"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// LoginThrottling
+
+/*
+LoginThrottling configures the protection against password guessing
+of LoginEmailPassword() and VerifyTwoFactor().
+
+Every failed login of an account doubles the time before the next
+attempt is accepted, starting with BackoffBase up to BackoffMax.
+After MaxFailures the account is locked for LockoutDuration and
+an email with a link to UnlockURL is sent to the user.
+Failed logins of a client IP are counted for all accounts,
+including unknown email addresses, if MaxFailuresPerIP is set.
+Behind a reverse proxy, all requests come from the IP of the proxy,
+so its IP has to be in TrustedProxies before enabling the IP limit.
+*/
+type LoginThrottling struct {
+	// MaxFailures before an account is locked, zero disables the lockout
+	MaxFailures     int
+	LockoutDuration time.Duration
+	BackoffBase     time.Duration
+	BackoffMax      time.Duration
+	// MaxFailuresPerIP within IPWindow, zero disables the IP limit
+	MaxFailuresPerIP int
+	IPWindow         time.Duration
+	// TrustedProxies are the IPs or CIDR ranges of reverse proxies.
+	// The client IP of their requests is taken from X-Forwarded-For.
+	TrustedProxies []string
+	UnlockMessage  ConfirmationMessage
+	// UnlockURL is a page with UnlockAccountView(),
+	// no unlock email is sent if it is nil
+	UnlockURL view.URL
+	// UnlockTimeout is the time an unlock link is valid
+	UnlockTimeout time.Duration
+}
+
+// ErrLoginThrottled is returned for login attempts
+// that are not checked because of too many failures.
+type ErrLoginThrottled struct {
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+func (self *ErrLoginThrottled) Error() string {
+	retry := (self.RetryAfter + time.Second - 1).Truncate(time.Second)
+	if self.Locked {
+		return fmt.Sprintf("The account is locked because of too many failed logins, try again in %s or use the link in the email we sent you", retry)
+	}
+	return fmt.Sprintf("Too many failed logins, try again in %s", retry)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// LoginFailures
+
+// LoginFailures tracks the failed logins of a User.
+type LoginFailures struct {
+	Count           model.Int
+	Last            model.DateTime
+	LockedUntil     model.DateTime
+	UnlockTokenHash model.String
+	UnlockExpires   model.DateTime
+}
+
+func (self *LoginFailures) Locked() bool {
+	return !self.LockedUntil.IsEmpty() && time.Now().Before(self.LockedUntil.Time())
+}
+
+func (self *LoginFailures) Clear() {
+	*self = LoginFailures{}
+}
+
+// check returns an ErrLoginThrottled if no login attempt is allowed now.
+func (self *LoginFailures) check() error {
+	if self.Locked() {
+		return &ErrLoginThrottled{Locked: true, RetryAfter: self.LockedUntil.Time().Sub(time.Now())}
+	}
+	if self.Count.Get() == 0 || self.Last.IsEmpty() {
+		return nil
+	}
+	backoff := Config.LoginThrottling.BackoffBase
+	for i := int64(1); i < self.Count.Get() && backoff < Config.LoginThrottling.BackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > Config.LoginThrottling.BackoffMax {
+		backoff = Config.LoginThrottling.BackoffMax
+	}
+	if wait := backoff - time.Since(self.Last.Time()); wait > 0 {
+		return &ErrLoginThrottled{RetryAfter: wait}
+	}
+	return nil
+}
+
+// outdated returns true if the last failure is older than
+// Config.LoginThrottling.LockoutDuration, so that old failures
+// and expired lockouts don't count anymore.
+func (self *LoginFailures) outdated() bool {
+	return !self.Last.IsEmpty() && time.Since(self.Last.Time()) > Config.LoginThrottling.LockoutDuration
+}
+
+// loginFailed counts a failed login of the user and locks the account
+// after Config.LoginThrottling.MaxFailures.
+// The database is changed with atomic and conditional updates,
+// so that concurrent failed logins can't overwrite each other.
+func loginFailed(ctx *view.Context, userDoc interface{}, ip string) error {
+	user := From(userDoc)
+	audit(AuditLoginFailed, user.PrimaryEmail(), ip, userDoc)
+
+	if user.LoginFailures.outdated() {
+		// Only reset if no other failure has been counted in the meantime
+		err := Config.Collection.Filter("_id", user.ID).Filter("LoginFailures.Last", user.LoginFailures.Last.Get()).UpdateOneWith(
+			mongo.NewUpdate().Set("LoginFailures.Count", 0).Set("LoginFailures.LockedUntil", ""),
+		)
+		if err != nil && err != mgo.NotFound {
+			return err
+		}
+	}
+	var now model.DateTime
+	now.SetNowUTC()
+	err := Config.Collection.UpdateWith(user.ID, mongo.NewUpdate().Inc("LoginFailures.Count", 1).Set("LoginFailures.Last", now.Get()))
+	if err != nil {
+		return err
+	}
+	if err = user.reloadLoginFailures(); err != nil {
+		return err
+	}
+
+	max := int64(Config.LoginThrottling.MaxFailures)
+	if max <= 0 || user.LoginFailures.Count.Get() < max || user.LoginFailures.Locked() {
+		return nil
+	}
+	// Only the failed login that wins the conditional update locks the account
+	var lockedUntil model.DateTime
+	lockedUntil.SetTime(time.Now().UTC().Add(Config.LoginThrottling.LockoutDuration))
+	err = Config.Collection.Filter("_id", user.ID).Filter("LoginFailures.LockedUntil", user.LoginFailures.LockedUntil.Get()).UpdateOneWith(
+		mongo.NewUpdate().Set("LoginFailures.LockedUntil", lockedUntil.Get()),
+	)
+	if err == mgo.NotFound {
+		return user.reloadLoginFailures()
+	}
+	if err != nil {
+		return err
+	}
+	user.LoginFailures.LockedUntil = lockedUntil
+	audit(AuditAccountLocked, user.PrimaryEmail(), ip, userDoc)
+
+	if Config.LoginThrottling.UnlockURL != nil && ctx != nil {
+		errChan := user.SendUnlockEmail(ctx, Config.LoginThrottling.UnlockURL)
+		go func() {
+			if err := <-errChan; err != nil {
+				config.Logger.Printf("user: Error while sending unlock email to %s: %s", user.PrimaryEmail(), err)
+			}
+		}()
+	}
+	return err
+}
+
+// reloadLoginFailures loads the current LoginFailures of the user
+// from the database.
+func (self *User) reloadLoginFailures() error {
+	doc, err := Config.Collection.DocumentWithID(self.ID)
+	if err != nil {
+		return err
+	}
+	self.LoginFailures = From(doc).LoginFailures
+	return nil
+}
+
+// SendUnlockEmail saves a new unlock token of the user that expires
+// after Config.LoginThrottling.UnlockTimeout before the email is sent.
+// unlockURL needs to be a page with UnlockAccountView(),
+// the unlock token is passed in the GET parameter "code".
+func (self *User) SendUnlockEmail(ctx *view.Context, unlockURL view.URL) <-chan error {
+	errChan := make(chan error, 1)
+
+	token, err := randomToken()
+	if err == nil {
+		self.LoginFailures.UnlockTokenHash.Set(hashToken(token))
+		self.LoginFailures.UnlockExpires.SetTime(time.Now().UTC().Add(Config.LoginThrottling.UnlockTimeout))
+		err = Config.Collection.UpdateWith(self.ID, mongo.NewUpdate().
+			Set("LoginFailures.UnlockTokenHash", self.LoginFailures.UnlockTokenHash.Get()).
+			Set("LoginFailures.UnlockExpires", self.LoginFailures.UnlockExpires.Get()),
+		)
+	}
+	if err != nil {
+		errChan <- err
+		close(errChan)
+		return errChan
+	}
+
+	unlock := unlockURL.URL(ctx) + "?code=" + url.QueryEscape(token)
+	return Config.LoginThrottling.UnlockMessage.send(self.PrimaryEmail(), unlock)
+}
+
+// UnlockAccount clears the failed logins of the user
+// with the unexpired unlock token from SendUnlockEmail().
+func UnlockAccount(token string) (userDoc interface{}, ok bool, err error) {
+	if token == "" {
+		return nil, false, nil
+	}
+	userDoc, found, err := Config.Collection.Filter("LoginFailures.UnlockTokenHash", hashToken(token)).TryOne()
+	if !found {
+		return nil, false, err
+	}
+	user := From(userDoc)
+	expires := user.LoginFailures.UnlockExpires
+	if expires.IsEmpty() || !time.Now().Before(expires.Time()) {
+		return nil, false, nil
+	}
+	user.LoginFailures.Clear()
+	if err = user.Save(); err != nil {
+		return nil, false, err
+	}
+	audit(AuditAccountUnlocked, user.PrimaryEmail(), "", userDoc)
+	return userDoc, true, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// ClientLoginFailures
+
+// ClientLoginFailures counts the failed logins of a client IP
+// within Config.LoginThrottling.IPWindow.
+// The ID is derived from the IP, see clientLoginFailuresID().
+type ClientLoginFailures struct {
+	mongo.DocumentBase `bson:",inline"`
+	IP                 model.String
+	Count              model.Int
+	First              model.DateTime
+}
+
+func (self *ClientLoginFailures) expired() bool {
+	return time.Since(self.First.Time()) > Config.LoginThrottling.IPWindow
+}
+
+// clientLoginFailuresID returns the ID of the ClientLoginFailures of ip.
+// Concurrent upserts for an IP can't create two documents,
+// because the unique index of the ID prevents it.
+func clientLoginFailuresID(ip string) bson.ObjectId {
+	hash := sha256.Sum256([]byte(ip))
+	return bson.ObjectId(hash[:12])
+}
+
+// checkClientIP returns an ErrLoginThrottled if the client IP
+// has too many failed logins.
+func checkClientIP(ip string) error {
+	max := int64(Config.LoginThrottling.MaxFailuresPerIP)
+	if ip == "" || max <= 0 {
+		return nil
+	}
+	doc, found, err := Config.LoginFailureCollection.Filter("_id", clientLoginFailuresID(ip)).TryOne()
+	if !found {
+		return err
+	}
+	failures := doc.(*ClientLoginFailures)
+	if failures.expired() || failures.Count.Get() < max {
+		return nil
+	}
+	audit(AuditClientThrottled, "", ip, nil)
+	retry := failures.First.Time().Add(Config.LoginThrottling.IPWindow).Sub(time.Now())
+	return &ErrLoginThrottled{RetryAfter: retry}
+}
+
+// clientLoginFailed counts a failed login of the client IP.
+// The counter is created or incremented with an atomic upsert.
+func clientLoginFailed(ip string) error {
+	if ip == "" || Config.LoginThrottling.MaxFailuresPerIP <= 0 {
+		return nil
+	}
+	query := Config.LoginFailureCollection.Filter("_id", clientLoginFailuresID(ip))
+	var now, windowStart model.DateTime
+	now.SetNowUTC()
+	windowStart.SetTime(now.Time().Add(-Config.LoginThrottling.IPWindow))
+	// Only one request can restart an expired window
+	err := query.FilterLess("First", windowStart.Get()).UpdateOneWith(
+		mongo.NewUpdate().Set("Count", 0).Set("First", now.Get()),
+	)
+	if err != nil && err != mgo.NotFound {
+		return err
+	}
+	// First is only set by the insert, because it is the minimum
+	update := mongo.NewUpdate().Set("IP", ip).Inc("Count", 1).Min("First", now.Get())
+	_, err = query.UpsertOneWith(update)
+	if lastErr, ok := err.(*mgo.LastError); ok && lastErr.Code == 11000 {
+		// A concurrent upsert has inserted the document
+		_, err = query.UpsertOneWith(update)
+	}
+	return err
+}
+
+// RemoveExpiredLoginFailures removes the failed logins of client IPs
+// that are older than Config.LoginThrottling.IPWindow.
+func RemoveExpiredLoginFailures() error {
+	var before model.DateTime
+	before.SetTime(time.Now().UTC().Add(-Config.LoginThrottling.IPWindow))
+	return Config.LoginFailureCollection.FilterLess("First", before.Get()).RemoveAll()
+}
+
+// clientIP returns the IP of the request of ctx or an empty string.
+// If the request comes from one of Config.LoginThrottling.TrustedProxies,
+// the last address in X-Forwarded-For that is not a trusted proxy is used.
+func clientIP(ctx *view.Context) string {
+	if ctx == nil || ctx.Request == nil || ctx.Request.Request == nil {
+		return ""
+	}
+	ip, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+	if err != nil {
+		ip = ctx.Request.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(ctx.Request.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(ip); i-- {
+		if address := strings.TrimSpace(forwarded[i]); address != "" {
+			ip = address
+		}
+	}
+	return ip
+}
+
+// isTrustedProxy returns true if ip matches an entry
+// of Config.LoginThrottling.TrustedProxies.
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, proxy := range Config.LoginThrottling.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(parsed) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// AuditEvent
+
+type AuditEventType string
+
+const (
+	AuditLoginFailed      AuditEventType = "login failed"
+	AuditLoginThrottled   AuditEventType = "login throttled"
+	AuditAccountLocked    AuditEventType = "account locked"
+	AuditAccountUnlocked  AuditEventType = "account unlocked"
+	AuditClientThrottled  AuditEventType = "client IP throttled"
+	AuditTwoFactorFailed  AuditEventType = "two-factor code failed"
+	AuditUnknownUserLogin AuditEventType = "login with unknown email"
+	AuditInvalidAPIToken  AuditEventType = "invalid API token"
+)
+
+// AuditEvent reports suspicious login activity to Config.OnAuditEvent.
+type AuditEvent struct {
+	Type   AuditEventType
+	Time   time.Time
+	Email  string
+	IP     string
+	UserID bson.ObjectId // Empty if there is no user
+}
+
+func (self *AuditEvent) String() string {
+	s := fmt.Sprintf("%s: %s", self.Time.Format(model.DateTimeFormat), self.Type)
+	if self.Email != "" {
+		s += " email=" + self.Email
+	}
+	if self.IP != "" {
+		s += " ip=" + self.IP
+	}
+	if self.UserID != "" {
+		s += " user=" + self.UserID.Hex()
+	}
+	return s
+}
+
+func audit(eventType AuditEventType, email, ip string, userDoc interface{}) {
+	event := &AuditEvent{Type: eventType, Time: time.Now().UTC(), Email: email, IP: ip}
+	if userDoc != nil {
+		event.UserID = userDoc.(mongo.Document).ObjectId()
+	}
+	if Config.OnAuditEvent != nil {
+		Config.OnAuditEvent(event)
+	} else {
+		config.Logger.Println("user audit", event)
+	}
+}
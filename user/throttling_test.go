@@ -0,0 +1,172 @@
+package user
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ungerik/go-start/model"
+	"github.com/ungerik/go-start/mongo"
+	"github.com/ungerik/go-start/view"
+)
+
+func TestLockoutAndUnlock(t *testing.T) {
+	outbox := setupTest()
+	defer outbox.Restore()
+	defer func(saved LoginThrottling) { Config.LoginThrottling = saved }(Config.LoginThrottling)
+	Config.LoginThrottling.MaxFailures = 3
+	Config.LoginThrottling.BackoffBase = 0
+	Config.LoginThrottling.BackoffMax = 0
+	Config.LoginThrottling.UnlockURL = view.StringURL("https://example.com/unlock")
+	newTestUser(t, "a@example.com", "password")
+	ctx := &view.Context{}
+
+	for i := 0; i < 3; i++ {
+		if _, ok, err := CheckEmailPassword(ctx, "a@example.com", "wrong"); ok || err != nil {
+			t.Fatalf("failed login %d: ok=%v err=%v", i, ok, err)
+		}
+	}
+	_, ok, err := CheckEmailPassword(ctx, "a@example.com", "password")
+	if throttled, _ := err.(*ErrLoginThrottled); ok || throttled == nil || !throttled.Locked {
+		t.Fatalf("locked account accepted the password: ok=%v err=%v", ok, err)
+	}
+
+	token := linkCode(t, waitForEmail(t, outbox, "a@example.com", "has been locked"))
+	if _, ok, err := UnlockAccount(token); !ok {
+		t.Fatal("unlock token rejected", err)
+	}
+	if _, ok, err := CheckEmailPassword(ctx, "a@example.com", "password"); !ok {
+		t.Error("unlocked account rejected the password", err)
+	}
+	if _, ok, _ := UnlockAccount(token); ok {
+		t.Error("unlock token accepted a second time")
+	}
+}
+
+func TestUnlockTokenExpires(t *testing.T) {
+	outbox := setupTest()
+	defer outbox.Restore()
+	_, user := newTestUser(t, "a@example.com", "password")
+
+	err := <-user.SendUnlockEmail(&view.Context{}, view.StringURL("https://example.com/unlock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.LoginFailures.UnlockExpires.SetTime(time.Now().UTC().Add(-time.Minute))
+	if err = user.Save(); err != nil {
+		t.Fatal(err)
+	}
+	token := linkCode(t, outbox.AssertSent(t, "a@example.com", "has been locked"))
+	if _, ok, _ := UnlockAccount(token); ok {
+		t.Error("expired unlock token accepted")
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	defer setupTest().Restore()
+	newTestUser(t, "a@example.com", "password")
+
+	if _, ok, err := CheckEmailPassword(nil, "a@example.com", "wrong"); ok || err != nil {
+		t.Fatalf("ok=%v err=%v", ok, err)
+	}
+	_, ok, err := CheckEmailPassword(nil, "a@example.com", "password")
+	if throttled, _ := err.(*ErrLoginThrottled); ok || throttled == nil || throttled.Locked {
+		t.Errorf("login within the backoff not throttled: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestClientIPThrottling(t *testing.T) {
+	defer setupTest().Restore()
+	defer func(saved LoginThrottling) { Config.LoginThrottling = saved }(Config.LoginThrottling)
+	Config.LoginThrottling.MaxFailuresPerIP = 2
+
+	for i := 0; i < 2; i++ {
+		if err := checkClientIP("192.0.2.1"); err != nil {
+			t.Fatalf("failed login %d throttled: %s", i, err)
+		}
+		if err := clientLoginFailed("192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, throttled := checkClientIP("192.0.2.1").(*ErrLoginThrottled); !throttled {
+		t.Error("client IP not throttled")
+	}
+	if err := checkClientIP("192.0.2.2"); err != nil {
+		t.Error("other client IP throttled:", err)
+	}
+}
+
+func TestClientIPThrottlingConcurrent(t *testing.T) {
+	defer setupTest().Restore()
+	defer func(saved LoginThrottling) { Config.LoginThrottling = saved }(Config.LoginThrottling)
+	Config.LoginThrottling.MaxFailuresPerIP = 100
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := clientLoginFailed("192.0.2.1"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n, _ := Config.LoginFailureCollection.Count(); n != 1 {
+		t.Fatalf("%d documents for one client IP", n)
+	}
+	doc, err := Config.LoginFailureCollection.One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures := doc.(*ClientLoginFailures)
+	if failures.Count != 20 || failures.IP != "192.0.2.1" || failures.First.IsEmpty() {
+		t.Errorf("failures: %+v", failures)
+	}
+
+	// An expired window starts again
+	var first model.DateTime
+	first.SetTime(time.Now().UTC().Add(-2 * Config.LoginThrottling.IPWindow))
+	if err = Config.LoginFailureCollection.Filter("IP", "192.0.2.1").UpdateOneWith(mongo.NewUpdate().Set("First", first.Get())); err != nil {
+		t.Fatal(err)
+	}
+	if err = clientLoginFailed("192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	doc, err = Config.LoginFailureCollection.One()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := doc.(*ClientLoginFailures).Count; count != 1 {
+		t.Errorf("Count is %d after the window expired", count)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(saved LoginThrottling) { Config.LoginThrottling = saved }(Config.LoginThrottling)
+	Config.LoginThrottling.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		ip         string
+	}{
+		{"198.51.100.1:1234", nil, "198.51.100.1"},
+		{"198.51.100.1:1234", []string{"203.0.113.1"}, "198.51.100.1"},
+		{"10.1.2.3:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"10.1.2.3:1234", []string{"203.0.113.9, 203.0.113.1, 192.0.2.1"}, "203.0.113.1"},
+		{"192.0.2.1:1234", []string{"203.0.113.9", "203.0.113.1"}, "203.0.113.1"},
+		{"10.1.2.3:1234", nil, "10.1.2.3"},
+	}
+	for _, test := range tests {
+		request := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+		for _, value := range test.forwarded {
+			request.Header.Add("X-Forwarded-For", value)
+		}
+		ctx := &view.Context{Request: &view.Request{Request: request}}
+		if ip := clientIP(ctx); ip != test.ip {
+			t.Errorf("%s with X-Forwarded-For %q: client IP %s instead of %s", test.remoteAddr, test.forwarded, ip, test.ip)
+		}
+	}
+}
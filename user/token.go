@@ -0,0 +1,24 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// randomToken returns 32 cryptographically random bytes as hex string.
+func randomToken() (token string, err error) {
+	var buf [32]byte
+	if _, err = rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// hashToken returns the SHA-256 hash of token as hex string.
+// Only hashes of tokens are stored, so that tokens can't be
+// recovered from the database.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
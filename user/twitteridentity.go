@@ -14,7 +14,7 @@ type TwitterIdentity struct {
 	ID          model.String
 	Name        model.String
 	Confirmed   model.DateTime
-	AccessToken model.String
+	AccessToken model.String `view:"excluded"`
 }
 
 func (self *TwitterIdentity) NameOrID() string {
@@ -0,0 +1,322 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ungerik/go-start/errs"
+	"github.com/ungerik/go-start/model"
+	"github.com/ungerik/go-start/view"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// TwoFactor
+
+/*
+TwoFactor holds the TOTP (RFC 6238) second factor of a User.
+
+Enrollment is started with User.BeginTwoFactorEnrollment(),
+which returns the otpauth:// provisioning URI for an authenticator app
+(usually shown as QR code), and finished with User.EnableTwoFactor()
+when the user entered the first valid code.
+
+Recovery codes can be used once instead of a TOTP code,
+only their hashes are stored.
+*/
+type TwoFactor struct {
+	Secret  model.String
+	Enabled model.DateTime
+	// LastStep is the TOTP time step of the last accepted code,
+	// so that a code can't be used twice
+	LastStep      model.Int
+	RecoveryCodes []model.String
+}
+
+// IsEnabled returns true if a second factor is required for the login.
+func (self *TwoFactor) IsEnabled() bool {
+	return !self.Enabled.IsEmpty() && !self.Secret.IsEmpty()
+}
+
+const (
+	totpPeriod          = 30
+	totpDigits          = 6
+	recoveryCodeCount   = 10
+	recoveryCodeLength  = 10
+	totpAllowedSkewStep = 1
+)
+
+// totpCode returns the HOTP value (RFC 4226) of secret for step.
+func totpCode(secret []byte, step int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+}
+
+// validateTOTP returns the time step of code if it is valid for secret
+// at time t with a tolerance of one step for clock differences.
+func validateTOTP(secret, code string, t time.Time) (step int64, ok bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := t.Unix() / totpPeriod
+	for step = current - totpAllowedSkewStep; step <= current+totpAllowedSkewStep; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPProvisioningURI returns the otpauth:// URI for authenticator apps.
+func TOTPProvisioningURI(issuer, account, secret string) string {
+	label := url.PathEscape(account)
+	params := url.Values{}
+	params.Set("secret", secret)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+		params.Set("issuer", issuer)
+	}
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// BeginTwoFactorEnrollment creates a new TOTP secret that becomes active
+// with EnableTwoFactor(). The user has to be saved after the call.
+func (self *User) BeginTwoFactorEnrollment() (provisioningURI string, err error) {
+	if self.TwoFactor.IsEnabled() {
+		return "", errs.Format("Two-factor authentication is already enabled")
+	}
+	var key [20]byte
+	if _, err = rand.Read(key[:]); err != nil {
+		return "", err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key[:])
+	self.TwoFactor.Secret.Set(secret)
+	return self.TwoFactorProvisioningURI(), nil
+}
+
+// TwoFactorProvisioningURI returns the otpauth:// URI of the TOTP secret
+// with Config.TwoFactorIssuer or view.Config.SiteName as issuer.
+func (self *User) TwoFactorProvisioningURI() string {
+	if self.TwoFactor.Secret.IsEmpty() {
+		return ""
+	}
+	issuer := Config.TwoFactorIssuer
+	if issuer == "" {
+		issuer = view.Config.SiteName
+	}
+	account := self.PrimaryEmail()
+	if account == "" {
+		account = self.Username.Get()
+	}
+	return TOTPProvisioningURI(issuer, account, self.TwoFactor.Secret.Get())
+}
+
+// EnableTwoFactor enables two-factor authentication if code is valid
+// for the secret of BeginTwoFactorEnrollment() and returns new
+// recovery codes. The user has to be saved after the call.
+func (self *User) EnableTwoFactor(code string) (recoveryCodes []string, ok bool, err error) {
+	if self.TwoFactor.IsEnabled() {
+		return nil, false, errs.Format("Two-factor authentication is already enabled")
+	}
+	step, ok := validateTOTP(self.TwoFactor.Secret.Get(), strings.TrimSpace(code), time.Now())
+	if !ok {
+		return nil, false, nil
+	}
+	recoveryCodes, err = self.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, false, err
+	}
+	self.TwoFactor.LastStep.Set(step)
+	self.TwoFactor.Enabled.SetNowUTC()
+	return recoveryCodes, true, nil
+}
+
+// DisableTwoFactor removes the TOTP secret and the recovery codes.
+// The user has to be saved after the call.
+func (self *User) DisableTwoFactor() {
+	self.TwoFactor = TwoFactor{}
+}
+
+// GenerateRecoveryCodes replaces the recovery codes with new ones.
+// Only the hashes are stored, so the returned codes have to be
+// shown to the user now. The user has to be saved after the call.
+func (self *User) GenerateRecoveryCodes() (recoveryCodes []string, err error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	recoveryCodes = make([]string, recoveryCodeCount)
+	hashes := make([]model.String, recoveryCodeCount)
+	for i := range recoveryCodes {
+		var buf [recoveryCodeLength]byte
+		if _, err = rand.Read(buf[:]); err != nil {
+			return nil, err
+		}
+		for j := range buf {
+			buf[j] = alphabet[int(buf[j])%len(alphabet)]
+		}
+		recoveryCodes[i] = string(buf[:5]) + "-" + string(buf[5:])
+		hashes[i].Set(hashToken(recoveryCodes[i]))
+	}
+	self.TwoFactor.RecoveryCodes = hashes
+	return recoveryCodes, nil
+}
+
+/*
+CheckTwoFactorCode returns true if code is a valid TOTP code
+that has not been used before or an unused recovery code.
+Used codes are invalidated, so the user has to be saved after the call.
+*/
+func (self *User) CheckTwoFactorCode(code string) bool {
+	if !self.TwoFactor.IsEnabled() {
+		return false
+	}
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), " ", "", -1))
+	step, ok := validateTOTP(self.TwoFactor.Secret.Get(), code, time.Now())
+	if ok {
+		if step <= self.TwoFactor.LastStep.Get() {
+			return false
+		}
+		self.TwoFactor.LastStep.Set(step)
+		return true
+	}
+	hash := hashToken(code)
+	for i := range self.TwoFactor.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(self.TwoFactor.RecoveryCodes[i].Get()), []byte(hash)) == 1 {
+			codes := self.TwoFactor.RecoveryCodes
+			self.TwoFactor.RecoveryCodes = append(codes[:i:i], codes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Two-factor login
+
+/*
+BeginLogin logs in userDoc if it has no second factor and returns
+complete == true. Otherwise the session becomes a pending login
+that has no user until VerifyTwoFactor() is called with a valid code
+within Config.TwoFactorLoginTimeout.
+*/
+func BeginLogin(session *view.Session, userDoc interface{}) (complete bool, err error) {
+	if !From(userDoc).TwoFactor.IsEnabled() {
+		return true, Login(session, userDoc)
+	}
+	err = login(session, userDoc, func(loginSession *LoginSession) {
+		loginSession.TwoFactorPending.Set(true)
+	})
+	if err != nil {
+		return false, err
+	}
+	// A pending login has no session user
+	session.User = nil
+	return false, nil
+}
+
+// TwoFactorPending returns true if the session is a login
+// that waits for VerifyTwoFactor().
+func TwoFactorPending(session *view.Session) bool {
+	loginSession, found, _ := CurrentSession(session)
+	return found && loginSession.TwoFactorPending.Get()
+}
+
+/*
+VerifyTwoFactor checks code for the user of the session.
+A pending login of BeginLogin() is completed with a new session token.
+For a logged in session, the time of the verification is renewed
+for TwoFactorAuth.
+*/
+func VerifyTwoFactor(session *view.Session, code string) (ok bool, err error) {
+	loginSession, found, err := CurrentSession(session)
+	if !found {
+		return false, err
+	}
+	pending := loginSession.TwoFactorPending.Get()
+	if pending && time.Since(loginSession.Created.Time()) > Config.TwoFactorLoginTimeout {
+		return false, Logout(session)
+	}
+	userDoc, found, err := loginSession.UserDoc()
+	if !found {
+		return false, err
+	}
+	user := From(userDoc)
+	ip := clientIP(session.Ctx)
+	if err = user.LoginFailures.check(); err != nil {
+		audit(AuditLoginThrottled, user.PrimaryEmail(), ip, userDoc)
+		return false, err
+	}
+	if !user.CheckTwoFactorCode(code) {
+		audit(AuditTwoFactorFailed, user.PrimaryEmail(), ip, userDoc)
+		return false, loginFailed(session.Ctx, userDoc, ip)
+	}
+	user.LoginFailures.Clear()
+	if err = user.Save(); err != nil {
+		return false, err
+	}
+	if pending {
+		err = login(session, userDoc, func(loginSession *LoginSession) {
+			loginSession.TwoFactorVerified.SetNowUTC()
+		})
+		return err == nil, err
+	}
+	loginSession.TwoFactorVerified.SetNowUTC()
+	return true, loginSession.Save()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// TwoFactorAuth
+
+/*
+TwoFactorAuth is a view.Authenticator for sensitive pages that
+requires a TOTP verification with VerifyTwoFactor() in the current
+session within MaxAge. Users without two-factor authentication are
+redirected to EnrollURL or denied if it is nil.
+*/
+type TwoFactorAuth struct {
+	MaxAge    time.Duration
+	VerifyURL view.URL
+	EnrollURL view.URL
+}
+
+func (self *TwoFactorAuth) Authenticate(ctx *view.Context) (ok bool, err error) {
+	userDoc := OfSession(ctx.Session)
+	if userDoc == nil || !From(userDoc).IdentityConfirmed() {
+		return false, nil
+	}
+	if !From(userDoc).TwoFactor.IsEnabled() {
+		if self.EnrollURL != nil {
+			err = view.Redirect(self.EnrollURL.URL(ctx))
+		}
+		return false, err
+	}
+	loginSession, found, err := CurrentSession(ctx.Session)
+	if err != nil {
+		return false, err
+	}
+	ok = found && !loginSession.TwoFactorVerified.IsEmpty() &&
+		(self.MaxAge <= 0 || time.Since(loginSession.TwoFactorVerified.Time()) <= self.MaxAge)
+	if !ok && self.VerifyURL != nil {
+		err = view.Redirect(self.VerifyURL.URL(ctx))
+	}
+	return ok, err
+}
@@ -0,0 +1,88 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+// enableTestTwoFactor enables two-factor authentication for user
+// with the code of the current time step and returns the secret.
+func enableTestTwoFactor(t *testing.T, user *User) (key []byte, step int64, recoveryCodes []string) {
+	t.Helper()
+	if _, err := user.BeginTwoFactorEnrollment(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := decodeTOTPSecret(user.TwoFactor.Secret.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	step = time.Now().Unix() / totpPeriod
+	recoveryCodes, ok, err := user.EnableTwoFactor(totpCode(key, step))
+	if !ok {
+		t.Fatal("EnableTwoFactor rejected the current code", err)
+	}
+	if err = user.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return key, step, recoveryCodes
+}
+
+func TestTwoFactorCodeReplay(t *testing.T) {
+	defer setupTest().Restore()
+	defer func(saved LoginThrottling) { Config.LoginThrottling = saved }(Config.LoginThrottling)
+	Config.LoginThrottling.BackoffBase = 0
+	Config.LoginThrottling.BackoffMax = 0
+	userDoc, user := newTestUser(t, "a@example.com", "password")
+	key, step, _ := enableTestTwoFactor(t, user)
+
+	session := newTestSession()
+	complete, err := BeginLogin(session, userDoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete || !TwoFactorPending(session) {
+		t.Fatal("login doesn't wait for the second factor")
+	}
+	if sessionUser(session) != nil {
+		t.Fatal("pending login has a user")
+	}
+
+	// The code used for the enrollment can't be used for the login
+	if ok, _ := VerifyTwoFactor(session, totpCode(key, step)); ok {
+		t.Error("code of the enrollment accepted")
+	}
+	code := totpCode(key, step+1)
+	if ok, err := VerifyTwoFactor(session, code); !ok {
+		t.Fatal("valid code rejected", err)
+	}
+	if sessionUser(session) == nil {
+		t.Fatal("verified login has no user")
+	}
+
+	replay := newTestSession()
+	if _, err = BeginLogin(replay, userDoc); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := VerifyTwoFactor(replay, code); ok {
+		t.Error("code accepted a second time")
+	}
+	if sessionUser(replay) != nil {
+		t.Error("replayed code logged in")
+	}
+}
+
+func TestTwoFactorRecoveryCodeIsSingleUse(t *testing.T) {
+	defer setupTest().Restore()
+	_, user := newTestUser(t, "a@example.com", "password")
+	_, _, recoveryCodes := enableTestTwoFactor(t, user)
+
+	if !user.CheckTwoFactorCode(recoveryCodes[0]) {
+		t.Fatal("recovery code rejected")
+	}
+	if user.CheckTwoFactorCode(recoveryCodes[0]) {
+		t.Error("recovery code accepted a second time")
+	}
+	if !user.CheckTwoFactorCode(recoveryCodes[1]) {
+		t.Error("other recovery code rejected")
+	}
+}
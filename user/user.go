@@ -1,6 +1,7 @@
 package user
 
 import (
+	"github.com/ungerik/go-start/errs"
 	"github.com/ungerik/go-start/model"
 	"github.com/ungerik/go-start/modelext"
 	"github.com/ungerik/go-start/mongo"
@@ -10,13 +11,22 @@ import (
 ///////////////////////////////////////////////////////////////////////////////
 // User
 
+// User is the user document. Fields with security data have the view tag
+// "excluded", so view.Form can't show or set them.
 type User struct {
 	mongo.DocumentBase `bson:",inline"`
 	Name               modelext.Name
 	Username           model.String `view:"size=20"`
 	Password           model.Password
+	PasswordReset      PasswordReset `view:"excluded"`
+	TwoFactor          TwoFactor     `view:"excluded"`
+	LoginFailures      LoginFailures `view:"excluded"`
 	Blocked            model.Bool
 	Admin              model.Bool
+	Roles              Roles                  `view:"excluded"`
+	Permissions        []model.String         `view:"excluded"`
+	ServiceAccount     model.Bool             `view:"excluded"`
+	APITokens          []APIToken             `view:"excluded"`
 	PostalAddress      modelext.PostalAddress `view:"label=Postal Address"`
 	Phone              []PhoneNumber
 	Web                []Website
@@ -30,10 +40,12 @@ type User struct {
 }
 
 func (self *User) IdentityConfirmed() bool {
-	return self.Blocked == false && (self.EmailPasswordConfirmed() ||
+	return self.Blocked == false && (self.ServiceAccount.Get() ||
+		self.EmailPasswordConfirmed() ||
 		self.FacebookIdentityConfirmed() ||
 		self.TwitterIdentityConfirmed() ||
-		self.LinkedInIdentityConfirmed())
+		self.LinkedInIdentityConfirmed() ||
+		self.GitHubIdentityConfirmed())
 }
 
 func (self *User) EmailPasswordMatch(email, password string) bool {
@@ -89,8 +101,17 @@ func (self *User) TwitterIdentityConfirmed() bool {
 }
 
 func (self *User) LinkedInIdentityConfirmed() bool {
-	for i := range self.Twitter {
-		if self.Twitter[i].Confirmed != "" {
+	for i := range self.LinkedIn {
+		if self.LinkedIn[i].Confirmed != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *User) GitHubIdentityConfirmed() bool {
+	for i := range self.GitHub {
+		if self.GitHub[i].Confirmed != "" {
 			return true
 		}
 	}
@@ -113,17 +134,29 @@ func (self *User) HasEmail(address string) bool {
 	return false
 }
 
+// AddEmail adds an unconfirmed email address.
+// An error is returned if the user already has the address
+// or if it is in use by another user, see EmailInUse().
 func (self *User) AddEmail(address, description string) (err error) {
 	var email EmailIdentity
 	err = email.Address.Set(address)
 	if err != nil {
 		return err
 	}
+	if self.HasEmail(email.Address.Get()) {
+		return errs.Format("Email address %s has already been added", email.Address.Get())
+	}
+	if Config.Collection != nil {
+		inUse, err := EmailInUse(email.Address.Get(), self)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return errs.Format("Email address %s is already in use", email.Address.Get())
+		}
+	}
 	email.Description.Set(description)
 	self.Email = append(self.Email, email)
-
-	/// self.Email[0] = email
-
 	return nil
 }
 
@@ -0,0 +1,99 @@
+package user
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ungerik/go-start/mail"
+	"github.com/ungerik/go-start/mail/mailtest"
+	"github.com/ungerik/go-start/mongo"
+	"github.com/ungerik/go-start/view"
+)
+
+var initTestCollection sync.Once
+
+// setupTest starts every test with empty collections
+// of the memory backend and captures the sent emails.
+// The returned Outbox has to be restored after the test.
+func setupTest() *mailtest.Outbox {
+	initTestCollection.Do(func() {
+		Init(mongo.NewCollection("users", (*User)(nil)))
+		Config.OnAuditEvent = func(event *AuditEvent) {}
+	})
+	mongo.InitMemory()
+	return mailtest.NewOutbox()
+}
+
+// newTestUser saves a user with a confirmed email address and password.
+func newTestUser(t *testing.T, email, password string) (userDoc interface{}, user *User) {
+	t.Helper()
+	user, userDoc, err := New(email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Email[0].Confirmed.SetNowUTC()
+	if err = user.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return userDoc, user
+}
+
+// testSessionTracker keeps the session ID in memory instead of a cookie.
+type testSessionTracker struct {
+	id string
+}
+
+func (self *testSessionTracker) ID(ctx *view.Context) (id string, ok bool) {
+	return self.id, self.id != ""
+}
+
+func (self *testSessionTracker) SetID(ctx *view.Context, id string) {
+	self.id = id
+}
+
+func (self *testSessionTracker) DeleteID(ctx *view.Context) {
+	self.id = ""
+}
+
+func newTestSession() *view.Session {
+	return &view.Session{Tracker: &testSessionTracker{}}
+}
+
+// sessionUser returns the user of session like a new request would.
+func sessionUser(session *view.Session) interface{} {
+	session.User = nil
+	return OfSession(session)
+}
+
+// waitForEmail waits for emails that are sent in the background.
+func waitForEmail(t *testing.T, outbox *mailtest.Outbox, address, subject string) *mail.Message {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if message, found := outbox.Find(address, subject); found {
+			return message
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return outbox.AssertSent(t, address, subject)
+}
+
+// linkCode returns the GET parameter "code" of the link in message.
+func linkCode(t *testing.T, message *mail.Message) string {
+	t.Helper()
+	if message == nil {
+		t.FailNow()
+	}
+	i := strings.Index(message.Text, "?code=")
+	if i == -1 {
+		t.Fatalf("No code in email '%s'", message.Subject)
+	}
+	code := strings.Fields(message.Text[i+len("?code="):])[0]
+	code, err := url.QueryUnescape(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
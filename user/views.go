@@ -2,6 +2,10 @@ package user
 
 import (
 	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/ungerik/go-start/config"
 	"github.com/ungerik/go-start/view"
 )
 
@@ -19,7 +23,9 @@ func EmailConfirmationView(profileURL view.URL) view.View {
 				return view.DIV("error", view.HTML("Invalid email confirmation code!")), err
 			}
 
-			Login(ctx.Session, doc)
+			if _, err = BeginLogin(ctx.Session, doc); err != nil {
+				return nil, err
+			}
 
 			return view.Views{
 				view.DIV("success", view.Printf("Email address %s confirmed!", email)),
@@ -38,9 +44,7 @@ func EmailConfirmationView(profileURL view.URL) view.View {
 func NewLoginForm(buttonText, class, errorMessageClass, successMessageClass string, redirectURL view.URL) view.View {
 	return view.DynamicView(
 		func(ctx *view.Context) (v view.View, err error) {
-			if from, ok := ctx.Request.Params["from"]; ok {
-				redirectURL = view.StringURL(from)
-			}
+			redirectURL := fromRedirect(ctx, redirectURL)
 			model := &LoginFormModel{}
 			if email, ok := ctx.Request.Params["email"]; ok {
 				model.Email.Set(email)
@@ -57,6 +61,9 @@ func NewLoginForm(buttonText, class, errorMessageClass, successMessageClass stri
 				OnSubmit: func(form *view.Form, formModel interface{}, ctx *view.Context) (string, view.URL, error) {
 					m := formModel.(*LoginFormModel)
 					ok, err := LoginEmailPassword(ctx.Session, m.Email.Get(), m.Password.Get())
+					if throttled, isThrottled := err.(*ErrLoginThrottled); isThrottled {
+						return "", nil, throttled
+					}
 					if err != nil {
 						if view.Config.Debug.Mode {
 							return "", nil, err
@@ -67,6 +74,9 @@ func NewLoginForm(buttonText, class, errorMessageClass, successMessageClass stri
 					if !ok {
 						return "", nil, errors.New("Wrong email and password combination")
 					}
+					if TwoFactorPending(ctx.Session) {
+						return "", twoFactorRedirect(ctx, redirectURL), nil
+					}
 					return "", nil, nil
 				},
 			}
@@ -75,11 +85,37 @@ func NewLoginForm(buttonText, class, errorMessageClass, successMessageClass stri
 	)
 }
 
+// UnlockAccountView clears the lockout of the account
+// with the unlock code in the GET parameter "code",
+// see User.SendUnlockEmail().
+func UnlockAccountView(loginURL view.URL) view.View {
+	return view.DynamicView(
+		func(ctx *view.Context) (view.View, error) {
+			_, ok, err := UnlockAccount(ctx.Request.Params["code"])
+			if !ok {
+				return view.DIV("error", view.HTML("Invalid account unlock code!")), err
+			}
+			return view.Views{
+				view.DIV("success", view.HTML("Your account has been unlocked")),
+				&view.If{
+					Condition: loginURL != nil,
+					Content: view.P(
+						view.HTML("Continue to the "),
+						view.A(loginURL, "login..."),
+					),
+				},
+			}, nil
+		},
+	)
+}
+
 // If redirect is nil, the redirect will go to "/"
 func LogoutView(redirect view.URL) view.View {
 	return view.RenderView(
 		func(ctx *view.Context) (err error) {
-			Logout(ctx.Session)
+			if err = Logout(ctx.Session); err != nil {
+				return err
+			}
 			if redirect != nil {
 				return view.Redirect(redirect.URL(ctx))
 			}
@@ -105,22 +141,18 @@ func NewSignupForm(buttonText, class, errorMessageClass, successMessageClass str
 			m := formModel.(*EmailPasswordFormModel)
 			email := m.Email.Get()
 			password := m.Password1.Get()
-			var user *User
-			doc, found, err := FindByEmail(email)
+			_, found, err := FindByEmail(email)
 			if err != nil {
 				return "", nil, err
 			}
 			if found {
-				user = From(doc)
-				if user.EmailPasswordConfirmed() {
-					return "", nil, errors.New("A user with that email and a password already exists")
-				}
-				user.Password.SetHashed(password)
-			} else {
-				user, _, err = New(email, password)
-				if err != nil {
-					return "", nil, err
-				}
+				// Only owners of confirmed addresses are found,
+				// they have to use the password reset to set a password
+				return "", nil, errors.New("A user with that email already exists")
+			}
+			user, _, err := New(email, password)
+			if err != nil {
+				return "", nil, err
 			}
 			err = <-user.Email[0].SendConfirmationEmail(ctx, confirmationURL)
 			if err != nil {
@@ -130,3 +162,223 @@ func NewSignupForm(buttonText, class, errorMessageClass, successMessageClass str
 		},
 	}
 }
+
+// NewPasswordResetRequestForm sends an email with a password reset link
+// to resetURL, which must be a page with NewPasswordResetForm().
+// The same success message is shown if there is no user with the
+// submitted email address, so the form can't be used to find out
+// who has an account.
+func NewPasswordResetRequestForm(buttonText, class, errorMessageClass, successMessageClass string, resetURL view.URL) *view.Form {
+	return &view.Form{
+		Class:               class,
+		ErrorMessageClass:   errorMessageClass,
+		SuccessMessageClass: successMessageClass,
+		SuccessMessage:      Config.PasswordResetMessage.Sent,
+		SubmitButtonText:    buttonText,
+		FormID:              "gostart_user_password_reset_request",
+		GetModel: func(form *view.Form, ctx *view.Context) (interface{}, error) {
+			return &PasswordResetRequestFormModel{}, nil
+		},
+		OnSubmit: func(form *view.Form, formModel interface{}, ctx *view.Context) (string, view.URL, error) {
+			m := formModel.(*PasswordResetRequestFormModel)
+			doc, found, err := FindByEmail(m.Email.Get())
+			if !found {
+				return "", nil, err
+			}
+			// Errors that only happen for existing accounts are logged
+			// instead of returned, so the response is always the same
+			user := From(doc)
+			errChan := user.SendPasswordResetEmail(ctx, resetURL)
+			go func() {
+				if err := <-errChan; err != nil {
+					config.Logger.Printf("user: Error while sending password reset email to %s: %s", user.PrimaryEmail(), err)
+				}
+			}()
+			return "", nil, nil
+		},
+	}
+}
+
+// NewPasswordResetForm sets a new password for the reset token
+// in the GET parameter "code", logs out all sessions of the user
+// and logs in the current one.
+// If redirectURL is nil, a success message is shown.
+func NewPasswordResetForm(buttonText, class, errorMessageClass, successMessageClass string, redirectURL view.URL) view.View {
+	return view.DynamicView(
+		func(ctx *view.Context) (view.View, error) {
+			token := ctx.Request.Params["code"]
+			_, found, err := FindByPasswordResetToken(token)
+			if !found {
+				return view.DIV("error", view.HTML("Invalid or expired password reset link!")), err
+			}
+			form := &view.Form{
+				Class:               class,
+				ErrorMessageClass:   errorMessageClass,
+				SuccessMessageClass: successMessageClass,
+				SuccessMessage:      "Your new password has been set",
+				SubmitButtonText:    buttonText,
+				FormID:              "gostart_user_password_reset",
+				GetModel: func(form *view.Form, ctx *view.Context) (interface{}, error) {
+					return &PasswordFormModel{}, nil
+				},
+				Redirect: redirectURL,
+				OnSubmit: func(form *view.Form, formModel interface{}, ctx *view.Context) (string, view.URL, error) {
+					m := formModel.(*PasswordFormModel)
+					doc, ok, err := ResetPassword(token, m.Password1.Get())
+					if err != nil {
+						return "", nil, err
+					}
+					if !ok {
+						return "", nil, errors.New("Invalid or expired password reset link")
+					}
+					complete, err := BeginLogin(ctx.Session, doc)
+					if err == nil && !complete {
+						return "", twoFactorRedirect(ctx, redirectURL), nil
+					}
+					return "", nil, err
+				},
+			}
+			return form, nil
+		},
+	)
+}
+
+// fromRedirect returns the GET parameter "from" as redirect URL
+// or redirectURL if there is none. Only paths on this site
+// are accepted, so the parameter can't redirect to other sites.
+func fromRedirect(ctx *view.Context, redirectURL view.URL) view.URL {
+	from, ok := ctx.Request.Params["from"]
+	if !ok || !isLocalPath(from) {
+		return redirectURL
+	}
+	return view.StringURL(from)
+}
+
+// isLocalPath returns true if path is an absolute path without
+// host. "//host" and "/\host" are URLs of other hosts for browsers.
+func isLocalPath(path string) bool {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.ContainsAny(path, "\\\r\n\t") {
+		return false
+	}
+	u, err := url.Parse(path)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
+
+// twoFactorRedirect returns Config.TwoFactorURL with redirectURL
+// as "from" parameter for NewTwoFactorForm().
+// NewTwoFactorForm() ignores redirectURL if it is not a path on this site.
+func twoFactorRedirect(ctx *view.Context, redirectURL view.URL) view.URL {
+	if Config.TwoFactorURL == nil || redirectURL == nil {
+		return Config.TwoFactorURL
+	}
+	return view.StringURL(Config.TwoFactorURL.URL(ctx) + "?from=" + url.QueryEscape(redirectURL.URL(ctx)))
+}
+
+// NewTwoFactorForm finishes a pending login of a user with
+// two-factor authentication, or renews the verification
+// of a logged in user for TwoFactorAuth.
+// A TOTP code or a recovery code can be entered.
+func NewTwoFactorForm(buttonText, class, errorMessageClass, successMessageClass string, redirectURL view.URL) view.View {
+	return view.DynamicView(
+		func(ctx *view.Context) (view.View, error) {
+			redirectURL := fromRedirect(ctx, redirectURL)
+			if !TwoFactorPending(ctx.Session) && OfSession(ctx.Session) == nil {
+				return view.DIV("error", view.HTML("Please log in first!")), nil
+			}
+			form := &view.Form{
+				Class:               class,
+				ErrorMessageClass:   errorMessageClass,
+				SuccessMessageClass: successMessageClass,
+				SuccessMessage:      "Login successful",
+				SubmitButtonText:    buttonText,
+				FormID:              "gostart_user_two_factor",
+				GetModel: func(form *view.Form, ctx *view.Context) (interface{}, error) {
+					return &TwoFactorCodeFormModel{}, nil
+				},
+				Redirect: redirectURL,
+				OnSubmit: func(form *view.Form, formModel interface{}, ctx *view.Context) (string, view.URL, error) {
+					m := formModel.(*TwoFactorCodeFormModel)
+					ok, err := VerifyTwoFactor(ctx.Session, m.Code.Get())
+					if err != nil {
+						return "", nil, err
+					}
+					if !ok {
+						return "", nil, errors.New("Invalid or expired code")
+					}
+					return "", nil, nil
+				},
+			}
+			return form, nil
+		},
+	)
+}
+
+// NewTwoFactorEnrollForm enables two-factor authentication for the
+// session user. The provisioning URI is shown as link with the class
+// "gostart-totp-uri" that can be rendered as QR code for authenticator apps.
+// After the first valid code the recovery codes are shown once.
+func NewTwoFactorEnrollForm(buttonText, class, errorMessageClass, successMessageClass string) view.View {
+	return view.DynamicView(
+		func(ctx *view.Context) (view.View, error) {
+			userDoc := OfSession(ctx.Session)
+			if userDoc == nil {
+				return view.DIV("error", view.HTML("Please log in first!")), nil
+			}
+			user := From(userDoc)
+			if user.TwoFactor.IsEnabled() {
+				return view.DIV("success", view.HTML("Two-factor authentication is enabled")), nil
+			}
+			if user.TwoFactor.Secret.IsEmpty() {
+				if _, err := user.BeginTwoFactorEnrollment(); err != nil {
+					return nil, err
+				}
+				if err := user.Save(); err != nil {
+					return nil, err
+				}
+			}
+			var recoveryCodes []string
+			form := &view.Form{
+				Class:               class,
+				ErrorMessageClass:   errorMessageClass,
+				SuccessMessageClass: successMessageClass,
+				SuccessMessage:      "Two-factor authentication enabled. Store these recovery codes in a safe place, each can be used once instead of a code:",
+				SubmitButtonText:    buttonText,
+				FormID:              "gostart_user_two_factor_enroll",
+				GetModel: func(form *view.Form, ctx *view.Context) (interface{}, error) {
+					return &TwoFactorCodeFormModel{}, nil
+				},
+				OnSubmit: func(form *view.Form, formModel interface{}, ctx *view.Context) (string, view.URL, error) {
+					m := formModel.(*TwoFactorCodeFormModel)
+					codes, ok, err := user.EnableTwoFactor(m.Code.Get())
+					if err != nil {
+						return "", nil, err
+					}
+					if !ok {
+						return "", nil, errors.New("Invalid code")
+					}
+					if err = user.Save(); err != nil {
+						return "", nil, err
+					}
+					recoveryCodes = codes
+					return "", nil, nil
+				},
+			}
+			uri := user.TwoFactorProvisioningURI()
+			return view.Views{
+				view.P(
+					view.HTML("Scan the code with your authenticator app or enter the secret "),
+					view.CODE(view.Escape(user.TwoFactor.Secret.Get())),
+				),
+				&view.Link{Class: "gostart-totp-uri", Model: &view.StringLink{Url: uri, Content: view.Escape(uri)}},
+				form,
+				// Rendered after the form, so recoveryCodes is set by OnSubmit
+				view.DynamicView(func(ctx *view.Context) (view.View, error) {
+					if recoveryCodes == nil {
+						return nil, nil
+					}
+					return view.PRE(view.Escape(strings.Join(recoveryCodes, "\n"))), nil
+				}),
+			}, nil
+		},
+	)
+}
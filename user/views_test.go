@@ -0,0 +1,104 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/ungerik/go-start/model"
+	"github.com/ungerik/go-start/view"
+)
+
+func TestFromRedirect(t *testing.T) {
+	tests := []struct {
+		from     string
+		redirect string
+	}{
+		{"/profile", "/profile"},
+		{"/profile?tab=security#top", "/profile?tab=security#top"},
+		{"https://evil.example.com/", "/default"},
+		{"//evil.example.com/", "/default"},
+		{"/\\evil.example.com/", "/default"},
+		{"javascript:alert(1)", "/default"},
+		{"profile", "/default"},
+		{"/profile\r\nLocation: https://evil.example.com/", "/default"},
+	}
+	for _, test := range tests {
+		ctx := &view.Context{Request: &view.Request{Params: map[string]string{"from": test.from}}}
+		if redirect := fromRedirect(ctx, view.StringURL("/default")); redirect != view.StringURL(test.redirect) {
+			t.Errorf("from=%q redirects to %q instead of %q", test.from, redirect, test.redirect)
+		}
+	}
+}
+
+func TestTwoFactorFormRedirectPerRequest(t *testing.T) {
+	defer setupTest().Restore()
+	userDoc, _ := newTestUser(t, "a@example.com", "password")
+	session := newTestSession()
+	if err := Login(session, userDoc); err != nil {
+		t.Fatal(err)
+	}
+	twoFactorForm := NewTwoFactorForm("Verify", "", "", "", view.StringURL("/default")).(view.DynamicView)
+	for _, test := range []struct {
+		params   map[string]string
+		redirect string
+	}{
+		{map[string]string{"from": "/profile"}, "/profile"},
+		// The "from" of the previous request is not kept
+		{map[string]string{}, "/default"},
+		{map[string]string{"from": "https://evil.example.com/"}, "/default"},
+	} {
+		ctx := &view.Context{Request: &view.Request{Params: test.params}, Session: session}
+		v, err := twoFactorForm(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		form, ok := v.(*view.Form)
+		if !ok {
+			t.Fatalf("%#v is not a form", v)
+		}
+		if redirect := form.Redirect; redirect != view.StringURL(test.redirect) {
+			t.Errorf("params %v redirect to %q instead of %q", test.params, redirect, test.redirect)
+		}
+	}
+}
+
+func TestFormExcludesSecurityFields(t *testing.T) {
+	user := &User{
+		APITokens: []APIToken{{}},
+		Email:     []EmailIdentity{{}},
+		GitHub:    []GitHubIdentity{{}},
+	}
+	form := &view.Form{}
+	shown := map[string]bool{}
+	err := model.Visit(user, model.VisitorFunc(func(field *model.MetaData) error {
+		if field.Parent != nil && !form.IsFieldExcluded(field, nil) {
+			shown[field.WildcardSelector()] = true
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, selector := range []string{
+		"PasswordReset",
+		"PasswordReset.TokenHash",
+		"TwoFactor",
+		"TwoFactor.Secret",
+		"LoginFailures",
+		"Roles",
+		"Permissions",
+		"ServiceAccount",
+		"APITokens",
+		"APITokens.$",
+		"Email.$.ConfirmationCodeHash",
+		"GitHub.$.AccessToken",
+	} {
+		if shown[selector] {
+			t.Errorf("%s is not excluded", selector)
+		}
+	}
+	for _, selector := range []string{"Name", "Password", "Email.$.Address", "GitHub.$.ID"} {
+		if !shown[selector] {
+			t.Errorf("%s is excluded", selector)
+		}
+	}
+}
@@ -1,8 +1,16 @@
 package view
 
 import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"os"
 	"strings"
+
+	"github.com/ungerik/go-start/errs"
 )
 
 // NewBasicAuth creates a BasicAuth instance with a single username and password.
@@ -13,33 +21,204 @@ func NewBasicAuth(realm string, username string, password string) *BasicAuth {
 	}
 }
 
+// NewHtpasswdAuth creates a BasicAuth instance with the users
+// of an htpasswd file, see LoadHtpasswd().
+func NewHtpasswdAuth(realm string, filename string) (*BasicAuth, error) {
+	hashes, err := LoadHtpasswd(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &BasicAuth{Realm: realm, HashedUserPassword: hashes}, nil
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // BasicAuth
 
-// BasicAuth implements HTTP basic auth as Authenticator.
+/*
+BasicAuth implements HTTP basic auth as Authenticator.
+
+The credentials are checked with CheckCredentials if it is not nil,
+else with the password hashes of HashedUserPassword
+and then with the plaintext passwords of UserPassword.
+Passwords are compared in constant time.
+
+CheckCredentials can be used to authenticate against other
+user stores, for example user.NewBasicAuth() for user.User accounts.
+*/
 type BasicAuth struct {
-	Realm        string
+	Realm string
+	// UserPassword maps usernames to plaintext passwords.
+	// Use HashedUserPassword to avoid plaintext passwords in the code.
 	UserPassword map[string]string
+	// HashedUserPassword maps usernames to password hashes
+	// in a format of CheckPasswordHash().
+	HashedUserPassword map[string]string
+	// CheckHash is used for HashedUserPassword if not nil,
+	// else CheckPasswordHash(). Can be used to support
+	// additional hash formats like bcrypt.
+	CheckHash func(hash, password string) bool
+	// CheckCredentials replaces the checks of UserPassword and
+	// HashedUserPassword if not nil. err is used for real errors,
+	// not for wrong credentials.
+	CheckCredentials func(ctx *Context, username, password string) (ok bool, err error)
 }
 
 func (self *BasicAuth) Authenticate(ctx *Context) (ok bool, err error) {
-	header := ctx.Request.Header.Get("Authorization")
-	f := strings.Fields(header)
-	if len(f) == 2 && f[0] == "Basic" {
-		if b, err := base64.StdEncoding.DecodeString(f[1]); err == nil {
-			a := strings.Split(string(b), ":")
-			if len(a) == 2 {
-				username := a[0]
-				password := a[1]
-				p, ok := self.UserPassword[username]
-				if ok && p == password {
-					return true, nil
-				}
-			}
-		}
-	}
-
-	ctx.Response.Header().Set("WWW-Authenticate", "Basic realm=\""+self.Realm+"\"")
+	// http.Request.BasicAuth() splits at the first colon,
+	// so passwords can contain colons
+	username, password, hasAuth := ctx.Request.BasicAuth()
+	if hasAuth {
+		ok, err = self.check(ctx, username, password)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+
+	ctx.Response.Header().Set("WWW-Authenticate", "Basic realm=\""+strings.Replace(self.Realm, `"`, `\"`, -1)+"\"")
 	ctx.Response.AuthorizationRequired401()
 	return false, nil
 }
+
+func (self *BasicAuth) check(ctx *Context, username, password string) (ok bool, err error) {
+	if self.CheckCredentials != nil {
+		return self.CheckCredentials(ctx, username, password)
+	}
+	if hash, found := self.HashedUserPassword[username]; found {
+		checkHash := self.CheckHash
+		if checkHash == nil {
+			checkHash = CheckPasswordHash
+		}
+		return checkHash(hash, password), nil
+	}
+	p, found := self.UserPassword[username]
+	// Compare hashes, so that the time doesn't depend
+	// on the length of the password or if the user exists
+	a := sha256.Sum256([]byte(p))
+	b := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1 && found, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Password hashes
+
+/*
+CheckPasswordHash returns true if password matches hash.
+The following hash formats are supported:
+
+	{SHA}<base64 SHA-1>           htpasswd -s
+	$apr1$<salt>$<hash>           htpasswd -m, Apache MD5
+	{SHA256}<base64 SHA-256>      model.PasswordHash() with prefix
+
+Other formats like bcrypt return false,
+use BasicAuth.CheckHash to support them.
+*/
+func CheckPasswordHash(hash, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "{SHA256}"):
+		sum := sha256.Sum256([]byte(password))
+		computed = "{SHA256}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.TrimPrefix(hash, "$apr1$")
+		if i := strings.IndexByte(salt, '$'); i != -1 {
+			salt = salt[:i]
+		}
+		computed = apr1Hash(password, salt)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// LoadHtpasswd reads username:hash lines of an htpasswd file.
+// Empty lines and lines starting with # are ignored.
+// See CheckPasswordHash() for the supported hash formats.
+func LoadHtpasswd(filename string) (userHash map[string]string, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	userHash = make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, errs.Format("Invalid line %d in htpasswd file %s", lineNumber, filename)
+		}
+		userHash[line[:i]] = line[i+1:]
+	}
+	return userHash, scanner.Err()
+}
+
+// apr1Hash returns the Apache MD5 hash of password with salt
+// in the format $apr1$<salt>$<hash>.
+func apr1Hash(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alternate := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alternate[:])
+		} else {
+			ctx.Write(alternate[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte{password[0]})
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write([]byte(password))
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write([]byte(password))
+		}
+		if i&1 == 1 {
+			round.Write(sum)
+		} else {
+			round.Write([]byte(password))
+		}
+		sum = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	encode := func(v uint, n int) string {
+		var s []byte
+		for ; n > 0; n-- {
+			s = append(s, itoa64[v&0x3f])
+			v >>= 6
+		}
+		return string(s)
+	}
+	result := magic + salt + "$"
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		result += encode(uint(sum[i[0]])<<16|uint(sum[i[1]])<<8|uint(sum[i[2]]), 4)
+	}
+	return result + encode(uint(sum[11]), 2)
+}
@@ -0,0 +1,64 @@
+package view
+
+import (
+	"testing"
+)
+
+func TestApr1Hash(t *testing.T) {
+	// Example of the Apache htpasswd documentation
+	const hash = "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"
+	if computed := apr1Hash("myPassword", "r31....."); computed != hash {
+		t.Errorf("apr1Hash returned %s, want %s", computed, hash)
+	}
+}
+
+func TestCheckPasswordHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"apr1", "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", "myPassword", true},
+		{"apr1 wrong password", "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", "mypassword", false},
+		{"apr1 other salt", "$apr1$9hJi8cMJ$gsrtWIR4uUg0fAyo3OD6A1", "secret", true},
+		{"SHA", "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password", true},
+		{"SHA wrong password", "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "Password", false},
+		{"SHA256", "{SHA256}XohImNooBHFR0OVvjcYpJ3NgPQ1qq73WKhHvch0VQtg=", "password", true},
+		{"SHA256 wrong password", "{SHA256}XohImNooBHFR0OVvjcYpJ3NgPQ1qq73WKhHvch0VQtg=", "", false},
+		{"bcrypt is not supported", "$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC", "password", false},
+		{"plaintext is not a hash", "password", "password", false},
+	}
+	for _, test := range tests {
+		if got := CheckPasswordHash(test.hash, test.password); got != test.want {
+			t.Errorf("%s: CheckPasswordHash returned %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBasicAuthCheck(t *testing.T) {
+	auth := &BasicAuth{
+		UserPassword:       map[string]string{"plain": "secret"},
+		HashedUserPassword: map[string]string{"hashed": "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"},
+	}
+	tests := []struct {
+		username string
+		password string
+		want     bool
+	}{
+		{"plain", "secret", true},
+		{"plain", "Secret", false},
+		{"hashed", "myPassword", true},
+		{"hashed", "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", false},
+		{"unknown", "", false},
+	}
+	for _, test := range tests {
+		ok, err := auth.check(nil, test.username, test.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.want {
+			t.Errorf("check(%q, %q) returned %v, want %v", test.username, test.password, ok, test.want)
+		}
+	}
+}
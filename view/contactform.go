@@ -2,7 +2,7 @@ package view
 
 import (
 	"fmt"
-	"github.com/ungerik/go-mail"
+	"github.com/ungerik/go-start/mail"
 	"github.com/ungerik/go-start/model"
 )
 
@@ -28,8 +28,9 @@ func NewContactForm(recipientEmail, subjectPrefix, formClass, buttonClass, formI
 		OnSubmit: func(form *Form, formModel interface{}, ctx *Context) (string, URL, error) {
 			model := formModel.(*ContactFormModel)
 			subject := fmt.Sprintf("%sFrom %s <%s>: %s", subjectPrefix, model.Name, model.Email, model.Subject)
-			err := email.NewBriefMessage(subject, model.Message.Get(), recipientEmail).Send()
-			return "", nil, err
+			message := mail.NewMessage(subject, model.Message.Get(), recipientEmail)
+			message.ReplyTo = model.Email.Get()
+			return "", nil, mail.Send(message)
 		},
 	}
 }
@@ -129,8 +129,10 @@ Required fields must not be empty to validate.
 Hidden fields generate hidden HTML form input elements,
 whereas excluded fields are completely ignored.
 
-required can also be set as model tag, hidden and disabled
+required can also be set as model tag, hidden, disabled and excluded
 as view tags at struct fields of the data model.
+Use the excluded tag for fields that must never be set by a form,
+because the values of hidden fields are posted back.
 
 Example:
 
@@ -141,13 +143,14 @@ Example:
 		Hidden2   model.Url
 		Disabled1 model.Bool `view:"disabled"`
 		Disabled2 model.Email
-		Excluded  model.String
+		Excluded1 model.String `view:"excluded"`
+		Excluded2 model.String
 	}
 	&Form{
 		RequiredFields: []string{"Required2"},
 		HiddenFields:   []string{"Hidden2"},
 		DisabledFields: []string{"Disabled2"},
-		ExcludedFields: []string{"Excluded"},
+		ExcludedFields: []string{"Excluded2"},
 		GetModel:       FormModel(&myModel),
 	}
 
@@ -504,7 +507,8 @@ func (self *Form) IsFieldHidden(field *model.MetaData) bool {
 }
 
 // IsFieldExcluded returns weather a field will be excluded from the form.
-// Fields will be excluded, if their selector matches one in Form.ExcludedFields
+// Fields will be excluded, if they have the view tag "excluded",
+// if their selector matches one in Form.ExcludedFields
 // or if a matching Authenticator from Form.ModelFieldAuth returns false.
 // A field is also excluded when its parent field is excluded.
 // This function is not restricted to model.Value, it works with all struct fields.
@@ -513,7 +517,7 @@ func (self *Form) IsFieldExcluded(field *model.MetaData, ctx *Context) bool {
 	if field.Parent == nil {
 		return false // can't exclude root
 	}
-	if self.IsFieldExcluded(field.Parent, ctx) || field.SelectorsMatch(self.ExcludedFields) {
+	if self.IsFieldExcluded(field.Parent, ctx) || field.BoolAttrib(StructTagKey, "excluded") || field.SelectorsMatch(self.ExcludedFields) {
 		return true
 	}
 	if len(self.ModelFieldAuth) > 0 {
@@ -55,7 +55,8 @@ func (self *LabeledModelView) FieldLabel(metaData *model.MetaData) string {
 }
 
 // IsFieldExcluded returns weather a field will be excluded.
-// Fields will be excluded, if their selector matches one in LabeledModelView.ExcludedFields.
+// Fields will be excluded, if they have the view tag "excluded"
+// or if their selector matches one in LabeledModelView.ExcludedFields.
 // A field is also excluded when its parent field is excluded.
 // This function is not restricted to model.Value, it works with all struct fields.
 // This way a whole sub struct an be excluded by adding its selector to LabeledModelView.ExcludedFields.
@@ -63,7 +64,7 @@ func (self *LabeledModelView) IsFieldExcluded(field *model.MetaData) bool {
 	if field.Parent == nil {
 		return false // can't exclude root
 	}
-	if self.IsFieldExcluded(field.Parent) || field.SelectorsMatch(self.ExcludedFields) {
+	if self.IsFieldExcluded(field.Parent) || field.BoolAttrib(StructTagKey, "excluded") || field.SelectorsMatch(self.ExcludedFields) {
 		return true
 	}
 	return false
@@ -0,0 +1,174 @@
+package view
+
+import (
+	"sync"
+
+	"github.com/ungerik/go-start/model"
+	"github.com/ungerik/go-start/mongo"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// QueryPaginator
+
+/*
+QueryPaginator renders one page of a mongo.Query with cursor pagination
+and links to the previous and next page.
+The cursor of the page is read from and written to the URL parameter
+CursorParam.
+
+Use the ModelIterator method of the paginator as GetModelIterator
+of a ModelIteratorView or ModelIteratorTableView in Content.
+The query has to be sorted by the keys used for pagination.
+
+Example:
+
+	paginator := &view.QueryPaginator{
+		GetQuery: func(ctx *view.Context) mongo.Query {
+			return models.Users.Sort("Name.Last")
+		},
+		PageSize: 20,
+	}
+	paginator.Content = &view.ModelIteratorTableView{
+		GetModelIterator: paginator.ModelIterator,
+		GetRowViews:      ...,
+	}
+*/
+type QueryPaginator struct {
+	ViewBase
+	Class       string // Class of the div around the links, default "pagination"
+	GetQuery    func(ctx *Context) mongo.Query
+	PageSize    int    // Default is 20
+	CursorParam string // Default is "cursor"
+	Content     View
+	PrevContent View // Default is "&larr; Previous"
+	NextContent View // Default is "Next &rarr;"
+	LinksAbove  bool // Render the links above and below Content
+
+	pagesMutex sync.Mutex
+	pages      map[*Request]*mongo.Page
+}
+
+func (self *QueryPaginator) IterateChildren(callback IterateChildrenCallback) {
+	if self.Content != nil {
+		callback(self, self.Content)
+	}
+}
+
+func (self *QueryPaginator) cursorParam() string {
+	if self.CursorParam == "" {
+		return "cursor"
+	}
+	return self.CursorParam
+}
+
+func (self *QueryPaginator) pageSize() int {
+	if self.PageSize <= 0 {
+		return 20
+	}
+	return self.PageSize
+}
+
+// Page returns the page of the current request.
+// It is loaded only once per request while the paginator is rendered.
+func (self *QueryPaginator) Page(ctx *Context) (*mongo.Page, error) {
+	self.pagesMutex.Lock()
+	page, ok := self.pages[ctx.Request]
+	self.pagesMutex.Unlock()
+	if ok {
+		return page, nil
+	}
+	return self.GetQuery(ctx).Page(ctx.Request.Params[self.cursorParam()], self.pageSize())
+}
+
+// ModelIterator returns an iterator for the documents of the current page.
+// It can be used as GetModelIterator of ModelIteratorView
+// and ModelIteratorTableView.
+func (self *QueryPaginator) ModelIterator(ctx *Context) model.Iterator {
+	page, err := self.Page(ctx)
+	if err != nil {
+		return model.NewErrorOnlyIterator(err)
+	}
+	return page.Iterator()
+}
+
+// PageURL returns the URL of the current request with
+// cursor as page cursor.
+func (self *QueryPaginator) PageURL(ctx *Context, cursor string) string {
+	url := *ctx.Request.URL
+	query := url.Query()
+	query.Set(self.cursorParam(), cursor)
+	url.RawQuery = query.Encode()
+	return ctx.Request.AddProtocolAndHostToURL(url.RequestURI())
+}
+
+func (self *QueryPaginator) renderLinks(ctx *Context, page *mongo.Page) (err error) {
+	if page.PrevCursor == "" && page.NextCursor == "" {
+		return nil
+	}
+	class := self.Class
+	if class == "" {
+		class = "pagination"
+	}
+	ctx.Response.XML.OpenTag("div")
+	ctx.Response.XML.Attrib("class", class)
+	if page.PrevCursor != "" {
+		content := self.PrevContent
+		if content == nil {
+			content = HTML("&larr; Previous")
+		}
+		link := &Link{
+			Class: "prev",
+			Model: &StringLink{Url: self.PageURL(ctx, page.PrevCursor), Content: content, Rel: "prev"},
+		}
+		if err = link.Render(ctx); err != nil {
+			return err
+		}
+	}
+	if page.NextCursor != "" {
+		content := self.NextContent
+		if content == nil {
+			content = HTML("Next &rarr;")
+		}
+		link := &Link{
+			Class: "next",
+			Model: &StringLink{Url: self.PageURL(ctx, page.NextCursor), Content: content, Rel: "next"},
+		}
+		if err = link.Render(ctx); err != nil {
+			return err
+		}
+	}
+	ctx.Response.XML.ForceCloseTag() // div
+	return nil
+}
+
+func (self *QueryPaginator) Render(ctx *Context) (err error) {
+	page, err := self.Page(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Content uses the same page via ModelIterator()
+	self.pagesMutex.Lock()
+	if self.pages == nil {
+		self.pages = make(map[*Request]*mongo.Page)
+	}
+	self.pages[ctx.Request] = page
+	self.pagesMutex.Unlock()
+	defer func() {
+		self.pagesMutex.Lock()
+		delete(self.pages, ctx.Request)
+		self.pagesMutex.Unlock()
+	}()
+
+	if self.LinksAbove {
+		if err = self.renderLinks(ctx, page); err != nil {
+			return err
+		}
+	}
+	if self.Content != nil {
+		if err = self.Content.Render(ctx); err != nil {
+			return err
+		}
+	}
+	return self.renderLinks(ctx, page)
+}
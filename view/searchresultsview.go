@@ -0,0 +1,171 @@
+package view
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ungerik/go-start/mongo"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Highlight
+
+// Highlight returns text as escaped HTML with all case insensitive
+// matches of terms wrapped in <mark> tags.
+func Highlight(text string, terms []string) HTML {
+	if len(terms) == 0 || text == "" {
+		return Escape(text)
+	}
+	// Longer terms first so that phrases win over their words
+	sorted := make([]string, 0, len(terms))
+	for _, term := range terms {
+		if term != "" {
+			sorted = append(sorted, regexp.QuoteMeta(term))
+		}
+	}
+	if len(sorted) == 0 {
+		return Escape(text)
+	}
+	sort.Sort(sort.Reverse(byLength(sorted)))
+	for i, term := range sorted {
+		// Words of phrases can be separated by any whitespace
+		sorted[i] = strings.Replace(term, " ", `\s+`, -1)
+	}
+	regex := regexp.MustCompile(`(?i)` + strings.Join(sorted, "|"))
+
+	var buf bytes.Buffer
+	last := 0
+	for _, match := range regex.FindAllStringIndex(text, -1) {
+		buf.WriteString(html.EscapeString(text[last:match[0]]))
+		buf.WriteString("<mark>")
+		buf.WriteString(html.EscapeString(text[match[0]:match[1]]))
+		buf.WriteString("</mark>")
+		last = match[1]
+	}
+	buf.WriteString(html.EscapeString(text[last:]))
+	return HTML(buf.String())
+}
+
+type byLength []string
+
+func (self byLength) Len() int           { return len(self) }
+func (self byLength) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self byLength) Less(i, j int) bool { return len(self[i]) < len(self[j]) }
+
+///////////////////////////////////////////////////////////////////////////////
+// SearchResultsView
+
+// GetSearchResultViewFunc returns the view for one document of the search
+// results. highlight returns a text with the matches of the search marked.
+type GetSearchResultViewFunc func(ctx *Context, document interface{}, highlight func(text string) HTML) (view View, err error)
+
+/*
+SearchResultsView renders the documents of a query matching the search
+text of the URL parameter QueryParam ordered by relevance.
+Matches of the search terms are highlighted with <mark> tags.
+The collection of the query needs a text index, see mongo.Collection.SetTextIndex().
+
+Example:
+
+	&view.SearchResultsView{
+		GetQuery: func(ctx *view.Context) mongo.Query {
+			return models.Posts.FilterEqual("Published", true)
+		},
+		Limit:     50,
+		NoResults: view.P("Nothing found"),
+	}
+*/
+type SearchResultsView struct {
+	ViewBase
+	Class      string // Class of the div around the results, default "search-results"
+	GetQuery   func(ctx *Context) mongo.Query
+	QueryParam string // Default is "q"
+	Limit      int    // Default is no limit
+	// GetResultView is optional, the default renders the
+	// highlighted texts of the text index fields of the document.
+	GetResultView GetSearchResultViewFunc
+	NoResults     View // Rendered if nothing is found
+}
+
+func (self *SearchResultsView) IterateChildren(callback IterateChildrenCallback) {
+	if self.NoResults != nil {
+		callback(self, self.NoResults)
+	}
+}
+
+func (self *SearchResultsView) queryParam() string {
+	if self.QueryParam == "" {
+		return "q"
+	}
+	return self.QueryParam
+}
+
+func (self *SearchResultsView) defaultResultView(collection *mongo.Collection) GetSearchResultViewFunc {
+	return func(ctx *Context, document interface{}, highlight func(text string) HTML) (view View, err error) {
+		texts := collection.TextIndexValues(document)
+		views := make(Views, len(texts))
+		for i, text := range texts {
+			views[i] = P(highlight(text))
+		}
+		return views, nil
+	}
+}
+
+func (self *SearchResultsView) Render(ctx *Context) (err error) {
+	search := strings.TrimSpace(ctx.Request.Params[self.queryParam()])
+	if search == "" {
+		return nil
+	}
+
+	query := self.GetQuery(ctx).Search(search)
+	if self.Limit > 0 {
+		query = query.Limit(self.Limit)
+	}
+	terms := mongo.SearchTerms(search)
+	highlight := func(text string) HTML {
+		return Highlight(text, terms)
+	}
+	getResultView := self.GetResultView
+	if getResultView == nil {
+		getResultView = self.defaultResultView(query.Collection())
+	}
+
+	var children Views
+	iter := query.Iterator()
+	for document := iter.Next(); document != nil; document = iter.Next() {
+		view, err := getResultView(ctx, document, highlight)
+		if err != nil {
+			return err
+		}
+		if view != nil {
+			view = DIV("search-result", view)
+			view.Init(view)
+			children = append(children, view)
+		}
+	}
+	if iter.Err() != nil {
+		return iter.Err()
+	}
+
+	if len(children) == 0 {
+		if self.NoResults != nil {
+			return self.NoResults.Render(ctx)
+		}
+		return nil
+	}
+
+	class := self.Class
+	if class == "" {
+		class = "search-results"
+	}
+	ctx.Response.XML.OpenTag("div")
+	ctx.Response.XML.Attrib("class", class)
+	if err = children.Render(ctx); err != nil {
+		return err
+	}
+	ctx.Response.XML.ForceCloseTag() // div
+	return nil
+}
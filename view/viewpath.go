@@ -9,6 +9,7 @@ import (
 
 	"github.com/ungerik/go-start/config"
 	"github.com/ungerik/go-start/debug"
+	"github.com/ungerik/go-start/mongo"
 	"github.com/ungerik/go-start/reflection"
 	"github.com/ungerik/web.go"
 )
@@ -111,6 +112,18 @@ func (self *ViewPath) initAndRegisterViewsRecursive(parentPath string) {
 			go runtime.GC()
 		}()
 
+		// Attribute the mongo queries of the request to the path.
+		// Only in debug mode, because tracing slows down every query.
+		if Config.Debug.Mode {
+			trace := mongo.StartQueryTrace(path)
+			defer func() {
+				trace.Stop()
+				if len(trace.Stats()) > 0 {
+					config.Logger.Println(trace.Summary())
+				}
+			}()
+		}
+
 		ctx := newContext(webContext, self.View, args)
 
 		for _, subdomain := range Config.RedirectSubdomains {